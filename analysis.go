@@ -0,0 +1,631 @@
+// (c) 2022-2022, LDC Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package jsonpatch
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// AffectedRoots returns the minimal set of JSON pointers such that every path
+// mutated by the patch is at or below one of them. Paths below another mutated path
+// are collapsed into it, so "/a" and "/a/b" become "/a", but sibling paths are kept,
+// as collapsing "/name" and "/age" into the root would affect the whole document.
+// "test" operations do not mutate the document and are ignored; a "move" also affects
+// its "from" path.
+// A result of [""] means the whole document may be affected.
+func (p Patch) AffectedRoots() []string {
+	paths := make([]string, 0, len(p))
+	for _, op := range p {
+		switch op.Op {
+		case "test":
+			continue
+		case "move":
+			paths = append(paths, op.From)
+		}
+		paths = append(paths, op.Path)
+	}
+	return dedupPaths(paths)
+}
+
+// GroupByOp groups the operations of the patch by their "op" names, e.g. to render the
+// additions, removals and changes of a diff separately. Each group keeps the order of its
+// operations in the patch, the groups of a patch that is applied in order can not be applied
+// independently in general, since operations may depend on earlier ones of other groups.
+func (p Patch) GroupByOp() map[string]Patch {
+	groups := make(map[string]Patch)
+	for _, op := range p {
+		groups[op.Op] = append(groups[op.Op], op)
+	}
+	return groups
+}
+
+// MergePatches concatenates the patches a and b into one, and returns the paths where both
+// of them mutate the same location, i.e. a path mutated by one is at or below a path mutated
+// by the other. On conflicts b wins: the operations of a that conflict with b are dropped, so
+// the merged patch is the other operations of a followed by all operations of b. Paths are
+// compared as written, without resolving array indexes. "test" operations do not mutate
+// the document and never conflict. Operations registered with RegisterOp may mutate the
+// whole document, so they conflict with every mutating operation at the root path "".
+// It returns an error for an unexpected operation.
+func MergePatches(a, b Patch) (Patch, []string, error) {
+	for _, op := range append(a[:len(a):len(a)], b...) {
+		if !builtinOps[op.Op] && customOp(op.Op) == nil {
+			return nil, nil, fmt.Errorf("unexpected operation %q", op.Op)
+		}
+	}
+
+	merged := make(Patch, 0, len(a)+len(b))
+	var conflicts []string
+	for _, opa := range a {
+		conflicted := false
+		for _, pa := range mergedPaths(opa) {
+			for _, opb := range b {
+				for _, pb := range mergedPaths(opb) {
+					switch {
+					case isPathAtOrBelow(pa, pb):
+						conflicts = append(conflicts, pb)
+					case isPathAtOrBelow(pb, pa):
+						conflicts = append(conflicts, pa)
+					default:
+						continue
+					}
+					conflicted = true
+				}
+			}
+		}
+		if !conflicted {
+			merged = append(merged, opa)
+		}
+	}
+	merged = append(merged, b...)
+
+	if conflicts == nil {
+		return merged, []string{}, nil
+	}
+	return merged, dedupSorted(conflicts), nil
+}
+
+// mutatedPaths returns the paths mutated by the operation.
+func mutatedPaths(op Operation) []string {
+	switch op.Op {
+	case "test":
+		return nil
+	case "move":
+		return []string{op.From, op.Path}
+	default:
+		return []string{op.Path}
+	}
+}
+
+// mergedPaths returns the paths mutated by the operation, or the root path for a custom
+// operation.
+func mergedPaths(op Operation) []string {
+	if !builtinOps[op.Op] {
+		return []string{""}
+	}
+	return mutatedPaths(op)
+}
+
+// dedupSorted returns the sorted unique paths.
+func dedupSorted(paths []string) []string {
+	sort.Strings(paths)
+	res := paths[:0]
+	for i, path := range paths {
+		if i == 0 || path != paths[i-1] {
+			res = append(res, path)
+		}
+	}
+	return res
+}
+
+// IsInverse reports whether applying the patch inv after the patch p to the JSON document
+// gives a document structurally equal to the original one, i.e. whether inv undoes p.
+// It returns an error if either patch does not apply.
+func IsInverse(p, inv Patch, doc []byte, options *Options) (bool, error) {
+	res, err := p.ApplyWithOptions(doc, options)
+	if err != nil {
+		return false, fmt.Errorf("unable to apply patch, %w", err)
+	}
+	if res, err = inv.ApplyWithOptions(res, options); err != nil {
+		return false, fmt.Errorf("unable to apply inverse patch, %w", err)
+	}
+	return Equal(doc, res), nil
+}
+
+// CommonAncestor returns the longest JSON pointer that all given pointers are equal to or
+// below, comparing them token by token, so "/a/bc" and "/a/b" have "/a" in common.
+// It returns "" for pointers with disjoint roots or an empty slice.
+func CommonAncestor(paths []string) string {
+	if len(paths) == 0 {
+		return ""
+	}
+
+	common := strings.Split(paths[0], "/")
+	for _, path := range paths[1:] {
+		tokens := strings.Split(path, "/")
+		n := 0
+		for n < len(common) && n < len(tokens) && common[n] == tokens[n] {
+			n++
+		}
+		common = common[:n]
+	}
+	return strings.Join(common, "/")
+}
+
+// NetChanges applies the patch to a copy of the JSON document and returns, for each container
+// touched by the patch, the net number of members or elements it gained, or lost if negative.
+// The counts are keyed by the path of the container with "-" and negative indexes resolved,
+// e.g. adding two elements to "/items" and removing one from it gives {"/items": 1}.
+// Containers without net changes are omitted, so are the root replaces and the containers
+// touched by extended "remove_each" operations.
+func (p Patch) NetChanges(doc []byte, options *Options) (map[string]int, error) {
+	if options == nil {
+		options = NewOptions()
+	}
+
+	node := NewNode(doc)
+	pd, err := node.intoContainer()
+	switch {
+	case err != nil:
+		return nil, fmt.Errorf("unexpected node %q, %w", options.errorValue(node), err)
+	case pd == nil:
+		return nil, fmt.Errorf("unexpected node %q", options.errorValue(node))
+	}
+
+	var accumulatedCopySize int64
+	res := make(map[string]int)
+	for _, op := range p {
+		paths := []string{op.Path}
+		if op.Op == "move" {
+			paths = append(paths, op.From)
+		}
+
+		cons := make([]container, len(paths))
+		sizes := make([]int, len(paths))
+		parents := make([]string, len(paths))
+		for i, path := range paths {
+			if path != "" {
+				cons[i], _, _ = resolveObject(&pd, path, options)
+				sizes[i] = containerSize(cons[i])
+				parents[i] = parentPath(resolvePath(pd, path, options))
+			}
+		}
+
+		if err := p.applyOp(&pd, op, &accumulatedCopySize, options); err != nil {
+			return nil, err
+		}
+
+		for i, path := range paths {
+			if path == "" {
+				continue
+			}
+			con := cons[i]
+			if con == nil {
+				// the container may have been created by the operation.
+				con, _, _ = resolveObject(&pd, path, options)
+			}
+			res[parents[i]] += containerSize(con) - sizes[i]
+		}
+	}
+
+	for path, n := range res {
+		if n == 0 {
+			delete(res, path)
+		}
+	}
+	return res, nil
+}
+
+// containerSize returns the number of members or elements in the container, 0 for nil.
+func containerSize(con container) int {
+	switch c := con.(type) {
+	case *partialDoc:
+		return c.obj.Len()
+	case *partialArray:
+		return len(*c)
+	}
+	return 0
+}
+
+// EstimateSizeDelta returns the change of the size in bytes of the JSON document, as marshaled
+// by ApplyWithOptions, that applying the patch causes, without marshaling the document. Each
+// operation counts the encoded size of the value it adds minus the one of the value it removes or
+// replaces, along with the object keys and separators, so a "move" only changes these and a "copy"
+// adds the copied value. The operations are applied to a copy of the document in turn, since they
+// may refer to the values of previous ones. An "add" creating missing parents with
+// EnsurePathExistsOnAdd, or an extended "remove_each", is measured by marshaling the document.
+// It returns an error if the patch does not apply.
+func (p Patch) EstimateSizeDelta(doc []byte, options *Options) (int64, error) {
+	if options == nil {
+		options = NewOptions()
+	}
+
+	node := NewNode(doc)
+	pd, err := node.intoContainer()
+	switch {
+	case err != nil:
+		return 0, fmt.Errorf("unexpected node %q, %w", options.errorValue(node), err)
+	case pd == nil:
+		return 0, fmt.Errorf("unexpected node %q", options.errorValue(node))
+	}
+
+	var accumulatedCopySize, delta int64
+	for _, op := range p {
+		d, ok, err := opSizeDelta(pd, op, options)
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			before, err := json.Marshal(pd)
+			if err != nil {
+				return 0, err
+			}
+			if err := p.applyOp(&pd, op, &accumulatedCopySize, options); err != nil {
+				return 0, err
+			}
+			after, err := json.Marshal(pd)
+			if err != nil {
+				return 0, err
+			}
+			delta += int64(len(after) - len(before))
+			continue
+		}
+
+		if err := p.applyOp(&pd, op, &accumulatedCopySize, options); err != nil {
+			return 0, err
+		}
+		delta += d
+	}
+	return delta, nil
+}
+
+// opSizeDelta returns the size change of the document that the operation causes, see
+// EstimateSizeDelta, or false if it must be measured. The result is meaningless if the
+// operation does not apply.
+func opSizeDelta(doc container, op Operation, options *Options) (int64, bool, error) {
+	switch op.Op {
+	case "test":
+		return 0, true, nil
+
+	case "add", "copy", "replace", "cas":
+		if _, ok := valueRef(op.Value); ok && options.ResolveValueRefs {
+			return 0, false, nil
+		}
+		var value *Node
+		if op.Op == "copy" {
+			con, key, _ := resolveObject(&doc, op.From, options)
+			if con == nil {
+				return 0, true, nil
+			}
+			value, _ = con.get(key, options)
+		} else {
+			value = newValueNode(op.Value, options)
+		}
+		size, err := encodedSize(value)
+		if err != nil {
+			return 0, false, err
+		}
+
+		if op.Path == "" {
+			old, err := encodedSize(doc)
+			return size - old, err == nil, err
+		}
+		con, key, _ := resolveObject(&doc, op.Path, options)
+		_, isDoc := con.(*partialDoc)
+		if op.Op == "add" && options.EnsurePathExistsOnAdd && !isDoc {
+			// the parents may be created, or the array padded with nulls.
+			return 0, false, nil
+		}
+		if con == nil {
+			return 0, true, nil
+		}
+		if isDoc || op.Op == "replace" || op.Op == "cas" {
+			if old, err := con.get(key, options); err == nil {
+				oldSize, err := encodedSize(old)
+				return size - oldSize, err == nil, err
+			}
+		}
+		return size + memberOverhead(con, key, containerSize(con)+1, options), true, nil
+
+	case "remove":
+		con, key, _ := resolveObject(&doc, op.Path, options)
+		if con == nil {
+			return 0, true, nil
+		}
+		old, err := con.get(key, options)
+		if err != nil {
+			return 0, true, nil
+		}
+		size, err := encodedSize(old)
+		return -size - memberOverhead(con, key, containerSize(con), options), err == nil, err
+
+	case "move":
+		if op.From == op.Path {
+			return 0, true, nil
+		}
+		from, fromKey, _ := resolveObject(&doc, op.From, options)
+		to, key, _ := resolveObject(&doc, op.Path, options)
+		if from == nil || to == nil {
+			return 0, true, nil
+		}
+		delta := -memberOverhead(from, fromKey, containerSize(from), options)
+		if _, ok := to.(*partialDoc); ok {
+			if old, err := to.get(key, options); err == nil {
+				size, err := encodedSize(old)
+				return delta - size, err == nil, err
+			}
+		}
+		n := containerSize(to) + 1
+		if to == from {
+			n--
+		}
+		return delta + memberOverhead(to, key, n, options), true, nil
+	}
+	return 0, false, nil
+}
+
+// memberOverhead returns the size of the key and the separators of a member or element
+// of the container, that has n members or elements with it.
+func memberOverhead(con container, key string, n int, options *Options) int64 {
+	var size int64
+	if n > 1 {
+		size++
+	}
+	if _, ok := con.(*partialDoc); ok {
+		if options.KeyNormalize != nil {
+			key = options.KeyNormalize(key)
+		}
+		raw, _ := json.Marshal(key)
+		size += int64(len(raw)) + 1
+	}
+	return size
+}
+
+// encodedSize returns the size of the JSON encoding of the value.
+func encodedSize(v interface{}) (int64, error) {
+	raw, err := json.Marshal(v)
+	return int64(len(raw)), err
+}
+
+// SortForApply reorders the operations so that the "add", "copy" and "move" operations
+// creating a parent path come before the operations on its children. A parent path that may
+// be created by an earlier operation is not hoisted, as it would overwrite the changes of the
+// operations on its children. Other operations keep their relative order if their paths are
+// related: on the same path, one below the other, or in the same array, as array indexes
+// shift. Independent operations keep their order too.
+// The parent paths are assumed to be missing in the document the patch applies to, since
+// hoisting the creator of an existing parent overwrites its children, use SortForApplyTo to
+// only hoist the creators of parents missing in a given document.
+// It returns an error if the operations can not be reordered safely, e.g. a child is added
+// before its parent is removed and added again.
+func (p Patch) SortForApply() (Patch, error) {
+	return p.sortForApply(nil, nil)
+}
+
+// SortForApplyTo is like SortForApply, but the "add", "copy" and "move" operations creating
+// a parent path are only hoisted if the parent is missing in the JSON document.
+func (p Patch) SortForApplyTo(doc []byte, options *Options) (Patch, error) {
+	if options == nil {
+		options = NewOptions()
+	}
+	return p.sortForApply(NewNode(doc), options)
+}
+
+// sortForApply sorts the patch for the document node, or for a document without the parents
+// created by the patch if node is nil.
+func (p Patch) sortForApply(node *Node, options *Options) (Patch, error) {
+	// after[i] lists the operations that must come after operation i.
+	after := make([][]int, len(p))
+	before := make([]int, len(p))
+	for i := range p {
+		for j := i + 1; j < len(p); j++ {
+			if !opsRelated(p[i], p[j]) {
+				continue
+			}
+			if createsParentOf(p[j], p[i]) && !createsParentOf(p[i], p[j]) && !p.mayExist(node, i, p[j].Path, options) {
+				after[j] = append(after[j], i)
+				before[i]++
+			} else {
+				after[i] = append(after[i], j)
+				before[j]++
+			}
+		}
+	}
+
+	res := make(Patch, 0, len(p))
+	done := make([]bool, len(p))
+	for len(res) < len(p) {
+		next := -1
+		for i := range p {
+			if !done[i] && before[i] == 0 {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			return nil, errors.New("unable to sort patch, operations depend on each other")
+		}
+
+		done[next] = true
+		res = append(res, p[next])
+		for _, j := range after[next] {
+			before[j]--
+		}
+	}
+	return res, nil
+}
+
+// Optimize returns a patch equivalent under the default options, with the consecutive operations
+// on the same path folded:
+//
+//   - "replace" then "replace" becomes the last "replace";
+//   - "add" then "replace" becomes "add" of the replaced value;
+//   - "replace" then "remove" becomes "remove";
+//   - "remove" then "add" becomes "replace" of the added value, so an object member keeps
+//     its position instead of becoming the last member.
+//
+// Operations are never reordered, and "test", "move", "copy" and the extended operations,
+// as well as operations with per-operation options, are left untouched. The root path and
+// paths ending with "-" or a negative array index are not folded, since the latter refer to
+// different elements once an element is added or removed. "add" then "remove" is not folded,
+// as the "add" may have replaced an existing member, which is removed.
+func (p Patch) Optimize() Patch {
+	res := make(Patch, 0, len(p))
+	for _, op := range p {
+		if n := len(res); n > 0 {
+			if folded, ok := foldOps(res[n-1], op); ok {
+				res[n-1] = folded
+				continue
+			}
+		}
+		res = append(res, op)
+	}
+	return res
+}
+
+// foldOps returns the operation equivalent to the operation a followed by b, see Optimize.
+func foldOps(a, b Operation) (Operation, bool) {
+	if a.Path != b.Path || !foldable(a) || !foldable(b) {
+		return Operation{}, false
+	}
+
+	switch {
+	case a.Op == "replace" && b.Op == "replace", a.Op == "replace" && b.Op == "remove":
+		return b, true
+	case a.Op == "add" && b.Op == "replace":
+		return Operation{Op: "add", Path: a.Path, Value: b.Value}, true
+	case a.Op == "remove" && b.Op == "add":
+		return Operation{Op: "replace", Path: a.Path, Value: b.Value}, true
+	}
+	return Operation{}, false
+}
+
+func foldable(op Operation) bool {
+	switch op.Op {
+	case "add", "remove", "replace":
+	default:
+		return false
+	}
+	if op.Path == "" || op.EnsurePath != nil || op.AllowMissing != nil {
+		return false
+	}
+
+	token := op.Path[strings.LastIndex(op.Path, "/")+1:]
+	return !strings.HasPrefix(token, "-")
+}
+
+// opPaths returns the paths read or written by the operation.
+func opPaths(op Operation) []string {
+	switch op.Op {
+	case "move", "copy":
+		return []string{op.From, op.Path}
+	default:
+		return []string{op.Path}
+	}
+}
+
+// opsRelated reports whether the order of two operations may matter.
+func opsRelated(a, b Operation) bool {
+	for _, pa := range opPaths(a) {
+		for _, pb := range opPaths(b) {
+			if pathsRelated(pa, pb) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// pathsRelated reports whether a path is at or below the other one, or whether they point
+// into the same array, since array operations shift the indexes of the following elements.
+func pathsRelated(a, b string) bool {
+	if isPathAtOrBelow(a, b) || isPathAtOrBelow(b, a) {
+		return true
+	}
+
+	ta := strings.Split(a, "/")
+	tb := strings.Split(b, "/")
+	for i := 0; i < len(ta) && i < len(tb); i++ {
+		if ta[i] != tb[i] {
+			return isArrayToken(ta[i]) || isArrayToken(tb[i])
+		}
+	}
+	return false
+}
+
+func isArrayToken(token string) bool {
+	if token == "-" {
+		return true
+	}
+	_, err := strconv.Atoi(token)
+	return err == nil
+}
+
+// createsParentOf reports whether the operation creates a value at a parent path of
+// the paths of the other operation.
+func createsParentOf(op, other Operation) bool {
+	switch op.Op {
+	case "add", "copy", "move":
+	default:
+		return false
+	}
+
+	for _, path := range opPaths(other) {
+		if path != op.Path && isPathAtOrBelow(path, op.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+// mayExist reports whether the path exists in the document, if any, or may be created by an
+// operation before the operation i.
+func (p Patch) mayExist(doc *Node, i int, path string, options *Options) bool {
+	if path == "" || doc != nil && doc.Exists(path, options) {
+		return true
+	}
+	for _, op := range p[:i] {
+		if op.Op != "test" && op.Op != "remove" && isPathAtOrBelow(path, op.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+// dedupPaths returns the sorted paths with duplicates and paths that are below
+// another path in the set removed.
+func dedupPaths(paths []string) []string {
+	sorted := make([]string, len(paths))
+	copy(sorted, paths)
+	sort.Strings(sorted)
+
+	res := make([]string, 0, len(sorted))
+Loop:
+	for _, path := range sorted {
+		for _, root := range res {
+			if isPathAtOrBelow(path, root) {
+				continue Loop
+			}
+		}
+		res = append(res, path)
+	}
+	return res
+}
+
+// isPathAtOrBelow reports whether path is equal to root or is a descendant of it.
+func isPathAtOrBelow(path, root string) bool {
+	return path == root || len(path) > len(root) && path[len(root)] == '/' && strings.HasPrefix(path, root)
+}
+
+func parentPath(path string) string {
+	if i := strings.LastIndex(path, "/"); i >= 0 {
+		return path[:i]
+	}
+	return ""
+}
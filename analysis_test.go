@@ -0,0 +1,554 @@
+// (c) 2022-2022, LDC Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package jsonpatch
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAffectedRoots(t *testing.T) {
+	assert := assert.New(t)
+
+	cases := []struct {
+		patch  string
+		result []string
+	}{
+		{`[]`, []string{}},
+		{`[{"op": "test", "path": "/a", "value": 1}]`, []string{}},
+		{`[{"op": "add", "path": "/a", "value": 1}]`, []string{"/a"}},
+		{`[{"op": "replace", "path": "", "value": {}}]`, []string{""}},
+		{`[
+			{"op": "add", "path": "/a/b", "value": 1},
+			{"op": "remove", "path": "/a/c"}
+		]`, []string{"/a/b", "/a/c"}},
+		{`[
+			{"op": "replace", "path": "/name", "value": "x"},
+			{"op": "replace", "path": "/age", "value": 1}
+		]`, []string{"/age", "/name"}},
+		{`[
+			{"op": "add", "path": "/a/b/c", "value": 1},
+			{"op": "remove", "path": "/a/b"},
+			{"op": "replace", "path": "/x/y", "value": 1}
+		]`, []string{"/a/b", "/x/y"}},
+		{`[
+			{"op": "add", "path": "/a/b", "value": 1},
+			{"op": "add", "path": "/a b/c", "value": 1},
+			{"op": "add", "path": "/a/b/c", "value": 1}
+		]`, []string{"/a b/c", "/a/b"}},
+		{`[
+			{"op": "move", "from": "/a/b", "path": "/x/y"},
+			{"op": "copy", "from": "/c/d", "path": "/x/z"}
+		]`, []string{"/a/b", "/x/y", "/x/z"}},
+		{`[
+			{"op": "add", "path": "/a/b/c", "value": 1},
+			{"op": "add", "path": "/a/b/d", "value": 1},
+			{"op": "remove", "path": "/a"},
+			{"op": "replace", "path": "/x/y", "value": 1}
+		]`, []string{"/a", "/x/y"}},
+		{`[
+			{"op": "add", "path": "/a/b/c/d", "value": 1},
+			{"op": "add", "path": "/a/b/c/e", "value": 1},
+			{"op": "remove", "path": "/a/b"}
+		]`, []string{"/a/b"}},
+		{`[
+			{"op": "add", "path": "/a/b", "value": 1},
+			{"op": "replace", "path": "", "value": {}}
+		]`, []string{""}},
+	}
+
+	for i, c := range cases {
+		patch, err := NewPatch([]byte(c.patch))
+		if !assert.NoErrorf(err, "case %d", i) {
+			continue
+		}
+		assert.Equalf(c.result, patch.AffectedRoots(), "case %d", i)
+	}
+}
+
+func TestGroupByOp(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(map[string]Patch{}, Patch{}.GroupByOp())
+
+	patch, err := Diff(
+		[]byte(`{"a": 1, "b": [1, 2, 3], "c": {"d": 1}, "e": 1}`),
+		[]byte(`{"a": 2, "b": [1], "c": {"d": 2, "f": 3}, "g": 4}`),
+		nil,
+	)
+	assert.NoError(err)
+
+	groups := patch.GroupByOp()
+	assert.Equal(3, len(groups))
+	assert.Equal(`[{"op":"replace","path":"/a","value":2},{"op":"replace","path":"/c/d","value":2}]`,
+		mustJSONString(groups["replace"]))
+	assert.Equal(`[{"op":"remove","path":"/e"},{"op":"remove","path":"/b/2"},{"op":"remove","path":"/b/1"}]`,
+		mustJSONString(groups["remove"]))
+	assert.Equal(`[{"op":"add","path":"/c/f","value":3},{"op":"add","path":"/g","value":4}]`,
+		mustJSONString(groups["add"]))
+
+	total := 0
+	for op, group := range groups {
+		for _, o := range group {
+			assert.Equal(op, o.Op)
+		}
+		total += len(group)
+	}
+	assert.Equal(len(patch), total)
+}
+
+func TestSortForApply(t *testing.T) {
+	assert := assert.New(t)
+
+	cases := []struct {
+		doc, patch, sorted, result string
+	}{
+		{
+			`{}`,
+			`[
+				{"op": "add", "path": "/a/b/c", "value": 1},
+				{"op": "add", "path": "/x", "value": 0},
+				{"op": "add", "path": "/a/b", "value": {}},
+				{"op": "add", "path": "/a", "value": {}}
+			]`,
+			`[{"op":"add","path":"/x","value":0},{"op":"add","path":"/a","value":{}},` +
+				`{"op":"add","path":"/a/b","value":{}},{"op":"add","path":"/a/b/c","value":1}]`,
+			`{"x":0,"a":{"b":{"c":1}}}`,
+		},
+		{
+			`{"src": {"v": 1}}`,
+			`[
+				{"op": "replace", "path": "/dst/v", "value": 2},
+				{"op": "copy", "from": "/src", "path": "/dst"}
+			]`,
+			`[{"op":"copy","path":"/dst","from":"/src"},{"op":"replace","path":"/dst/v","value":2}]`,
+			`{"src":{"v":1},"dst":{"v":2}}`,
+		},
+		{
+			`{"arr": [1, 2]}`,
+			`[
+				{"op": "add", "path": "/arr/0", "value": 0},
+				{"op": "remove", "path": "/arr/2"},
+				{"op": "add", "path": "/obj/k", "value": 1},
+				{"op": "add", "path": "/obj", "value": {}}
+			]`,
+			`[{"op":"add","path":"/arr/0","value":0},{"op":"remove","path":"/arr/2"},` +
+				`{"op":"add","path":"/obj","value":{}},{"op":"add","path":"/obj/k","value":1}]`,
+			`{"arr":[0,1],"obj":{"k":1}}`,
+		},
+		{
+			`{"a": 1}`,
+			`[
+				{"op": "replace", "path": "/a", "value": 2},
+				{"op": "test", "path": "/a", "value": 2},
+				{"op": "add", "path": "/b", "value": 3}
+			]`,
+			`[{"op":"replace","path":"/a","value":2},{"op":"test","path":"/a","value":2},` +
+				`{"op":"add","path":"/b","value":3}]`,
+			`{"a":2,"b":3}`,
+		},
+		{
+			`{"a": {"b": 0}}`,
+			`[
+				{"op": "replace", "path": "/a/b", "value": 1},
+				{"op": "add", "path": "/a", "value": {"c": 2}}
+			]`,
+			`[{"op":"replace","path":"/a/b","value":1},{"op":"add","path":"/a","value":{"c":2}}]`,
+			`{"a":{"c":2}}`,
+		},
+		{
+			`{}`,
+			`[
+				{"op": "add", "path": "/a", "value": {"b": 0}},
+				{"op": "replace", "path": "/a/b", "value": 1},
+				{"op": "add", "path": "/a", "value": {"c": 2}}
+			]`,
+			`[{"op":"add","path":"/a","value":{"b":0}},{"op":"replace","path":"/a/b","value":1},` +
+				`{"op":"add","path":"/a","value":{"c":2}}]`,
+			`{"a":{"c":2}}`,
+		},
+	}
+
+	for i, c := range cases {
+		patch, err := NewPatch([]byte(c.patch))
+		if !assert.NoErrorf(err, "case %d", i) {
+			continue
+		}
+
+		sorted, err := patch.SortForApplyTo([]byte(c.doc), nil)
+		if !assert.NoErrorf(err, "case %d", i) {
+			continue
+		}
+		assert.Equalf(c.sorted, mustJSONString(sorted), "case %d", i)
+
+		out, err := sorted.Apply([]byte(c.doc))
+		if assert.NoErrorf(err, "case %d", i) {
+			assert.Equalf(c.result, string(out), "case %d", i)
+		}
+	}
+
+	// without a document the parents are assumed to be missing.
+	for i, c := range cases[:4] {
+		patch, _ := NewPatch([]byte(c.patch))
+		sorted, err := patch.SortForApply()
+		assert.NoErrorf(err, "case %d", i)
+		assert.Equalf(c.sorted, mustJSONString(sorted), "case %d", i)
+	}
+	patch, _ := NewPatch([]byte(cases[4].patch))
+	sorted, err := patch.SortForApply()
+	assert.NoError(err)
+	assert.Equal(`[{"op":"add","path":"/a","value":{"c":2}},{"op":"replace","path":"/a/b","value":1}]`, mustJSONString(sorted))
+	patch, _ = NewPatch([]byte(cases[5].patch))
+	sorted, err = patch.SortForApply()
+	assert.NoError(err)
+	assert.Equal(cases[5].sorted, mustJSONString(sorted))
+
+	patch, _ = NewPatch([]byte(`[
+		{"op": "add", "path": "/a/b", "value": 1},
+		{"op": "remove", "path": "/a"},
+		{"op": "add", "path": "/a", "value": {}}
+	]`))
+	_, err = patch.SortForApply()
+	assert.EqualError(err, "unable to sort patch, operations depend on each other")
+}
+
+func TestCommonAncestor(t *testing.T) {
+	assert := assert.New(t)
+
+	cases := []struct {
+		paths  []string
+		result string
+	}{
+		{nil, ""},
+		{[]string{""}, ""},
+		{[]string{"/a/b/c"}, "/a/b/c"},
+		{[]string{"/a/b/c", "/a/b/d"}, "/a/b"},
+		{[]string{"/a/b/c", "/a/b/c/d", "/a/b/c"}, "/a/b/c"},
+		{[]string{"/a/bc", "/a/b"}, "/a"},
+		{[]string{"/a/b", "/x/b"}, ""},
+		{[]string{"/a/b", ""}, ""},
+		{[]string{"/a/", "/a/"}, "/a/"},
+		{[]string{"/a~1b/c", "/a~1b/d", "/a~1b"}, "/a~1b"},
+	}
+
+	for i, c := range cases {
+		assert.Equalf(c.result, CommonAncestor(c.paths), "case %d", i)
+	}
+}
+
+func TestNetChanges(t *testing.T) {
+	assert := assert.New(t)
+
+	doc := `{"items": [1, 2, 3], "meta": {"a": 1}, "list": [{"tags": ["x"]}]}`
+	cases := []struct {
+		patch  string
+		result map[string]int
+	}{
+		{`[]`, map[string]int{}},
+		{`[
+			{"op": "add", "path": "/items/-", "value": 4},
+			{"op": "add", "path": "/items/0", "value": 0},
+			{"op": "remove", "path": "/items/1"}
+		]`, map[string]int{"/items": 1}},
+		{`[
+			{"op": "replace", "path": "/items/0", "value": 0},
+			{"op": "test", "path": "/meta/a", "value": 1}
+		]`, map[string]int{}},
+		{`[
+			{"op": "add", "path": "/meta/b", "value": 2},
+			{"op": "remove", "path": "/meta/a"},
+			{"op": "remove", "path": "/items"}
+		]`, map[string]int{"": -1}},
+		{`[
+			{"op": "move", "from": "/items/0", "path": "/list/-1/tags/-"},
+			{"op": "copy", "from": "/meta", "path": "/list/-"}
+		]`, map[string]int{"/items": -1, "/list/0/tags": 1, "/list": 1}},
+		{`[
+			{"op": "add", "path": "/new", "value": []},
+			{"op": "add", "path": "/new/-", "value": 1},
+			{"op": "replace", "path": "", "value": [1]}
+		]`, map[string]int{"": 1, "/new": 1}},
+	}
+
+	for i, c := range cases {
+		patch, err := NewPatch([]byte(c.patch))
+		if !assert.NoErrorf(err, "case %d", i) {
+			continue
+		}
+		res, err := patch.NetChanges([]byte(doc), nil)
+		if !assert.NoErrorf(err, "case %d", i) {
+			continue
+		}
+		assert.Equalf(c.result, res, "case %d", i)
+	}
+
+	patch, _ := NewPatch([]byte(`[{"op": "remove", "path": "/missing"}]`))
+	_, err := patch.NetChanges([]byte(doc), nil)
+	assert.Error(err)
+
+	_, err = patch.NetChanges([]byte(`1`), nil)
+	assert.Error(err)
+}
+
+func TestMergePatches(t *testing.T) {
+	assert := assert.New(t)
+
+	doc := `{"a": {"b": 1, "c": 2}, "list": [1, 2], "x": "y"}`
+	cases := []struct {
+		a, b, merged string
+		conflicts    []string
+		result       string
+	}{
+		{
+			`[{"op": "replace", "path": "/a/b", "value": 10}]`,
+			`[{"op": "add", "path": "/list/-", "value": 3}, {"op": "remove", "path": "/x"}]`,
+			`[{"op":"replace","path":"/a/b","value":10},{"op":"add","path":"/list/-","value":3},{"op":"remove","path":"/x"}]`,
+			[]string{},
+			`{"a":{"b":10,"c":2},"list":[1,2,3]}`,
+		},
+		{
+			`[{"op": "replace", "path": "/a/b", "value": 10}, {"op": "replace", "path": "/x", "value": "z"}]`,
+			`[{"op": "replace", "path": "/a/b", "value": 20}]`,
+			`[{"op":"replace","path":"/x","value":"z"},{"op":"replace","path":"/a/b","value":20}]`,
+			[]string{"/a/b"},
+			`{"a":{"b":20,"c":2},"list":[1,2],"x":"z"}`,
+		},
+		{
+			`[{"op": "remove", "path": "/a/c"}, {"op": "move", "from": "/x", "path": "/a/x"}]`,
+			`[{"op": "replace", "path": "/a", "value": {}}, {"op": "test", "path": "/list/0", "value": 1}]`,
+			`[{"op":"replace","path":"/a","value":{}},{"op":"test","path":"/list/0","value":1}]`,
+			[]string{"/a"},
+			`{"a":{},"list":[1,2],"x":"y"}`,
+		},
+		{
+			`[{"op": "test", "path": "/a", "value": {"b": 1, "c": 2}}, {"op": "copy", "from": "/x", "path": "/z"}]`,
+			`[{"op": "remove", "path": "/x"}, {"op": "add", "path": "/z", "value": 1}]`,
+			`[{"op":"test","path":"/a","value":{"b":1,"c":2}},` +
+				`{"op":"remove","path":"/x"},{"op":"add","path":"/z","value":1}]`,
+			[]string{"/z"},
+			`{"a":{"b":1,"c":2},"list":[1,2],"z":1}`,
+		},
+	}
+
+	for i, c := range cases {
+		a, _ := NewPatch([]byte(c.a))
+		b, _ := NewPatch([]byte(c.b))
+		merged, conflicts, err := MergePatches(a, b)
+		if !assert.NoErrorf(err, "case %d", i) {
+			continue
+		}
+		assert.Equalf(c.merged, mustJSONString(merged), "case %d", i)
+		assert.Equalf(c.conflicts, conflicts, "case %d", i)
+
+		out, err := merged.Apply([]byte(doc))
+		assert.NoErrorf(err, "case %d", i)
+		assert.Equalf(c.result, string(out), "case %d", i)
+	}
+
+	_, _, err := MergePatches(Patch{{Op: "add", Path: "/a"}}, Patch{{Op: "bad", Path: "/a"}})
+	assert.EqualError(err, `unexpected operation "bad"`)
+	assert.NoError(RegisterOp("merge_touch", func(doc *Node, op Operation, options *Options) error {
+		return doc.SetValue("/touched", json.RawMessage(`true`), options)
+	}))
+	t.Cleanup(func() { RegisterOp("merge_touch", nil) })
+
+	a := Patch{{Op: "add", Path: "/x", Value: json.RawMessage(`1`)}, {Op: "test", Path: "/a/b", Value: json.RawMessage(`1`)}}
+	merged, conflicts, err := MergePatches(a, Patch{{Op: "merge_touch", Path: "/y"}})
+	assert.NoError(err)
+	assert.Equal(`[{"op":"test","path":"/a/b","value":1},{"op":"merge_touch","path":"/y"}]`, mustJSONString(merged))
+	assert.Equal([]string{""}, conflicts)
+
+	merged, conflicts, err = MergePatches(Patch{{Op: "merge_touch", Path: "/y"}}, a)
+	assert.NoError(err)
+	assert.Equal(mustJSONString(a), mustJSONString(merged))
+	assert.Equal([]string{""}, conflicts)
+}
+
+func TestIsInverse(t *testing.T) {
+	assert := assert.New(t)
+
+	doc := `{"a": 1, "list": [1, 2], "obj": {"b": "c"}}`
+	cases := []struct {
+		p, inv string
+		ok     bool
+	}{
+		{`[]`, `[]`, true},
+		{
+			`[{"op": "replace", "path": "/a", "value": 2}, {"op": "add", "path": "/list/0", "value": 0}]`,
+			`[{"op": "remove", "path": "/list/0"}, {"op": "replace", "path": "/a", "value": 1}]`,
+			true,
+		},
+		{
+			`[{"op": "move", "from": "/obj/b", "path": "/b"}]`,
+			`[{"op": "move", "from": "/b", "path": "/obj/b"}]`,
+			true,
+		},
+		{
+			`[{"op": "remove", "path": "/obj"}]`,
+			`[{"op": "add", "path": "/obj", "value": {"b": "c"}}]`,
+			true,
+		},
+		{
+			`[{"op": "replace", "path": "/a", "value": 2}, {"op": "add", "path": "/list/0", "value": 0}]`,
+			`[{"op": "remove", "path": "/list/1"}, {"op": "replace", "path": "/a", "value": 1}]`,
+			false,
+		},
+		{
+			`[{"op": "remove", "path": "/obj"}]`,
+			`[{"op": "add", "path": "/obj", "value": {}}]`,
+			false,
+		},
+	}
+
+	for i, c := range cases {
+		p, _ := NewPatch([]byte(c.p))
+		inv, _ := NewPatch([]byte(c.inv))
+		ok, err := IsInverse(p, inv, []byte(doc), nil)
+		assert.NoErrorf(err, "case %d", i)
+		assert.Equalf(c.ok, ok, "case %d", i)
+	}
+
+	p, _ := NewPatch([]byte(`[{"op": "remove", "path": "/a"}]`))
+	_, err := IsInverse(p, p, []byte(doc), nil)
+	assert.EqualError(err, `unable to apply inverse patch, remove operation does not apply for "/a", unable to remove nonexistent key "a", missing value`)
+
+	_, err = IsInverse(p, p, []byte(`{}`), nil)
+	assert.Error(err)
+}
+
+func TestOptimize(t *testing.T) {
+	assert := assert.New(t)
+
+	cases := []struct {
+		doc, patch, optimized string
+	}{
+		{
+			`{"a": 1}`,
+			`[{"op": "replace", "path": "/a", "value": 2}, {"op": "replace", "path": "/a", "value": 3}]`,
+			`[{"op":"replace","path":"/a","value":3}]`,
+		},
+		{
+			`{"list": [1, 2]}`,
+			`[{"op": "add", "path": "/list/1", "value": 5}, {"op": "replace", "path": "/list/1", "value": 6}]`,
+			`[{"op":"add","path":"/list/1","value":6}]`,
+		},
+		{
+			`{"a": 1, "b": 2}`,
+			`[{"op": "replace", "path": "/a", "value": 2}, {"op": "remove", "path": "/a"}]`,
+			`[{"op":"remove","path":"/a"}]`,
+		},
+		{
+			`{"list": [1, 2, 3]}`,
+			`[{"op": "remove", "path": "/list/1"}, {"op": "add", "path": "/list/1", "value": 5}]`,
+			`[{"op":"replace","path":"/list/1","value":5}]`,
+		},
+		{
+			`{"a": 1}`,
+			`[{"op": "remove", "path": "/a"}, {"op": "add", "path": "/a", "value": 2}, {"op": "replace", "path": "/a", "value": 3}, {"op": "remove", "path": "/a"}]`,
+			`[{"op":"remove","path":"/a"}]`,
+		},
+		{
+			`{"a": 1, "list": [1, 2]}`,
+			`[
+				{"op": "add", "path": "/a", "value": 2},
+				{"op": "remove", "path": "/a"},
+				{"op": "add", "path": "/list/-", "value": 3},
+				{"op": "replace", "path": "/list/-1", "value": 4},
+				{"op": "add", "path": "/list/0", "value": 0},
+				{"op": "add", "path": "/list/0", "value": -1},
+				{"op": "test", "path": "/list/0", "value": -1},
+				{"op": "replace", "path": "/list/0", "value": -2},
+				{"op": "replace", "path": "/list/1", "value": 1},
+				{"op": "copy", "from": "/list/0", "path": "/b"},
+				{"op": "replace", "path": "/b", "value": 1},
+				{"op": "add", "path": "/c/d", "value": 1, "x-ensure-path": true},
+				{"op": "replace", "path": "/c/d", "value": 2}
+			]`,
+			`[{"op":"add","path":"/a","value":2},{"op":"remove","path":"/a"},` +
+				`{"op":"add","path":"/list/-","value":3},{"op":"replace","path":"/list/-1","value":4},` +
+				`{"op":"add","path":"/list/0","value":0},{"op":"add","path":"/list/0","value":-1},` +
+				`{"op":"test","path":"/list/0","value":-1},{"op":"replace","path":"/list/0","value":-2},` +
+				`{"op":"replace","path":"/list/1","value":1},{"op":"copy","path":"/b","from":"/list/0"},` +
+				`{"op":"replace","path":"/b","value":1},{"op":"add","path":"/c/d","value":1,"x-ensure-path":true},` +
+				`{"op":"replace","path":"/c/d","value":2}]`,
+		},
+		{
+			`{}`,
+			`[]`,
+			`[]`,
+		},
+	}
+
+	for i, c := range cases {
+		p, err := NewPatch([]byte(c.patch))
+		if !assert.NoErrorf(err, "case %d", i) {
+			continue
+		}
+		optimized := p.Optimize()
+		assert.Equalf(c.optimized, mustJSONString(optimized), "case %d", i)
+
+		expected, err := p.Apply([]byte(c.doc))
+		if !assert.NoErrorf(err, "case %d", i) {
+			continue
+		}
+		out, err := optimized.Apply([]byte(c.doc))
+		assert.NoErrorf(err, "case %d", i)
+		assert.Truef(Equal(expected, out), "case %d, %s", i, string(out))
+	}
+}
+
+func TestEstimateSizeDelta(t *testing.T) {
+	assert := assert.New(t)
+
+	doc := `{"a": {"b": [1, 2, 3], "c": "x"}, "d": [], "e": {}, "f": null, "<k>": true}`
+	cases := []string{
+		`[{"op": "test", "path": "/a/c", "value": "x"}]`,
+		`[{"op": "add", "path": "/a/x", "value": {"y": [1, 2]}}]`,
+		`[{"op": "add", "path": "/a/c", "value": "longer"}]`,
+		`[{"op": "add", "path": "/a/b/1", "value": 10}, {"op": "add", "path": "/a/b/-", "value": "s"}]`,
+		`[{"op": "add", "path": "/d/0", "value": 1}, {"op": "add", "path": "/e/k", "value": 1}]`,
+		`[{"op": "remove", "path": "/a/b/0"}, {"op": "remove", "path": "/a/c"}, {"op": "remove", "path": "/f"}]`,
+		`[{"op": "remove", "path": "/a/b/2"}, {"op": "remove", "path": "/a/b/1"}, {"op": "remove", "path": "/a/b/0"}]`,
+		`[{"op": "replace", "path": "/a/b", "value": {"z": 1}}, {"op": "replace", "path": "/f", "value": 123}]`,
+		`[{"op": "replace", "path": "", "value": [1, 2]}]`,
+		`[{"op": "move", "from": "/a/c", "path": "/longer key"}]`,
+		`[{"op": "move", "from": "/a/c", "path": "/a/b"}]`,
+		`[{"op": "move", "from": "/a/b/0", "path": "/a/b/2"}, {"op": "move", "from": "/a/b/0", "path": "/d/-"}]`,
+		`[{"op": "move", "from": "/<k>", "path": "/e/k"}, {"op": "move", "from": "/a", "path": "/a"}]`,
+		`[{"op": "copy", "from": "/a", "path": "/e/copy"}, {"op": "copy", "from": "/a/b", "path": "/a/b/0"}]`,
+		`[{"op": "add", "path": "/n", "value": 1}, {"op": "copy", "from": "/n", "path": "/m"}, {"op": "remove", "path": "/n"}]`,
+		`[{"op": "add", "path": "/x/y/z", "value": 1}, {"op": "add", "path": "/d/0", "value": 1}]`,
+		`[{"op": "cas", "path": "/a/c", "expected": "x", "value": "y"}, {"op": "remove_each", "path": "/a/b/*"}]`,
+		`[{"op": "remove", "path": "/missing"}]`,
+	}
+
+	options := NewOptions()
+	options.EnsurePathExistsOnAdd = true
+	options.AllowMissingPathOnRemove = true
+	options.AllowExtendedOps = true
+	for i, c := range cases {
+		p, err := NewPatch([]byte(c))
+		if !assert.NoErrorf(err, "case %d", i) {
+			continue
+		}
+
+		before, err := NewNode([]byte(doc)).MarshalJSON()
+		assert.NoError(err)
+		after, err := p.ApplyWithOptions([]byte(doc), options)
+		if !assert.NoErrorf(err, "case %d", i) {
+			continue
+		}
+		delta, err := p.EstimateSizeDelta([]byte(doc), options)
+		assert.NoErrorf(err, "case %d", i)
+		assert.Equalf(int64(len(after)-len(before)), delta, "case %d: %s", i, after)
+	}
+
+	p, _ := NewPatch([]byte(`[{"op": "remove", "path": "/missing"}]`))
+	_, err := p.EstimateSizeDelta([]byte(doc), nil)
+	assert.ErrorContains(err, "remove operation does not apply")
+	_, err = p.EstimateSizeDelta([]byte(`1`), nil)
+	assert.Error(err)
+}
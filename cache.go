@@ -0,0 +1,164 @@
+// (c) 2022-2022, LDC Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package jsonpatch
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/json"
+	"hash/fnv"
+	"sync"
+)
+
+// NodeCache is a size-bounded LRU cache of parsed nodes, for servers that repeatedly patch
+// or query a known set of documents by key. A document is parsed once per content, later
+// gets of the same key and content return a copy of the parsed node without parsing again.
+// The returned nodes are independent copies, so changes to them never affect the cache nor
+// other callers. The zero value is ready to use, and it is safe for concurrent use.
+type NodeCache struct {
+	// MaxEntries is the maximum number of cached documents before the least recently used
+	// one is evicted. Default to 0, which means no limit.
+	MaxEntries int
+
+	mu      sync.Mutex
+	ll      *list.List
+	entries map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key  string
+	hash uint64
+	raw  []byte
+	node *Node
+}
+
+// NewNodeCache returns a new NodeCache with the given maximum number of entries.
+func NewNodeCache(maxEntries int) *NodeCache {
+	return &NodeCache{MaxEntries: maxEntries}
+}
+
+// Get returns a parsed node of the raw encoded JSON document cached by the key. The cached
+// node is reused if the document has the same content as the cached one, otherwise the
+// document is parsed and replaces the cached one.
+// A document that fails to parse is not cached, and it returns a node like NewNode for it.
+func (c *NodeCache) Get(key string, raw []byte) *Node {
+	h := fnv.New64a()
+	h.Write(raw)
+	sum := h.Sum64()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.entries == nil {
+		c.ll = list.New()
+		c.entries = make(map[string]*list.Element)
+	}
+
+	if ele, ok := c.entries[key]; ok {
+		entry := ele.Value.(*cacheEntry)
+		if entry.hash == sum && bytes.Equal(entry.raw, raw) {
+			c.ll.MoveToFront(ele)
+			return entry.node.clone()
+		}
+		c.ll.Remove(ele)
+		delete(c.entries, key)
+	}
+
+	data := append([]byte(nil), raw...)
+	node := NewNode(data)
+	if err := node.parse(); err != nil {
+		return NewNode(data)
+	}
+
+	c.entries[key] = c.ll.PushFront(&cacheEntry{key: key, hash: sum, raw: data, node: node})
+	if c.MaxEntries > 0 && c.ll.Len() > c.MaxEntries {
+		ele := c.ll.Back()
+		c.ll.Remove(ele)
+		delete(c.entries, ele.Value.(*cacheEntry).key)
+	}
+	return node.clone()
+}
+
+// Remove removes the cached document of the key.
+func (c *NodeCache) Remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if ele, ok := c.entries[key]; ok {
+		c.ll.Remove(ele)
+		delete(c.entries, key)
+	}
+}
+
+// Len returns the number of cached documents.
+func (c *NodeCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.ll == nil {
+		return 0
+	}
+	return c.ll.Len()
+}
+
+// parse parses the node and all of its descendants.
+func (n *Node) parse() error {
+	if _, err := n.intoContainer(); err != nil && err != ErrInvalid {
+		return err
+	}
+
+	switch n.which {
+	case eDoc:
+		for _, k := range n.doc.obj.Keys() {
+			if v, _ := n.doc.obj.Get(k); v != nil {
+				if err := v.parse(); err != nil {
+					return err
+				}
+			}
+		}
+	case eAry:
+		for _, v := range n.ary {
+			if v != nil {
+				if err := v.parse(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// clone returns a deep copy of the node that shares no memory with it.
+func (n *Node) clone() *Node {
+	if n == nil {
+		return nil
+	}
+
+	c := &Node{which: n.which, newObject: n.newObject, disallowDuplicateKeys: n.disallowDuplicateKeys,
+		depth: n.depth}
+	if n.raw != nil {
+		raw := append(json.RawMessage(nil), *n.raw...)
+		c.raw = &raw
+	}
+	switch n.which {
+	case eDoc:
+		c.doc = &partialDoc{newObject: n.doc.newObject, disallowDuplicateKeys: n.doc.disallowDuplicateKeys,
+			depth: n.doc.depth}
+		if n.doc.newObject == nil {
+			c.doc.obj = newOrderedObject()
+		} else {
+			c.doc.obj = n.doc.newObject()
+		}
+		for _, k := range n.doc.obj.Keys() {
+			v, _ := n.doc.obj.Get(k)
+			c.doc.obj.Set(k, v.clone())
+		}
+	case eAry:
+		c.ary = make(partialArray, len(n.ary))
+		for i, v := range n.ary {
+			c.ary[i] = v.clone()
+		}
+	}
+	return c
+}
@@ -0,0 +1,74 @@
+// (c) 2022-2022, LDC Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package jsonpatch
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNodeCache(t *testing.T) {
+	assert := assert.New(t)
+
+	cached := func(c *NodeCache, key string) *Node {
+		if ele, ok := c.entries[key]; ok {
+			return ele.Value.(*cacheEntry).node
+		}
+		return nil
+	}
+
+	c := NewNodeCache(2)
+	doc := []byte(`{"a": {"b": [1, 2]}, "c": "x"}`)
+
+	n1 := c.Get("k1", doc)
+	assert.Equal(`{"a":{"b":[1,2]},"c":"x"}`, mustJSONString(n1))
+	assert.Equal(1, c.Len())
+	entry := cached(c, "k1")
+	assert.NotNil(entry)
+
+	// hit
+	n2 := c.Get("k1", []byte(`{"a": {"b": [1, 2]}, "c": "x"}`))
+	assert.True(entry == cached(c, "k1"))
+	assert.False(n1 == n2)
+	assert.Equal(`{"a":{"b":[1,2]},"c":"x"}`, mustJSONString(n2))
+
+	// isolation
+	patch, _ := NewPatch([]byte(`[{"op": "add", "path": "/a/b/-", "value": 3}, {"op": "replace", "path": "/c", "value": "y"}]`))
+	assert.NoError(n1.Patch(patch, nil))
+	assert.NoError(n1.UnmarshalJSON([]byte(`{"z": 0}`)))
+	assert.Equal(`{"a":{"b":[1,2]},"c":"x"}`, mustJSONString(n2))
+	assert.Equal(`{"a":{"b":[1,2]},"c":"x"}`, mustJSONString(c.Get("k1", doc)))
+	doc[2] = 'z'
+	assert.Equal(`{"a":{"b":[1,2]},"c":"x"}`, mustJSONString(entry))
+
+	// miss on changed content
+	n3 := c.Get("k1", []byte(`{"a": 2}`))
+	assert.Equal(`{"a":2}`, mustJSONString(n3))
+	assert.False(entry == cached(c, "k1"))
+	assert.Equal(1, c.Len())
+
+	// eviction of the least recently used
+	c.Get("k2", []byte(`[1, 2]`))
+	c.Get("k1", []byte(`{"a": 2}`))
+	c.Get("k3", []byte(`"s"`))
+	assert.Equal(2, c.Len())
+	assert.Nil(cached(c, "k2"))
+	assert.NotNil(cached(c, "k1"))
+	assert.Equal(`"s"`, mustJSONString(c.Get("k3", []byte(`"s"`))))
+
+	c.Remove("k1")
+	assert.Equal(1, c.Len())
+
+	// invalid documents are not cached
+	n4 := c.Get("k4", []byte(`{"a": [}`))
+	assert.Nil(cached(c, "k4"))
+	_, err := n4.MarshalJSON()
+	assert.Error(err)
+
+	var zero NodeCache
+	assert.Equal(0, zero.Len())
+	assert.Equal(`{"a":1}`, mustJSONString(zero.Get("k", []byte(`{"a": 1}`))))
+	assert.Equal(1, zero.Len())
+}
@@ -1,24 +1,491 @@
 package jsonpatch
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
 	"strconv"
 	"strings"
 )
 
 // Diff two JSON documents and generate a JSON Patch.
+// Arrays are diffed element by element, but when their lengths differ and the common
+// leading and trailing elements produce a shorter patch, only the elements in between
+// are diffed, so inserting or deleting an element does not replace the shifted tail.
 func Diff(src, dst []byte, opts *DiffOptions) (Patch, error) {
 	return NewNode(src).Diff(NewNode(dst), opts)
 }
 
+// DiffValue diffs a JSON document against the JSON encoding of target, e.g. a struct holding
+// the desired state, and generates a JSON Patch. Struct fields are encoded in declaration order,
+// so new fields are added in that order; with OrderSensitiveObjects, existing members are also
+// reordered to match it.
+func DiffValue(src []byte, target interface{}, opts *DiffOptions) (Patch, error) {
+	dst, err := json.Marshal(target)
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal target, %w", err)
+	}
+	return Diff(src, dst, opts)
+}
+
+// DiffRemovals diffs two JSON documents like Diff, and returns only the "remove" operations of
+// the members and elements in src that are absent in dst, in the order Diff generates them, so
+// the elements of an array are removed from the end and the patch applies cleanly to src.
+// The members removed only to be added again, as with OrderSensitiveObjects, are not included.
+func DiffRemovals(src, dst []byte, opts *DiffOptions) (Patch, error) {
+	patch, err := Diff(src, dst, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	added := make(map[string]bool)
+	for _, op := range patch {
+		if op.Op == "add" {
+			added[op.Path] = true
+		}
+	}
+
+	res := make(Patch, 0)
+	for _, op := range patch {
+		if op.Op == "remove" && !added[op.Path] {
+			res = append(res, op)
+		}
+	}
+	return res, nil
+}
+
+// DiffNDJSON diffs two JSON documents like Diff, but writes each generated operation to w
+// as a line of JSON as soon as it is generated, instead of returning the whole patch.
+// The operations of an array are buffered until the array is diffed, see Diff, and the whole
+// patch is buffered with UseMoveAndCopy.
+func DiffNDJSON(src, dst []byte, w io.Writer, opts *DiffOptions) error {
+	enc := json.NewEncoder(w)
+	if opts != nil && opts.UseMoveAndCopy {
+		patch, err := Diff(src, dst, opts)
+		if err != nil {
+			return err
+		}
+		for _, op := range patch {
+			if err := enc.Encode(op); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	c := &collector{emit: func(op Operation) error { return enc.Encode(op) }}
+	if opts != nil {
+		c.pairedTests = opts.PairedTests || opts.GuardWithTest
+		c.escape = opts.PointerEscape
+		if opts.CopyWithinPatch {
+			c.copies = make(map[string]string)
+		}
+	}
+	if err := NewNode(src).diff(NewNode(dst), c, opts); err != nil {
+		return err
+	}
+	return c.err
+}
+
+// ApplyAndDiff applies the patch to the JSON document and diffs the result against the
+// expected document. It returns the residual patch that transforms the result into the
+// expected document, which is empty if they match.
+func ApplyAndDiff(doc []byte, p Patch, expected []byte, options *Options) (Patch, error) {
+	node := NewNode(doc)
+	if err := node.Patch(p, options); err != nil {
+		return nil, err
+	}
+	return node.Diff(NewNode(expected), nil)
+}
+
+// ReverseDiff generates a JSON Patch that transforms dst back into src, it is equal to
+// Diff(dst, src, opts). Paired with Diff(src, dst, opts), it can be used for bidirectional sync.
+func ReverseDiff(src, dst []byte, opts *DiffOptions) (Patch, error) {
+	return Diff(dst, src, opts)
+}
+
+// ClearPatch generates a JSON Patch that removes all members of the root object
+// or all elements of the root array in the given JSON document.
+func ClearPatch(doc []byte) (Patch, error) {
+	n := NewNode(doc)
+	if _, err := n.intoContainer(); err != nil {
+		return nil, fmt.Errorf("unexpected node %q, %w", n.String(), err)
+	}
+
+	c := &collector{patch: make(Patch, 0)}
+	if n.which == eDoc {
+		for _, key := range n.doc.obj.Keys() {
+			c.removeOp(encodePatchKey(key))
+		}
+		return c.patch, nil
+	}
+
+	for i := len(n.ary) - 1; i >= 0; i-- {
+		c.removeOp(strconv.Itoa(i))
+	}
+	return c.patch, nil
+}
+
+// RenameKeysPatch generates a JSON Patch of "move" operations that renames object members
+// in the given JSON document. The keys of renames are JSON Pointers of the members to rename,
+// or plain member names of the root object, and the values are their new member names.
+// Nested members are renamed before their parents. Since RFC 6902 can not insert a member
+// at a position, each renamed member becomes the last member of its object.
+// It returns an error if a member does not exist or its new name is already taken.
+func RenameKeysPatch(doc []byte, renames map[string]string) (Patch, error) {
+	n := NewNode(doc)
+	pd, err := n.intoContainer()
+	switch {
+	case err != nil:
+		return nil, fmt.Errorf("unexpected node %q, %w", n.String(), err)
+	case pd == nil:
+		return nil, fmt.Errorf("unexpected node %q", n.String())
+	}
+
+	paths := make([]string, 0, len(renames))
+	keys := make(map[string]string, len(renames))
+	for path, key := range renames {
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + encodePatchKey(path)
+		}
+		paths = append(paths, path)
+		keys[path] = key
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		di, dj := strings.Count(paths[i], "/"), strings.Count(paths[j], "/")
+		if di != dj {
+			return di > dj
+		}
+		return paths[i] < paths[j]
+	})
+
+	var accumulatedCopySize int64
+	options := NewOptions()
+	p := make(Patch, 0, len(paths))
+	for _, path := range paths {
+		con, old, _ := resolveObject(&pd, path, options)
+		if con == nil {
+			return nil, fmt.Errorf("unable to rename %q, %w", path, ErrMissing)
+		}
+		if _, ok := con.(*partialDoc); !ok {
+			return nil, fmt.Errorf("unable to rename %q, parent is not an object, %w", path, ErrInvalid)
+		}
+		if _, err := con.get(old, options); err != nil {
+			return nil, fmt.Errorf("unable to rename %q, %w", path, err)
+		}
+
+		key := keys[path]
+		if key == old {
+			continue
+		}
+		if _, err := con.get(key, options); err == nil {
+			return nil, fmt.Errorf("unable to rename %q to existing key %q, %w", path, key, ErrInvalid)
+		}
+
+		op := Operation{Op: "move", From: path, Path: path[:strings.LastIndex(path, "/")+1] + encodePatchKey(key)}
+		if err := p.applyOp(&pd, op, &accumulatedCopySize, options); err != nil {
+			return nil, err
+		}
+		p = append(p, op)
+	}
+	return p, nil
+}
+
+// UpsertPatch generates a JSON Patch that upserts the elements into the array at arrayPath in the
+// JSON document by their idKey member, e.g. to sync a collection: an element with the same id as
+// an element of the array replaces it at its current index, other elements are appended in order.
+// Ids are compared as JSON values, and an element with the same id as a previous one replaces it.
+// It returns an error if the array is missing, or if an element is not an object with a non-null id.
+func UpsertPatch(doc []byte, arrayPath string, idKey string, elements []json.RawMessage) (Patch, error) {
+	n := NewNode(doc)
+	if arrayPath != "" {
+		var err error
+		if n, err = n.GetChild(arrayPath, nil); err != nil {
+			return nil, fmt.Errorf("unable to resolve array %q, %w", arrayPath, err)
+		}
+	}
+	if _, err := n.intoContainer(); n.which != eAry {
+		return nil, fmt.Errorf("unexpected node %q at %q, %w", n.String(), arrayPath, err)
+	}
+
+	ids := make([]*Node, 0, len(n.ary)+len(elements))
+	for _, v := range n.ary {
+		ids = append(ids, elementID(v, idKey))
+	}
+
+	p := make(Patch, 0, len(elements))
+	for i, raw := range elements {
+		id := elementID(NewNode(raw), idKey)
+		if id == nil {
+			return nil, fmt.Errorf("element %d has no %q member, %w", i, idKey, ErrInvalid)
+		}
+
+		idx := len(ids)
+		for j, v := range ids {
+			if v != nil && v.Equal(id) {
+				idx = j
+				break
+			}
+		}
+
+		op := Operation{Op: "replace", Path: arrayPath + "/" + strconv.Itoa(idx), Value: raw}
+		if idx == len(ids) {
+			op.Op = "add"
+			ids = append(ids, id)
+		}
+		p = append(p, op)
+	}
+	return p, nil
+}
+
+// elementID returns the non-null idKey member of the object node, or nil.
+func elementID(n *Node, idKey string) *Node {
+	if n == nil {
+		return nil
+	}
+	if _, err := n.intoContainer(); err != nil || n.which != eDoc {
+		return nil
+	}
+	if id, ok := n.doc.obj.Get(idKey); ok && !id.isNull() {
+		return id
+	}
+	return nil
+}
+
+// ScalarChange is a change of a scalar leaf value, see ScalarDiff.
+type ScalarChange struct {
+	Path string          `json:"path"`
+	Old  json.RawMessage `json:"old"`
+	New  json.RawMessage `json:"new"`
+}
+
+// ScalarDiff diffs two JSON documents like Diff, and returns the changes of the scalar leaf
+// values that are present in both, e.g. for a "fields changed" summary. Structural changes,
+// such as added or removed members and elements, and values changed from or to objects or
+// arrays, are omitted. Null is a scalar value.
+func ScalarDiff(src, dst []byte) ([]ScalarChange, error) {
+	patch, err := Diff(src, dst, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	node := NewNode(src)
+	res := make([]ScalarChange, 0)
+	for _, op := range patch {
+		if op.Op != "replace" || !isScalar(op.Value) {
+			continue
+		}
+		v := node
+		if op.Path != "" {
+			if v, err = node.GetChild(op.Path, nil); err != nil {
+				return nil, err
+			}
+		}
+		old, err := v.MarshalJSON()
+		if err != nil {
+			return nil, err
+		}
+		if isScalar(old) {
+			res = append(res, ScalarChange{Path: op.Path, Old: old, New: op.Value})
+		}
+	}
+	return res, nil
+}
+
+func isScalar(raw []byte) bool {
+	switch DocumentType(raw) {
+	case TypeNull, TypeBool, TypeNumber, TypeString:
+		return true
+	default:
+		return false
+	}
+}
+
 // DiffOptions is used to customize the behavior of the Diff function.
 type DiffOptions struct {
 	// IDKey is the name of the key to use as the unique identifier for JSON object
 	IDKey string
+	// IDPointer is the JSON Pointer, relative to each JSON object or array, of the value
+	// to use as its unique identifier, e.g. "/0" for arrays identified by their first element.
+	// Like IDKey, nodes with different identifiers are replaced instead of diffed.
+	IDPointer string
+	// PairedTests precedes every "replace" and "remove" operation with a "test"
+	// operation of the source value, so that the patch fails on any divergent field.
+	PairedTests bool
+	// GuardWithTest guards every "replace" and "remove" operation with a preceding "test"
+	// operation of the source value, as with PairedTests, so that applying the patch to a
+	// document that changed since it was diffed fails cleanly instead of corrupting it.
+	GuardWithTest bool
+	// EqualFunc is consulted before Node.Equal for each pair of compared nodes.
+	// The second return value reports whether it handled the comparison, if so,
+	// the first one reports whether the nodes are equal and no operation is emitted for equal nodes.
+	EqualFunc func(a, b *Node) (bool, bool)
+	// OrderSensitiveObjects emits operations to reorder the members of objects to match the target.
+	// Since RFC 6902 can not reorder members, the out of order members are removed and added again.
+	OrderSensitiveObjects bool
+	// UseHashShortcut compares hashes of the encoded values of the common members of objects
+	// before diffing them, and skips members with equal hashes without walking them.
+	// Unparsed values are hashed without being parsed, which speeds up diffing large objects
+	// with few changes, at the cost of missing changes in the unlikely case of a hash collision.
+	UseHashShortcut bool
+	// TreatNullAsAbsent treats object members with null values as absent, as in JSON Merge Patch,
+	// so no operation is emitted to add or remove a null member, and a member changed to null
+	// is removed instead of replaced.
+	TreatNullAsAbsent bool
+	// PointerEscape encodes each object key into a token of the generated paths, in place of
+	// the standard RFC 6901 encoding of "~" and "/", see Options.PointerUnescape.
+	// Default to nil, which means the standard RFC 6901 encoding.
+	PointerEscape func(key string) string
+	// PreferArrayReplace replaces a changed array as a whole with a single "replace" operation
+	// when the JSON encoding of its element-wise operations is larger than ArrayReplaceRatio
+	// times the encoding of the "replace" operation, e.g. when most of its elements change.
+	PreferArrayReplace bool
+	// ArrayReplaceRatio is the size ratio of PreferArrayReplace, default to 1, which means
+	// the array is replaced whenever it gives a smaller patch.
+	ArrayReplaceRatio float64
+	// CopyWithinPatch emits a "copy" operation from the path of a previous "add" operation
+	// of an equal value, instead of another "add" operation, when it is shorter than the value.
+	// A path is only copied from while no operation in between has changed or shifted it.
+	CopyWithinPatch bool
+	// CoerceNumericObjects treats an object whose keys are the contiguous array indexes from "0",
+	// as emitted by some serializers, as the array of its members when it is diffed against an
+	// array, so that element-wise operations are emitted instead of replacing it. The object is
+	// diffed positionally and remains an object, the elements are only added or removed at its end.
+	CoerceNumericObjects bool
+	// DetectReorder emits "move" operations for an array whose elements are reordered, i.e. it has
+	// the same elements as the target array in a different order, instead of diffing it element
+	// by element. The elements in the longest run that keeps its relative order stay in place,
+	// so the minimal number of "move" operations is emitted, to be applied in order.
+	DetectReorder bool
+	// UseMoveAndCopy emits a "move" operation in place of a "remove" operation and an "add"
+	// operation of an equal value, e.g. when a subtree is relocated, and a "copy" operation in place
+	// of an "add" operation of a value found unchanged in the source document, when it is shorter
+	// than the value. A pair is only combined when no operation in between changes, shifts or reads
+	// the removed path, so the patch applies the same. Arrays whose elements are reordered are
+	// diffed as with DetectReorder. Operations are not combined with PointerEscape. If the
+	// combined patch does not produce the same document, the patch is returned uncombined.
+	UseMoveAndCopy bool
+	// CoalesceReplaces replaces an object or array as a whole with a single "replace" operation
+	// when more than one operation is emitted on its members and their number exceeds
+	// CoalesceRatio times its number of members, e.g. when most of the keys of an object are
+	// removed and a few are added. Nested containers are coalesced first.
+	CoalesceReplaces bool
+	// CoalesceRatio is the fraction of members of CoalesceReplaces, default to 0.5.
+	CoalesceRatio float64
+	// IDPaths diffs the arrays whose elements are all objects with distinct string or number IDKey
+	// members by id instead of by index: the operations address the elements with "id:" path tokens,
+	// e.g. "/items/id:abc/name", the ones on a changed or removed element are preceded by a "test"
+	// operation of its id, and new elements are appended. The patch is applied with
+	// Options.AllowIDPaths and Options.IDPathKey set to IDKey, and it applies the same after the
+	// elements were reordered, since the order of the elements is not diffed.
+	IDPaths bool
 }
 
 type collector struct {
-	path  string
-	patch Patch
+	path        string
+	patch       Patch
+	pairedTests bool
+	escape      func(key string) string
+	// copies, if set, maps the compact encoding of the added values to their paths,
+	// see CopyWithinPatch, it is only set on the root collector.
+	copies map[string]string
+	// emit, if set, is called with each operation instead of collecting it into patch,
+	// err is the first error it returned.
+	emit func(Operation) error
+	err  error
+}
+
+// push collects the operation, or emits it if the collector streams.
+func (c *collector) push(op Operation) {
+	if c.copies != nil {
+		op = c.copyWithin(op)
+	}
+
+	switch {
+	case c.err != nil:
+	case c.emit != nil:
+		c.err = c.emit(op)
+	default:
+		c.patch = append(c.patch, op)
+	}
+}
+
+// copyWithin returns a "copy" operation for an "add" operation of a value previously added
+// at a path that is still unchanged, or the operation itself.
+func (c *collector) copyWithin(op Operation) Operation {
+	for _, path := range mutatedPaths(op) {
+		for v, from := range c.copies {
+			if changesPath(op.Op, path, from) {
+				delete(c.copies, v)
+			}
+		}
+	}
+	// an appended value can not be copied from its "-" path.
+	if op.Op != "add" || strings.HasSuffix(op.Path, "/-") {
+		return op
+	}
+
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, op.Value); err != nil {
+		return op
+	}
+	value := buf.String()
+	if from, ok := c.copies[value]; ok && len(from)+2 < len(value) {
+		return Operation{Op: "copy", From: from, Path: op.Path}
+	}
+	c.copies[value] = op.Path
+	return op
+}
+
+// changesPath reports whether an operation at the path may change the value at the other path,
+// including by shifting the index of an array element that it is at or below.
+func changesPath(op, path, other string) bool {
+	if isPathAtOrBelow(path, other) || isPathAtOrBelow(other, path) {
+		return true
+	}
+	if op == "replace" {
+		return false
+	}
+
+	parent := parentPath(path)
+	if !isPathAtOrBelow(other, parent) || other == parent {
+		return false
+	}
+	k, ok := indexToken(path[len(parent)+1:])
+	if !ok {
+		return false
+	}
+	token := other[len(parent)+1:]
+	if i := strings.IndexByte(token, '/'); i >= 0 {
+		token = token[:i]
+	}
+	j, ok := indexToken(token)
+	return ok && j >= k
+}
+
+// indexToken parses the path token as a non-negative array index, without allocating for
+// the tokens that are not, e.g. object keys.
+func indexToken(token string) (int, bool) {
+	if token == "" || strings.Trim(token, "0123456789") != "" {
+		return 0, false
+	}
+	i, err := strconv.Atoi(token)
+	return i, err == nil
+}
+
+// fork returns a new empty collector at the same path.
+func (c *collector) fork() *collector {
+	return &collector{path: c.path, patch: make(Patch, 0), pairedTests: c.pairedTests, escape: c.escape}
+}
+
+// escapeKey encodes the object key into a path token.
+func (c *collector) escapeKey(key string) string {
+	if c.escape != nil {
+		return c.escape(key)
+	}
+	return encodePatchKey(key)
 }
 
 func (c *collector) withPathToken(token string) string {
@@ -41,98 +508,893 @@ func (c *collector) popPathToken() {
 func (c *collector) replaceOp(token string, node *Node) error {
 	raw, err := node.MarshalJSON()
 	if err == nil {
-		c.patch = append(c.patch, Operation{Op: "replace", Path: c.withPathToken(token), Value: raw})
+		c.push(Operation{Op: "replace", Path: c.withPathToken(token), Value: raw})
 	}
 	return err
 }
 
+func (c *collector) replaceWithTestOp(token string, src, node *Node) error {
+	if err := c.testOp(token, src); err != nil {
+		return err
+	}
+	return c.replaceOp(token, node)
+}
+
 func (c *collector) addOp(token string, node *Node) error {
 	raw, err := node.MarshalJSON()
 	if err == nil {
-		c.patch = append(c.patch, Operation{Op: "add", Path: c.withPathToken(token), Value: raw})
+		c.push(Operation{Op: "add", Path: c.withPathToken(token), Value: raw})
+	}
+	return err
+}
+
+func (c *collector) testOp(token string, node *Node) error {
+	if !c.pairedTests {
+		return nil
+	}
+	raw, err := node.MarshalJSON()
+	if err == nil {
+		c.push(Operation{Op: "test", Path: c.withPathToken(token), Value: raw})
 	}
 	return err
 }
 
 func (c *collector) removeOp(token string) {
-	c.patch = append(c.patch, Operation{Op: "remove", Path: c.withPathToken(token)})
+	c.push(Operation{Op: "remove", Path: c.withPathToken(token)})
 }
 
 // Diff two JSON nodes and generate a JSON Patch.
 func (n *Node) Diff(target *Node, opts *DiffOptions) (Patch, error) {
 	c := &collector{patch: make(Patch, 0)}
+	if opts != nil {
+		c.pairedTests = opts.PairedTests || opts.GuardWithTest
+		c.escape = opts.PointerEscape
+		if opts.CopyWithinPatch {
+			c.copies = make(map[string]string)
+		}
+	}
 	if err := n.diff(target, c, opts); err != nil {
 		return nil, err
 	}
+	if opts != nil && opts.UseMoveAndCopy && opts.PointerEscape == nil {
+		return moveAndCopy(n, c.patch), nil
+	}
 	return c.patch, nil
 }
 
 func (n *Node) diff(target *Node, c *collector, opts *DiffOptions) error {
 	if n == nil || target == nil {
-		return c.replaceOp("", target)
+		return c.replaceWithTestOp("", n, target)
 	}
 
-	if n.Equal(target) {
+	if n.diffEqual(target, opts) {
 		return nil
 	}
 
+	if opts != nil && opts.CoerceNumericObjects && target.which != n.which {
+		src, sok := n.numericArray()
+		dst, dok := target.numericArray()
+		switch {
+		case sok && dok && n.which == eDoc:
+			return diffArrayRange(src.ary, dst.ary, 0, c, opts)
+		case sok && dok:
+			return src.diffArray(dst, c, opts)
+		}
+	}
+
 	if target.which != n.which || target.which == eOther {
-		return c.replaceOp("", target)
+		return c.replaceWithTestOp("", n, target)
+	}
+
+	if opts != nil && opts.IDPointer != "" {
+		if v, err := n.GetChild(opts.IDPointer, nil); err == nil && !v.isNull() {
+			if tv, _ := target.GetChild(opts.IDPointer, nil); !v.Equal(tv) {
+				return c.replaceWithTestOp("", n, target)
+			}
+		}
 	}
 
+	if opts != nil && opts.CoalesceReplaces {
+		return n.diffCoalesced(target, c, opts)
+	}
 	if n.which == eDoc {
-		if opts != nil && opts.IDKey != "" {
-			if v := n.doc.obj[opts.IDKey]; !v.isNull() && !v.Equal(target.doc.obj[opts.IDKey]) {
-				return c.replaceOp("", target)
+		return n.diffObject(target, c, opts)
+	}
+	return n.diffArray(target, c, opts)
+}
+
+// diffCoalesced diffs the objects or arrays into a forked collector, and replaces the container
+// as a whole instead if the operations on its members are too many, see CoalesceReplaces.
+func (n *Node) diffCoalesced(target *Node, c *collector, opts *DiffOptions) error {
+	members := c.fork()
+	var err error
+	if n.which == eDoc {
+		err = n.diffObject(target, members, opts)
+	} else {
+		err = n.diffArray(target, members, opts)
+	}
+	if err != nil {
+		return err
+	}
+
+	count := 0
+	for _, op := range members.patch {
+		if op.Op != "test" && parentPath(op.Path) == c.path {
+			count++
+		}
+	}
+	size := n.containerLen()
+	if l := target.containerLen(); l > size {
+		size = l
+	}
+	ratio := opts.CoalesceRatio
+	if ratio <= 0 {
+		ratio = 0.5
+	}
+	if count > 1 && float64(count) > ratio*float64(size) {
+		return c.replaceWithTestOp("", n, target)
+	}
+
+	for _, op := range members.patch {
+		c.push(op)
+	}
+	return nil
+}
+
+// containerLen returns the number of members or elements of the parsed object or array node.
+func (n *Node) containerLen() int {
+	if n.which == eDoc {
+		return n.doc.obj.Len()
+	}
+	return len(n.ary)
+}
+
+// diffObject diffs two objects member by member.
+func (n *Node) diffObject(target *Node, c *collector, opts *DiffOptions) error {
+	if opts != nil && opts.IDKey != "" {
+		v, _ := n.doc.obj.Get(opts.IDKey)
+		if tv, _ := target.doc.obj.Get(opts.IDKey); !v.isNull() && !v.Equal(tv) {
+			return c.replaceWithTestOp("", n, target)
+		}
+	}
+
+	nullAsAbsent := opts != nil && opts.TreatNullAsAbsent
+	for _, key := range n.doc.obj.Keys() {
+		if _, ok := target.doc.obj.Get(key); !ok {
+			node, _ := n.doc.obj.Get(key)
+			if nullAsAbsent && node.isNull() {
+				continue
+			}
+			if err := c.testOp(c.escapeKey(key), node); err != nil {
+				return err
 			}
+			c.removeOp(c.escapeKey(key))
 		}
+	}
 
-		for _, key := range n.doc.keys {
-			if _, ok := target.doc.obj[key]; !ok {
-				c.removeOp(encodePatchKey(key))
+	// members from the reordered index onward are appended again in the target order.
+	reordered := len(target.doc.obj.Keys())
+	if opts != nil && opts.OrderSensitiveObjects {
+		reordered = 0
+		tkeys := target.doc.obj.Keys()
+		for _, key := range n.doc.obj.Keys() {
+			if _, ok := target.doc.obj.Get(key); !ok {
+				continue
 			}
+			if key != tkeys[reordered] {
+				break
+			}
+			reordered++
 		}
+	}
 
-		for _, key := range target.doc.keys {
-			node, ok := n.doc.obj[key]
-			switch {
-			case ok:
-				c.pushPathToken(encodePatchKey(key))
-				if err := node.diff(target.doc.obj[key], c, opts); err != nil {
-					return err
-				}
-				c.popPathToken()
+	for i, key := range target.doc.obj.Keys() {
+		node, ok := n.doc.obj.Get(key)
+		tnode, _ := target.doc.obj.Get(key)
+		switch {
+		case ok && i >= reordered:
+			if err := c.testOp(c.escapeKey(key), node); err != nil {
+				return err
+			}
+			c.removeOp(c.escapeKey(key))
+			if err := c.addOp(c.escapeKey(key), tnode); err != nil {
+				return err
+			}
+
+		case ok && nullAsAbsent && tnode.isNull() && !node.isNull():
+			if err := c.testOp(c.escapeKey(key), node); err != nil {
+				return err
+			}
+			c.removeOp(c.escapeKey(key))
 
-			default:
-				if err := c.addOp(encodePatchKey(key), target.doc.obj[key]); err != nil {
-					return err
-				}
+		case ok:
+			if opts != nil && opts.UseHashShortcut && node.valueHash() == tnode.valueHash() {
+				continue
+			}
+			c.pushPathToken(c.escapeKey(key))
+			if err := node.diff(tnode, c, opts); err != nil {
+				return err
+			}
+			c.popPathToken()
+
+		case nullAsAbsent && tnode.isNull():
+
+		default:
+			if err := c.addOp(c.escapeKey(key), tnode); err != nil {
+				return err
 			}
 		}
+	}
 
-		return nil
+	return nil
+}
+
+// numericArray returns the node as an array node if it is an array, or an object whose keys are
+// the contiguous array indexes from "0", see CoerceNumericObjects.
+func (n *Node) numericArray() (*Node, bool) {
+	switch n.which {
+	case eAry:
+		return n, true
+	case eDoc:
+	default:
+		return nil, false
 	}
 
-	nl := len(n.ary)
-	for i, node := range target.ary {
+	keys := n.doc.obj.Keys()
+	ary := make(partialArray, len(keys))
+	seen := make([]bool, len(keys))
+	for _, key := range keys {
+		i, err := strconv.Atoi(key)
+		if err != nil || i < 0 || i >= len(keys) || seen[i] || strconv.Itoa(i) != key {
+			return nil, false
+		}
+		seen[i] = true
+		ary[i], _ = n.doc.obj.Get(key)
+	}
+	return &Node{ary: ary, which: eAry, newObject: n.newObject}, true
+}
+
+// diffArray diffs two arrays positionally. When their lengths differ, the common prefix and
+// suffix elements are also skipped and only the elements in between are diffed positionally,
+// so that a single insertion or deletion produces one "add" or "remove" instead of cascading
+// replaces over the shifted tail. The shorter of the two patches is used.
+func (n *Node) diffArray(target *Node, c *collector, opts *DiffOptions) error {
+	if opts != nil && opts.IDPaths && opts.IDKey != "" {
+		if ok, err := n.diffKeyedArray(target, c, opts); ok || err != nil {
+			return err
+		}
+	}
+	if opts != nil && (opts.DetectReorder || opts.UseMoveAndCopy) {
+		if perm, ok := reorderPermutation(n.ary, target.ary, opts); ok {
+			for _, op := range reorderMoves(perm) {
+				op.From = c.withPathToken(op.From)
+				op.Path = c.withPathToken(op.Path)
+				c.push(op)
+			}
+			return nil
+		}
+	}
+
+	positional := c.fork()
+	if err := diffArrayRange(n.ary, target.ary, 0, positional, opts); err != nil {
+		return err
+	}
+
+	ns, nt := len(n.ary), len(target.ary)
+	if ns != nt {
+		prefix := 0
+		for prefix < ns && prefix < nt && elemEqual(n.ary[prefix], target.ary[prefix], opts) {
+			prefix++
+		}
+		suffix := 0
+		for suffix < ns-prefix && suffix < nt-prefix &&
+			elemEqual(n.ary[ns-1-suffix], target.ary[nt-1-suffix], opts) {
+			suffix++
+		}
+
+		if suffix > 0 {
+			trimmed := c.fork()
+			err := diffArrayRange(n.ary[prefix:ns-suffix], target.ary[prefix:nt-suffix], prefix, trimmed, opts)
+			if err != nil {
+				return err
+			}
+			if len(trimmed.patch) < len(positional.patch) {
+				positional = trimmed
+			}
+		}
+	}
+
+	if opts != nil && opts.PreferArrayReplace {
+		whole := c.fork()
+		if err := whole.replaceWithTestOp("", n, target); err != nil {
+			return err
+		}
+		replace, err := arrayReplaceCheaper(positional.patch, whole.patch, opts.ArrayReplaceRatio)
+		if err != nil {
+			return err
+		}
+		if replace {
+			positional = whole
+		}
+	}
+
+	for _, op := range positional.patch {
+		c.push(op)
+	}
+	return nil
+}
+
+// diffKeyedArray diffs the arrays element by element by their ids, see IDPaths. It returns false
+// without collecting any operation if an element is not an object with a string or number id,
+// or if two elements of an array have the same id token.
+func (n *Node) diffKeyedArray(target *Node, c *collector, opts *DiffOptions) (bool, error) {
+	src, ok := idTokens(n.ary, opts.IDKey)
+	if !ok {
+		return false, nil
+	}
+	dst, ok := idTokens(target.ary, opts.IDKey)
+	if !ok {
+		return false, nil
+	}
+
+	index := make(map[string]int, len(dst))
+	for i, token := range dst {
+		index[token] = i
+	}
+
+	idToken := c.escapeKey(opts.IDKey)
+	found := make(map[string]bool, len(src))
+	for i, token := range src {
+		elem := n.ary[i]
+		j, ok := index[token]
+		found[token] = ok
+		if ok && elemEqual(elem, target.ary[j], opts) {
+			continue
+		}
+
+		// the id pins the type of the id matched by the token, e.g. 5 and not "5".
+		id, _ := elem.doc.obj.Get(opts.IDKey)
+		raw, err := id.MarshalJSON()
+		if err != nil {
+			return true, err
+		}
+		c.push(Operation{Op: "test", Path: c.withPathToken(token + "/" + idToken), Value: raw})
+
+		if !ok {
+			if err := c.testOp(token, elem); err != nil {
+				return true, err
+			}
+			c.removeOp(token)
+			continue
+		}
+
+		c.pushPathToken(token)
+		if err := elem.diff(target.ary[j], c, opts); err != nil {
+			return true, err
+		}
+		c.popPathToken()
+	}
+
+	for i, token := range dst {
+		if !found[token] {
+			if err := c.addOp("-", target.ary[i]); err != nil {
+				return true, err
+			}
+		}
+	}
+	return true, nil
+}
+
+// idTokens returns the "id:" path tokens of the elements by their idKey members, see IDPaths.
+func idTokens(ary partialArray, idKey string) ([]string, bool) {
+	tokens := make([]string, len(ary))
+	seen := make(map[string]bool, len(ary))
+	for i, elem := range ary {
+		id := elementID(elem, idKey)
+		if id == nil {
+			return nil, false
+		}
+
+		var token string
+		switch DocumentType(*id.raw) {
+		case TypeString:
+			var s string
+			if err := json.Unmarshal(*id.raw, &s); err != nil {
+				return nil, false
+			}
+			token = "id:" + encodePatchKey(s)
+		case TypeNumber:
+			token = "id:" + strings.TrimSpace(string(*id.raw))
+		default:
+			return nil, false
+		}
+
+		if seen[token] {
+			return nil, false
+		}
+		seen[token] = true
+		tokens[i] = token
+	}
+	return tokens, true
+}
+
+// moveAndCopy combines the "remove" and "add" operations of equal values into "move" operations,
+// and turns the "add" operations of values found unchanged in src into "copy" operations,
+// see UseMoveAndCopy. The candidate values are indexed by valueHash, so equal values with members
+// in another order are not combined. It returns the patch itself if the result does not apply
+// the same.
+func moveAndCopy(src *Node, p Patch) Patch {
+	options := NewOptions()
+	base, doc := src.clone(), src.clone()
+	removed := make([]*Node, len(p))
+	// removes holds the indexes of the "remove" operations by the hash of their removed values.
+	removes := make(map[uint64][]int)
+	for i, op := range p {
+		if op.Op == "remove" {
+			if removed[i], _ = doc.GetChild(op.Path, options); removed[i] != nil {
+				h := removed[i].valueHash()
+				removes[h] = append(removes[h], i)
+			}
+		}
+		if err := doc.Patch(Patch{op}, options); err != nil {
+			return p
+		}
+	}
+
+	res := make(Patch, len(p))
+	copy(res, p)
+	dropped := make([]bool, len(p))
+	idx := newOpIndex(res)
+	// tests holds the "test" operations of the removed values, which go before their "move" operations.
+	tests := make(map[int]Operation)
+	for j, op := range res {
+		if op.Op != "add" {
+			continue
+		}
+
+		value := NewNode(op.Value)
+		for _, i := range removes[value.valueHash()] {
+			if dropped[i] || !removed[i].Equal(value) {
+				continue
+			}
+			test := i > 0 && !dropped[i-1] && res[i-1].Op == "test" && res[i-1].Path == res[i].Path
+			if !canMove(res, dropped, idx, i, j, test) {
+				continue
+			}
+
+			if test && j < i {
+				tests[j] = res[i-1]
+				dropped[i-1] = true
+			}
+			res[j] = Operation{Op: "move", From: res[i].Path, Path: op.Path}
+			idx.add(j, res[j])
+			dropped[i] = true
+			break
+		}
+	}
+
+	var sources map[uint64][]copySource
+	for j, op := range res {
+		if op.Op != "add" {
+			continue
+		}
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, op.Value); err != nil {
+			continue
+		}
+		if sources == nil {
+			sources = make(map[uint64][]copySource)
+			indexCopySources(base, "", sources)
+		}
+		if from, ok := findCopySource(sources, NewNode(op.Value), res, dropped, idx, j); ok && len(from)+2 < buf.Len() {
+			res[j] = Operation{Op: "copy", From: from, Path: op.Path}
+			idx.add(j, res[j])
+		}
+	}
+
+	out := make(Patch, 0, len(res))
+	for k, op := range res {
+		if test, ok := tests[k]; ok {
+			out = append(out, test)
+		}
+		if !dropped[k] {
+			out = append(out, op)
+		}
+	}
+
+	if applied := src.clone(); applied.Patch(out, options) != nil || !applied.Equal(doc) {
+		return p
+	}
+	return out
+}
+
+// canMove reports whether the "remove" operation at i and the "add" operation at j can be
+// combined into a "move" operation at j, i.e. whether no operation in between changes or
+// shifts the removed path, nor depends on whether it is removed. If test is true, the
+// "test" operation of the removed value at i-1 is moved along with it.
+func canMove(p Patch, dropped []bool, idx *opIndex, i, j int, test bool) bool {
+	from, path := p[i].Path, p[j].Path
+	if isPathAtOrBelow(path, from) || isPathAtOrBelow(from, path) {
+		return false
+	}
+	if j < i && changesPath("remove", from, path) {
+		return false
+	}
+
+	lo, hi := i, j
+	if j < i {
+		lo, hi = j, i
+		if test {
+			hi = i - 1
+		}
+	}
+	for _, k := range idx.between(from, lo, hi) {
+		if dropped[k] {
+			continue
+		}
+		for _, m := range mutatedPaths(p[k]) {
+			if changesPath(p[k].Op, m, from) {
+				return false
+			}
+		}
+		for _, q := range opPaths(p[k]) {
+			if changesPath("remove", from, q) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// copySource is a value of the source document that can be copied, and its path.
+type copySource struct {
+	path  string
+	value *Node
+}
+
+// indexCopySources indexes the values of the node and its descendants by their valueHash,
+// each bucket in document order.
+func indexCopySources(n *Node, path string, sources map[uint64][]copySource) {
+	if n == nil {
+		return
+	}
+
+	h := n.valueHash()
+	sources[h] = append(sources[h], copySource{path: path, value: n})
+	if _, err := n.intoContainer(); err != nil {
+		return
+	}
+	switch n.which {
+	case eDoc:
+		for _, k := range n.doc.obj.Keys() {
+			v, _ := n.doc.obj.Get(k)
+			indexCopySources(v, path+"/"+encodePatchKey(k), sources)
+		}
+	case eAry:
+		for i, v := range n.ary {
+			indexCopySources(v, path+"/"+strconv.Itoa(i), sources)
+		}
+	}
+}
+
+// findCopySource returns the path of the first indexed value, in document order, that is
+// equal to value and is not changed by the operations of the patch before j.
+func findCopySource(sources map[uint64][]copySource, value *Node, p Patch, dropped []bool, idx *opIndex,
+	j int) (string, bool) {
+	for _, src := range sources[value.valueHash()] {
+		if src.value.Equal(value) && !changedBy(p, dropped, idx, j, src.path) {
+			return src.path, true
+		}
+	}
+	return "", false
+}
+
+// changedBy reports whether an operation of the patch before j that is not dropped changes
+// the path.
+func changedBy(p Patch, dropped []bool, idx *opIndex, j int, path string) bool {
+	for _, k := range idx.between(path, -1, j) {
+		if dropped[k] {
+			continue
+		}
+		op := p[k]
+		for _, m := range mutatedPaths(op) {
+			if changesPath(op.Op, m, path) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// opIndex indexes the operations of a patch by the first token of their paths, so that the
+// operations related to a path are found without scanning the patch: the operations below
+// another member of the root object than the path are unrelated to it.
+type opIndex struct {
+	size  int
+	byTop map[string][]int
+	// root holds the operations on the root, which are related to every path.
+	root []int
+}
+
+func newOpIndex(p Patch) *opIndex {
+	x := &opIndex{size: len(p), byTop: make(map[string][]int)}
+	for k, op := range p {
+		x.add(k, op)
+	}
+	return x
+}
+
+// add indexes the operation at k, e.g. once it replaced the previous operation at k.
+func (x *opIndex) add(k int, op Operation) {
+	paths := opPaths(op)
+	for _, path := range paths {
+		if path == "" {
+			x.root = insertSorted(x.root, k)
+			return
+		}
+	}
+	for _, path := range paths {
+		top := firstToken(path)
+		x.byTop[top] = insertSorted(x.byTop[top], k)
+	}
+}
+
+// between returns the indexes of the operations between lo and hi, exclusive, that may be
+// related to the path. The elements of a root array shift, so all operations may be related
+// to a path below an index of the root.
+func (x *opIndex) between(path string, lo, hi int) []int {
+	top := firstToken(path)
+	if _, ok := indexToken(top); ok || path == "" {
+		res := make([]int, 0, hi-lo)
+		for k := lo + 1; k < hi && k < x.size; k++ {
+			res = append(res, k)
+		}
+		return res
+	}
+
+	var res []int
+	for _, ks := range [][]int{x.byTop[top], x.root} {
+		for _, k := range ks[sort.SearchInts(ks, lo+1):] {
+			if k >= hi {
+				break
+			}
+			res = append(res, k)
+		}
+	}
+	return res
+}
+
+// insertSorted inserts k into the sorted indexes, unless it is already there.
+func insertSorted(s []int, k int) []int {
+	i := sort.SearchInts(s, k)
+	if i < len(s) && s[i] == k {
+		return s
+	}
+	s = append(s, 0)
+	copy(s[i+1:], s[i:])
+	s[i] = k
+	return s
+}
+
+// firstToken returns the first token of the path, without decoding it.
+func firstToken(path string) string {
+	if path == "" {
+		return ""
+	}
+	if i := strings.IndexByte(path[1:], '/'); i >= 0 {
+		return path[1 : i+1]
+	}
+	return path[1:]
+}
+
+// arrayReplaceCheaper reports whether the encoding of the element-wise operations is larger
+// than ratio times the encoding of the whole array replacement, see PreferArrayReplace.
+func arrayReplaceCheaper(elems, whole Patch, ratio float64) (bool, error) {
+	if ratio <= 0 {
+		ratio = 1
+	}
+	eb, err := json.Marshal(elems)
+	if err != nil {
+		return false, err
+	}
+	wb, err := json.Marshal(whole)
+	if err != nil {
+		return false, err
+	}
+	return float64(len(eb)) > ratio*float64(len(wb)), nil
+}
+
+// reorderPermutation returns the index in src of each element of dst, if dst has the same
+// elements as src, see DetectReorder. Equal elements are matched in order.
+func reorderPermutation(src, dst []*Node, opts *DiffOptions) ([]int, bool) {
+	if len(src) != len(dst) {
+		return nil, false
+	}
+
+	buckets := make(map[uint64][]int, len(src))
+	for i, v := range src {
+		h := v.valueHash()
+		buckets[h] = append(buckets[h], i)
+	}
+
+	used := make([]bool, len(src))
+	perm := make([]int, len(dst))
+	for j, v := range dst {
+		perm[j] = -1
+		for _, i := range buckets[v.valueHash()] {
+			if !used[i] && elemEqual(src[i], v, opts) {
+				perm[j] = i
+				break
+			}
+		}
+		// equal elements may have different hashes, e.g. objects with members in another order.
+		for i := 0; perm[j] < 0 && i < len(src); i++ {
+			if !used[i] && elemEqual(src[i], v, opts) {
+				perm[j] = i
+			}
+		}
+		if perm[j] < 0 {
+			return nil, false
+		}
+		used[perm[j]] = true
+	}
+	return perm, true
+}
+
+// reorderMoves returns the "move" operations, with the array indexes as paths, that reorder
+// the elements of an array so that perm[j] is the original index of the element at index j.
+// The elements of the longest increasing subsequence of perm stay in place, and every other
+// element is moved right after the element that precedes it in the target order.
+func reorderMoves(perm []int) Patch {
+	// tails[k] is the index in perm of the smallest tail of the increasing subsequences of length k+1.
+	tails := make([]int, 0, len(perm))
+	prev := make([]int, len(perm))
+	for j, v := range perm {
+		k := sort.Search(len(tails), func(k int) bool { return perm[tails[k]] >= v })
+		prev[j] = -1
+		if k > 0 {
+			prev[j] = tails[k-1]
+		}
+		if k == len(tails) {
+			tails = append(tails, j)
+		} else {
+			tails[k] = j
+		}
+	}
+
+	stay := make([]bool, len(perm))
+	if len(tails) > 0 {
+		for j := tails[len(tails)-1]; j >= 0; j = prev[j] {
+			stay[j] = true
+		}
+	}
+
+	cur := make([]int, len(perm))
+	for i := range cur {
+		cur[i] = i
+	}
+	indexOf := func(v int) int {
+		for i, e := range cur {
+			if e == v {
+				return i
+			}
+		}
+		return -1
+	}
+
+	moves := make(Patch, 0)
+	for j, v := range perm {
+		if stay[j] {
+			continue
+		}
+		from := indexOf(v)
+		cur = append(cur[:from], cur[from+1:]...)
+		to := 0
+		if j > 0 {
+			to = indexOf(perm[j-1]) + 1
+		}
+		cur = append(cur[:to], append([]int{v}, cur[to:]...)...)
+		if from != to {
+			moves = append(moves, Operation{Op: "move", From: strconv.Itoa(from), Path: strconv.Itoa(to)})
+		}
+	}
+	return moves
+}
+
+// diffArrayRange diffs the elements of two arrays positionally, the element at index i
+// is at index offset+i in the diffed arrays.
+func diffArrayRange(src, dst []*Node, offset int, c *collector, opts *DiffOptions) error {
+	ns := len(src)
+	for i, node := range dst {
 		switch {
-		case i < nl:
-			c.pushPathToken(strconv.Itoa(i))
-			if err := n.ary[i].diff(node, c, opts); err != nil {
+		case i < ns:
+			c.pushPathToken(strconv.Itoa(offset + i))
+			if err := src[i].diff(node, c, opts); err != nil {
 				return err
 			}
 			c.popPathToken()
 
 		default:
-			if err := c.addOp(strconv.Itoa(i), node); err != nil {
+			if err := c.addOp(strconv.Itoa(offset+i), node); err != nil {
 				return err
 			}
 		}
 	}
 
-	for i := len(target.ary); i < nl; i++ {
-		c.removeOp(strconv.Itoa(i))
+	// remove from the end so that the indexes of the remaining elements do not shift.
+	for i := ns - 1; i >= len(dst); i-- {
+		if err := c.testOp(strconv.Itoa(offset+i), src[i]); err != nil {
+			return err
+		}
+		c.removeOp(strconv.Itoa(offset + i))
 	}
 
 	return nil
 }
+
+func elemEqual(a, b *Node, opts *DiffOptions) bool {
+	if a == nil || b == nil {
+		return a.Equal(b)
+	}
+	return a.diffEqual(b, opts)
+}
+
+func (n *Node) diffEqual(target *Node, opts *DiffOptions) bool {
+	var equal, ok bool
+	if opts != nil && opts.EqualFunc != nil {
+		equal, ok = opts.EqualFunc(n, target)
+	}
+	if !ok {
+		equal = n.Equal(target) &&
+			(opts == nil || !opts.OrderSensitiveObjects || n.sameKeyOrder(target))
+	}
+
+	// the diff walker relies on both nodes being parsed.
+	n.intoContainer()
+	target.intoContainer()
+	return equal
+}
+
+// sameKeyOrder reports whether the members of the objects in two equal nodes are in the same order.
+func (n *Node) sameKeyOrder(o *Node) bool {
+	switch {
+	case n.isNull() || o.isNull():
+		return true
+	case n.which == eDoc:
+		okeys := o.doc.obj.Keys()
+		for i, key := range n.doc.obj.Keys() {
+			if key != okeys[i] {
+				return false
+			}
+			v, _ := n.doc.obj.Get(key)
+			ov, _ := o.doc.obj.Get(key)
+			if !v.sameKeyOrder(ov) {
+				return false
+			}
+		}
+	case n.which == eAry:
+		for i, v := range n.ary {
+			if !v.sameKeyOrder(o.ary[i]) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// valueHash returns an ordered rawHash of the encoded JSON of the node, unparsed nodes are
+// hashed from their raw encoded JSON.
+func (n *Node) valueHash() uint64 {
+	var data []byte
+	switch {
+	case n == nil:
+		data = []byte("null")
+	case n.raw != nil && (n.which == eRaw || n.which == eOther):
+		data = *n.raw
+	default:
+		data, _ = n.MarshalJSON()
+	}
+
+	h, _ := rawHash(data, true)
+	return h
+}
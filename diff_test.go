@@ -4,7 +4,13 @@
 package jsonpatch
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
 	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -131,6 +137,12 @@ var DiffCases = []DiffCase{
 		`{"key": { }}`,
 		`[{"op":"replace","path":"/key","value":{}}]`,
 	},
+	{
+		``,
+		`[1, 2, 3, 4]`,
+		`[1, 2]`,
+		`[{"op":"remove","path":"/3"},{"op":"remove","path":"/2"}]`,
+	},
 }
 
 func TestAllCasesDiff(t *testing.T) {
@@ -177,3 +189,1490 @@ func TestAllCasesDiff(t *testing.T) {
 			i, reformatJSON(c.src), reformatJSON(c.dst), reformatJSON(string(out)), mustJSONString(patch))
 	}
 }
+
+func TestDiffWithPairedTests(t *testing.T) {
+	assert := assert.New(t)
+
+	src := `{"name": "John", "age": 24, "tags": ["a", "b", "c", null], "address": {"city": "Paris"}}`
+	dst := `{"name": "Jane", "age": 24, "tags": ["a", "x"], "address": {"city": "Paris", "zip": "75001"}}`
+
+	patch, err := Diff([]byte(src), []byte(dst), &DiffOptions{PairedTests: true})
+	assert.NoError(err)
+	assert.Equal(`[`+
+		`{"op":"test","path":"/name","value":"John"},{"op":"replace","path":"/name","value":"Jane"},`+
+		`{"op":"test","path":"/tags/1","value":"b"},{"op":"replace","path":"/tags/1","value":"x"},`+
+		`{"op":"test","path":"/tags/3","value":null},{"op":"remove","path":"/tags/3"},`+
+		`{"op":"test","path":"/tags/2","value":"c"},{"op":"remove","path":"/tags/2"},`+
+		`{"op":"add","path":"/address/zip","value":"75001"}]`, mustJSONString(patch))
+
+	out, err := patch.Apply([]byte(src))
+	assert.NoError(err)
+	assert.True(compareJSON(string(out), dst))
+
+	for _, divergent := range []string{
+		`{"name": "Joe", "age": 24, "tags": ["a", "b", "c", null], "address": {"city": "Paris"}}`,
+		`{"name": "John", "age": 24, "tags": ["a", "y", "c", null], "address": {"city": "Paris"}}`,
+		`{"name": "John", "age": 24, "tags": ["a", "b", "c", 1], "address": {"city": "Paris"}}`,
+		`{"name": "John", "age": 24, "tags": ["a", "b", "d", null], "address": {"city": "Paris"}}`,
+	} {
+		_, err = patch.Apply([]byte(divergent))
+		assert.ErrorContainsf(err, "test operation for path", "should fail for %s", divergent)
+	}
+
+	patch, err = Diff([]byte(src), []byte(`[]`), &DiffOptions{PairedTests: true})
+	assert.NoError(err)
+	assert.Equal(`[{"op":"test","path":"","value":`+mustJSONString(NewNode([]byte(src)))+`},`+
+		`{"op":"replace","path":"","value":[]}]`, mustJSONString(patch))
+	_, err = patch.Apply([]byte(`{}`))
+	assert.Error(err)
+	out, err = patch.Apply([]byte(src))
+	assert.NoError(err)
+	assert.Equal(`[]`, string(out))
+
+	patch, err = Diff([]byte(`[1, {"a": 2}]`), []byte(`{"a": [1]}`), &DiffOptions{PairedTests: true, CoalesceReplaces: true})
+	assert.NoError(err)
+	out, err = patch.Apply([]byte(`[1, {"a": 2}]`))
+	assert.NoError(err)
+	assert.Equal(`{"a":[1]}`, string(out))
+
+	for i, c := range Cases {
+		patch, err := Diff([]byte(c.doc), []byte(c.result), &DiffOptions{PairedTests: true})
+		if !assert.NoErrorf(err, "Failed to diff at case %d", i) {
+			continue
+		}
+
+		out, err := patch.Apply([]byte(c.doc))
+		if !assert.NoErrorf(err, "Failed to apply patch at case %d\nPatch:%s\n", i, mustJSONString(patch)) {
+			continue
+		}
+		assert.Truef(compareJSON(string(out), c.result), "Not equal at case %d", i)
+	}
+}
+
+func TestDiffWithGuardWithTest(t *testing.T) {
+	assert := assert.New(t)
+
+	src := `{"name": "John", "tags": ["a", "b"], "address": {"city": "Paris", "zip": "75001"}}`
+	dst := `{"name": "Jane", "tags": ["a"], "address": {"city": "Lyon"}}`
+
+	patch, err := Diff([]byte(src), []byte(dst), &DiffOptions{GuardWithTest: true})
+	assert.NoError(err)
+	assert.Equal(`[`+
+		`{"op":"test","path":"/name","value":"John"},{"op":"replace","path":"/name","value":"Jane"},`+
+		`{"op":"test","path":"/tags/1","value":"b"},{"op":"remove","path":"/tags/1"},`+
+		`{"op":"test","path":"/address/zip","value":"75001"},{"op":"remove","path":"/address/zip"},`+
+		`{"op":"test","path":"/address/city","value":"Paris"},{"op":"replace","path":"/address/city","value":"Lyon"}]`,
+		mustJSONString(patch))
+
+	out, err := patch.Apply([]byte(src))
+	assert.NoError(err)
+	assert.True(compareJSON(string(out), dst))
+
+	var buf bytes.Buffer
+	assert.NoError(DiffNDJSON([]byte(src), []byte(dst), &buf, &DiffOptions{GuardWithTest: true}))
+	assert.Equal(len(patch), strings.Count(buf.String(), "\n"))
+
+	cases := []struct {
+		mutated string
+		step    int
+	}{
+		{`{"name": "Joe", "tags": ["a", "b"], "address": {"city": "Paris", "zip": "75001"}}`, 0},
+		{`{"name": "John", "tags": ["a", "c"], "address": {"city": "Paris", "zip": "75001"}}`, 2},
+		{`{"name": "John", "tags": ["a", "b"], "address": {"city": "Paris"}}`, 4},
+		{`{"name": "John", "tags": ["a", "b"], "address": {"city": "Nice", "zip": "75001"}}`, 6},
+	}
+	for i, c := range cases {
+		_, err := patch.Apply([]byte(c.mutated))
+		var opErr *OpError
+		if assert.ErrorAsf(err, &opErr, "case %d", i) {
+			assert.Equalf(c.step, opErr.Index, "case %d", i)
+			assert.Equalf("test", opErr.Op.Op, "case %d", i)
+		}
+	}
+}
+
+func TestDiffWithEqualFunc(t *testing.T) {
+	assert := assert.New(t)
+
+	caseInsensitive := func(a, b *Node) (bool, bool) {
+		var sa, sb string
+		if json.Unmarshal(*a.raw, &sa) != nil || json.Unmarshal(*b.raw, &sb) != nil {
+			return false, false
+		}
+		return strings.EqualFold(sa, sb), true
+	}
+
+	src := `{"name": "John", "city": "Paris", "tags": ["A", "b"], "age": 24}`
+	dst := `{"name": "JOHN", "city": "London", "tags": ["a", "B", "c"], "age": 25}`
+
+	patch, err := Diff([]byte(src), []byte(dst), nil)
+	assert.NoError(err)
+	assert.Equal(`[{"op":"replace","path":"/name","value":"JOHN"},`+
+		`{"op":"replace","path":"/city","value":"London"},`+
+		`{"op":"replace","path":"/tags/0","value":"a"},{"op":"replace","path":"/tags/1","value":"B"},`+
+		`{"op":"add","path":"/tags/2","value":"c"},{"op":"replace","path":"/age","value":25}]`,
+		mustJSONString(patch))
+
+	patch, err = Diff([]byte(src), []byte(dst), &DiffOptions{EqualFunc: caseInsensitive})
+	assert.NoError(err)
+	assert.Equal(`[{"op":"replace","path":"/city","value":"London"},`+
+		`{"op":"add","path":"/tags/2","value":"c"},{"op":"replace","path":"/age","value":25}]`,
+		mustJSONString(patch))
+
+	patch, err = Diff([]byte(`"abc"`), []byte(`"ABC"`), &DiffOptions{EqualFunc: caseInsensitive})
+	assert.NoError(err)
+	assert.Equal(`[]`, mustJSONString(patch))
+
+	patch, err = Diff([]byte(`"abc"`), []byte(`"abd"`), &DiffOptions{EqualFunc: caseInsensitive})
+	assert.NoError(err)
+	assert.Equal(`[{"op":"replace","path":"","value":"abd"}]`, mustJSONString(patch))
+}
+
+func TestClearPatch(t *testing.T) {
+	assert := assert.New(t)
+
+	cases := []struct {
+		doc, patch, result string
+	}{
+		{`{}`, `[]`, `{}`},
+		{`[]`, `[]`, `[]`},
+		{
+			`{"a": 1, "b/c": [1, 2], "d": {"e": null}}`,
+			`[{"op":"remove","path":"/a"},{"op":"remove","path":"/b~1c"},{"op":"remove","path":"/d"}]`,
+			`{}`,
+		},
+		{
+			`[1, [2, 3], {"a": 4}]`,
+			`[{"op":"remove","path":"/2"},{"op":"remove","path":"/1"},{"op":"remove","path":"/0"}]`,
+			`[]`,
+		},
+	}
+
+	for i, c := range cases {
+		patch, err := ClearPatch([]byte(c.doc))
+		if !assert.NoErrorf(err, "case %d", i) {
+			continue
+		}
+		assert.Equalf(c.patch, mustJSONString(patch), "case %d", i)
+
+		out, err := patch.Apply([]byte(c.doc))
+		assert.NoErrorf(err, "case %d", i)
+		assert.Equalf(c.result, string(out), "case %d", i)
+	}
+
+	for _, doc := range []string{``, `null`, `1`, `"abc"`, `{"a":`} {
+		_, err := ClearPatch([]byte(doc))
+		assert.Errorf(err, "should fail for %q", doc)
+	}
+}
+
+func TestRenameKeysPatch(t *testing.T) {
+	assert := assert.New(t)
+
+	cases := []struct {
+		doc     string
+		renames map[string]string
+		patch   string
+		result  string
+	}{
+		{`{"a": 1, "b": 2}`, map[string]string{}, `[]`, `{"a":1,"b":2}`},
+		{`{"a": 1, "b": 2}`, map[string]string{"a": "a"}, `[]`, `{"a":1,"b":2}`},
+		{
+			`{"a": 1, "b": 2}`,
+			map[string]string{"a": "c"},
+			`[{"op":"move","path":"/c","from":"/a"}]`,
+			`{"b":2,"c":1}`,
+		},
+		{
+			`{"a": {"x/y": 1, "z": 2}, "b": [{"c": 3}]}`,
+			map[string]string{"/a/x~1y": "x~y", "/b/0/c": "d"},
+			`[{"op":"move","path":"/b/0/d","from":"/b/0/c"},{"op":"move","path":"/a/x~0y","from":"/a/x~1y"}]`,
+			`{"a":{"z":2,"x~y":1},"b":[{"d":3}]}`,
+		},
+		{
+			`{"a": {"b": 1}}`,
+			map[string]string{"/a": "c", "/a/b": "d"},
+			`[{"op":"move","path":"/a/d","from":"/a/b"},{"op":"move","path":"/c","from":"/a"}]`,
+			`{"c":{"d":1}}`,
+		},
+	}
+
+	for i, c := range cases {
+		patch, err := RenameKeysPatch([]byte(c.doc), c.renames)
+		if !assert.NoErrorf(err, "case %d", i) {
+			continue
+		}
+		assert.Equalf(c.patch, mustJSONString(patch), "case %d", i)
+
+		out, err := patch.Apply([]byte(c.doc))
+		assert.NoErrorf(err, "case %d", i)
+		assert.Equalf(c.result, string(out), "case %d", i)
+	}
+
+	errCases := []struct {
+		doc     string
+		renames map[string]string
+	}{
+		{`1`, map[string]string{"a": "b"}},
+		{`{"a": 1}`, map[string]string{"b": "c"}},
+		{`{"a": 1}`, map[string]string{"/x/a": "c"}},
+		{`{"a": 1, "b": 2}`, map[string]string{"a": "b"}},
+		{`{"a": [1]}`, map[string]string{"/a/0": "b"}},
+	}
+	for i, c := range errCases {
+		_, err := RenameKeysPatch([]byte(c.doc), c.renames)
+		assert.Errorf(err, "case %d", i)
+	}
+}
+
+func TestDiffWithOrderSensitiveObjects(t *testing.T) {
+	assert := assert.New(t)
+
+	cases := []struct {
+		src, dst, patch string
+	}{
+		{
+			`{"a": 1, "b": 2}`,
+			`{"b": 2, "a": 1}`,
+			`[{"op":"remove","path":"/b"},{"op":"add","path":"/b","value":2},` +
+				`{"op":"remove","path":"/a"},{"op":"add","path":"/a","value":1}]`,
+		},
+		{
+			`{"a": 1, "b": 2, "c": 3}`,
+			`{"a": 1, "c": 3, "b": 4}`,
+			`[{"op":"remove","path":"/c"},{"op":"add","path":"/c","value":3},` +
+				`{"op":"remove","path":"/b"},{"op":"add","path":"/b","value":4}]`,
+		},
+		{
+			`{"a": 1, "b": 2, "c": 3}`,
+			`{"a": 1, "x": 0, "b": 2}`,
+			`[{"op":"remove","path":"/c"},{"op":"add","path":"/x","value":0},` +
+				`{"op":"remove","path":"/b"},{"op":"add","path":"/b","value":2}]`,
+		},
+		{
+			`{"a": 1, "b": 2}`,
+			`{"a": 2, "b": 2, "c": 3}`,
+			`[{"op":"replace","path":"/a","value":2},{"op":"add","path":"/c","value":3}]`,
+		},
+		{
+			`[{"a": 1, "b": {"x": 1, "y": 2}}]`,
+			`[{"a": 1, "b": {"y": 2, "x": 1}}]`,
+			`[{"op":"remove","path":"/0/b/y"},{"op":"add","path":"/0/b/y","value":2},` +
+				`{"op":"remove","path":"/0/b/x"},{"op":"add","path":"/0/b/x","value":1}]`,
+		},
+	}
+
+	for i, c := range cases {
+		patch, err := Diff([]byte(c.src), []byte(c.dst), nil)
+		assert.NoErrorf(err, "case %d", i)
+		out, err := patch.Apply([]byte(c.src))
+		assert.NoErrorf(err, "case %d", i)
+		assert.Truef(compareJSON(string(out), c.dst), "case %d", i)
+
+		patch, err = Diff([]byte(c.src), []byte(c.dst), &DiffOptions{OrderSensitiveObjects: true})
+		if !assert.NoErrorf(err, "case %d", i) {
+			continue
+		}
+		assert.Equalf(c.patch, mustJSONString(patch), "case %d", i)
+
+		out, err = patch.Apply([]byte(c.src))
+		assert.NoErrorf(err, "case %d", i)
+		assert.Equalf(mustJSONString(NewNode([]byte(c.dst))), string(out), "case %d", i)
+	}
+}
+
+func TestDiffWithIDPointer(t *testing.T) {
+	assert := assert.New(t)
+
+	src := `["root", ["p",
+		["span", {"data-type": "text"},
+			["span", {"data-type": "leaf"}, "Hello 1"],
+			["span", {"data-type": "leaf"}, "Hello 2"]
+		]
+	]]`
+	dst := `["root", ["p",
+		["span", {"data-type": "text"},
+			["b", {"data-type": "leaf"}, "Hello 1"],
+			["span", {"data-type": "leaf"}, "Hello 3"]
+		]
+	]]`
+
+	patch, err := Diff([]byte(src), []byte(dst), nil)
+	assert.NoError(err)
+	assert.Equal(`[{"op":"replace","path":"/1/1/2/0","value":"b"},`+
+		`{"op":"replace","path":"/1/1/3/2","value":"Hello 3"}]`, mustJSONString(patch))
+
+	patch, err = Diff([]byte(src), []byte(dst), &DiffOptions{IDPointer: "/0"})
+	assert.NoError(err)
+	assert.Equal(`[{"op":"replace","path":"/1/1/2","value":["b",{"data-type":"leaf"},"Hello 1"]},`+
+		`{"op":"replace","path":"/1/1/3/2","value":"Hello 3"}]`, mustJSONString(patch))
+
+	out, err := patch.Apply([]byte(src))
+	assert.NoError(err)
+	assert.True(compareJSON(string(out), dst))
+
+	patch, err = Diff([]byte(src), []byte(dst), &DiffOptions{IDPointer: "/1/data-type"})
+	assert.NoError(err)
+	assert.Equal(`[{"op":"replace","path":"/1/1/2/0","value":"b"},`+
+		`{"op":"replace","path":"/1/1/3/2","value":"Hello 3"}]`, mustJSONString(patch))
+
+	patch, err = Diff([]byte(`[["span", {"data-type": "text"}]]`), []byte(`[["span", {"data-type": "leaf"}]]`),
+		&DiffOptions{IDPointer: "/1/data-type"})
+	assert.NoError(err)
+	assert.Equal(`[{"op":"replace","path":"/0","value":["span",{"data-type":"leaf"}]}]`, mustJSONString(patch))
+}
+
+func TestReverseDiff(t *testing.T) {
+	assert := assert.New(t)
+
+	for i, c := range append(Cases, Case{doc: `[1, 2, 3, 4]`, result: `[1, 5]`}) {
+		forward, err := Diff([]byte(c.doc), []byte(c.result), nil)
+		assert.NoErrorf(err, "case %d", i)
+		reverse, err := ReverseDiff([]byte(c.doc), []byte(c.result), nil)
+		assert.NoErrorf(err, "case %d", i)
+
+		expected, _ := Diff([]byte(c.result), []byte(c.doc), nil)
+		assert.Equalf(expected, reverse, "case %d", i)
+
+		out, err := forward.Apply([]byte(c.doc))
+		if !assert.NoErrorf(err, "case %d", i) {
+			continue
+		}
+		out, err = reverse.Apply(out)
+		if !assert.NoErrorf(err, "case %d", i) {
+			continue
+		}
+		assert.Truef(compareJSON(string(out), c.doc), "case %d\nSrc: %s\nOut: %s", i, c.doc, string(out))
+	}
+}
+
+func largeArray(n int, edit func(i int) []string) []byte {
+	items := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		items = append(items, edit(i)...)
+	}
+	return []byte("[" + strings.Join(items, ",") + "]")
+}
+
+func item(i int) []string {
+	return []string{`{"id":` + strconv.Itoa(i) + `}`}
+}
+
+func TestDiffLargeArray(t *testing.T) {
+	assert := assert.New(t)
+
+	src := largeArray(1000, item)
+	cases := []struct {
+		name  string
+		dst   []byte
+		patch string
+	}{
+		{
+			"replace 3 elements",
+			largeArray(1000, func(i int) []string {
+				if i == 10 || i == 500 || i == 999 {
+					return []string{`{"id":-1}`}
+				}
+				return item(i)
+			}),
+			`[{"op":"replace","path":"/10/id","value":-1},{"op":"replace","path":"/500/id","value":-1},` +
+				`{"op":"replace","path":"/999/id","value":-1}]`,
+		},
+		{
+			"insert 1 element",
+			largeArray(1000, func(i int) []string {
+				if i == 10 {
+					return append([]string{`"new"`}, item(i)...)
+				}
+				return item(i)
+			}),
+			`[{"op":"add","path":"/10","value":"new"}]`,
+		},
+		{
+			"insert 2 elements",
+			largeArray(1000, func(i int) []string {
+				if i == 0 {
+					return append([]string{`"a"`, `"b"`}, item(i)...)
+				}
+				return item(i)
+			}),
+			`[{"op":"add","path":"/0","value":"a"},{"op":"add","path":"/1","value":"b"}]`,
+		},
+		{
+			"delete 1 element",
+			largeArray(1000, func(i int) []string {
+				if i == 10 {
+					return nil
+				}
+				return item(i)
+			}),
+			`[{"op":"remove","path":"/10"}]`,
+		},
+		{
+			"delete and replace",
+			largeArray(1000, func(i int) []string {
+				switch i {
+				case 10:
+					return nil
+				case 11:
+					return []string{`{"id":-1}`}
+				}
+				return item(i)
+			}),
+			`[{"op":"replace","path":"/10/id","value":-1},{"op":"remove","path":"/11"}]`,
+		},
+		{
+			"append 1 element",
+			largeArray(1001, func(i int) []string {
+				if i == 1000 {
+					return []string{`"new"`}
+				}
+				return item(i)
+			}),
+			`[{"op":"add","path":"/1000","value":"new"}]`,
+		},
+	}
+
+	for _, c := range cases {
+		patch, err := Diff(src, c.dst, nil)
+		if !assert.NoError(err, c.name) {
+			continue
+		}
+		assert.Equal(c.patch, mustJSONString(patch), c.name)
+
+		out, err := patch.Apply(src)
+		assert.NoError(err, c.name)
+		assert.True(Equal(out, c.dst), c.name)
+
+		patch, err = Diff(src, c.dst, &DiffOptions{PairedTests: true})
+		assert.NoError(err, c.name)
+		out, err = patch.Apply(src)
+		assert.NoError(err, c.name)
+		assert.True(Equal(out, c.dst), c.name)
+	}
+
+	patch, err := Diff([]byte(`[1, null, 2]`), []byte(`[1, null, 3, 2]`), nil)
+	assert.NoError(err)
+	assert.Equal(`[{"op":"add","path":"/2","value":3}]`, mustJSONString(patch))
+}
+
+func BenchmarkDiffLargeArrayInsert(b *testing.B) {
+	src := largeArray(1000, item)
+	dst := largeArray(1000, func(i int) []string {
+		if i == 10 {
+			return append([]string{`"new"`}, item(i)...)
+		}
+		return item(i)
+	})
+
+	var ops int
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		patch, err := Diff(src, dst, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		ops = len(patch)
+	}
+	b.ReportMetric(float64(ops), "ops")
+}
+
+func BenchmarkDiffLargeArrayPositional(b *testing.B) {
+	src := NewNode(largeArray(1000, item))
+	dst := NewNode(largeArray(1000, func(i int) []string {
+		if i == 10 {
+			return append([]string{`"new"`}, item(i)...)
+		}
+		return item(i)
+	}))
+	src.intoContainer()
+	dst.intoContainer()
+
+	var ops int
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c := &collector{patch: make(Patch, 0)}
+		if err := diffArrayRange(src.ary, dst.ary, 0, c, nil); err != nil {
+			b.Fatal(err)
+		}
+		ops = len(c.patch)
+	}
+	b.ReportMetric(float64(ops), "ops")
+}
+
+func largeObject(n int, edit func(i int) string) []byte {
+	members := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		members = append(members, `"k`+strconv.Itoa(i)+`":`+edit(i))
+	}
+	return []byte("{" + strings.Join(members, ",") + "}")
+}
+
+func member(i int) string {
+	return `{"id":` + strconv.Itoa(i) + `,"tags":["a","b"],"meta":{"deep":{"value":` + strconv.Itoa(i) + `}}}`
+}
+
+func TestDiffWithHashShortcut(t *testing.T) {
+	assert := assert.New(t)
+
+	for i, c := range DiffCases {
+		patch, err := Diff([]byte(c.src), []byte(c.dst), &DiffOptions{IDKey: c.idKey, UseHashShortcut: true})
+		if !assert.NoErrorf(err, "case %d", i) {
+			continue
+		}
+		assert.Equalf(c.patch, mustJSONString(patch), "case %d", i)
+	}
+
+	src := NewNode([]byte(`{"a": {"b": [1, 2]}, "c": {"d": "x y"}, "e": 1}`))
+	dst := NewNode([]byte(`{"a": { "b": [1,2] }, "c": {"d": "x  y"}, "e": 1}`))
+	patch, err := src.Diff(dst, &DiffOptions{UseHashShortcut: true})
+	assert.NoError(err)
+	assert.Equal(`[{"op":"replace","path":"/c/d","value":"x  y"}]`, mustJSONString(patch))
+
+	a, _ := src.doc.obj.Get("a")
+	assert.Equal(eRaw, a.which, "unchanged member should not be parsed")
+	c, _ := src.doc.obj.Get("c")
+	assert.Equal(eDoc, c.which)
+	// swapped values and escaped strings have different hashes.
+	patch, err = Diff([]byte(`{"a": {"x": 1, "y": 2}, "b": [1, 2], "c": {"d": "a\"b"}}`),
+		[]byte(`{"a": {"x": 2, "y": 1}, "b": [2, 1], "c": {"d": "a\"c"}}`), &DiffOptions{UseHashShortcut: true})
+	assert.NoError(err)
+	assert.Equal(`[{"op":"replace","path":"/a/x","value":2},{"op":"replace","path":"/a/y","value":1},`+
+		`{"op":"replace","path":"/b/0","value":2},{"op":"replace","path":"/b/1","value":1},`+
+		`{"op":"replace","path":"/c/d","value":"a\"c"}]`, mustJSONString(patch))
+}
+
+func BenchmarkDiffLargeObjectFewChanges(b *testing.B) {
+	src := largeObject(1000, member)
+	dst := largeObject(1000, func(i int) string {
+		if i%100 == 0 {
+			return `{"id":` + strconv.Itoa(i) + `,"tags":["a","c"]}`
+		}
+		return member(i)
+	})
+
+	for _, shortcut := range []bool{false, true} {
+		b.Run(fmt.Sprintf("UseHashShortcut=%v", shortcut), func(b *testing.B) {
+			opts := &DiffOptions{UseHashShortcut: shortcut}
+			for i := 0; i < b.N; i++ {
+				if _, err := Diff(src, dst, opts); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkDiffMoveAndCopy(b *testing.B) {
+	src := largeObject(1000, member)
+	// every member is renamed, and every tenth is also added as a copy.
+	members := make([]string, 0, 1100)
+	for i := 0; i < 1000; i++ {
+		members = append(members, `"r`+strconv.Itoa(i)+`":`+member(i))
+		if i%10 == 0 {
+			members = append(members, `"c`+strconv.Itoa(i)+`":`+member(i))
+		}
+	}
+	dst := []byte("{" + strings.Join(members, ",") + "}")
+
+	opts := &DiffOptions{UseMoveAndCopy: true}
+	for i := 0; i < b.N; i++ {
+		if _, err := Diff(src, dst, opts); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestDiffValue(t *testing.T) {
+	assert := assert.New(t)
+
+	type Address struct {
+		City string `json:"city"`
+		Zip  string `json:"zip,omitempty"`
+	}
+	type User struct {
+		Name    string   `json:"name"`
+		Age     int      `json:"age"`
+		Tags    []string `json:"tags"`
+		Address Address  `json:"address"`
+		Email   string   `json:"email"`
+	}
+
+	src := `{"age": 24, "name": "John", "tags": ["a"], "address": {"city": "Paris"}, "nick": "j"}`
+	user := User{Name: "Jane", Age: 24, Tags: []string{"a", "b"}, Address: Address{City: "Paris", Zip: "75001"}, Email: "j@x.io"}
+
+	patch, err := DiffValue([]byte(src), user, nil)
+	assert.NoError(err)
+	assert.Equal(`[`+
+		`{"op":"remove","path":"/nick"},`+
+		`{"op":"replace","path":"/name","value":"Jane"},`+
+		`{"op":"add","path":"/tags/1","value":"b"},`+
+		`{"op":"add","path":"/address/zip","value":"75001"},`+
+		`{"op":"add","path":"/email","value":"j@x.io"}]`, mustJSONString(patch))
+
+	out, err := patch.Apply([]byte(src))
+	assert.NoError(err)
+	assert.Equal(`{"age":24,"name":"Jane","tags":["a","b"],"address":{"city":"Paris","zip":"75001"},"email":"j@x.io"}`, string(out))
+
+	patch, err = DiffValue([]byte(src), user, &DiffOptions{OrderSensitiveObjects: true})
+	assert.NoError(err)
+	out, err = patch.Apply([]byte(src))
+	assert.NoError(err)
+	assert.Equal(`{"name":"Jane","age":24,"tags":["a","b"],"address":{"city":"Paris","zip":"75001"},"email":"j@x.io"}`, string(out))
+
+	_, err = DiffValue([]byte(src), make(chan int), nil)
+	assert.EqualError(err, "unable to marshal target, json: unsupported type: chan int")
+}
+
+func TestDiffRemovals(t *testing.T) {
+	assert := assert.New(t)
+
+	cases := []struct {
+		src, dst, patch, result string
+		opts                    *DiffOptions
+	}{
+		{`{"a": 1}`, `{"a": 2, "b": 3}`, `[]`, `{"a":1}`, nil},
+		{
+			`{"a": 1, "b": {"c": 2, "d": {"e": 3, "f": 4}}, "g": [1, 2, 3, {"h": 5, "i": 6}]}`,
+			`{"a": 0, "b": {"d": {"e": 3}, "x": 1}, "g": [1, 2, 3, {"h": 5}]}`,
+			`[{"op":"remove","path":"/b/c"},{"op":"remove","path":"/b/d/f"},{"op":"remove","path":"/g/3/i"}]`,
+			`{"a":1,"b":{"d":{"e":3}},"g":[1,2,3,{"h":5}]}`,
+			nil,
+		},
+		{
+			`{"list": [{"a": 1, "b": 2}, 2, 3, 4], "x": true}`,
+			`{"list": [{"a": 1}, 2]}`,
+			`[{"op":"remove","path":"/x"},{"op":"remove","path":"/list/0/b"},{"op":"remove","path":"/list/3"},{"op":"remove","path":"/list/2"}]`,
+			`{"list":[{"a":1},2]}`,
+			nil,
+		},
+		{
+			`{"a": 1, "b": 2, "c": 3}`,
+			`{"b": 2, "a": 1}`,
+			`[{"op":"remove","path":"/c"}]`,
+			`{"a":1,"b":2}`,
+			&DiffOptions{OrderSensitiveObjects: true, PairedTests: true},
+		},
+	}
+
+	for i, c := range cases {
+		patch, err := DiffRemovals([]byte(c.src), []byte(c.dst), c.opts)
+		if !assert.NoErrorf(err, "case %d", i) {
+			continue
+		}
+		assert.Equalf(c.patch, mustJSONString(patch), "case %d", i)
+
+		out, err := patch.Apply([]byte(c.src))
+		assert.NoErrorf(err, "case %d", i)
+		assert.Equalf(c.result, string(out), "case %d", i)
+	}
+}
+
+func TestDiffWithTreatNullAsAbsent(t *testing.T) {
+	assert := assert.New(t)
+
+	cases := []struct {
+		src, dst, patch, nullAsAbsent string
+	}{
+		{
+			`{"a": 1}`,
+			`{"a": 1, "x": null}`,
+			`[{"op":"add","path":"/x","value":null}]`,
+			`[]`,
+		},
+		{
+			`{"a": 1, "x": null}`,
+			`{"a": 1}`,
+			`[{"op":"remove","path":"/x"}]`,
+			`[]`,
+		},
+		{
+			`{"a": 1, "x": {"y": null, "z": 1}}`,
+			`{"a": 1, "x": {"w": null, "z": 2}}`,
+			`[{"op":"remove","path":"/x/y"},{"op":"add","path":"/x/w","value":null},{"op":"replace","path":"/x/z","value":2}]`,
+			`[{"op":"replace","path":"/x/z","value":2}]`,
+		},
+		{
+			`{"a": 1, "x": [{"y": 1}]}`,
+			`{"a": null, "x": [{"y": 1, "z": null}]}`,
+			`[{"op":"replace","path":"/a","value":null},{"op":"add","path":"/x/0/z","value":null}]`,
+			`[{"op":"remove","path":"/a"}]`,
+		},
+		{
+			`{"a": null}`,
+			`{"a": 1}`,
+			`[{"op":"replace","path":"/a","value":1}]`,
+			`[{"op":"replace","path":"/a","value":1}]`,
+		},
+	}
+
+	for i, c := range cases {
+		patch, err := Diff([]byte(c.src), []byte(c.dst), nil)
+		if assert.NoErrorf(err, "case %d", i) {
+			assert.Equalf(c.patch, mustJSONString(patch), "case %d", i)
+		}
+
+		patch, err = Diff([]byte(c.src), []byte(c.dst), &DiffOptions{TreatNullAsAbsent: true})
+		if !assert.NoErrorf(err, "case %d", i) {
+			continue
+		}
+		assert.Equalf(c.nullAsAbsent, mustJSONString(patch), "case %d", i)
+
+		out, err := patch.Apply([]byte(c.src))
+		assert.NoErrorf(err, "case %d", i)
+		res, _ := Diff(out, []byte(c.dst), &DiffOptions{TreatNullAsAbsent: true})
+		assert.Equalf(0, len(res), "case %d", i)
+	}
+
+	patch, err := Diff([]byte(`{"x": 1}`), []byte(`{"x": null}`), &DiffOptions{TreatNullAsAbsent: true, PairedTests: true})
+	assert.NoError(err)
+	assert.Equal(`[{"op":"test","path":"/x","value":1},{"op":"remove","path":"/x"}]`, mustJSONString(patch))
+}
+
+func TestDiffWithPointerEscape(t *testing.T) {
+	assert := assert.New(t)
+
+	escape := func(key string) string { return strings.ReplaceAll(key, "/", "%2F") }
+	options := NewOptions()
+	options.PointerUnescape = func(token string) string { return strings.ReplaceAll(token, "%2F", "/") }
+
+	cases := []struct {
+		src, dst, patch string
+	}{
+		{
+			`{"a/b": 1, "c~d": 1}`,
+			`{"a/b": 2, "c~d": 2}`,
+			`[{"op":"replace","path":"/a%2Fb","value":2},{"op":"replace","path":"/c~d","value":2}]`,
+		},
+		{
+			`{"x/y": {"a": [1, 2]}}`,
+			`{"x/y": {"a": [1]}, "z/w": null}`,
+			`[{"op":"remove","path":"/x%2Fy/a/1"},{"op":"add","path":"/z%2Fw","value":null}]`,
+		},
+	}
+
+	for i, c := range cases {
+		patch, err := Diff([]byte(c.src), []byte(c.dst), &DiffOptions{PointerEscape: escape})
+		if !assert.NoErrorf(err, "case %d", i) {
+			continue
+		}
+		assert.Equalf(c.patch, mustJSONString(patch), "case %d", i)
+
+		out, err := patch.ApplyWithOptions([]byte(c.src), options)
+		assert.NoErrorf(err, "case %d", i)
+		assert.Truef(Equal(out, []byte(c.dst)), "case %d", i)
+	}
+}
+
+func TestDiffWithPreferArrayReplace(t *testing.T) {
+	assert := assert.New(t)
+
+	cases := []struct {
+		src, dst string
+		ratio    float64
+		ops      int
+		replace  bool
+	}{
+		{`{"a": [1, 2, 3, 4, 5]}`, `{"a": [6, 7, 8, 9]}`, 0, 1, true},
+		{`{"a": [1, 2, 3, 4, 5]}`, `{"a": [6, 7, 8, 9]}`, 10, 5, false},
+		{`{"a": [1, 2, 3, 4, 5]}`, `{"a": [1, 2, 3, 4, 6]}`, 0, 1, false},
+		{`{"a": [{"x": 1}, {"x": 2}], "b": 1}`, `{"a": [{"x": 3}, {"x": 4}], "b": 1}`, 0, 1, true},
+		{`[1, 2, 3]`, `[4, 5, 6]`, 0, 1, true},
+		{`[1, 2, 3]`, `[4, 5, 6]`, 3, 3, false},
+	}
+
+	for i, c := range cases {
+		full, err := Diff([]byte(c.src), []byte(c.dst), nil)
+		if !assert.NoErrorf(err, "case %d", i) {
+			continue
+		}
+		patch, err := Diff([]byte(c.src), []byte(c.dst), &DiffOptions{PreferArrayReplace: true, ArrayReplaceRatio: c.ratio})
+		if !assert.NoErrorf(err, "case %d", i) {
+			continue
+		}
+		assert.Equalf(c.ops, len(patch), "case %d", i)
+		assert.Equalf(c.replace, len(patch) == 1 && patch[0].Op == "replace" && len(full) > 1, "case %d", i)
+		if c.ratio <= 1 {
+			assert.LessOrEqualf(len(mustJSONString(patch)), len(mustJSONString(full)), "case %d", i)
+		}
+
+		out, err := patch.Apply([]byte(c.src))
+		assert.NoErrorf(err, "case %d", i)
+		assert.Truef(Equal(out, []byte(c.dst)), "case %d", i)
+	}
+
+	patch, err := Diff([]byte(`{"a": [1, 2, 3]}`), []byte(`{"a": [4, 5, 6]}`),
+		&DiffOptions{PreferArrayReplace: true, PairedTests: true})
+	assert.NoError(err)
+	assert.Equal(`[{"op":"test","path":"/a","value":[1,2,3]},{"op":"replace","path":"/a","value":[4,5,6]}]`,
+		mustJSONString(patch))
+}
+
+func TestDiffWithCopyWithinPatch(t *testing.T) {
+	assert := assert.New(t)
+
+	big := `{"name": "a long enough value", "tags": ["x", "y", "z"]}`
+	cases := []struct {
+		src, dst, patch string
+	}{
+		{
+			`{"a": 1}`,
+			`{"a": 1, "b": ` + big + `, "c": ` + big + `}`,
+			`[{"op":"add","path":"/b","value":{"name":"a long enough value","tags":["x","y","z"]}},{"op":"copy","path":"/c","from":"/b"}]`,
+		},
+		{
+			`{"list": []}`,
+			`{"list": [` + big + `, 1, ` + big + `], "x": {"y": ` + big + `}}`,
+			`[{"op":"add","path":"/list/0","value":{"name":"a long enough value","tags":["x","y","z"]}},{"op":"add","path":"/list/1","value":1},{"op":"copy","path":"/list/2","from":"/list/0"},{"op":"add","path":"/x","value":{"y":{"name":"a long enough value","tags":["x","y","z"]}}}]`,
+		},
+		{
+			`{"a": {"b": 1}}`,
+			`{"a": {"b": 2, "c": 1}, "d": 1}`,
+			`[{"op":"replace","path":"/a/b","value":2},{"op":"add","path":"/a/c","value":1},{"op":"add","path":"/d","value":1}]`,
+		},
+	}
+
+	for i, c := range cases {
+		patch, err := Diff([]byte(c.src), []byte(c.dst), &DiffOptions{CopyWithinPatch: true})
+		if !assert.NoErrorf(err, "case %d", i) {
+			continue
+		}
+		assert.Equalf(c.patch, mustJSONString(patch), "case %d", i)
+
+		out, err := patch.Apply([]byte(c.src))
+		assert.NoErrorf(err, "case %d", i)
+		assert.Truef(Equal(out, []byte(c.dst)), "case %d", i)
+
+		var buf bytes.Buffer
+		assert.NoErrorf(DiffNDJSON([]byte(c.src), []byte(c.dst), &buf, &DiffOptions{CopyWithinPatch: true}), "case %d", i)
+		assert.Equalf(len(patch), strings.Count(buf.String(), "\n"), "case %d", i)
+	}
+
+	value := json.RawMessage(big)
+	c := &collector{patch: make(Patch, 0), copies: make(map[string]string)}
+	c.push(Operation{Op: "add", Path: "/a", Value: value})
+	c.push(Operation{Op: "remove", Path: "/a"})
+	c.push(Operation{Op: "add", Path: "/b", Value: value})
+	c.push(Operation{Op: "add", Path: "/l/1", Value: value})
+	c.push(Operation{Op: "add", Path: "/l/0", Value: json.RawMessage(`1`)})
+	c.push(Operation{Op: "add", Path: "/b/tags/0", Value: json.RawMessage(`"w"`)})
+	c.push(Operation{Op: "add", Path: "/c", Value: value})
+	c.push(Operation{Op: "add", Path: "/d", Value: value})
+	ops := make([]string, 0, len(c.patch))
+	for _, op := range c.patch {
+		ops = append(ops, op.Op+" "+op.From+" "+op.Path)
+	}
+	assert.Equal([]string{"add  /a", "remove  /a", "add  /b", "copy /b /l/1", "add  /l/0", "add  /b/tags/0", "add  /c", "copy /c /d"}, ops)
+}
+
+func TestDiffWithCoerceNumericObjects(t *testing.T) {
+	assert := assert.New(t)
+
+	cases := []struct {
+		src, dst, patch, coerced string
+	}{
+		{
+			`{"0": 1, "1": 2}`,
+			`[1, 3]`,
+			`[{"op":"replace","path":"","value":[1,3]}]`,
+			`[{"op":"replace","path":"/1","value":3}]`,
+		},
+		{
+			`[1, 2]`,
+			`{"1": 3, "0": 1}`,
+			`[{"op":"replace","path":"","value":{"1":3,"0":1}}]`,
+			`[{"op":"replace","path":"/1","value":3}]`,
+		},
+		{
+			`{"a": {"0": "x", "1": "y", "2": "z"}}`,
+			`{"a": ["x", "w"]}`,
+			`[{"op":"replace","path":"/a","value":["x","w"]}]`,
+			`[{"op":"replace","path":"/a/1","value":"w"},{"op":"remove","path":"/a/2"}]`,
+		},
+		{
+			`{"a": {"0": "x"}}`,
+			`{"a": ["y", "x", {"b": 1}]}`,
+			`[{"op":"replace","path":"/a","value":["y","x",{"b":1}]}]`,
+			`[{"op":"replace","path":"/a/0","value":"y"},{"op":"add","path":"/a/1","value":"x"},{"op":"add","path":"/a/2","value":{"b":1}}]`,
+		},
+		{
+			`{"a": [1, 2, 3]}`,
+			`{"a": {"0": 1, "1": 3}}`,
+			`[{"op":"replace","path":"/a","value":{"0":1,"1":3}}]`,
+			`[{"op":"remove","path":"/a/1"}]`,
+		},
+		{
+			`{"0": 1, "2": 2}`,
+			`[1, 2]`,
+			`[{"op":"replace","path":"","value":[1,2]}]`,
+			`[{"op":"replace","path":"","value":[1,2]}]`,
+		},
+		{
+			`{"0": 1, "01": 2}`,
+			`[1, 2]`,
+			`[{"op":"replace","path":"","value":[1,2]}]`,
+			`[{"op":"replace","path":"","value":[1,2]}]`,
+		},
+		{
+			`{"0": 1, "1": 2}`,
+			`[1, 2]`,
+			`[{"op":"replace","path":"","value":[1,2]}]`,
+			`[]`,
+		},
+	}
+
+	for i, c := range cases {
+		patch, err := Diff([]byte(c.src), []byte(c.dst), nil)
+		if assert.NoErrorf(err, "case %d", i) {
+			assert.Equalf(c.patch, mustJSONString(patch), "case %d", i)
+		}
+
+		patch, err = Diff([]byte(c.src), []byte(c.dst), &DiffOptions{CoerceNumericObjects: true})
+		if !assert.NoErrorf(err, "case %d", i) {
+			continue
+		}
+		assert.Equalf(c.coerced, mustJSONString(patch), "case %d", i)
+		_, err = patch.Apply([]byte(c.src))
+		assert.NoErrorf(err, "case %d", i)
+	}
+
+	out, _ := Patch{{Op: "replace", Path: "/1", Value: json.RawMessage(`3`)}}.Apply([]byte(`{"0": 1, "1": 2}`))
+	assert.Equal(`{"0":1,"1":3}`, string(out))
+}
+
+func TestDiffWithDetectReorder(t *testing.T) {
+	assert := assert.New(t)
+
+	cases := []struct {
+		src, dst, patch string
+	}{
+		{
+			`["a", "b", "c", "d", "e"]`,
+			`["e", "a", "b", "c", "d"]`,
+			`[{"op":"move","path":"/0","from":"/4"}]`,
+		},
+		{
+			`["a", "b", "c", "d", "e"]`,
+			`["b", "c", "d", "e", "a"]`,
+			`[{"op":"move","path":"/4","from":"/0"}]`,
+		},
+		{
+			`["a", "b", "c", "d", "e"]`,
+			`["e", "d", "c", "b", "a"]`,
+			`[{"op":"move","path":"/0","from":"/4"},{"op":"move","path":"/1","from":"/4"},{"op":"move","path":"/2","from":"/4"},{"op":"move","path":"/3","from":"/4"}]`,
+		},
+		{
+			`["a", "b", "c", "d", "e"]`,
+			`["a", "d", "c", "b", "e"]`,
+			`[{"op":"move","path":"/1","from":"/3"},{"op":"move","path":"/2","from":"/3"}]`,
+		},
+		{
+			`{"list": [{"id": 1}, {"id": 2}, {"id": 1}, 3, [4]]}`,
+			`{"list": [[4], {"id": 1}, 3, {"id": 2}, {"id": 1}]}`,
+			`[{"op":"move","path":"/list/0","from":"/list/4"},{"op":"move","path":"/list/2","from":"/list/4"}]`,
+		},
+		{
+			`[{"a": 1, "b": 2}, "x"]`,
+			`["x", {"b": 2, "a": 1}]`,
+			`[{"op":"move","path":"/0","from":"/1"}]`,
+		},
+		{
+			`["a", "b", "c", "d", "e"]`,
+			`["e", "a", "b", "c", "x"]`,
+			`[{"op":"replace","path":"/0","value":"e"},{"op":"replace","path":"/1","value":"a"},{"op":"replace","path":"/2","value":"b"},{"op":"replace","path":"/3","value":"c"},{"op":"replace","path":"/4","value":"x"}]`,
+		},
+		{
+			`["a", "a", "b"]`,
+			`["a", "b", "b"]`,
+			`[{"op":"replace","path":"/1","value":"b"}]`,
+		},
+	}
+
+	for i, c := range cases {
+		patch, err := Diff([]byte(c.src), []byte(c.dst), &DiffOptions{DetectReorder: true})
+		if !assert.NoErrorf(err, "case %d", i) {
+			continue
+		}
+		assert.Equalf(c.patch, mustJSONString(patch), "case %d", i)
+
+		out, err := patch.Apply([]byte(c.src))
+		assert.NoErrorf(err, "case %d", i)
+		assert.Truef(Equal(out, []byte(c.dst)), "case %d", i)
+	}
+
+	// every permutation of 5 elements
+	var permute func(ary []string, k int)
+	src := `["a","b","c","d","e"]`
+	permute = func(ary []string, k int) {
+		if k == len(ary) {
+			dst := `["` + strings.Join(ary, `","`) + `"]`
+			patch, err := Diff([]byte(src), []byte(dst), &DiffOptions{DetectReorder: true})
+			assert.NoError(err)
+			assert.LessOrEqual(len(patch), 4)
+			for _, op := range patch {
+				assert.Equal("move", op.Op)
+			}
+			out, err := patch.Apply([]byte(src))
+			assert.NoError(err)
+			assert.Equalf(dst, string(out), "patch %s", mustJSONString(patch))
+			return
+		}
+		for i := k; i < len(ary); i++ {
+			ary[k], ary[i] = ary[i], ary[k]
+			permute(ary, k+1)
+			ary[k], ary[i] = ary[i], ary[k]
+		}
+	}
+	permute([]string{"a", "b", "c", "d", "e"}, 0)
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+func TestDiffWithUseMoveAndCopy(t *testing.T) {
+	assert := assert.New(t)
+
+	big := `{"name": "a long enough value", "tags": ["x", "y", "z"]}`
+	value := `{"name":"a long enough value","tags":["x","y","z"]}`
+	cases := []struct {
+		src, dst    string
+		pairedTests bool
+		patch       string
+	}{
+		{
+			`{"a": {"x": ` + big + `}, "b": {}}`,
+			`{"a": {}, "b": {"y": ` + big + `}}`,
+			false,
+			`[{"op":"move","path":"/b/y","from":"/a/x"}]`,
+		},
+		{
+			`{"b": {}, "z": {"x": ` + big + `}}`,
+			`{"b": {"y": ` + big + `}, "z": {}}`,
+			false,
+			`[{"op":"move","path":"/b/y","from":"/z/x"}]`,
+		},
+		{
+			`{"b": {}, "z": {"x": ` + big + `}}`,
+			`{"b": {"y": ` + big + `}, "z": {}}`,
+			true,
+			`[{"op":"test","path":"/z/x","value":` + value + `},{"op":"move","path":"/b/y","from":"/z/x"}]`,
+		},
+		{
+			`{"a": [` + big + `, 1], "b": [2]}`,
+			`{"a": [1], "b": [2, ` + big + `]}`,
+			false,
+			`[{"op":"move","path":"/b/1","from":"/a/0"}]`,
+		},
+		{
+			`{"list": [` + big + `, 1, 2, 3]}`,
+			`{"list": [1, 2, 3, ` + big + `]}`,
+			false,
+			`[{"op":"move","path":"/list/3","from":"/list/0"}]`,
+		},
+		{
+			`{"list": [1, 2, 3, ` + big + `]}`,
+			`{"list": [` + big + `, 1, 2, 3]}`,
+			true,
+			`[{"op":"move","path":"/list/0","from":"/list/3"}]`,
+		},
+		{
+			`{"a": ` + big + `, "l": [1, 2]}`,
+			`{"a": ` + big + `, "l": [1, 2, ` + big + `]}`,
+			false,
+			`[{"op":"copy","path":"/l/2","from":"/a"}]`,
+		},
+		{
+			`{"a": ` + big + `, "l": [1]}`,
+			`{"a": {"name": "changed"}, "l": [1, ` + big + `]}`,
+			false,
+			`[{"op":"remove","path":"/a/tags"},{"op":"replace","path":"/a/name","value":"changed"},{"op":"add","path":"/l/1","value":` + value + `}]`,
+		},
+		{
+			`{"a": [` + big + `, 1, 2], "b": [3]}`,
+			`{"a": [2], "b": [` + big + `, 3]}`,
+			false,
+			`[{"op":"remove","path":"/a/1"},{"op":"move","path":"/b/0","from":"/a/0"}]`,
+		},
+		{
+			`{"a": 1, "b": 2}`,
+			`{"a": 1, "b": 3}`,
+			false,
+			`[{"op":"replace","path":"/b","value":3}]`,
+		},
+	}
+
+	for i, c := range cases {
+		opts := &DiffOptions{UseMoveAndCopy: true, PairedTests: c.pairedTests}
+		patch, err := Diff([]byte(c.src), []byte(c.dst), opts)
+		if !assert.NoErrorf(err, "case %d", i) {
+			continue
+		}
+		assert.Equalf(c.patch, mustJSONString(patch), "case %d", i)
+
+		out, err := patch.Apply([]byte(c.src))
+		assert.NoErrorf(err, "case %d", i)
+		assert.Truef(Equal(out, []byte(c.dst)), "case %d, %s", i, string(out))
+
+		var buf bytes.Buffer
+		assert.NoErrorf(DiffNDJSON([]byte(c.src), []byte(c.dst), &buf, opts), "case %d", i)
+		assert.Equalf(len(patch), strings.Count(buf.String(), "\n"), "case %d", i)
+	}
+
+	// a value removed from an array before the element that is moved is not combined.
+	p := Patch{
+		{Op: "remove", Path: "/a/0"},
+		{Op: "add", Path: "/a/1", Value: json.RawMessage(`"y"`)},
+		{Op: "add", Path: "/b", Value: json.RawMessage(big)},
+	}
+	src := NewNode([]byte(`{"a": [` + big + `, "x"]}`))
+	assert.Equal(mustJSONString(Patch{{Op: "remove", Path: "/a/0"}, p[1], {Op: "add", Path: "/b", Value: json.RawMessage(big)}}),
+		mustJSONString(moveAndCopy(src, p)))
+	assert.False(canMove(p, make([]bool, len(p)), newOpIndex(p), 0, 2, false))
+	p2 := Patch{p[0], {Op: "add", Path: "/c", Value: json.RawMessage(`1`)}, p[2]}
+	assert.True(canMove(p2, make([]bool, 3), newOpIndex(p2), 0, 2, false))
+
+	patch, err := Diff([]byte(`{"a": {"x/y": `+big+`}}`), []byte(`{"b": {"x/y": `+big+`}}`),
+		&DiffOptions{UseMoveAndCopy: true, PointerEscape: func(key string) string { return key }})
+	assert.NoError(err)
+	assert.Equal("add", patch[len(patch)-1].Op)
+}
+
+func TestDiffWithCoalesceReplaces(t *testing.T) {
+	assert := assert.New(t)
+
+	cases := []struct {
+		src, dst string
+		ratio    float64
+		patch    string
+	}{
+		{
+			`{"a": 1, "b": 2, "c": 3, "d": 4}`,
+			`{"a": 1, "x": 5}`,
+			0,
+			`[{"op":"replace","path":"","value":{"a":1,"x":5}}]`,
+		},
+		{
+			`{"a": 1, "b": 2, "c": 3, "d": 4}`,
+			`{"a": 1, "b": 2, "c": 3, "e": 5}`,
+			0,
+			`[{"op":"remove","path":"/d"},{"op":"add","path":"/e","value":5}]`,
+		},
+		{
+			`{"a": 1, "b": 2, "c": 3, "d": 4}`,
+			`{"a": 1, "b": 2, "c": 3, "e": 5}`,
+			0.25,
+			`[{"op":"replace","path":"","value":{"a":1,"b":2,"c":3,"e":5}}]`,
+		},
+		{
+			`{"keep": [1, 2, 3, 4, 5, 6], "obj": {"a": 1, "b": 2, "c": 3}, "x": 1, "y": 2}`,
+			`{"keep": [1, 2, 3, 4, 5, 7], "obj": {"d": 4}, "x": 1, "y": 2}`,
+			0,
+			`[{"op":"replace","path":"/keep/5","value":7},{"op":"replace","path":"/obj","value":{"d":4}}]`,
+		},
+		{
+			`{"list": [1, 2, 3, 4], "x": 1}`,
+			`{"list": [5, 6, 7, 4], "x": 1}`,
+			0,
+			`[{"op":"replace","path":"/list","value":[5,6,7,4]}]`,
+		},
+		{
+			`{"a": 1}`,
+			`{"a": 2}`,
+			0,
+			`[{"op":"replace","path":"/a","value":2}]`,
+		},
+		{
+			`{"a": {"b": 1, "c": 2}, "d": {"e": 1, "f": 2}, "g": 1}`,
+			`{"a": {"x": 1}, "d": {"y": 2}, "g": 1}`,
+			0,
+			`[{"op":"replace","path":"","value":{"a":{"x":1},"d":{"y":2},"g":1}}]`,
+		},
+	}
+
+	for i, c := range cases {
+		opts := &DiffOptions{CoalesceReplaces: true, CoalesceRatio: c.ratio}
+		patch, err := Diff([]byte(c.src), []byte(c.dst), opts)
+		if !assert.NoErrorf(err, "case %d", i) {
+			continue
+		}
+		assert.Equalf(c.patch, mustJSONString(patch), "case %d", i)
+
+		plain, err := Diff([]byte(c.src), []byte(c.dst), nil)
+		assert.NoErrorf(err, "case %d", i)
+		assert.LessOrEqualf(len(patch), len(plain), "case %d", i)
+
+		out, err := patch.Apply([]byte(c.src))
+		assert.NoErrorf(err, "case %d", i)
+		assert.Truef(Equal(out, []byte(c.dst)), "case %d, %s", i, string(out))
+	}
+
+	patch, err := Diff([]byte(`{"a": 1, "b": 2}`), []byte(`{"c": 3}`), &DiffOptions{CoalesceReplaces: true, PairedTests: true})
+	assert.NoError(err)
+	assert.Equal(`[{"op":"test","path":"","value":{"a":1,"b":2}},{"op":"replace","path":"","value":{"c":3}}]`, mustJSONString(patch))
+
+	for i, c := range DiffCases {
+		patch, err := Diff([]byte(c.src), []byte(c.dst), &DiffOptions{IDKey: c.idKey, CoalesceReplaces: true})
+		if !assert.NoErrorf(err, "case %d", i) {
+			continue
+		}
+		out, err := patch.Apply([]byte(c.src))
+		if assert.NoErrorf(err, "case %d", i) {
+			assert.Truef(Equal(out, []byte(c.dst)), "case %d", i)
+		}
+	}
+}
+
+func TestDiffNDJSON(t *testing.T) {
+	assert := assert.New(t)
+
+	cases := append([]DiffCase{
+		{``, `{"a": [1, 2, 3], "b": {"c": 1}}`, `{"a": [1, 3], "b": {"c": 2, "d": "<x>"}}`, ``},
+	}, DiffCases...)
+	for i, c := range cases {
+		opts := &DiffOptions{IDKey: c.idKey, PairedTests: true}
+		patch, err := Diff([]byte(c.src), []byte(c.dst), opts)
+		if !assert.NoErrorf(err, "case %d", i) {
+			continue
+		}
+
+		var buf bytes.Buffer
+		if !assert.NoErrorf(DiffNDJSON([]byte(c.src), []byte(c.dst), &buf, opts), "case %d", i) {
+			continue
+		}
+
+		streamed := make(Patch, 0)
+		for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+			if line == "" {
+				continue
+			}
+			var op Operation
+			if assert.NoErrorf(json.Unmarshal([]byte(line), &op), "case %d", i) {
+				streamed = append(streamed, op)
+			}
+		}
+		assert.Equalf(mustJSONString(patch), mustJSONString(streamed), "case %d", i)
+		assert.Equalf(len(patch), strings.Count(buf.String(), "\n"), "case %d", i)
+	}
+
+	err := DiffNDJSON([]byte(`{"a": 1}`), []byte(`{"a": 2}`), failingWriter{}, nil)
+	assert.EqualError(err, "write failed")
+
+	var buf bytes.Buffer
+	assert.NoError(DiffNDJSON([]byte(`{"a": 1}`), []byte(`{"a": 1}`), &buf, nil))
+	assert.Equal("", buf.String())
+}
+
+func TestApplyAndDiff(t *testing.T) {
+	assert := assert.New(t)
+
+	doc := []byte(`{"name": "John", "age": 24, "tags": ["a"]}`)
+	patch, err := NewPatch([]byte(`[
+		{"op": "replace", "path": "/name", "value": "Jane"},
+		{"op": "add", "path": "/tags/-", "value": "b"}
+	]`))
+	assert.NoError(err)
+
+	residual, err := ApplyAndDiff(doc, patch, []byte(`{"name": "Jane", "age": 24, "tags": ["a", "b"]}`), nil)
+	assert.NoError(err)
+	assert.Equal(`[]`, mustJSONString(residual))
+
+	residual, err = ApplyAndDiff(doc, patch, []byte(`{"name": "Jane", "age": 25, "tags": ["a", "b", "c"]}`), nil)
+	assert.NoError(err)
+	assert.Equal(`[{"op":"replace","path":"/age","value":25},{"op":"add","path":"/tags/2","value":"c"}]`,
+		mustJSONString(residual))
+
+	patch = append(patch, Operation{Op: "remove", Path: "/missing"})
+	_, err = ApplyAndDiff(doc, patch, doc, nil)
+	assert.Error(err)
+}
+
+func TestScalarDiff(t *testing.T) {
+	assert := assert.New(t)
+
+	cases := []struct {
+		src, dst, changes string
+	}{
+		{`{"a": 1}`, `{"a": 1}`, `[]`},
+		{
+			`{"a": 1, "b": "x", "c": true, "d": null}`,
+			`{"a": 2, "b": "y", "c": false, "d": 0}`,
+			`[{"path":"/a","old":1,"new":2},{"path":"/b","old":"x","new":"y"},{"path":"/c","old":true,"new":false},{"path":"/d","old":null,"new":0}]`,
+		},
+		{
+			`{"a": {"b": {"c": 1, "d": 2}}, "e": [1, 2, 3]}`,
+			`{"a": {"b": {"c": 1, "d": 3}}, "e": [1, 5, 3]}`,
+			`[{"path":"/a/b/d","old":2,"new":3},{"path":"/e/1","old":2,"new":5}]`,
+		},
+		{
+			`{"a": 1, "b": 2, "e": [1, 2]}`,
+			`{"a": 1, "c": {"d": 1}, "e": [0, 1, 2], "f": [1]}`,
+			`[]`,
+		},
+		{
+			`{"a": 1, "b": {"c": 1}, "d": [1], "e": "x"}`,
+			`{"a": {"c": 1}, "b": 1, "d": "x", "e": [1]}`,
+			`[]`,
+		},
+		{
+			`{"a/b": {"c~d": "x"}, "e": {"f": 1}}`,
+			`{"a/b": {"c~d": "y"}, "e": {"f": 1, "g": 2}}`,
+			`[{"path":"/a~1b/c~0d","old":"x","new":"y"}]`,
+		},
+		{`1`, `2`, `[{"path":"","old":1,"new":2}]`},
+		{`[1, {"a": 1}]`, `[2, {"a": 1, "b": 2}]`, `[{"path":"/0","old":1,"new":2}]`},
+	}
+
+	for i, c := range cases {
+		changes, err := ScalarDiff([]byte(c.src), []byte(c.dst))
+		if assert.NoErrorf(err, "case %d", i) {
+			assert.Equalf(c.changes, mustJSONString(changes), "case %d", i)
+		}
+	}
+
+	_, err := ScalarDiff([]byte(`{"a": 1}`), []byte(`{"a":`))
+	assert.Error(err)
+}
+
+func TestUpsertPatch(t *testing.T) {
+	assert := assert.New(t)
+
+	doc := `{"items": [{"id": 1, "v": "a"}, {"id": "2", "v": "b"}, 3, {"id": 3, "v": "c"}]}`
+	elements := []json.RawMessage{
+		json.RawMessage(`{"id": 3, "v": "C"}`),
+		json.RawMessage(`{"id": 4, "v": "d"}`),
+		json.RawMessage(`{"id": 2, "v": "e"}`),
+		json.RawMessage(`{"id": "2", "v": "B"}`),
+		json.RawMessage(`{"id": 4, "v": "D"}`),
+	}
+
+	p, err := UpsertPatch([]byte(doc), "/items", "id", elements)
+	assert.NoError(err)
+	assert.Equal(`[`+
+		`{"op":"replace","path":"/items/3","value":{"id":3,"v":"C"}},`+
+		`{"op":"add","path":"/items/4","value":{"id":4,"v":"d"}},`+
+		`{"op":"add","path":"/items/5","value":{"id":2,"v":"e"}},`+
+		`{"op":"replace","path":"/items/1","value":{"id":"2","v":"B"}},`+
+		`{"op":"replace","path":"/items/4","value":{"id":4,"v":"D"}}]`, mustJSONString(p))
+
+	out, err := p.Apply([]byte(doc))
+	assert.NoError(err)
+	assert.Equal(`{"items":[{"id":1,"v":"a"},{"id":"2","v":"B"},3,{"id":3,"v":"C"},{"id":4,"v":"D"},{"id":2,"v":"e"}]}`, string(out))
+
+	p, err = UpsertPatch([]byte(`[]`), "", "key", []json.RawMessage{json.RawMessage(`{"key": {"a": 1}}`), json.RawMessage(`{"key": {"a": 1}, "x": 1}`)})
+	assert.NoError(err)
+	assert.Equal(`[{"op":"add","path":"/0","value":{"key":{"a":1}}},{"op":"replace","path":"/0","value":{"key":{"a":1},"x":1}}]`, mustJSONString(p))
+
+	p, err = UpsertPatch([]byte(doc), "/items", "id", nil)
+	assert.NoError(err)
+	assert.Equal(`[]`, mustJSONString(p))
+
+	_, err = UpsertPatch([]byte(doc), "/missing", "id", elements)
+	assert.ErrorContains(err, `unable to resolve array "/missing"`)
+	_, err = UpsertPatch([]byte(`{"items": {}}`), "/items", "id", elements)
+	assert.ErrorContains(err, `unexpected node "map[]" at "/items"`)
+	_, err = UpsertPatch([]byte(doc), "/items", "id", []json.RawMessage{json.RawMessage(`{"v": 1}`)})
+	assert.EqualError(err, `element 0 has no "id" member, invalid node detected`)
+	_, err = UpsertPatch([]byte(doc), "/items", "id", []json.RawMessage{json.RawMessage(`{"id": null}`)})
+	assert.EqualError(err, `element 0 has no "id" member, invalid node detected`)
+}
+
+func TestDiffWithIDPaths(t *testing.T) {
+	assert := assert.New(t)
+
+	cases := []struct {
+		src, dst string
+		patch    string
+	}{
+		{
+			`{"items": [{"id": "a", "n": 1}, {"id": "b", "n": 2}, {"id": "c", "n": 3}]}`,
+			`{"items": [{"id": "a", "n": 1}, {"id": "c", "n": 30}, {"id": "d", "n": 4}]}`,
+			`[{"op":"test","path":"/items/id:b/id","value":"b"},{"op":"remove","path":"/items/id:b"},` +
+				`{"op":"test","path":"/items/id:c/id","value":"c"},{"op":"replace","path":"/items/id:c/n","value":30},` +
+				`{"op":"add","path":"/items/-","value":{"id":"d","n":4}}]`,
+		},
+		{
+			`[{"id": 1, "tags": [{"id": "x", "v": 1}]}, {"id": "a/b", "v": 1}]`,
+			`[{"id": "a/b", "v": 2}, {"id": 1, "tags": [{"id": "x", "v": 2}]}]`,
+			`[{"op":"test","path":"/id:1/id","value":1},{"op":"test","path":"/id:1/tags/id:x/id","value":"x"},` +
+				`{"op":"replace","path":"/id:1/tags/id:x/v","value":2},` +
+				`{"op":"test","path":"/id:a~1b/id","value":"a/b"},{"op":"replace","path":"/id:a~1b/v","value":2}]`,
+		},
+		{
+			// duplicated ids are diffed by index.
+			`[{"id": 1, "v": 1}, {"id": 1, "v": 2}]`,
+			`[{"id": 1, "v": 1}, {"id": 1, "v": 3}]`,
+			`[{"op":"replace","path":"/1/v","value":3}]`,
+		},
+		{
+			// elements without id are diffed by index.
+			`[{"id": 1, "v": 1}, {"v": 2}]`,
+			`[{"id": 1, "v": 1}, {"v": 3}]`,
+			`[{"op":"replace","path":"/1/v","value":3}]`,
+		},
+	}
+
+	options := NewOptions()
+	options.AllowIDPaths = true
+	for i, c := range cases {
+		patch, err := Diff([]byte(c.src), []byte(c.dst), &DiffOptions{IDKey: "id", IDPaths: true})
+		if !assert.NoErrorf(err, "case %d", i) {
+			continue
+		}
+		assert.Equalf(c.patch, mustJSONString(patch), "case %d", i)
+
+		res, err := patch.ApplyWithOptions([]byte(c.src), options)
+		if assert.NoErrorf(err, "case %d", i) {
+			assert.Truef(Equal(reorderByID(t, res), reorderByID(t, []byte(c.dst))), "case %d: %s", i, res)
+		}
+	}
+
+	t.Run("reordered before applying", func(t *testing.T) {
+		src := `{"items": [{"id": "a", "n": 1}, {"id": "b", "n": 2}, {"id": "c", "n": 3}]}`
+		dst := `{"items": [{"id": "a", "n": 10}, {"id": "c", "n": 3}, {"id": "d", "n": 4}]}`
+		patch, err := Diff([]byte(src), []byte(dst), &DiffOptions{IDKey: "id", IDPaths: true})
+		assert.NoError(err)
+
+		reordered := `{"items": [{"id": "c", "n": 3}, {"id": "b", "n": 2}, {"id": "a", "n": 1}]}`
+		res, err := patch.ApplyWithOptions([]byte(reordered), options)
+		assert.NoError(err)
+		assert.JSONEq(`{"items": [{"id": "c", "n": 3}, {"id": "a", "n": 10}, {"id": "d", "n": 4}]}`, string(res))
+
+		// the index-based patch changes the wrong elements of the reordered array.
+		plain, err := Diff([]byte(src), []byte(dst), &DiffOptions{IDKey: "id"})
+		assert.NoError(err)
+		res, err = plain.Apply([]byte(reordered))
+		if err == nil {
+			assert.False(Equal(reorderByID(t, res), reorderByID(t, []byte(dst))))
+		}
+
+		// an element removed in between fails the patch, and so does an id of another type.
+		_, err = patch.ApplyWithOptions([]byte(`{"items": [{"id": "c", "n": 3}, {"id": "a", "n": 1}]}`), options)
+		assert.ErrorContains(err, "missing value")
+		patch, err = Diff([]byte(`[{"id": 5, "n": 1}]`), []byte(`[{"id": 5, "n": 2}]`),
+			&DiffOptions{IDKey: "id", IDPaths: true})
+		assert.NoError(err)
+		_, err = patch.ApplyWithOptions([]byte(`[{"id": "5", "n": 1}]`), options)
+		assert.ErrorContains(err, "test operation")
+	})
+}
+
+// reorderByID sorts the "items" array, or the document array, of objects by their "id" members.
+func reorderByID(t *testing.T, doc []byte) []byte {
+	var v interface{}
+	assert.NoError(t, json.Unmarshal(doc, &v))
+	ary, ok := v.([]interface{})
+	if m, isObj := v.(map[string]interface{}); isObj {
+		ary, ok = m["items"].([]interface{})
+	}
+	if ok {
+		sort.Slice(ary, func(i, j int) bool {
+			return fmt.Sprint(ary[i].(map[string]interface{})["id"]) < fmt.Sprint(ary[j].(map[string]interface{})["id"])
+		})
+	}
+	res, err := json.Marshal(v)
+	assert.NoError(t, err)
+	return res
+}
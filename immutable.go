@@ -0,0 +1,151 @@
+// (c) 2022-2022, LDC Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package jsonpatch
+
+import (
+	"strconv"
+)
+
+// ApplyImmutable applies the patch to a new node and returns it, src is never changed.
+// Only the objects and arrays on the paths changed by the operations are copied, the other values
+// are shared with src, so keeping many versions of a large document is cheap. The shared values
+// must not be changed in place afterwards, e.g. through Node.Ref, which would change all versions.
+// With AllowFilterPaths, AllowIDPaths or StableArrayIndices, whose paths are translated while
+// applying, the whole document is copied instead.
+func (p Patch) ApplyImmutable(src *Node, options *Options) (*Node, error) {
+	if options == nil {
+		options = NewOptions()
+	}
+	// custom operations may change the document beyond their path.
+	if options.AllowFilterPaths || options.AllowIDPaths || options.StableArrayIndices || p.hasCustomOps() {
+		n := src.clone()
+		if err := n.Patch(p, options); err != nil {
+			return nil, err
+		}
+		return n, nil
+	}
+
+	// src is parsed first so that its members or elements are the ones shared.
+	src.intoContainer()
+	n := src.shallowCopy()
+	owned := make(map[container]bool)
+	if pd, _ := n.intoContainer(); pd != nil {
+		owned[pd] = true
+	}
+
+	o := *options
+	o.beforeOp = func(doc container, op Operation) {
+		if op.Op == "remove_each" {
+			if prefix, _, ok := splitWildcard(op.Path); ok {
+				ownPath(doc, prefix, true, owned, &o)
+			}
+			return
+		}
+		for _, path := range mutatedPaths(op) {
+			ownPath(doc, path, false, owned, &o)
+		}
+	}
+	if err := n.Patch(p, &o); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// ownPath replaces the containers from the document down to the parent of path with copies,
+// unless they are already owned, so that changing the value at path does not change a shared
+// container. If deep is true, the value at path is replaced with a deep copy too.
+func ownPath(doc container, path string, deep bool, owned map[container]bool, options *Options) {
+	split, err := splitPointer(path, options)
+	if err != nil || len(split) < 2 {
+		return
+	}
+
+	parts := split[1:]
+	for i, part := range parts {
+		key := options.unescape(part)
+		last := i == len(parts)-1
+		if last && !deep {
+			return
+		}
+
+		child, err := doc.get(key, options)
+		if err != nil || child == nil {
+			return
+		}
+		if last {
+			setChild(doc, key, child.clone(), options)
+			return
+		}
+
+		if con := child.parsedContainer(); con != nil && owned[con] {
+			doc = con
+			continue
+		}
+		if con, _ := child.intoContainer(); con == nil {
+			return
+		}
+		cp := child.shallowCopy()
+		con := cp.parsedContainer()
+		setChild(doc, key, cp, options)
+		owned[con] = true
+		doc = con
+	}
+}
+
+// setChild sets the existing member or element of the container to the node, in place.
+func setChild(doc container, key string, child *Node, options *Options) {
+	switch con := doc.(type) {
+	case *partialDoc:
+		if k, err := con.lookupKey(key, options); err == nil {
+			con.obj.Set(k, child)
+		}
+	case *partialArray:
+		idx, err := strconv.Atoi(key)
+		if err != nil {
+			return
+		}
+		if idx < 0 && options.SupportNegativeIndices {
+			idx += len(*con)
+		}
+		if idx >= 0 && idx < len(*con) {
+			(*con)[idx] = child
+		}
+	}
+}
+
+// parsedContainer returns the container of the node if it is parsed, without parsing it.
+func (n *Node) parsedContainer() container {
+	switch n.which {
+	case eDoc:
+		return n.doc
+	case eAry:
+		return &n.ary
+	}
+	return nil
+}
+
+// shallowCopy returns a copy of the node that shares its members or elements, and its raw
+// encoded JSON, with it.
+func (n *Node) shallowCopy() *Node {
+	c := &Node{raw: n.raw, which: n.which, newObject: n.newObject, disallowDuplicateKeys: n.disallowDuplicateKeys,
+		depth: n.depth}
+	switch n.which {
+	case eDoc:
+		c.doc = &partialDoc{newObject: n.doc.newObject, disallowDuplicateKeys: n.doc.disallowDuplicateKeys,
+			depth: n.doc.depth}
+		if n.doc.newObject == nil {
+			c.doc.obj = newOrderedObject()
+		} else {
+			c.doc.obj = n.doc.newObject()
+		}
+		for _, k := range n.doc.obj.Keys() {
+			v, _ := n.doc.obj.Get(k)
+			c.doc.obj.Set(k, v)
+		}
+	case eAry:
+		c.ary = make(partialArray, len(n.ary))
+		copy(c.ary, n.ary)
+	}
+	return c
+}
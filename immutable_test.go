@@ -0,0 +1,88 @@
+// (c) 2022-2022, LDC Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package jsonpatch
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApplyImmutable(t *testing.T) {
+	assert := assert.New(t)
+
+	doc := `{"a":{"b":[1,2,{"c":3}],"d":{"e":4}},"f":{"g":5},"h":[{"i":6},{"i":7}]}`
+	cases := []struct {
+		patch   string
+		options *Options
+	}{
+		{`[{"op": "add", "path": "/a/b/2/c", "value": 30}]`, nil},
+		{`[{"op": "remove", "path": "/a/d/e"}, {"op": "add", "path": "/a/d/x", "value": 1}]`, nil},
+		{`[{"op": "replace", "path": "/f/g", "value": {"y": 1}}, {"op": "add", "path": "/f/g/z", "value": 2}]`, nil},
+		{`[{"op": "move", "from": "/a/b/0", "path": "/f/m"}]`, nil},
+		{`[{"op": "copy", "from": "/a/d", "path": "/h/0/d"}, {"op": "add", "path": "/h/0/d/e", "value": 0}]`, nil},
+		{`[{"op": "remove_each", "path": "/h/*/i"}]`, &Options{AllowExtendedOps: true}},
+		{`[{"op": "cas", "path": "/h/1/i", "expected": 7, "value": 0}]`, &Options{AllowExtendedOps: true}},
+		{`[{"op": "replace", "path": "/h/-1/i", "value": 0}]`, &Options{SupportNegativeIndices: true}},
+		{`[{"op": "replace", "path": "", "value": {"x": 1}}]`, nil},
+		{`[{"op": "add", "path": "/h[i=7]/j", "value": 1}]`, &Options{AllowFilterPaths: true}},
+	}
+
+	for _, c := range cases {
+		p, err := NewPatch([]byte(c.patch))
+		assert.NoError(err)
+
+		src := NewNode([]byte(doc))
+		_, err = src.GetChild("/a/b/2/c", nil)
+		assert.NoError(err)
+		res, err := p.ApplyImmutable(src, c.options)
+		assert.NoError(err, c.patch)
+		assert.Equal(doc, marshal(t, src), c.patch)
+
+		expected := NewNode([]byte(doc))
+		o := c.options
+		if o == nil {
+			o = NewOptions()
+		}
+		assert.NoError(expected.Patch(p, o))
+		assert.True(res.Equal(expected), "%s: %s", c.patch, marshal(t, res))
+	}
+
+	t.Run("shares unchanged subtrees", func(t *testing.T) {
+		src := NewNode([]byte(doc))
+		p, err := NewPatch([]byte(`[{"op": "add", "path": "/a/b/-", "value": 8}]`))
+		assert.NoError(err)
+		res, err := p.ApplyImmutable(src, nil)
+		assert.NoError(err)
+
+		for _, path := range []string{"/a/d", "/f", "/h", "/a/b/2"} {
+			x, _ := src.GetChild(path, nil)
+			y, _ := res.GetChild(path, nil)
+			assert.True(x == y, path)
+		}
+		for _, path := range []string{"/a", "/a/b"} {
+			x, _ := src.GetChild(path, nil)
+			y, _ := res.GetChild(path, nil)
+			assert.False(x == y, path)
+		}
+		assert.Equal(doc, marshal(t, src))
+	})
+
+	t.Run("error", func(t *testing.T) {
+		src := NewNode([]byte(doc))
+		p, err := NewPatch([]byte(`[{"op": "add", "path": "/a/x", "value": 1}, {"op": "remove", "path": "/z"}]`))
+		assert.NoError(err)
+		res, err := p.ApplyImmutable(src, nil)
+		assert.ErrorContains(err, "missing value")
+		assert.Nil(res)
+		assert.Equal(doc, marshal(t, src))
+	})
+}
+
+func marshal(t *testing.T, n *Node) string {
+	data, err := json.Marshal(n)
+	assert.NoError(t, err)
+	return string(data)
+}
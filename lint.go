@@ -0,0 +1,174 @@
+// (c) 2022-2022, LDC Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package jsonpatch
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// LintCopySizeThreshold is the size in bytes above which a copied value is
+// reported by LintWithDocument as a large copy.
+var LintCopySizeThreshold = 64 * 1024
+
+// Lint warning codes.
+const (
+	LintTestOnly         = "test-only"
+	LintAddCouldAppend   = "add-could-append"
+	LintRedundantReplace = "redundant-replace"
+	LintNoopMove         = "noop-move"
+	LintLargeCopy        = "large-copy"
+	LintShiftedIndex     = "shifted-index"
+)
+
+// LintWarning is a non-fatal issue found in a patch.
+type LintWarning struct {
+	// Index is the index of the offending operation in the patch,
+	// or -1 if the warning applies to the patch as a whole.
+	Index   int    `json:"index"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// String returns a string representation of the warning.
+func (w LintWarning) String() string {
+	if w.Index < 0 {
+		return fmt.Sprintf("%s: %s", w.Code, w.Message)
+	}
+	return fmt.Sprintf("operation %d, %s: %s", w.Index, w.Code, w.Message)
+}
+
+// Lint returns non-fatal warnings about the patch, such as patches that only
+// test, consecutive replaces of the same path, moves onto themselves or array
+// indexes shifted by previous insertions or removals, see Options.StableArrayIndices.
+// Checks that depend on the target document are skipped, use LintWithDocument
+// to run them as well.
+func (p Patch) Lint() []LintWarning {
+	return p.LintWithDocument(nil)
+}
+
+// LintWithDocument is like Lint but also runs the checks that depend on the
+// target document, such as "add" operations that could use "-" to append and
+// "copy" operations of values larger than LintCopySizeThreshold.
+// A nil doc skips these checks.
+func (p Patch) LintWithDocument(doc []byte) []LintWarning {
+	var res []LintWarning
+
+	testOnly := len(p) > 0
+	for i, op := range p {
+		if op.Op != "test" {
+			testOnly = false
+		}
+
+		if j, path, ok := p.shiftedIndex(i); ok {
+			res = append(res, LintWarning{i, LintShiftedIndex,
+				fmt.Sprintf("index in %q is shifted by operation %d", path, j)})
+		}
+
+		switch op.Op {
+		case "replace":
+			if i+1 < len(p) && p[i+1].Op == "replace" && p[i+1].Path == op.Path {
+				res = append(res, LintWarning{i, LintRedundantReplace,
+					fmt.Sprintf("replace of %q is overridden by the next operation", op.Path)})
+			}
+		case "move":
+			if op.From == op.Path {
+				res = append(res, LintWarning{i, LintNoopMove,
+					fmt.Sprintf("move from %q to itself has no effect", op.Path)})
+			}
+		}
+	}
+	if testOnly {
+		res = append(res, LintWarning{-1, LintTestOnly, "patch only contains test operations"})
+	}
+
+	if doc == nil {
+		return res
+	}
+
+	pd, _ := NewNode(doc).intoContainer()
+	if pd == nil {
+		return res
+	}
+
+	var accumulatedCopySize int64
+	options := NewOptions()
+	for i, op := range p {
+		switch op.Op {
+		case "add":
+			if con, key, _ := resolveObject(&pd, op.Path, options); con != nil {
+				if ary, ok := con.(*partialArray); ok && key == strconv.Itoa(len(*ary)) {
+					res = append(res, LintWarning{i, LintAddCouldAppend,
+						fmt.Sprintf("add to %q appends to the array, use \"-\" instead", op.Path)})
+				}
+			}
+		case "copy":
+			if con, key, _ := resolveObject(&pd, op.From, options); con != nil {
+				if val, err := con.get(key, options); err == nil {
+					if raw, err := val.MarshalJSON(); err == nil && len(raw) > LintCopySizeThreshold {
+						res = append(res, LintWarning{i, LintLargeCopy,
+							fmt.Sprintf("copy from %q duplicates %d bytes", op.From, len(raw))})
+					}
+				}
+			}
+		}
+
+		// keep tracking the document until the patch stops applying.
+		if err := p.applyOp(&pd, op, &accumulatedCopySize, options); err != nil {
+			break
+		}
+	}
+
+	sort.SliceStable(res, func(i, j int) bool { return res[i].Index < res[j].Index })
+	return res
+}
+
+// shiftedIndex reports whether operation i refers to an array element whose index was shifted by
+// a previous operation inserting an element before it, or removing it or an element before it.
+// It returns the last such operation and the path.
+func (p Patch) shiftedIndex(i int) (int, string, bool) {
+	var path string
+	switch p[i].Op {
+	case "remove", "replace", "test", "cas":
+		path = p[i].Path
+	case "move", "copy":
+		path = p[i].From
+	default:
+		return 0, "", false
+	}
+
+	for j := i - 1; j >= 0; j-- {
+		var inserted, removed string
+		switch p[j].Op {
+		case "add", "copy":
+			inserted = p[j].Path
+		case "move":
+			inserted, removed = p[j].Path, p[j].From
+		case "remove":
+			removed = p[j].Path
+		}
+
+		for _, e := range []string{inserted, removed} {
+			array := parentPath(e)
+			if e == "" || !strings.HasPrefix(path, array+"/") {
+				continue
+			}
+			k, err := strconv.Atoi(e[len(array)+1:])
+			if err != nil || k < 0 {
+				continue
+			}
+
+			token := path[len(array)+1:]
+			if n := strings.Index(token, "/"); n >= 0 {
+				token = token[:n]
+			}
+			if m, err := strconv.Atoi(token); err == nil && (m > k || e == removed && m == k) {
+				return j, path, true
+			}
+		}
+	}
+	return 0, "", false
+}
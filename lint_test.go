@@ -0,0 +1,128 @@
+// (c) 2022-2022, LDC Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package jsonpatch
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLint(t *testing.T) {
+	assert := assert.New(t)
+
+	lintCodes := func(ws []LintWarning) []string {
+		codes := make([]string, 0, len(ws))
+		for _, w := range ws {
+			codes = append(codes, w.Code)
+		}
+		return codes
+	}
+
+	large := `"` + strings.Repeat("a", 100) + `"`
+	defer func(v int) { LintCopySizeThreshold = v }(LintCopySizeThreshold)
+	LintCopySizeThreshold = 64
+
+	cases := []struct {
+		doc, patch string
+		codes      []string
+		indexes    []int
+	}{
+		{``, `[]`, []string{}, []int{}},
+		{``, `[{"op": "add", "path": "/a", "value": 1}]`, []string{}, []int{}},
+		{
+			``,
+			`[{"op": "test", "path": "/a", "value": 1}, {"op": "test", "path": "/b", "value": 1}]`,
+			[]string{LintTestOnly},
+			[]int{-1},
+		},
+		{
+			``,
+			`[
+				{"op": "replace", "path": "/a", "value": 1},
+				{"op": "replace", "path": "/a", "value": 2},
+				{"op": "replace", "path": "/b", "value": 2}
+			]`,
+			[]string{LintRedundantReplace},
+			[]int{0},
+		},
+		{
+			``,
+			`[{"op": "add", "path": "/a", "value": 1}, {"op": "move", "from": "/a", "path": "/a"}]`,
+			[]string{LintNoopMove},
+			[]int{1},
+		},
+		{
+			`{"a": [1, 2]}`,
+			`[{"op": "add", "path": "/a/2", "value": 3}, {"op": "add", "path": "/a/3", "value": 4}]`,
+			[]string{LintAddCouldAppend, LintAddCouldAppend},
+			[]int{0, 1},
+		},
+		{
+			`{"a": [1, 2]}`,
+			`[{"op": "add", "path": "/a/1", "value": 3}, {"op": "add", "path": "/a/-", "value": 4}]`,
+			[]string{},
+			[]int{},
+		},
+		{
+			``,
+			`[
+				{"op": "remove", "path": "/arr/0"},
+				{"op": "replace", "path": "/arr/0", "value": 1},
+				{"op": "add", "path": "/arr/3", "value": 1},
+				{"op": "test", "path": "/arr/3/a", "value": 1},
+				{"op": "copy", "from": "/arr/1", "path": "/x"},
+				{"op": "replace", "path": "/other/0", "value": 1}
+			]`,
+			[]string{LintShiftedIndex, LintShiftedIndex, LintShiftedIndex},
+			[]int{1, 3, 4},
+		},
+		{
+			``,
+			`[
+				{"op": "add", "path": "/arr/1", "value": 1},
+				{"op": "replace", "path": "/arr/1", "value": 2},
+				{"op": "move", "from": "/arr/0", "path": "/arr/-"},
+				{"op": "test", "path": "/arr/-1", "value": 1}
+			]`,
+			[]string{},
+			[]int{},
+		},
+		{
+			`{"a": ` + large + `, "b": 1}`,
+			`[{"op": "copy", "from": "/a", "path": "/c"}, {"op": "copy", "from": "/b", "path": "/d"}]`,
+			[]string{LintLargeCopy},
+			[]int{0},
+		},
+	}
+
+	for i, c := range cases {
+		patch, err := NewPatch([]byte(c.patch))
+		if !assert.NoErrorf(err, "case %d", i) {
+			continue
+		}
+
+		var ws []LintWarning
+		if c.doc == "" {
+			ws = patch.Lint()
+		} else {
+			ws = patch.LintWithDocument([]byte(c.doc))
+		}
+		assert.Equalf(c.codes, lintCodes(ws), "case %d", i)
+		for j, w := range ws {
+			assert.Equalf(c.indexes[j], w.Index, "case %d", i)
+			assert.NotEmptyf(w.Message, "case %d", i)
+		}
+	}
+
+	patch, _ := NewPatch([]byte(`[{"op": "add", "path": "/a/0", "value": 1}]`))
+	assert.Equal(0, len(patch.Lint()))
+	assert.Equal([]string{LintAddCouldAppend}, lintCodes(patch.LintWithDocument([]byte(`{"a": []}`))))
+	assert.Equal(`operation 0, add-could-append: add to "/a/0" appends to the array, use "-" instead`,
+		patch.LintWithDocument([]byte(`{"a": []}`))[0].String())
+
+	patch, _ = NewPatch([]byte(`[{"op": "remove", "path": "/a/0"}, {"op": "replace", "path": "/a/0/b", "value": 1}]`))
+	assert.Equal(`operation 1, shifted-index: index in "/a/0/b" is shifted by operation 0`, patch.Lint()[0].String())
+}
@@ -0,0 +1,251 @@
+// (c) 2022-2022, LDC Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package jsonpatch
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// ToMergePatch converts the JSON Patch to an equivalent JSON Merge Patch (RFC 7386) for the
+// base JSON document, by applying it to base and diffing the result against base.
+// Merge patches can only replace arrays as a whole and remove members with null, so it returns
+// an error if an operation edits the elements of an array, or moves from one, or if the patch
+// sets a member to null. "test" operations are evaluated against base, but not represented.
+func ToMergePatch(p Patch, base []byte) ([]byte, error) {
+	options := NewOptions()
+	node := NewNode(base)
+	for i, op := range p {
+		pd, err := node.intoContainer()
+		if pd == nil {
+			return nil, fmt.Errorf("unexpected node %q, %w", options.errorValue(node), err)
+		}
+		for _, path := range mutatedPaths(op) {
+			if inArray(pd, path, options) {
+				return nil, fmt.Errorf("%s operation %d edits the array elements at %q, which a merge patch can not represent, %w",
+					op.Op, i, path, ErrInvalid)
+			}
+		}
+		if err = node.Patch(Patch{op}, options); err != nil {
+			return nil, reindex(err, i)
+		}
+	}
+
+	src := NewNode(base)
+	for _, n := range []*Node{src, node} {
+		if _, err := n.intoContainer(); err != nil && err != ErrInvalid {
+			return nil, err
+		}
+	}
+	return mergeDiff(src, node, "")
+}
+
+// CreateMergePatch diffs two JSON documents and generates a JSON Merge Patch (RFC 7396),
+// in which the changed members of objects have their new values and the removed members
+// are null. Arrays and other values that differ are replaced as a whole, since merge
+// patches can not edit array elements. The members follow the order of dst, the removed
+// members come last. It returns an error if dst has a null member that src does not, since
+// merge patches can not set null values.
+func CreateMergePatch(src, dst []byte) ([]byte, error) {
+	s, d := NewNode(src), NewNode(dst)
+	for _, n := range []*Node{s, d} {
+		if !json.Valid(*n.raw) {
+			return nil, fmt.Errorf("invalid JSON document, %w", ErrInvalid)
+		}
+		if _, err := n.intoContainer(); err != nil && err != ErrInvalid {
+			return nil, err
+		}
+	}
+	return mergeDiff(s, d, "")
+}
+
+// FromMergePatch converts the JSON Merge Patch (RFC 7386) to a JSON Patch of RFC 6902 operations.
+// A merge patch that is not an object replaces the whole document. Otherwise null members become
+// "remove" operations, and the other members "add" operations of their values, without the null
+// members of object values. Since the target document is unknown, the removed members must exist
+// in it, and an object value, even {}, replaces the member instead of merging into it.
+// FromMergePatchTo converts the merge patch exactly for a given target document.
+func FromMergePatch(merge []byte) (Patch, error) {
+	return fromMergePatch(nil, merge)
+}
+
+// FromMergePatchTo converts the JSON Merge Patch (RFC 7386) to a JSON Patch of RFC 6902
+// operations that has the same effect on the target JSON document doc: members of doc set
+// to null are removed, missing ones are skipped, object values are merged recursively into
+// the object members of doc, and the other values add or replace the members.
+func FromMergePatchTo(doc, merge []byte) (Patch, error) {
+	target := NewNode(doc)
+	if _, err := target.intoContainer(); err != nil && err != ErrInvalid {
+		return nil, err
+	}
+	return fromMergePatch(target, merge)
+}
+
+// fromMergePatch converts the merge patch for the target node, or for an unknown target if nil.
+func fromMergePatch(target *Node, merge []byte) (Patch, error) {
+	n := NewNode(merge)
+	if _, err := n.intoContainer(); err != nil && err != ErrInvalid {
+		return nil, err
+	}
+
+	p := make(Patch, 0)
+	if n.which != eDoc || target != nil && target.which != eDoc {
+		raw, err := mergeValue(n)
+		if err != nil {
+			return nil, err
+		}
+		return append(p, Operation{Op: "replace", Path: "", Value: raw}), nil
+	}
+	return fromMergeObject(target, n, "", p)
+}
+
+func fromMergeObject(target, n *Node, path string, p Patch) (Patch, error) {
+	for _, k := range n.doc.obj.Keys() {
+		v, _ := n.doc.obj.Get(k)
+		kpath := path + "/" + encodePatchKey(k)
+
+		var tv *Node
+		exists := false
+		if target != nil {
+			tv, exists = target.doc.obj.Get(k)
+		}
+		if v.isNullValue() {
+			if target == nil || exists {
+				p = append(p, Operation{Op: "remove", Path: kpath})
+			}
+			continue
+		}
+
+		if _, err := v.intoContainer(); err != nil && err != ErrInvalid {
+			return nil, err
+		}
+		if v.which == eDoc && tv != nil {
+			if _, err := tv.intoContainer(); err != nil && err != ErrInvalid {
+				return nil, err
+			}
+			if tv.which == eDoc {
+				var err error
+				if p, err = fromMergeObject(tv, v, kpath, p); err != nil {
+					return nil, err
+				}
+				continue
+			}
+		}
+
+		raw, err := mergeValue(v)
+		if err != nil {
+			return nil, err
+		}
+		op := "add"
+		if exists {
+			op = "replace"
+		}
+		p = append(p, Operation{Op: op, Path: kpath, Value: raw})
+	}
+	return p, nil
+}
+
+// mergeValue returns the value that the merge patch value n sets on a member that is not an
+// object, which is n without the null members of its objects.
+func mergeValue(n *Node) (json.RawMessage, error) {
+	if n.which != eDoc {
+		return n.MarshalJSON()
+	}
+
+	out := &partialDoc{obj: newOrderedObject()}
+	for _, k := range n.doc.obj.Keys() {
+		v, _ := n.doc.obj.Get(k)
+		if v.isNullValue() {
+			continue
+		}
+		if _, err := v.intoContainer(); err != nil && err != ErrInvalid {
+			return nil, err
+		}
+		raw, err := mergeValue(v)
+		if err != nil {
+			return nil, err
+		}
+		out.obj.Set(k, NewNode(raw))
+	}
+	return out.MarshalJSON()
+}
+
+// inArray reports whether the path is an element of an array, or below one, in the document.
+func inArray(doc container, path string, options *Options) bool {
+	split, err := splitPointer(path, options)
+	if err != nil || len(split) < 2 {
+		return false
+	}
+
+	for _, part := range split[1:] {
+		if _, ok := doc.(*partialArray); ok {
+			return true
+		}
+		if doc = childContainer(doc, part, options); doc == nil {
+			return false
+		}
+	}
+	return false
+}
+
+// mergeDiff returns the merge patch that transforms src into dst, with the changed members
+// in the order of dst followed by the removed members in the order of src.
+func mergeDiff(src, dst *Node, path string) (json.RawMessage, error) {
+	if dst.which != eDoc || src.which != eDoc {
+		if err := checkMergeValue(dst, path); err != nil {
+			return nil, err
+		}
+		return dst.MarshalJSON()
+	}
+
+	out := &partialDoc{obj: newOrderedObject()}
+	for _, k := range dst.doc.obj.Keys() {
+		v, _ := dst.doc.obj.Get(k)
+		sv, ok := src.doc.obj.Get(k)
+		if ok && sv.Equal(v) {
+			continue
+		}
+
+		kpath := path + "/" + encodePatchKey(k)
+		if v.isNullValue() {
+			return nil, fmt.Errorf("null value at %q can not be represented by a merge patch, %w", kpath, ErrInvalid)
+		}
+		if !ok {
+			sv = NewNode(nil)
+		}
+		sv.intoContainer()
+		v.intoContainer()
+		raw, err := mergeDiff(sv, v, kpath)
+		if err != nil {
+			return nil, err
+		}
+		out.obj.Set(k, NewNode(raw))
+	}
+	for _, k := range src.doc.obj.Keys() {
+		if _, ok := dst.doc.obj.Get(k); !ok {
+			out.obj.Set(k, nil)
+		}
+	}
+	return out.MarshalJSON()
+}
+
+// checkMergeValue checks that the value has no null members, which would be removed
+// when the value is merged.
+func checkMergeValue(n *Node, path string) error {
+	if n.which != eDoc {
+		return nil
+	}
+	for _, k := range n.doc.obj.Keys() {
+		v, _ := n.doc.obj.Get(k)
+		kpath := path + "/" + encodePatchKey(k)
+		if v.isNullValue() {
+			return fmt.Errorf("null value at %q can not be represented by a merge patch, %w", kpath, ErrInvalid)
+		}
+		v.intoContainer()
+		if err := checkMergeValue(v, kpath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
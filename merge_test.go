@@ -0,0 +1,269 @@
+// (c) 2022-2022, LDC Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package jsonpatch
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestToMergePatch(t *testing.T) {
+	assert := assert.New(t)
+
+	base := `{"a": 1, "b": {"c": 2, "d": 3}, "e": [1, 2], "n": null}`
+	cases := []struct {
+		patch, merge, err string
+	}{
+		{`[]`, `{}`, ``},
+		{`[{"op": "test", "path": "/a", "value": 1}]`, `{}`, ``},
+		{
+			`[
+				{"op": "replace", "path": "/a", "value": 5},
+				{"op": "remove", "path": "/b/c"},
+				{"op": "add", "path": "/b/f", "value": {"g": [null]}},
+				{"op": "add", "path": "/h", "value": "x"}
+			]`,
+			`{"a":5,"b":{"f":{"g":[null]},"c":null},"h":"x"}`,
+			``,
+		},
+		{
+			`[{"op": "replace", "path": "/e", "value": [3]}, {"op": "move", "from": "/b/d", "path": "/d"}]`,
+			`{"b":{"d":null},"e":[3],"d":3}`,
+			``,
+		},
+		{
+			`[{"op": "copy", "from": "/e/0", "path": "/b"}, {"op": "remove", "path": "/n"}]`,
+			`{"b":1,"n":null}`,
+			``,
+		},
+		{
+			`[{"op": "replace", "path": "/b", "value": {"c": 2, "x": {"y": 1}}}]`,
+			`{"b":{"x":{"y":1},"d":null}}`,
+			``,
+		},
+		{
+			`[{"op": "replace", "path": "", "value": [1]}]`,
+			`[1]`,
+			``,
+		},
+		{
+			`[{"op": "add", "path": "/e/-", "value": 3}]`,
+			``,
+			`add operation 0 edits the array elements at "/e/-", which a merge patch can not represent, invalid node detected`,
+		},
+		{
+			`[{"op": "add", "path": "/a", "value": 2}, {"op": "move", "from": "/e/0", "path": "/x"}]`,
+			``,
+			`move operation 1 edits the array elements at "/e/0", which a merge patch can not represent, invalid node detected`,
+		},
+		{
+			`[{"op": "add", "path": "/e", "value": [{"x": 1}]}, {"op": "replace", "path": "/e/0/x", "value": 2}]`,
+			``,
+			`replace operation 1 edits the array elements at "/e/0/x", which a merge patch can not represent, invalid node detected`,
+		},
+		{
+			`[{"op": "replace", "path": "/a", "value": null}]`,
+			``,
+			`null value at "/a" can not be represented by a merge patch, invalid node detected`,
+		},
+		{
+			`[{"op": "add", "path": "/b/x", "value": {"y": null}}]`,
+			``,
+			`null value at "/b/x/y" can not be represented by a merge patch, invalid node detected`,
+		},
+		{
+			`[{"op": "test", "path": "/a", "value": 2}]`,
+			``,
+			`test operation for path "/a" failed, expected "2", got "1"`,
+		},
+	}
+
+	for i, c := range cases {
+		p, err := NewPatch([]byte(c.patch))
+		if !assert.NoErrorf(err, "case %d", i) {
+			continue
+		}
+
+		merge, err := ToMergePatch(p, []byte(base))
+		if c.err != "" {
+			assert.EqualErrorf(err, c.err, "case %d", i)
+			continue
+		}
+		if !assert.NoErrorf(err, "case %d", i) {
+			continue
+		}
+		assert.Equalf(c.merge, string(merge), "case %d", i)
+
+		// round trip
+		expected, err := p.Apply([]byte(base))
+		assert.NoErrorf(err, "case %d", i)
+		mp, err := FromMergePatchTo([]byte(base), merge)
+		assert.NoErrorf(err, "case %d", i)
+		out, err := mp.Apply([]byte(base))
+		assert.NoErrorf(err, "case %d", i)
+		assert.Truef(Equal(expected, out), "case %d, %s", i, string(out))
+	}
+}
+
+func TestFromMergePatch(t *testing.T) {
+	assert := assert.New(t)
+
+	cases := []struct {
+		merge, patch string
+	}{
+		{`{}`, `[]`},
+		{`[1, null]`, `[{"op":"replace","path":"","value":[1,null]}]`},
+		{`null`, `[{"op":"replace","path":"","value":null}]`},
+		{`{"a": {}}`, `[{"op":"add","path":"/a","value":{}}]`},
+		{
+			`{"a": null, "b": {"c": 1, "d/e": null, "f": {}}, "g": [1, {"h": null}]}`,
+			`[{"op":"remove","path":"/a"},{"op":"add","path":"/b","value":{"c":1,"f":{}}},{"op":"add","path":"/g","value":[1,{"h":null}]}]`,
+		},
+	}
+
+	for i, c := range cases {
+		p, err := FromMergePatch([]byte(c.merge))
+		if assert.NoErrorf(err, "case %d", i) {
+			assert.Equalf(c.patch, mustJSONString(p), "case %d", i)
+		}
+	}
+
+	p, _ := FromMergePatch([]byte(`{"a": {}, "b": {"c": {"d": 1}}, "e": "x"}`))
+	out, err := p.Apply([]byte(`{"a": 1, "b": {"x": 1}, "e": [1]}`))
+	assert.NoError(err)
+	assert.Equal(`{"a":{},"b":{"c":{"d":1}},"e":"x"}`, string(out))
+
+	_, err = FromMergePatch([]byte(`{"a": [}`))
+	assert.Error(err)
+}
+
+func TestFromMergePatchTo(t *testing.T) {
+	assert := assert.New(t)
+
+	doc := `{"a": 1, "b": {"x": 1, "y": {"z": 1}}, "e": [1], "n": null}`
+	cases := []struct {
+		merge, patch, result string
+	}{
+		{`{}`, `[]`, doc},
+		{`[1]`, `[{"op":"replace","path":"","value":[1]}]`, `[1]`},
+		{
+			`{"a": {}}`,
+			`[{"op":"replace","path":"/a","value":{}}]`,
+			`{"a": {}, "b": {"x": 1, "y": {"z": 1}}, "e": [1], "n": null}`,
+		},
+		{
+			`{"b": {}, "f": {}}`,
+			`[{"op":"add","path":"/f","value":{}}]`,
+			`{"a": 1, "b": {"x": 1, "y": {"z": 1}}, "e": [1], "n": null, "f": {}}`,
+		},
+		{
+			`{"a": null, "m": null, "n": null}`,
+			`[{"op":"remove","path":"/a"},{"op":"remove","path":"/n"}]`,
+			`{"b": {"x": 1, "y": {"z": 1}}, "e": [1]}`,
+		},
+		{
+			`{"b": {"x": null, "y": {"w": 2}, "c": {"d": null, "e": 1}}, "e": {"f": null}, "n": {"g": 1}}`,
+			`[{"op":"remove","path":"/b/x"},{"op":"add","path":"/b/y/w","value":2},{"op":"add","path":"/b/c","value":{"e":1}},{"op":"replace","path":"/e","value":{}},{"op":"replace","path":"/n","value":{"g":1}}]`,
+			`{"a": 1, "b": {"y": {"z": 1, "w": 2}, "c": {"e": 1}}, "e": {}, "n": {"g": 1}}`,
+		},
+	}
+
+	for i, c := range cases {
+		p, err := FromMergePatchTo([]byte(doc), []byte(c.merge))
+		if !assert.NoErrorf(err, "case %d", i) {
+			continue
+		}
+		assert.Equalf(c.patch, mustJSONString(p), "case %d", i)
+
+		out, err := p.Apply([]byte(doc))
+		if assert.NoErrorf(err, "case %d", i) {
+			assert.Truef(Equal([]byte(c.result), out), "case %d, %s", i, string(out))
+		}
+	}
+
+	p, err := FromMergePatchTo([]byte(`[1]`), []byte(`{"a": {"b": null}}`))
+	assert.NoError(err)
+	assert.Equal(`[{"op":"replace","path":"","value":{"a":{}}}]`, mustJSONString(p))
+
+	_, err = FromMergePatchTo([]byte(`{"a": [}`), []byte(`{}`))
+	assert.Error(err)
+}
+
+func TestCreateMergePatch(t *testing.T) {
+	assert := assert.New(t)
+
+	cases := []struct {
+		src, dst, merge string
+	}{
+		{`{"a": 1}`, `{"a": 1}`, `{}`},
+		{`{"a": 1, "b": 2}`, `{"b": 3, "a": 1, "c": 4}`, `{"b":3,"c":4}`},
+		{`{"a": 1, "b": 2, "c": 3}`, `{"c": 3}`, `{"a":null,"b":null}`},
+		{
+			`{"x": {"y": 1, "z": [1, 2]}, "k": "v"}`,
+			`{"w": true, "x": {"z": [1, 3], "q": {"r": 1}}, "k": "v"}`,
+			`{"w":true,"x":{"z":[1,3],"q":{"r":1},"y":null}}`,
+		},
+		{`{"a": {"b": 1}}`, `{"a": [1]}`, `{"a":[1]}`},
+		{`{"a": [1]}`, `{"a": {"b": 1}}`, `{"a":{"b":1}}`},
+		{`{"a": "s"}`, `{"a": {"b": {"c": 1}}}`, `{"a":{"b":{"c":1}}}`},
+		{`{"a": null}`, `{"a": null, "b": [null]}`, `{"b":[null]}`},
+		{`[1, 2]`, `[1, 3]`, `[1,3]`},
+		{`{"a": 1}`, `"s"`, `"s"`},
+	}
+
+	for i, c := range cases {
+		merge, err := CreateMergePatch([]byte(c.src), []byte(c.dst))
+		if !assert.NoErrorf(err, "case %d", i) {
+			continue
+		}
+		assert.Equalf(c.merge, string(merge), "case %d", i)
+
+		out, err := applyMergePatch([]byte(c.src), merge)
+		assert.NoErrorf(err, "case %d", i)
+		assert.Truef(Equal(out, []byte(c.dst)), "case %d, %s", i, string(out))
+	}
+
+	_, err := CreateMergePatch([]byte(`{"a": 1}`), []byte(`{"a": null}`))
+	assert.EqualError(err, `null value at "/a" can not be represented by a merge patch, invalid node detected`)
+	_, err = CreateMergePatch([]byte(`{}`), []byte(`{"a": {"b": null}}`))
+	assert.EqualError(err, `null value at "/a/b" can not be represented by a merge patch, invalid node detected`)
+	_, err = CreateMergePatch([]byte(`{"a": [}`), []byte(`{}`))
+	assert.EqualError(err, `invalid JSON document, invalid node detected`)
+	_, err = CreateMergePatch([]byte(`{}`), []byte(`tru`))
+	assert.Error(err)
+}
+
+// applyMergePatch applies the JSON Merge Patch as specified by RFC 7396.
+func applyMergePatch(doc, merge []byte) ([]byte, error) {
+	var target, patch interface{}
+	if err := json.Unmarshal(doc, &target); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(merge, &patch); err != nil {
+		return nil, err
+	}
+
+	var mergeValue func(target, patch interface{}) interface{}
+	mergeValue = func(target, patch interface{}) interface{} {
+		pm, ok := patch.(map[string]interface{})
+		if !ok {
+			return patch
+		}
+		tm, ok := target.(map[string]interface{})
+		if !ok {
+			tm = make(map[string]interface{})
+		}
+		for k, v := range pm {
+			if v == nil {
+				delete(tm, k)
+			} else {
+				tm[k] = mergeValue(tm[k], v)
+			}
+		}
+		return tm
+	}
+	return json.Marshal(mergeValue(target, patch))
+}
@@ -0,0 +1,89 @@
+// (c) 2022-2022, LDC Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package jsonpatch
+
+import (
+	"fmt"
+	"sync"
+)
+
+// OpFunc applies a custom operation, see RegisterOp. doc is the root of the patched document,
+// the changes made to it, e.g. with SetValue, DeleteValue or Patch, are changes of the patched
+// document, options are the options the patch is applied with.
+type OpFunc func(doc *Node, op Operation, options *Options) error
+
+var (
+	customOpsMu sync.RWMutex
+	customOps   = make(map[string]OpFunc)
+)
+
+// builtinOps are the operations that can not be overridden by RegisterOp.
+var builtinOps = map[string]bool{
+	"add":         true,
+	"remove":      true,
+	"replace":     true,
+	"move":        true,
+	"test":        true,
+	"copy":        true,
+	"cas":         true,
+	"remove_each": true,
+}
+
+// RegisterOp registers fn to apply the operations named name, so that the patch language can be
+// extended with custom operations, e.g. an "increment" of a number. The built-in operations,
+// including the extended ones, can not be overridden. Registering a name again replaces its
+// OpFunc, and a nil fn unregisters it. Custom operations are rejected with Options.StrictRFC6902.
+// It is safe for concurrent use.
+func RegisterOp(name string, fn OpFunc) error {
+	if builtinOps[name] {
+		return fmt.Errorf("unable to register operation %q, it is a built-in operation, %w", name, ErrConflict)
+	}
+
+	customOpsMu.Lock()
+	defer customOpsMu.Unlock()
+	if fn == nil {
+		delete(customOps, name)
+	} else {
+		customOps[name] = fn
+	}
+	return nil
+}
+
+// customOp returns the OpFunc registered for the operation name, or nil.
+func customOp(name string) OpFunc {
+	customOpsMu.RLock()
+	defer customOpsMu.RUnlock()
+	return customOps[name]
+}
+
+// hasCustomOps reports whether the patch has an operation registered with RegisterOp.
+func (p Patch) hasCustomOps() bool {
+	for _, op := range p {
+		if !builtinOps[op.Op] && customOp(op.Op) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (p Patch) applyCustom(doc *container, op Operation, fn OpFunc, options *Options) error {
+	self := &Node{newObject: options.NewObject, disallowDuplicateKeys: options.DisallowDuplicateKeys}
+	switch v := (*doc).(type) {
+	case *partialDoc:
+		self.doc = v
+		self.which = eDoc
+	case *partialArray:
+		self.ary = *v
+		self.which = eAry
+	}
+
+	if err := fn(self, op, options); err != nil {
+		return fmt.Errorf("%s operation does not apply for %q, %w", op.Op, op.Path, err)
+	}
+	// the operation may have replaced the root, or the elements of a root array.
+	if pd, _ := self.intoContainer(); pd != nil {
+		*doc = pd
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+// (c) 2022-2022, LDC Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package jsonpatch
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func increment(doc *Node, op Operation, options *Options) error {
+	raw, err := doc.GetValue(op.Path, options)
+	if err != nil {
+		return err
+	}
+	var num, delta float64 = 0, 1
+	if err := json.Unmarshal(raw, &num); err != nil {
+		return fmt.Errorf("value %s is not a number, %v", raw, ErrInvalid)
+	}
+	if op.Value != nil {
+		if err := json.Unmarshal(op.Value, &delta); err != nil {
+			return fmt.Errorf("delta %s is not a number, %v", op.Value, ErrInvalid)
+		}
+	}
+	val, _ := json.Marshal(num + delta)
+	return doc.SetValue(op.Path, val, options)
+}
+
+func TestRegisterOp(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(RegisterOp("increment", increment))
+	t.Cleanup(func() { RegisterOp("increment", nil) })
+	assert.EqualError(RegisterOp("add", increment),
+		`unable to register operation "add", it is a built-in operation, conflicting operation`)
+	assert.EqualError(RegisterOp("remove_each", nil),
+		`unable to register operation "remove_each", it is a built-in operation, conflicting operation`)
+
+	doc := `{"a": 1, "b": {"c": [2.5, "x"]}}`
+	cases := []struct {
+		patch, result, err string
+	}{
+		{
+			`[{"op": "increment", "path": "/a"}]`,
+			`{"a":2,"b":{"c":[2.5,"x"]}}`,
+			``,
+		},
+		{
+			`[{"op": "increment", "path": "/b/c/0", "value": -0.5}, {"op": "test", "path": "/b/c/0", "value": 2}]`,
+			`{"a":1,"b":{"c":[2,"x"]}}`,
+			``,
+		},
+		{
+			`[{"op": "add", "path": "/d", "value": 9}, {"op": "increment", "path": "/d", "value": 10}]`,
+			`{"a":1,"b":{"c":[2.5,"x"]},"d":19}`,
+			``,
+		},
+		{
+			`[{"op": "increment", "path": "/b/c/1"}]`,
+			``,
+			`increment operation does not apply for "/b/c/1", value "x" is not a number, invalid node detected`,
+		},
+		{
+			`[{"op": "increment", "path": "/missing"}]`,
+			``,
+			`increment operation does not apply for "/missing"`,
+		},
+		{
+			`[{"op": "decrement", "path": "/a"}]`,
+			``,
+			`unexpected operation "decrement"`,
+		},
+	}
+
+	for i, c := range cases {
+		p, err := NewPatch([]byte(c.patch))
+		if !assert.NoErrorf(err, "case %d", i) {
+			continue
+		}
+		assert.Equalf(c.err != `unexpected operation "decrement"`, p.Validate() == nil, "case %d", i)
+		res, err := p.Apply([]byte(doc))
+		if c.err != "" {
+			assert.ErrorContainsf(err, c.err, "case %d", i)
+			continue
+		}
+		if assert.NoErrorf(err, "case %d", i) {
+			assert.JSONEqf(c.result, string(res), "case %d", i)
+		}
+
+		// the source of ApplyImmutable is not changed.
+		src := NewNode([]byte(doc))
+		n, err := p.ApplyImmutable(src, nil)
+		if assert.NoErrorf(err, "case %d", i) {
+			assert.JSONEqf(c.result, marshal(t, n), "case %d", i)
+			assert.JSONEqf(doc, marshal(t, src), "case %d", i)
+		}
+	}
+
+	// the root can be replaced.
+	assert.NoError(RegisterOp("wrap", func(doc *Node, op Operation, options *Options) error {
+		raw, err := doc.MarshalJSON()
+		if err != nil {
+			return err
+		}
+		return doc.SetValue("", append(append([]byte(`[`), raw...), ']'), options)
+	}))
+	t.Cleanup(func() { RegisterOp("wrap", nil) })
+	p, _ := NewPatch([]byte(`[{"op": "wrap", "path": ""}, {"op": "add", "path": "/-", "value": 1}]`))
+	res, err := p.Apply([]byte(doc))
+	assert.NoError(err)
+	assert.JSONEq(`[{"a": 1, "b": {"c": [2.5, "x"]}}, 1]`, string(res))
+
+	options := NewOptions()
+	options.StrictRFC6902 = true
+	p, _ = NewPatch([]byte(`[{"op": "increment", "path": "/a"}]`))
+	_, err = p.ApplyWithOptions([]byte(doc), options)
+	assert.ErrorContains(err, `unexpected operation "increment"`)
+
+	assert.NoError(RegisterOp("increment", nil))
+	_, err = p.Apply([]byte(doc))
+	assert.ErrorContains(err, `unexpected operation "increment"`)
+}
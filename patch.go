@@ -39,11 +39,17 @@ package jsonpatch
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"net/url"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 )
 
 var (
@@ -60,8 +66,46 @@ var (
 	ErrMissing      = errors.New("missing value")
 	ErrInvalid      = errors.New("invalid node detected")
 	ErrInvalidIndex = errors.New("invalid index referenced")
+	ErrTimeout      = errors.New("patch application timed out")
+	ErrConflict     = errors.New("conflicting operation")
+	// ErrSkip is returned by the function of Node.Walk to skip the children of a value.
+	ErrSkip = errors.New("skip children")
 )
 
+// OpError is the error of a failed operation returned by Node.Patch and the functions applying
+// a patch. Its message is the message of the underlying error, which ends with one of the Err*
+// errors for the failures of the operation itself, e.g. ErrMissing for a missing path,
+// so errors.Is reports it.
+type OpError struct {
+	// Index is the index of the operation in the patch.
+	Index int
+	// Op is the failed operation.
+	Op Operation
+	// Path is the path of the operation.
+	Path string
+	// Err is the underlying error.
+	Err error
+}
+
+// Error implements the error interface.
+func (e *OpError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *OpError) Unwrap() error {
+	return e.Err
+}
+
+// reindex sets the index of the OpError of an operation applied on its own to its index i
+// in the patch.
+func reindex(err error, i int) error {
+	if e, ok := err.(*OpError); ok {
+		e.Index = i
+	}
+	return err
+}
+
 const (
 	eRaw = iota
 	eDoc
@@ -89,6 +133,56 @@ type Operation struct {
 	Path  string          `json:"path"`
 	From  string          `json:"from,omitempty"`
 	Value json.RawMessage `json:"value,omitempty"`
+	// Expected is the expected current value of the extended "cas" operation.
+	Expected json.RawMessage `json:"expected,omitempty"`
+	// EnsurePath overrides Options.EnsurePathExistsOnAdd for this operation.
+	EnsurePath *bool `json:"x-ensure-path,omitempty"`
+	// AllowMissing overrides Options.AllowMissingPathOnRemove for this operation.
+	AllowMissing *bool `json:"x-allow-missing,omitempty"`
+
+	// unknown is the first member of the decoded operation that is not a field, in key order.
+	unknown string
+}
+
+// UnmarshalJSON decodes the operation, the members that are not fields are ignored, but
+// rejected when it is applied with Options.StrictRFC6902.
+func (o *Operation) UnmarshalJSON(data []byte) error {
+	type operation Operation
+	var op operation
+	if err := json.Unmarshal(data, &op); err != nil {
+		return err
+	}
+
+	var members map[string]json.RawMessage
+	if err := json.Unmarshal(data, &members); err != nil {
+		return err
+	}
+	for k := range members {
+		switch k {
+		case "op", "path", "from", "value", "expected", "x-ensure-path", "x-allow-missing":
+		default:
+			if op.unknown == "" || k < op.unknown {
+				op.unknown = k
+			}
+		}
+	}
+	*o = Operation(op)
+	return nil
+}
+
+// extraMember returns a member of the operation that is not defined by RFC 6902, if any.
+func (o Operation) extraMember() string {
+	switch {
+	case o.unknown != "":
+		return o.unknown
+	case o.Expected != nil:
+		return "expected"
+	case o.EnsurePath != nil:
+		return "x-ensure-path"
+	case o.AllowMissing != nil:
+		return "x-allow-missing"
+	}
+	return ""
 }
 
 // Patch is an ordered collection of Operations.
@@ -110,6 +204,134 @@ type Options struct {
 	// EnsurePathExistsOnAdd instructs json-patch to recursively create the missing parts of path on "add" operation.
 	// Default to false.
 	EnsurePathExistsOnAdd bool
+	// NewObject creates the Object used to hold the members of JSON objects parsed while patching.
+	// Default to nil, which uses the built-in ordered map.
+	NewObject func() Object
+	// DisallowDuplicateKeys rejects the JSON objects with duplicate keys, which encoding/json would
+	// silently resolve to the last value, and the error names the duplicate key. The "value" and
+	// "expected" members of operations are checked whole. The document is parsed lazily, so only
+	// its objects that the patch reaches are checked: the untouched raw subtrees pass through
+	// unchecked, duplicate keys included. Use CheckDuplicateKeys to check a whole document upfront.
+	// Default to false.
+	DisallowDuplicateKeys bool
+	// MaxErrorValueLen truncates the values rendered into error messages to the given length
+	// with an ellipsis.
+	// Default to 0, which means no truncation.
+	MaxErrorValueLen int
+	// Timeout aborts applying a patch with ErrTimeout once the given duration is exceeded.
+	// Default to 0, which means no timeout.
+	Timeout time.Duration
+	// AllowExtendedOps enables the operations that are not defined by RFC 6902:
+	// "cas" replaces the value at path with value only if the current value equals expected,
+	// "remove_each" removes the path from every member or element matched by its one "*" token.
+	// Default to false.
+	AllowExtendedOps bool
+	// OnArrayShift is called for each array element whose index shifts from fromIdx to toIdx
+	// because of an element inserted or removed before it by an "add", "remove", "move" or "copy"
+	// operation, path is the path of the array. A "move" within an array reports the shifts of
+	// its removal and then of its insertion. It allows callers to keep side metadata keyed by path,
+	// e.g. the selected elements of a UI, aligned with the document.
+	// Default to nil.
+	OnArrayShift func(path string, fromIdx, toIdx int)
+	// OnIndexChange is called for each existing array element whose index changes from oldIndex
+	// to newIndex because of an "add", "remove", "move" or "copy" operation, arrayPath is the path
+	// of the array. Unlike OnArrayShift, a "move" within an array reports the net changes once,
+	// including the moved element, so callers can remap their references, e.g. a UI selection.
+	// Default to nil.
+	OnIndexChange func(arrayPath string, oldIndex, newIndex int)
+	// AllowFilterPaths resolves path tokens like "items[id=5]" to the element of the "items" array
+	// whose "id" member equals 5, the value is compared as JSON if valid, e.g. 5, true or "5",
+	// otherwise as a string. A token like "[id=5]" filters the array at the preceding path.
+	// The first matching element is used, and a token without match resolves to a missing value.
+	// Default to false.
+	AllowFilterPaths bool
+	// AllowIDPaths resolves path tokens like "id:abc" of an array to the index of its element
+	// whose IDPathKey member is the string "abc", or the number if the rest of the token is one,
+	// e.g. "/items/id:abc/name". A token without matching element resolves to a missing value,
+	// tokens of objects are not resolved, so "id:abc" remains a valid member key.
+	// Default to false.
+	AllowIDPaths bool
+	// IDPathKey is the name of the member holding the element ids of AllowIDPaths.
+	// Default to "id".
+	IDPathKey string
+	// NormalizeNumbers re-encodes the numbers with a fraction or an exponent in the values added
+	// or replaced by the patch as encoding/json encodes a float64, e.g. 1e3 as 1000 and 1.50 as 1.5.
+	// By default the values are stored and marshaled with their exact bytes.
+	// Default to false.
+	NormalizeNumbers bool
+	// PercentDecodePointers percent-decodes each token of the paths, as in the URI fragment
+	// representation of JSON Pointers, for clients that percent-encode reserved characters.
+	// Tokens are percent-decoded first and then "~1" and "~0" decoded, so "/a%20b" resolves to
+	// the key "a b", and both "/a~1b" and "/a%7E1b" resolve to the key "a/b".
+	// Default to false.
+	PercentDecodePointers bool
+	// MaxStringValueLen rejects the "add", "replace", "copy" and "cas" operations whose value is
+	// a string longer than the given number of characters, once decoded from JSON.
+	// Values of other types, including objects and arrays of long strings, are not measured.
+	// Default to 0, which means no limit.
+	MaxStringValueLen int
+	// StableArrayIndices interprets the non-negative array indexes in the paths of all operations
+	// against the original document, instead of the document as modified by the previous operations.
+	// For example, after "remove" of "/arr/0", "/arr/1" still refers to the original second element,
+	// which is now at "/arr/0". An "add" at an original index inserts before the original element at
+	// that index, after the elements inserted there by previous operations. The elements inserted by
+	// previous operations can only be referred to with "-" and negative indexes, which are interpreted
+	// against the modified document as usual, and referring to an element removed by a previous
+	// operation is an error. Only array indexes are translated, object members are not.
+	// Default to false.
+	StableArrayIndices bool
+	// NextRevision returns the new revision that ApplyIfRevision sets after applying a patch
+	// to the given revision, it is set as a JSON string.
+	// Default to nil, which means the revision is not changed.
+	NextRevision func(rev string) string
+	// PointerUnescape decodes each token of the paths into an object key or array index,
+	// in place of the standard RFC 6901 decoding of "~1" and "~0", for pointer dialects
+	// that escape the reserved characters differently, e.g. "/" as "%2F".
+	// Default to nil, which means the standard RFC 6901 decoding.
+	PointerUnescape func(token string) string
+	// KeyNormalize normalizes the object keys, e.g. to lower case, both when members are stored
+	// and when they are looked up, so that keys with inconsistent casing or whitespace refer to
+	// the same member. A stored member replaces the members whose keys normalize to the same key,
+	// so the last one written wins, and looking up a key that several existing members normalize
+	// to, but none is equal to, is an error. The keys within the added values are not normalized.
+	// Default to nil, which means the keys are used as is.
+	KeyNormalize func(key string) string
+	// StepValidate is called after each operation with its index and the encoded document as
+	// modified so far, e.g. to check an invariant on every intermediate state. Applying the patch
+	// aborts with the first error it returns. Since the document is encoded after each operation,
+	// it is costly for large documents.
+	// Default to nil.
+	StepValidate func(index int, afterOp []byte) error
+	// ResolveValueRefs replaces the value of an "add", "replace" or "cas" operation that is an object
+	// with a "$ref" member holding a JSON Pointer as its sole member, e.g. {"$ref": "/a"}, with the
+	// current value at the pointer in the document before storing it, like a "copy" operation.
+	// Objects with other members than "$ref" are stored as is, but a sole "$ref" member can not be
+	// stored literally, e.g. a JSON Schema reference, since it is resolved, or fails to.
+	// Default to false.
+	ResolveValueRefs bool
+	// MaxMoveCopyOps rejects the patches with more "move" and "copy" operations combined than
+	// the given number before applying any operation, since these traverse and clone values.
+	// Default to 0, which means no limit.
+	MaxMoveCopyOps int
+	// StrictRFC6902 applies patches as strictly defined by RFC 6902 and overrides the options that
+	// deviate from it: SupportNegativeIndices, AllowMissingPathOnRemove, EnsurePathExistsOnAdd,
+	// AllowExtendedOps, AllowFilterPaths, AllowIDPaths, StableArrayIndices, PercentDecodePointers,
+	// PointerUnescape, KeyNormalize and ResolveValueRefs are disabled, and so are the operations
+	// registered with RegisterOp. The operations with members not defined by RFC 6902 are
+	// rejected, e.g. "x-ensure-path", "x-allow-missing" and "expected".
+	// Array indexes with leading zeros, e.g. "01", are rejected, and so are the "add", "replace"
+	// and "test" operations without a "value", and the "move" and "copy" operations without a
+	// "from", which can not be told from the root pointer "", so it is rejected too. A "test"
+	// operation of a missing value fails, even if its "value" is null.
+	// Default to false.
+	StrictRFC6902 bool
+
+	// ctx is the context of ApplyWithContext.
+	ctx context.Context
+	// beforeOp is called before each operation with the document, see ApplyImmutable.
+	beforeOp func(doc container, op Operation)
+	// onApplied is called after each operation with its paths resolved, see ApplyRecording.
+	onApplied func(op Operation)
 }
 
 // NewOptions creates a default set of options for calls to ApplyWithOptions.
@@ -122,6 +344,84 @@ func NewOptions() *Options {
 	}
 }
 
+// strict returns the options to apply a patch with, the options overridden by StrictRFC6902
+// are disabled if it is set.
+func (o *Options) strict() *Options {
+	if !o.StrictRFC6902 {
+		return o
+	}
+
+	s := *o
+	s.SupportNegativeIndices = false
+	s.AllowMissingPathOnRemove = false
+	s.EnsurePathExistsOnAdd = false
+	s.AllowExtendedOps = false
+	s.AllowFilterPaths = false
+	s.AllowIDPaths = false
+	s.StableArrayIndices = false
+	s.PercentDecodePointers = false
+	s.PointerUnescape = nil
+	s.KeyNormalize = nil
+	s.ResolveValueRefs = false
+	return &s
+}
+
+// forOp returns the options with the per-operation overrides of op applied.
+func (o *Options) forOp(op Operation) *Options {
+	if o.StrictRFC6902 || op.EnsurePath == nil && op.AllowMissing == nil {
+		return o
+	}
+
+	s := *o
+	if op.EnsurePath != nil {
+		s.EnsurePathExistsOnAdd = *op.EnsurePath
+	}
+	if op.AllowMissing != nil {
+		s.AllowMissingPathOnRemove = *op.AllowMissing
+	}
+	return &s
+}
+
+// arrayIndex parses the array index token, only the digits without leading zeros are an index
+// with StrictRFC6902.
+func (o *Options) arrayIndex(key string) (int, error) {
+	if o.StrictRFC6902 && (key == "" || len(key) > 1 && key[0] == '0' || strings.Trim(key, "0123456789") != "") {
+		return 0, ErrInvalidIndex
+	}
+	return strconv.Atoi(key)
+}
+
+// unescape decodes the path token into an object key or array index.
+func (o *Options) unescape(token string) string {
+	if o.PointerUnescape != nil {
+		return o.PointerUnescape(token)
+	}
+	return decodePatchKey(token)
+}
+
+// ctxErrEvery returns the error of the context of ApplyWithContext, it is only checked
+// once every 1024 iterations of a loop, at the given iteration, to keep loops cheap.
+func (o *Options) ctxErrEvery(i int) error {
+	if o.ctx == nil || i%1024 != 0 {
+		return nil
+	}
+	return o.ctx.Err()
+}
+
+// errorValue returns the string representation of the node to render into an error message.
+func (o *Options) errorValue(n *Node) string {
+	s := n.String()
+	if o.MaxErrorValueLen <= 0 || len(s) <= o.MaxErrorValueLen {
+		return s
+	}
+
+	r := []rune(s)
+	if len(r) <= o.MaxErrorValueLen {
+		return s
+	}
+	return string(r[:o.MaxErrorValueLen]) + "..."
+}
+
 // NewPatch decodes the passed JSON document as an RFC 6902 patch.
 func NewPatch(doc []byte) (Patch, error) {
 	var p Patch
@@ -134,6 +434,44 @@ func NewPatch(doc []byte) (Patch, error) {
 	return p, nil
 }
 
+// envelopeVersion is the version of the patch format in a patch envelope.
+const envelopeVersion = "6902"
+
+// MarshalEnvelope encodes the patch with metadata, such as author or timestamp, as
+// {"version":"6902","meta":{...},"operations":[...]}.
+// The operations are encoded as a standard RFC 6902 patch.
+func (p Patch) MarshalEnvelope(meta map[string]interface{}) ([]byte, error) {
+	ops := p
+	if ops == nil {
+		ops = Patch{}
+	}
+	return json.Marshal(struct {
+		Version    string                 `json:"version"`
+		Meta       map[string]interface{} `json:"meta,omitempty"`
+		Operations Patch                  `json:"operations"`
+	}{envelopeVersion, meta, ops})
+}
+
+// UnmarshalEnvelope decodes a patch envelope encoded by MarshalEnvelope,
+// it returns the patch and the metadata.
+func UnmarshalEnvelope(doc []byte) (Patch, map[string]interface{}, error) {
+	var env struct {
+		Version    string                 `json:"version"`
+		Meta       map[string]interface{} `json:"meta"`
+		Operations *Patch                 `json:"operations"`
+	}
+	if err := json.Unmarshal(doc, &env); err != nil {
+		return nil, nil, err
+	}
+	if env.Version != envelopeVersion {
+		return nil, nil, fmt.Errorf("unsupported patch envelope version %q", env.Version)
+	}
+	if env.Operations == nil {
+		return nil, nil, errors.New("patch envelope without operations")
+	}
+	return *env.Operations, env.Meta, nil
+}
+
 // Apply mutates a JSON document according to the patch, and returns the new document.
 func (p Patch) Apply(doc []byte) ([]byte, error) {
 	return p.ApplyWithOptions(doc, NewOptions())
@@ -149,12 +487,217 @@ func (p Patch) ApplyWithOptions(doc []byte, options *Options) ([]byte, error) {
 	return node.MarshalJSON()
 }
 
+// ApplyWithContext applies the patch to the JSON document like ApplyWithOptions, and aborts
+// with the error of the context once it is done, e.g. when the client of a request disconnects.
+// The context is checked before each operation, and while padding arrays with null values
+// for EnsurePathExistsOnAdd.
+func (p Patch) ApplyWithContext(ctx context.Context, doc []byte, options *Options) ([]byte, error) {
+	if options == nil {
+		options = NewOptions()
+	}
+	o := *options
+	o.ctx = ctx
+	return p.ApplyWithOptions(doc, &o)
+}
+
+// ApplyTemplate substitutes the "${name}" variables in the path and from of each
+// operation with the given vars, and applies the resulting patch to the JSON document.
+// The substituted values are escaped as JSON Pointer reference tokens,
+// so a value can not inject additional path segments.
+func ApplyTemplate(doc []byte, p Patch, vars map[string]string, options *Options) ([]byte, error) {
+	pp := make(Patch, len(p))
+	for i, op := range p {
+		var err error
+		if op.Path, err = expandTemplate(op.Path, vars); err != nil {
+			return nil, err
+		}
+		if op.From, err = expandTemplate(op.From, vars); err != nil {
+			return nil, err
+		}
+		pp[i] = op
+	}
+	return pp.ApplyWithOptions(doc, options)
+}
+
+// ApplyIfRevision applies the patch to the JSON document only if the value at revPath is the
+// expected revision, either as a string or as the encoded JSON of another type, e.g. 5 for "5".
+// A stale revision is reported as an ErrConflict error, and the patch is not applied.
+// If Options.NextRevision is set, the revision at revPath is then set to its result.
+func ApplyIfRevision(doc []byte, p Patch, expectedRev string, revPath string, options *Options) ([]byte, error) {
+	if options == nil {
+		options = NewOptions()
+	}
+
+	node := NewNode(doc)
+	node.newObject = options.NewObject
+	rev, err := node.GetChild(revPath, options)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get revision at %q, %w", revPath, err)
+	}
+	raw, err := rev.MarshalJSON()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read revision at %q, %w", revPath, err)
+	}
+	var s string
+	if json.Unmarshal(raw, &s) != nil {
+		s = string(raw)
+	}
+	if s != expectedRev {
+		return nil, fmt.Errorf("stale revision %q at %q, expected %q, %w", s, revPath, expectedRev, ErrConflict)
+	}
+
+	if options.NextRevision != nil {
+		next, err := json.Marshal(options.NextRevision(expectedRev))
+		if err != nil {
+			return nil, err
+		}
+		p = append(p[:len(p):len(p)], Operation{Op: "add", Path: revPath, Value: next})
+	}
+	if err = node.Patch(p, options); err != nil {
+		return nil, err
+	}
+	return node.MarshalJSON()
+}
+
+func expandTemplate(path string, vars map[string]string) (string, error) {
+	var sb strings.Builder
+	for {
+		i := strings.Index(path, "${")
+		if i < 0 {
+			sb.WriteString(path)
+			return sb.String(), nil
+		}
+		j := strings.IndexByte(path[i:], '}')
+		if j < 0 {
+			return "", fmt.Errorf("unterminated template variable in %q", path)
+		}
+		name := path[i+2 : i+j]
+		v, ok := vars[name]
+		if !ok {
+			return "", fmt.Errorf("undefined template variable %q", name)
+		}
+		sb.WriteString(path[:i])
+		sb.WriteString(encodePatchKey(v))
+		path = path[i+j+1:]
+	}
+}
+
+// TemplateVars returns the names of the "${name}" variables referenced in the path and from
+// of the operations, in the order they first appear and without duplicates, so that callers
+// can check they have all of them before calling ApplyTemplate.
+// An unterminated variable is not returned, ApplyTemplate rejects it.
+func (p Patch) TemplateVars() []string {
+	names := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, op := range p {
+		for _, path := range []string{op.Path, op.From} {
+			for {
+				i := strings.Index(path, "${")
+				if i < 0 {
+					break
+				}
+				j := strings.IndexByte(path[i:], '}')
+				if j < 0 {
+					break
+				}
+				if name := path[i+2 : i+j]; !seen[name] {
+					seen[name] = true
+					names = append(names, name)
+				}
+				path = path[i+j+1:]
+			}
+		}
+	}
+	return names
+}
+
+// Check reports whether the patch applies to the JSON document without producing the new document.
+// A patch that only consists of "test" operations is checked without copying the document,
+// and only the tested paths are parsed.
+func (p Patch) Check(doc []byte, options *Options) error {
+	for _, op := range p {
+		if op.Op != "test" {
+			return NewNode(doc).Patch(p, options)
+		}
+	}
+
+	raw := json.RawMessage(doc)
+	if len(raw) == 0 {
+		raw = []byte("null")
+	}
+	return (&Node{raw: &raw}).Patch(p, options)
+}
+
+// NodeType is the type of a JSON value.
+type NodeType int
+
+// JSON value types.
+const (
+	TypeInvalid NodeType = iota
+	TypeNull
+	TypeBool
+	TypeNumber
+	TypeString
+	TypeArray
+	TypeObject
+)
+
+// String returns the name of the type.
+func (t NodeType) String() string {
+	switch t {
+	case TypeNull:
+		return "null"
+	case TypeBool:
+		return "boolean"
+	case TypeNumber:
+		return "number"
+	case TypeString:
+		return "string"
+	case TypeArray:
+		return "array"
+	case TypeObject:
+		return "object"
+	default:
+		return "invalid"
+	}
+}
+
+// DocumentType returns the type of the raw encoded JSON document by scanning its leading bytes,
+// without parsing nor validating the document. A nil or empty document is JSON null.
+func DocumentType(doc []byte) NodeType {
+	for _, c := range doc {
+		switch c {
+		case ' ', '\t', '\n', '\r':
+			continue
+		case '{':
+			return TypeObject
+		case '[':
+			return TypeArray
+		case '"':
+			return TypeString
+		case 't', 'f':
+			return TypeBool
+		case 'n':
+			return TypeNull
+		case '-', '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+			return TypeNumber
+		default:
+			return TypeInvalid
+		}
+	}
+	return TypeNull
+}
+
 // Node represents a lazy parsing JSON document.
 type Node struct {
-	raw   *json.RawMessage
-	doc   *partialDoc
-	ary   partialArray
-	which int
+	raw                   *json.RawMessage
+	doc                   *partialDoc
+	ary                   partialArray
+	which                 int
+	newObject             func() Object
+	disallowDuplicateKeys bool
+	// depth is the nesting depth of the value in its document, see maxNestingDepth.
+	depth int
 }
 
 // NewNode returns a new Node with the given raw encoded JSON document.
@@ -170,6 +713,17 @@ func NewNode(doc json.RawMessage) *Node {
 	return &Node{raw: &raw}
 }
 
+// newValueNode returns a new Node for a value applied with the given options.
+func newValueNode(doc json.RawMessage, options *Options) *Node {
+	if options.NormalizeNumbers {
+		doc = normalizeNumbers(doc)
+	}
+	n := NewNode(doc)
+	n.newObject = options.NewObject
+	n.disallowDuplicateKeys = options.DisallowDuplicateKeys
+	return n
+}
+
 // String returns a string representation of the node.
 func (n *Node) String() string {
 	if n.raw == nil || isNull(*n.raw) {
@@ -182,51 +736,654 @@ func (n *Node) String() string {
 	return fmt.Sprintf("%v", v)
 }
 
+// Type returns the type of the value of the node, without parsing it.
+func (n *Node) Type() NodeType {
+	switch {
+	case n != nil && n.which == eDoc:
+		return TypeObject
+	case n != nil && n.which == eAry:
+		return TypeArray
+	case n.isNull():
+		return TypeNull
+	}
+	return DocumentType(*n.raw)
+}
+
 // Patch applies the given patch to the node.
 func (n *Node) Patch(p Patch, options *Options) error {
+	if options == nil {
+		options = NewOptions()
+	}
+	options = options.strict()
+	if n.which == eRaw && options.NewObject != nil {
+		n.newObject = options.NewObject
+	}
+	if n.which == eRaw && options.DisallowDuplicateKeys {
+		n.disallowDuplicateKeys = true
+	}
+
 	pd, err := n.intoContainer()
 	switch {
 	case err != nil:
-		return fmt.Errorf("unexpected node %q, %v", n.String(), err)
+		return fmt.Errorf("unexpected node %q, %w", options.errorValue(n), err)
 	case pd == nil:
-		return fmt.Errorf("unexpected node %q", n.String())
+		return fmt.Errorf("unexpected node %q", options.errorValue(n))
+	}
+
+	if options.MaxMoveCopyOps > 0 {
+		count := 0
+		for _, op := range p {
+			if op.Op == "move" || op.Op == "copy" {
+				count++
+			}
+		}
+		if count > options.MaxMoveCopyOps {
+			return fmt.Errorf("patch has %d move and copy operations, exceeds the limit %d, %w",
+				count, options.MaxMoveCopyOps, ErrInvalid)
+		}
+	}
+
+	var deadline time.Time
+	if options.Timeout > 0 {
+		deadline = time.Now().Add(options.Timeout)
+	}
+
+	var accumulatedCopySize int64
+	var edits []otOp
+	for i, op := range p {
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return fmt.Errorf("unable to apply operation %d after %v, %w", i, options.Timeout, ErrTimeout)
+		}
+		if options.ctx != nil {
+			if err := options.ctx.Err(); err != nil {
+				return err
+			}
+		}
+		if options.beforeOp != nil {
+			options.beforeOp(pd, op)
+		}
+		if options.StableArrayIndices {
+			err = p.applyStable(&pd, i, op, &edits, &accumulatedCopySize, options)
+		} else {
+			err = p.applyOp(&pd, op, &accumulatedCopySize, options)
+		}
+		if err != nil {
+			return &OpError{Index: i, Op: op, Path: op.Path, Err: err}
+		}
+		if options.StepValidate != nil {
+			doc, err := json.Marshal(pd)
+			if err != nil {
+				return &OpError{Index: i, Op: op, Path: op.Path, Err: err}
+			}
+			if err := options.StepValidate(i, doc); err != nil {
+				err = fmt.Errorf("%s operation %d does not validate, %w", op.Op, i, err)
+				return &OpError{Index: i, Op: op, Path: op.Path, Err: err}
+			}
+		}
 	}
+	// a root "replace" may have changed the type of the node.
+	switch v := pd.(type) {
+	case *partialDoc:
+		n.doc = v
+		n.which = eDoc
+	case *partialArray:
+		n.ary = *v
+		n.which = eAry
+	}
+	return nil
+}
 
+// ApplyOpResolved applies the given operation to the node and returns the concrete path
+// where the change took effect, with "-" and negative array indexes resolved,
+// e.g. "/arr/3" when "/arr/-" appended to a 3-element array.
+func (n *Node) ApplyOpResolved(op Operation, options *Options) (string, error) {
 	if options == nil {
 		options = NewOptions()
 	}
-	var accumulatedCopySize int64
-	for _, op := range p {
+
+	// the value of an "add", "move" or "copy" lands at path only after the operation applies.
+	after := op.Op == "add" || op.Op == "move" || op.Op == "copy"
+
+	var effectivePath string
+	if pd, _ := n.intoContainer(); pd != nil && !after {
+		effectivePath = resolvePath(pd, op.Path, options)
+	}
+
+	if err := n.Patch(Patch{op}, options); err != nil {
+		return "", err
+	}
+
+	if after {
+		pd, _ := n.intoContainer()
+		effectivePath = resolvePath(pd, op.Path, options)
+	}
+	return effectivePath, nil
+}
+
+// ApplyRecording applies the patch to the JSON document like ApplyWithOptions, and also returns
+// the recorded patch with the paths and froms resolved to where the changes took effect, so that
+// replaying it is position-deterministic. For example, "add" to "/arr/-" on a 2-element array is
+// recorded as "add" to "/arr/2".
+func (p Patch) ApplyRecording(doc []byte, options *Options) ([]byte, Patch, error) {
+	if options == nil {
+		options = NewOptions()
+	}
+
+	recorded := make(Patch, 0, len(p))
+	o := *options
+	o.onApplied = func(op Operation) {
+		recorded = append(recorded, op)
+	}
+
+	node := NewNode(doc)
+	if err := node.Patch(p, &o); err != nil {
+		return nil, nil, err
+	}
+	res, err := node.MarshalJSON()
+	if err != nil {
+		return nil, nil, err
+	}
+	return res, recorded, nil
+}
+
+// ApplyWithTouched applies the patch to the JSON document like ApplyWithOptions, and also returns
+// the concrete paths whose values were added, replaced or removed, including the "from" paths of
+// "move" operations, with "-" and negative array indexes resolved, in the order they were first
+// touched. Paths are not adjusted for the array elements shifted by later operations.
+func (p Patch) ApplyWithTouched(doc []byte, options *Options) ([]byte, []string, error) {
+	if options == nil {
+		options = NewOptions()
+	}
+
+	node := NewNode(doc)
+	touched := make([]string, 0, len(p))
+	seen := make(map[string]bool, len(p))
+	touch := func(path string) {
+		if !seen[path] {
+			seen[path] = true
+			touched = append(touched, path)
+		}
+	}
+
+	o := *options
+	o.onApplied = func(op Operation) {
 		switch op.Op {
-		case "add":
-			err = p.add(&pd, op, options)
-		case "remove":
-			err = p.remove(&pd, op, options)
-		case "replace":
-			err = p.replace(&pd, op, options)
-		case "move":
-			err = p.move(&pd, op, options)
 		case "test":
-			err = p.test(&pd, op, options)
-		case "copy":
-			err = p.copy(&pd, op, &accumulatedCopySize, options)
+		case "move":
+			touch(op.From)
+			touch(op.Path)
+		default:
+			touch(op.Path)
+		}
+	}
+
+	if err := node.Patch(p, &o); err != nil {
+		return nil, nil, err
+	}
+	res, err := node.MarshalJSON()
+	if err != nil {
+		return nil, nil, err
+	}
+	return res, touched, nil
+}
+
+// Invert returns the patch that undoes the patch once applied to the original JSON document,
+// e.g. for undo stacks. The operations are applied one by one to the original document to
+// capture the values they overwrite: "add" and "copy" are inverted by "remove", or "replace"
+// of the overwritten member, "remove" by "add" of the removed value at its exact array index,
+// "replace" by "replace" with the prior value and "move" by "move" back. Since RFC 6902 can not
+// insert a member at a position, restored object members become the last members of their objects.
+// It returns an error if the patch does not apply to the original document.
+func (p Patch) Invert(original []byte) (Patch, error) {
+	options := NewOptions()
+	node := NewNode(original)
+	inverses := make([]Patch, len(p))
+	for i, op := range p {
+		ops, err := node.invertOp(op, options)
+		if err != nil {
+			return nil, fmt.Errorf("unable to invert %s operation %d, %w", op.Op, i, err)
+		}
+		inverses[i] = ops
+	}
+
+	inverse := make(Patch, 0, len(p))
+	for i := len(inverses) - 1; i >= 0; i-- {
+		inverse = append(inverse, inverses[i]...)
+	}
+	return inverse, nil
+}
+
+// invertOp applies the operation to the node and returns the operations that undo it.
+func (n *Node) invertOp(op Operation, options *Options) (Patch, error) {
+	pd, err := n.intoContainer()
+	if pd == nil {
+		return nil, fmt.Errorf("unexpected node %q, %w", options.errorValue(n), err)
+	}
+
+	var inv Patch
+	switch op.Op {
+	case "remove", "replace", "cas":
+		path := resolvePath(pd, op.Path, options)
+		prior, ok, err := priorValue(pd, path, options)
+		switch {
+		case err != nil:
+			return nil, err
+		case !ok:
+			// a missing value allowed to be removed, nothing to undo.
+		case op.Op == "remove":
+			inv = Patch{{Op: "add", Path: path, Value: prior}}
 		default:
-			err = fmt.Errorf("unexpected operation %q", op.Op)
+			inv = Patch{{Op: "replace", Path: path, Value: prior}}
+		}
+
+	case "add", "copy", "move":
+		var from string
+		if op.Op == "move" {
+			from = resolvePath(pd, op.From, options)
+		}
+		path := resolvePath(pd, op.Path, options)
+		prior, ok, err := priorValue(pd, path, options)
+		if err != nil {
+			return nil, err
+		}
+		if _, isArray := parentContainer(pd, path, options).(*partialArray); isArray {
+			ok = false
+		}
+		if !ok && op.Op != "move" && path != "" {
+			if ancestor, ok := missingAncestor(pd, path, options); ok {
+				if inv, err = replaceOf(pd, ancestor, options); err != nil {
+					return nil, err
+				}
+				break
+			}
+		}
+
+		effective, err := n.ApplyOpResolved(op, options)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case path == "":
+			inv = Patch{{Op: "replace", Path: path, Value: prior}}
+		case op.Op == "move" && from == effective:
+		case op.Op == "move":
+			inv = Patch{{Op: "move", From: effective, Path: from}}
+			if ok {
+				inv = append(inv, Operation{Op: "add", Path: path, Value: prior})
+			}
+		case ok:
+			inv = Patch{{Op: "replace", Path: path, Value: prior}}
+		default:
+			inv = Patch{{Op: "remove", Path: effective}}
+		}
+		return inv, nil
+
+	case "test":
+
+	default:
+		root := op.Path
+		if prefix, _, ok := splitWildcard(op.Path); ok {
+			root = resolvePath(pd, prefix, options)
+		}
+		if inv, err = replaceOf(pd, root, options); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := n.Patch(Patch{op}, options); err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
+
+// priorValue returns a copy of the encoded value at path in the document, it reports false
+// if the value is missing.
+func priorValue(doc container, path string, options *Options) (json.RawMessage, bool, error) {
+	var v *Node
+	if path == "" {
+		v = &Node{}
+		switch d := doc.(type) {
+		case *partialDoc:
+			v.doc, v.which = d, eDoc
+		case *partialArray:
+			v.ary, v.which = *d, eAry
+		}
+	} else {
+		con, key, err := resolveObject(&doc, path, options)
+		if con == nil {
+			return nil, false, nil
+		}
+		if v, err = con.get(key, options); err != nil {
+			return nil, false, nil
+		}
+	}
+
+	raw, err := v.MarshalJSON()
+	if err != nil {
+		return nil, false, err
+	}
+	return append(json.RawMessage(nil), raw...), true, nil
+}
+
+// parentContainer returns the container of the value at path, or nil if it does not exist.
+func parentContainer(doc container, path string, options *Options) container {
+	if path == "" {
+		return nil
+	}
+	con, _, _ := resolveObject(&doc, path, options)
+	return con
+}
+
+// missingAncestor returns the path of the deepest existing ancestor of path in the document,
+// if the parent of path is missing, as when an "add" operation ensures the path exists.
+func missingAncestor(doc container, path string, options *Options) (string, bool) {
+	if parentContainer(doc, path, options) != nil {
+		return "", false
+	}
+	for path = parentPath(path); path != ""; path = parentPath(path) {
+		if _, ok, _ := priorValue(doc, path, options); ok {
+			return path, true
+		}
+	}
+	return "", true
+}
+
+// replaceOf returns a "replace" operation of the value at path with its current value.
+func replaceOf(doc container, path string, options *Options) (Patch, error) {
+	prior, ok, err := priorValue(doc, path, options)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return Patch{{Op: "replace", Path: path, Value: prior}}, nil
+}
+
+// resolvePath returns the path with "-" and negative array indexes resolved
+// against the given document. "-" resolves to the last element of an array,
+// as it was just appended.
+func resolvePath(doc container, path string, options *Options) string {
+	if path == "" {
+		return path
+	}
+
+	parts := strings.Split(path, "/")[1:]
+	for i, part := range parts {
+		if ary, ok := doc.(*partialArray); ok {
+			if part == "-" {
+				parts[i] = strconv.Itoa(len(*ary) - 1)
+			} else if idx, err := strconv.Atoi(part); err == nil && idx < 0 {
+				parts[i] = strconv.Itoa(idx + len(*ary))
+			}
+		}
+
+		if i == len(parts)-1 {
+			break
+		}
+		next, err := doc.get(options.unescape(parts[i]), options)
+		if err != nil {
+			break
+		}
+		if doc, _ = next.intoContainer(); doc == nil {
+			break
+		}
+	}
+	return "/" + strings.Join(parts, "/")
+}
+
+func (p Patch) applyOp(doc *container, op Operation, accumulatedCopySize *int64, options *Options) error {
+	if options.onApplied != nil {
+		return p.applyResolved(doc, op, accumulatedCopySize, options)
+	}
+	if options.StrictRFC6902 {
+		switch {
+		case (op.Op == "add" || op.Op == "replace" || op.Op == "test") && op.Value == nil:
+			return fmt.Errorf("%s operation for %q has no value, %w", op.Op, op.Path, ErrInvalid)
+		case (op.Op == "move" || op.Op == "copy") && op.From == "":
+			return fmt.Errorf("%s operation for %q has no from, %w", op.Op, op.Path, ErrInvalid)
+		case op.extraMember() != "":
+			return fmt.Errorf("%s operation for %q has member %q not defined by RFC 6902, %w",
+				op.Op, op.Path, op.extraMember(), ErrInvalid)
+		}
+	} else {
+		options = options.forOp(op)
+	}
+
+	if options.DisallowDuplicateKeys {
+		for _, v := range []json.RawMessage{op.Value, op.Expected} {
+			if v == nil {
+				continue
+			}
+			if err := CheckDuplicateKeys(v); err != nil {
+				return fmt.Errorf("%s operation does not apply for %q, %w", op.Op, op.Path, err)
+			}
+		}
+	}
+
+	if options.ResolveValueRefs && (op.Op == "add" || op.Op == "replace" || op.Op == "cas") {
+		if ref, ok := valueRef(op.Value); ok {
+			v, err := resolveValueRef(*doc, ref, accumulatedCopySize, options)
+			if err != nil {
+				return fmt.Errorf("%s operation does not apply for %q, unable to resolve value reference %q, %w",
+					op.Op, op.Path, ref, err)
+			}
+			op.Value = v
+		}
+	}
+
+	switch op.Op {
+	case "add":
+		return p.add(doc, op, options)
+	case "remove":
+		return p.remove(doc, op, options)
+	case "replace":
+		return p.replace(doc, op, options)
+	case "move":
+		return p.move(doc, op, options)
+	case "test":
+		return p.test(doc, op, options)
+	case "copy":
+		return p.copy(doc, op, accumulatedCopySize, options)
+	case "cas":
+		if options.AllowExtendedOps {
+			return p.cas(doc, op, options)
+		}
+		return fmt.Errorf("unexpected operation %q", op.Op)
+	case "remove_each":
+		if options.AllowExtendedOps {
+			return p.removeEach(doc, op, options)
+		}
+		return fmt.Errorf("unexpected operation %q", op.Op)
+	default:
+		if fn := customOp(op.Op); fn != nil && !options.StrictRFC6902 {
+			return p.applyCustom(doc, op, fn, options)
+		}
+		return fmt.Errorf("unexpected operation %q", op.Op)
+	}
+}
+
+// applyResolved applies the operation like applyOp, and then calls Options.onApplied with the
+// operation with its paths resolved to where the changes took effect.
+func (p Patch) applyResolved(doc *container, op Operation, accumulatedCopySize *int64, options *Options) error {
+	// the value of an "add", "move" or "copy" lands at path only after the operation applies.
+	after := op.Op == "add" || op.Op == "move" || op.Op == "copy"
+	resolved := op
+	if op.Op == "move" || op.Op == "copy" {
+		resolved.From = resolvePath(*doc, op.From, options)
+	}
+	if !after {
+		resolved.Path = resolvePath(*doc, op.Path, options)
+	}
+
+	// the operations applied by a custom operation are not recorded.
+	o := *options
+	o.onApplied = nil
+	if err := p.applyOp(doc, op, accumulatedCopySize, &o); err != nil {
+		return err
+	}
+
+	if after {
+		resolved.Path = resolvePath(*doc, op.Path, options)
+	}
+	options.onApplied(resolved)
+	return nil
+}
+
+// ReplaceWhere walks the node and replaces every value for which pred returns
+// a replacement and true, the replacement is not walked further.
+// It returns the number of replaced values.
+func (n *Node) ReplaceWhere(pred func(path string, value *Node) (json.RawMessage, bool)) (int, error) {
+	count := 0
+	err := n.replaceWhere("", pred, &count)
+	return count, err
+}
+
+func (n *Node) replaceWhere(path string, pred func(string, *Node) (json.RawMessage, bool), count *int) error {
+	if v, ok := pred(path, n); ok {
+		n.reset(v)
+		*count++
+		return nil
+	}
+
+	if _, err := n.intoContainer(); err != nil && err != ErrInvalid {
+		return err
+	}
+
+	switch n.which {
+	case eDoc:
+		for _, k := range n.doc.obj.Keys() {
+			v, _ := n.doc.obj.Get(k)
+			if v == nil {
+				v = NewNode(nil)
+				n.doc.obj.Set(k, v)
+			}
+			if err := v.replaceWhere(path+"/"+encodePatchKey(k), pred, count); err != nil {
+				return err
+			}
+		}
+	case eAry:
+		for i, v := range n.ary {
+			if v == nil {
+				v = NewNode(nil)
+				n.ary[i] = v
+			}
+			if err := v.replaceWhere(path+"/"+strconv.Itoa(i), pred, count); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// SortArraysByKey sorts the elements of every array in the JSON document, at any depth,
+// by the value of their member with the given key, so that inherently unordered lists of
+// objects have a stable order for comparison or signing.
+// Values of different types are ordered null, boolean, number, string, array and object,
+// numbers are compared numerically, strings lexicographically, and arrays and objects by
+// their compact encoding. Elements that are not objects or that are missing the key are
+// sorted last, in their original order, so arrays without such objects are left unchanged.
+func SortArraysByKey(doc []byte, key string) ([]byte, error) {
+	n := NewNode(doc)
+	if err := n.sortArraysByKey(key); err != nil {
+		return nil, err
+	}
+	return n.MarshalJSON()
+}
+
+func (n *Node) sortArraysByKey(key string) error {
+	if _, err := n.intoContainer(); err != nil && err != ErrInvalid {
+		return err
+	}
+
+	switch n.which {
+	case eDoc:
+		for _, k := range n.doc.obj.Keys() {
+			if v, _ := n.doc.obj.Get(k); v != nil {
+				if err := v.sortArraysByKey(key); err != nil {
+					return err
+				}
+			}
+		}
+	case eAry:
+		vals := make([][]byte, len(n.ary))
+		for i, v := range n.ary {
+			if v == nil {
+				continue
+			}
+			if err := v.sortArraysByKey(key); err != nil {
+				return err
+			}
+			if v.which != eDoc {
+				continue
+			}
+			if m, ok := v.doc.obj.Get(key); ok {
+				raw, err := m.MarshalJSON()
+				if err != nil {
+					return err
+				}
+				vals[i] = raw
+			}
 		}
 
-		if err != nil {
-			return err
+		idx := make([]int, len(n.ary))
+		for i := range idx {
+			idx[i] = i
 		}
-	}
-	switch n.which {
-	case eDoc:
-		n.doc = pd.(*partialDoc)
-	case eAry:
-		n.ary = *(pd.(*partialArray))
+		sort.SliceStable(idx, func(i, j int) bool {
+			a, b := vals[idx[i]], vals[idx[j]]
+			if a == nil || b == nil {
+				return a != nil
+			}
+			return compareValues(a, b) < 0
+		})
+
+		ary := make(partialArray, len(n.ary))
+		for i, j := range idx {
+			ary[i] = n.ary[j]
+		}
+		n.ary = ary
 	}
 	return nil
 }
 
+// compareValues compares two raw encoded JSON values, see SortArraysByKey.
+func compareValues(a, b []byte) int {
+	ta, tb := DocumentType(a), DocumentType(b)
+	if ta != tb {
+		return int(ta) - int(tb)
+	}
+
+	switch ta {
+	case TypeBool:
+		return int(a[0]) - int(b[0]) // "f" < "t"
+	case TypeNumber:
+		fa, erra := strconv.ParseFloat(string(a), 64)
+		fb, errb := strconv.ParseFloat(string(b), 64)
+		if erra == nil && errb == nil {
+			switch {
+			case fa < fb:
+				return -1
+			case fa > fb:
+				return 1
+			}
+			return 0
+		}
+	case TypeString:
+		var sa, sb string
+		if json.Unmarshal(a, &sa) == nil && json.Unmarshal(b, &sb) == nil {
+			return strings.Compare(sa, sb)
+		}
+	}
+	return bytes.Compare(a, b)
+}
+
+// reset sets the node to the given raw encoded JSON document.
+func (n *Node) reset(doc json.RawMessage) {
+	v := NewNode(doc)
+	n.raw = v.raw
+	n.doc = nil
+	n.ary = nil
+	n.which = eRaw
+}
+
 // MarshalJSON implements the json.Marshaler interface.
 func (n *Node) MarshalJSON() ([]byte, error) {
 	if n == nil {
@@ -272,11 +1429,73 @@ type container interface {
 	remove(key string, options *Options) error
 }
 
-type partialDoc struct {
+// Object is an ordered collection of JSON object members. It can be implemented
+// to back JSON objects with a custom data structure, see Options.NewObject.
+type Object interface {
+	// Len returns the number of members.
+	Len() int
+	// Keys returns the member keys in order.
+	Keys() []string
+	// Get returns the member value of the given key.
+	Get(key string) (*Node, bool)
+	// Set sets the member value of the given key, the key is appended if it
+	// does not exist, otherwise its position is kept.
+	Set(key string, val *Node)
+	// Delete removes the member of the given key, it reports whether the key existed.
+	Delete(key string) bool
+}
+
+type orderedObject struct {
 	keys []string
 	obj  map[string]*Node
 }
 
+func newOrderedObject() Object {
+	return &orderedObject{obj: make(map[string]*Node)}
+}
+
+func (o *orderedObject) Len() int {
+	return len(o.keys)
+}
+
+func (o *orderedObject) Keys() []string {
+	return o.keys
+}
+
+func (o *orderedObject) Get(key string) (*Node, bool) {
+	v, ok := o.obj[key]
+	return v, ok
+}
+
+func (o *orderedObject) Set(key string, val *Node) {
+	if _, ok := o.obj[key]; !ok {
+		o.keys = append(o.keys, key)
+	}
+	o.obj[key] = val
+}
+
+func (o *orderedObject) Delete(key string) bool {
+	if _, ok := o.obj[key]; !ok {
+		return false
+	}
+
+	for i, k := range o.keys {
+		if k == key {
+			o.keys = append(o.keys[0:i], o.keys[i+1:]...)
+			break
+		}
+	}
+	delete(o.obj, key)
+	return true
+}
+
+type partialDoc struct {
+	obj                   Object
+	newObject             func() Object
+	disallowDuplicateKeys bool
+	depth                 int
+}
+
 type partialArray []*Node
 
 func (d *partialDoc) MarshalJSON() ([]byte, error) {
@@ -284,7 +1503,7 @@ func (d *partialDoc) MarshalJSON() ([]byte, error) {
 	if _, err := buf.WriteString("{"); err != nil {
 		return nil, err
 	}
-	for i, k := range d.keys {
+	for i, k := range d.obj.Keys() {
 		if i > 0 {
 			if _, err := buf.WriteString(","); err != nil {
 				return nil, err
@@ -300,7 +1519,8 @@ func (d *partialDoc) MarshalJSON() ([]byte, error) {
 		if _, err := buf.WriteString(":"); err != nil {
 			return nil, err
 		}
-		value, err := json.Marshal(d.obj[k])
+		v, _ := d.obj.Get(k)
+		value, err := json.Marshal(v)
 		if err != nil {
 			return nil, err
 		}
@@ -315,9 +1535,12 @@ func (d *partialDoc) MarshalJSON() ([]byte, error) {
 }
 
 func (d *partialDoc) UnmarshalJSON(data []byte) error {
-	if err := json.Unmarshal(data, &d.obj); err != nil {
-		return err
+	if d.newObject == nil {
+		d.obj = newOrderedObject()
+	} else {
+		d.obj = d.newObject()
 	}
+
 	buffer := bytes.NewBuffer(data)
 	de := json.NewDecoder(buffer)
 	if t, err := de.Token(); err != nil {
@@ -326,6 +1549,10 @@ func (d *partialDoc) UnmarshalJSON(data []byte) error {
 		return fmt.Errorf("unexpected JSON token %v in document node", t)
 	}
 
+	var seen map[string]struct{}
+	if d.disallowDuplicateKeys {
+		seen = make(map[string]struct{})
+	}
 	for de.More() {
 		k, err := de.Token()
 		if err != nil {
@@ -335,26 +1562,36 @@ func (d *partialDoc) UnmarshalJSON(data []byte) error {
 		if !ok {
 			return fmt.Errorf("unexpected JSON token %v as document node key", k)
 		}
-		if err := skipValue(de); err != nil {
+		if seen != nil {
+			if _, ok := seen[key]; ok {
+				return fmt.Errorf("duplicate key %q in document node, %w", key, ErrInvalid)
+			}
+			seen[key] = struct{}{}
+		}
+		var raw json.RawMessage
+		if err := de.Decode(&raw); err != nil {
 			return err
 		}
-		d.keys = append(d.keys, key)
+		var val *Node
+		if !isNull(raw) {
+			val = &Node{raw: &raw, newObject: d.newObject, disallowDuplicateKeys: d.disallowDuplicateKeys,
+				depth: d.depth + 1}
+		}
+		d.obj.Set(key, val)
 	}
 	return nil
 }
 
 func (d *partialDoc) set(key string, val *Node, options *Options) error {
-	found := false
-	for _, k := range d.keys {
-		if k == key {
-			found = true
-			break
+	if options != nil && options.KeyNormalize != nil {
+		key = options.KeyNormalize(key)
+		for _, k := range d.obj.Keys() {
+			if k != key && options.KeyNormalize(k) == key {
+				d.obj.Delete(k)
+			}
 		}
 	}
-	if !found {
-		d.keys = append(d.keys, key)
-	}
-	d.obj[key] = val
+	d.obj.Set(key, val)
 	return nil
 }
 
@@ -363,9 +1600,13 @@ func (d *partialDoc) add(key string, val *Node, options *Options) error {
 }
 
 func (d *partialDoc) get(key string, options *Options) (*Node, error) {
-	v, ok := d.obj[key]
+	key, err := d.lookupKey(key, options)
+	if err != nil {
+		return nil, err
+	}
+	v, ok := d.obj.Get(key)
 	if !ok {
-		return nil, fmt.Errorf("unable to get nonexistent key %q, %v", key, ErrMissing)
+		return nil, fmt.Errorf("unable to get nonexistent key %q, %w", key, ErrMissing)
 	}
 	if v == nil {
 		v = NewNode(nil)
@@ -373,39 +1614,58 @@ func (d *partialDoc) get(key string, options *Options) (*Node, error) {
 	return v, nil
 }
 
-func (d *partialDoc) remove(key string, options *Options) error {
-	_, ok := d.obj[key]
-	if !ok {
-		if options.AllowMissingPathOnRemove {
-			return nil
+// lookupKey returns the key of the member that the key refers to, see KeyNormalize.
+func (d *partialDoc) lookupKey(key string, options *Options) (string, error) {
+	if options == nil || options.KeyNormalize == nil {
+		return key, nil
+	}
+
+	key = options.KeyNormalize(key)
+	if _, ok := d.obj.Get(key); ok {
+		return key, nil
+	}
+	found := ""
+	for _, k := range d.obj.Keys() {
+		if options.KeyNormalize(k) != key {
+			continue
 		}
-		return fmt.Errorf("unable to remove nonexistent key %q, %v", key, ErrMissing)
+		if found != "" {
+			return "", fmt.Errorf("keys %q and %q both normalize to %q, %w", found, k, key, ErrConflict)
+		}
+		found = k
+	}
+	if found == "" {
+		return key, nil
 	}
+	return found, nil
+}
 
-	idx := -1
-	for i, k := range d.keys {
-		if k == key {
-			idx = i
-			break
+func (d *partialDoc) remove(key string, options *Options) error {
+	key, err := d.lookupKey(key, options)
+	if err != nil {
+		return err
+	}
+	if !d.obj.Delete(key) {
+		if options.AllowMissingPathOnRemove {
+			return nil
 		}
+		return fmt.Errorf("unable to remove nonexistent key %q, %w", key, ErrMissing)
 	}
-	d.keys = append(d.keys[0:idx], d.keys[idx+1:]...)
-	delete(d.obj, key)
 	return nil
 }
 
 // set should only be used to implement the "replace" operation, so "key" must
 // be an already existing index in "d".
 func (d *partialArray) set(key string, val *Node, options *Options) error {
-	idx, err := strconv.Atoi(key)
+	idx, err := options.arrayIndex(key)
 	if err != nil {
-		return err
+		return fmt.Errorf("value was not a proper array index %s, %w", key, err)
 	}
 
 	sz := len(*d)
 	if idx < 0 {
 		if !options.SupportNegativeIndices || idx < -sz {
-			return fmt.Errorf("unable to access invalid index %s, %v", key, ErrInvalidIndex)
+			return fmt.Errorf("unable to access invalid index %s, %w", key, ErrInvalidIndex)
 		}
 		idx += sz
 	}
@@ -420,23 +1680,28 @@ func (d *partialArray) add(key string, val *Node, options *Options) error {
 		return nil
 	}
 
-	idx, err := strconv.Atoi(key)
+	idx, err := options.arrayIndex(key)
 	if err != nil {
-		return fmt.Errorf("value was not a proper array index %s, %v", key, err)
+		return fmt.Errorf("value was not a proper array index %s, %w", key, err)
 	}
 
 	sz := len(*d) + 1
 	if idx >= sz {
-		return fmt.Errorf("unable to access invalid index %s, %v", key, ErrInvalidIndex)
+		return fmt.Errorf("unable to access invalid index %s, %w", key, ErrInvalidIndex)
 	}
 
 	if idx < 0 {
 		if !options.SupportNegativeIndices || idx < -sz {
-			return fmt.Errorf("unable to access invalid index %s, %v", key, ErrInvalidIndex)
+			return fmt.Errorf("unable to access invalid index %s, %w", key, ErrInvalidIndex)
 		}
 		idx += sz
 	}
 
+	if idx == sz-1 {
+		*d = append(*d, val)
+		return nil
+	}
+
 	cur := *d
 	ary := make([]*Node, sz)
 	copy(ary[0:idx], cur[0:idx])
@@ -448,21 +1713,21 @@ func (d *partialArray) add(key string, val *Node, options *Options) error {
 }
 
 func (d *partialArray) get(key string, options *Options) (*Node, error) {
-	idx, err := strconv.Atoi(key)
+	idx, err := options.arrayIndex(key)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("value was not a proper array index %s, %w", key, err)
 	}
 
 	sz := len(*d)
 	if idx < 0 {
 		if !options.SupportNegativeIndices || idx < -sz {
-			return nil, fmt.Errorf("unable to access invalid index %s, %v", key, ErrInvalidIndex)
+			return nil, fmt.Errorf("unable to access invalid index %s, %w", key, ErrInvalidIndex)
 		}
 		idx += sz
 	}
 
 	if idx >= sz {
-		return nil, fmt.Errorf("unable to access invalid index %s, %v", key, ErrInvalidIndex)
+		return nil, fmt.Errorf("unable to access invalid index %s, %w", key, ErrInvalidIndex)
 	}
 	v := (*d)[idx]
 	if v == nil {
@@ -472,9 +1737,9 @@ func (d *partialArray) get(key string, options *Options) (*Node, error) {
 }
 
 func (d *partialArray) remove(key string, options *Options) error {
-	idx, err := strconv.Atoi(key)
+	idx, err := options.arrayIndex(key)
 	if err != nil {
-		return err
+		return fmt.Errorf("value was not a proper array index %s, %w", key, err)
 	}
 
 	sz := len(*d)
@@ -482,18 +1747,18 @@ func (d *partialArray) remove(key string, options *Options) error {
 		if options.AllowMissingPathOnRemove {
 			return nil
 		}
-		return fmt.Errorf("unable to access invalid index %s, %v", key, ErrInvalidIndex)
+		return fmt.Errorf("unable to access invalid index %s, %w", key, ErrInvalidIndex)
 	}
 
 	if idx < 0 {
 		if !options.SupportNegativeIndices {
-			return fmt.Errorf("unable to access invalid index %s, %v", key, ErrInvalidIndex)
+			return fmt.Errorf("unable to access invalid index %s, %w", key, ErrInvalidIndex)
 		}
 		if idx < -sz {
 			if options.AllowMissingPathOnRemove {
 				return nil
 			}
-			return fmt.Errorf("unable to access invalid index %s, %v", key, ErrInvalidIndex)
+			return fmt.Errorf("unable to access invalid index %s, %w", key, ErrInvalidIndex)
 		}
 		idx += sz
 	}
@@ -522,17 +1787,30 @@ func (n *Node) intoContainer() (container, error) {
 		return nil, ErrInvalid
 	}
 
-	switch checkWhich(*n.raw) {
+	which := checkWhich(*n.raw)
+	if which != eOther && n.depth >= maxNestingDepth {
+		return nil, fmt.Errorf("exceeded max nesting depth %d, %w", maxNestingDepth, ErrInvalid)
+	}
+	switch which {
 	case eDoc:
-		if err := json.Unmarshal(*n.raw, &n.doc); err != nil {
+		doc := &partialDoc{newObject: n.newObject, disallowDuplicateKeys: n.disallowDuplicateKeys, depth: n.depth}
+		if err := json.Unmarshal(*n.raw, doc); err != nil {
 			return nil, err
 		}
+		n.doc = doc
 		n.which = eDoc
 		return n.doc, nil
 	case eAry:
 		if err := json.Unmarshal(*n.raw, &n.ary); err != nil {
 			return nil, err
 		}
+		for _, v := range n.ary {
+			if v != nil {
+				v.newObject = n.newObject
+				v.disallowDuplicateKeys = n.disallowDuplicateKeys
+				v.depth = n.depth + 1
+			}
+		}
 		n.which = eAry
 		return &n.ary, nil
 	}
@@ -546,8 +1824,41 @@ func (n *Node) isNull() bool {
 	return isNull(*n.raw)
 }
 
+// MaybeEqual is a fast pre-check of Equal. It reports false only if the two nodes
+// are certainly not equal, by comparing the length and a cheap hash of their
+// raw encoded JSON without allocation. Since the last member of a repeated key wins,
+// the nodes with different hashes are still maybe equal if an object repeats a key.
+// Nodes that have been parsed are not checked and reported as maybe equal.
+func (n *Node) MaybeEqual(o *Node) bool {
+	if n.isNull() || o.isNull() {
+		return n.isNull() == o.isNull()
+	}
+
+	if (n.which != eRaw && n.which != eOther) || (o.which != eRaw && o.which != eOther) {
+		return true
+	}
+
+	if len(*n.raw) == len(*o.raw) && bytes.Equal(*n.raw, *o.raw) {
+		return true
+	}
+
+	nh, nok := rawHash(*n.raw, false)
+	oh, ook := rawHash(*o.raw, false)
+	if !nok || !ook || nh == oh {
+		return true
+	}
+	return hasRepeatedKeys(*n.raw) || hasRepeatedKeys(*o.raw)
+}
+
 // Equal indicates if two JSON Nodes have the same structural equality.
 func (n *Node) Equal(o *Node) bool {
+	if !n.MaybeEqual(o) {
+		return false
+	}
+	return n.equal(o)
+}
+
+func (n *Node) equal(o *Node) bool {
 	if n.isNull() {
 		return o.isNull()
 	}
@@ -571,12 +1882,13 @@ func (n *Node) Equal(o *Node) bool {
 	}
 
 	if n.which == eDoc {
-		if len(n.doc.obj) != len(o.doc.obj) {
+		if n.doc.obj.Len() != o.doc.obj.Len() {
 			return false
 		}
 
-		for k, v := range n.doc.obj {
-			if ov, ok := o.doc.obj[k]; !ok || !v.Equal(ov) {
+		for _, k := range n.doc.obj.Keys() {
+			v, _ := n.doc.obj.Get(k)
+			if ov, ok := o.doc.obj.Get(k); !ok || !v.equal(ov) {
 				return false
 			}
 		}
@@ -589,11 +1901,173 @@ func (n *Node) Equal(o *Node) bool {
 	}
 
 	for idx, val := range n.ary {
-		if !val.Equal(o.ary[idx]) {
+		if !val.equal(o.ary[idx]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Diff1 compares two JSON Nodes like Equal, and returns the JSON Pointer of the first location
+// where they differ, walking the members of objects in order and the elements of arrays by
+// index, with an early return. A member or element missing in either node differs at its path,
+// values of different types differ at the path of the values.
+// It returns true and an empty path if the nodes are equal.
+func (n *Node) Diff1(o *Node) (string, bool) {
+	return n.diff1(o, "")
+}
+
+func (n *Node) diff1(o *Node, path string) (string, bool) {
+	nn, on := n.isNullValue(), o.isNullValue()
+	if nn || on {
+		if nn == on {
+			return "", true
+		}
+		return path, false
+	}
+
+	n.intoContainer()
+	o.intoContainer()
+	if n.which != o.which {
+		return path, false
+	}
+
+	switch n.which {
+	case eDoc:
+		for _, k := range n.doc.obj.Keys() {
+			v, _ := n.doc.obj.Get(k)
+			ov, ok := o.doc.obj.Get(k)
+			if !ok {
+				return path + "/" + encodePatchKey(k), false
+			}
+			if p, equal := v.diff1(ov, path+"/"+encodePatchKey(k)); !equal {
+				return p, false
+			}
+		}
+		if n.doc.obj.Len() != o.doc.obj.Len() {
+			for _, k := range o.doc.obj.Keys() {
+				if _, ok := n.doc.obj.Get(k); !ok {
+					return path + "/" + encodePatchKey(k), false
+				}
+			}
+		}
+	case eAry:
+		for i, v := range n.ary {
+			if i >= len(o.ary) {
+				return path + "/" + strconv.Itoa(i), false
+			}
+			if p, equal := v.diff1(o.ary[i], path+"/"+strconv.Itoa(i)); !equal {
+				return p, false
+			}
+		}
+		if len(n.ary) < len(o.ary) {
+			return path + "/" + strconv.Itoa(len(n.ary)), false
+		}
+	default:
+		if !bytes.Equal(*n.raw, *o.raw) {
+			return path, false
+		}
+	}
+	return "", true
+}
+
+// isNullValue is like isNull, but reports false for parsed containers without raw document.
+func (n *Node) isNullValue() bool {
+	if n != nil && (n.which == eDoc || n.which == eAry) {
+		return false
+	}
+	return n.isNull()
+}
+
+// EqualWithRules is like Equal, but compares the arrays at the given paths as multisets,
+// ignoring the order of their elements, and everything else strictly. A "*" token in the
+// paths matches any member or element, e.g. "/users/*/roles".
+func (n *Node) EqualWithRules(o *Node, unorderedArrayPaths []string) bool {
+	return n.equalWithRules(o, "", unorderedArrayPaths)
+}
+
+func (n *Node) equalWithRules(o *Node, path string, rules []string) bool {
+	below := false
+	for _, rule := range rules {
+		if matchPointer(path, rule, true) {
+			below = true
+			break
+		}
+	}
+	if !below {
+		return n.Equal(o)
+	}
+
+	if n.isNull() || o.isNull() {
+		return n.isNull() && o.isNull()
+	}
+	n.intoContainer()
+	o.intoContainer()
+	if n.which != o.which || n.which == eOther {
+		return n.equal(o)
+	}
+
+	if n.which == eDoc {
+		if n.doc.obj.Len() != o.doc.obj.Len() {
 			return false
 		}
+		for _, k := range n.doc.obj.Keys() {
+			v, _ := n.doc.obj.Get(k)
+			if ov, ok := o.doc.obj.Get(k); !ok || !v.equalWithRules(ov, path+"/"+encodePatchKey(k), rules) {
+				return false
+			}
+		}
+		return true
+	}
+
+	if len(n.ary) != len(o.ary) {
+		return false
+	}
+
+	unordered := false
+	for _, rule := range rules {
+		if matchPointer(path, rule, false) {
+			unordered = true
+			break
+		}
+	}
+
+	matched := make([]bool, len(o.ary))
+Elements:
+	for idx, val := range n.ary {
+		elemPath := path + "/" + strconv.Itoa(idx)
+		if !unordered {
+			if !val.equalWithRules(o.ary[idx], elemPath, rules) {
+				return false
+			}
+			continue
+		}
+		for j, ov := range o.ary {
+			if !matched[j] && val.equalWithRules(ov, elemPath, rules) {
+				matched[j] = true
+				continue Elements
+			}
+		}
+		return false
 	}
+	return true
+}
 
+// matchPointer reports whether path matches the pattern token by token, where a "*" token
+// in the pattern matches any token. If prefix is true, it also reports whether the pattern
+// matches a descendant of path.
+func matchPointer(path, pattern string, prefix bool) bool {
+	tp := strings.Split(path, "/")
+	tr := strings.Split(pattern, "/")
+	if len(tr) < len(tp) || !prefix && len(tr) != len(tp) {
+		return false
+	}
+	for i, token := range tp {
+		if tr[i] != "*" && tr[i] != token {
+			return false
+		}
+	}
 	return true
 }
 
@@ -604,120 +2078,241 @@ func (p Patch) add(doc *container, op Operation, options *Options) error {
 		}
 	}
 
-	con, key := findObject(doc, op.Path, options)
+	con, key, err := resolveObject(doc, op.Path, options)
 	if con == nil {
-		return fmt.Errorf("add operation does not apply for %q, %v", op.Path, ErrMissing)
+		return fmt.Errorf("add operation does not apply for %q, %w", op.Path, err)
 	}
 
-	if err := con.add(key, NewNode(op.Value), options); err != nil {
-		return fmt.Errorf("add operation does not apply for %q, %v", op.Path, err)
+	val := newValueNode(op.Value, options)
+	if err := options.checkStringLen(val); err != nil {
+		return fmt.Errorf("add operation does not apply for %q, %w", op.Path, err)
 	}
 
+	sz := containerLen(con)
+	if err := con.add(key, val, options); err != nil {
+		return fmt.Errorf("add operation does not apply for %q, %w", op.Path, err)
+	}
+
+	options.shiftArray(con, op.Path, key, sz)
 	return nil
 }
 
 func (p Patch) remove(doc *container, op Operation, options *Options) error {
-	con, key := findObject(doc, op.Path, options)
+	con, key, err := resolveObject(doc, op.Path, options)
 	if con == nil {
 		if options.AllowMissingPathOnRemove {
 			return nil
 		}
-		return fmt.Errorf("remove operation does not apply for %q, %v", op.Path, ErrMissing)
+		return fmt.Errorf("remove operation does not apply for %q, %w", op.Path, err)
+	}
+
+	sz := containerLen(con)
+	if err := con.remove(key, options); err != nil {
+		return fmt.Errorf("remove operation does not apply for %q, %w", op.Path, err)
+	}
+
+	options.shiftArray(con, op.Path, key, sz)
+	return nil
+}
+
+func (p Patch) replace(doc *container, op Operation, options *Options) error {
+	if op.Path == "" {
+		val := newValueNode(op.Value, options)
+		val.intoContainer()
+
+		switch val.which {
+		case eAry:
+			*doc = &val.ary
+		case eDoc:
+			*doc = val.doc
+		case eOther:
+			return errors.New("replace operation hit impossible case")
+		}
+
+		return nil
+	}
+
+	con, key, err := resolveObject(doc, op.Path, options)
+	if con == nil {
+		return fmt.Errorf("replace operation does not apply for %q, %w", op.Path, err)
+	}
+
+	_, ok := con.get(key, options)
+	if ok != nil {
+		return fmt.Errorf("replace operation does not apply for %q, %w", op.Path, ErrMissing)
+	}
+
+	val := newValueNode(op.Value, options)
+	if err := options.checkStringLen(val); err != nil {
+		return fmt.Errorf("replace operation does not apply for %q, %w", op.Path, err)
+	}
+
+	if err := con.set(key, val, options); err != nil {
+		return fmt.Errorf("replace operation does not apply for %q, %w", op.Path, err)
+	}
+	return nil
+}
+
+func (p Patch) cas(doc *container, op Operation, options *Options) error {
+	con, key, err := resolveObject(doc, op.Path, options)
+	if con == nil {
+		return fmt.Errorf("cas operation does not apply for %q, %w", op.Path, err)
+	}
+
+	val, err := con.get(key, options)
+	if err != nil {
+		return fmt.Errorf("cas operation does not apply for %q, %w", op.Path, err)
+	}
+
+	if !val.Equal(NewNode(op.Expected)) {
+		return fmt.Errorf("cas operation for path %q failed, expected %q, got %q",
+			op.Path, options.errorValue(NewNode(op.Expected)), options.errorValue(val))
+	}
+
+	val = newValueNode(op.Value, options)
+	if err := options.checkStringLen(val); err != nil {
+		return fmt.Errorf("cas operation does not apply for %q, %w", op.Path, err)
+	}
+
+	if err := con.set(key, val, options); err != nil {
+		return fmt.Errorf("cas operation does not apply for %q, %w", op.Path, err)
+	}
+	return nil
+}
+
+// removeEach expands the "*" token of the path to every member or element of the matched
+// container and removes the rest of the path from each of them, skipping the unresolvable ones.
+func (p Patch) removeEach(doc *container, op Operation, options *Options) error {
+	prefix, suffix, ok := splitWildcard(op.Path)
+	if !ok {
+		return fmt.Errorf("remove_each operation does not apply for %q, need exactly one \"*\" token, %w",
+			op.Path, ErrInvalid)
+	}
+
+	con := *doc
+	if prefix != "" {
+		parent, key, err := resolveObject(doc, prefix, options)
+		if parent == nil {
+			return fmt.Errorf("remove_each operation does not apply for %q, %w", op.Path, err)
+		}
+		val, err := parent.get(key, options)
+		if err != nil {
+			return fmt.Errorf("remove_each operation does not apply for %q, %w", op.Path, err)
+		}
+		if con, _ = val.intoContainer(); con == nil {
+			return fmt.Errorf("remove_each operation does not apply for %q, %w", op.Path, ErrInvalid)
+		}
+	}
+
+	// gather the matches before removing any, array elements from the end so that
+	// removing an element does not shift the indexes of the remaining ones.
+	var keys []string
+	switch c := con.(type) {
+	case *partialDoc:
+		for _, k := range c.obj.Keys() {
+			keys = append(keys, encodePatchKey(k))
+		}
+	case *partialArray:
+		for i := len(*c) - 1; i >= 0; i-- {
+			keys = append(keys, strconv.Itoa(i))
+		}
 	}
 
-	if err := con.remove(key, options); err != nil {
-		return fmt.Errorf("remove operation does not apply for %q, %v", op.Path, err)
+	for _, key := range keys {
+		path := prefix + "/" + key + suffix
+		if resolveTarget(*doc, path, options) != nil {
+			continue
+		}
+		if err := p.remove(doc, Operation{Op: "remove", Path: path}, options); err != nil {
+			return fmt.Errorf("remove_each operation does not apply for %q, %w", op.Path, err)
+		}
 	}
 	return nil
 }
 
-func (p Patch) replace(doc *container, op Operation, options *Options) error {
-	if op.Path == "" {
-		val := NewNode(op.Value)
-		val.intoContainer()
-
-		switch val.which {
-		case eAry:
-			*doc = &val.ary
-		case eDoc:
-			*doc = val.doc
-		case eOther:
-			return errors.New("replace operation hit impossible case")
+// splitWildcard splits the path around its only "*" token,
+// it reports false if the path has no or more than one "*" token.
+func splitWildcard(path string) (prefix, suffix string, ok bool) {
+	parts := strings.Split(path, "/")
+	at := -1
+	for i, part := range parts[1:] {
+		if part == "*" {
+			if at >= 0 {
+				return "", "", false
+			}
+			at = i + 1
 		}
-
-		return nil
-	}
-
-	con, key := findObject(doc, op.Path, options)
-	if con == nil {
-		return fmt.Errorf("replace operation does not apply for %q, %v", op.Path, ErrMissing)
 	}
-
-	_, ok := con.get(key, options)
-	if ok != nil {
-		return fmt.Errorf("replace operation does not apply for %q, %v", op.Path, ErrMissing)
+	if at < 0 {
+		return "", "", false
 	}
 
-	if err := con.set(key, NewNode(op.Value), options); err != nil {
-		return fmt.Errorf("replace operation does not apply for %q, %v", op.Path, err)
+	prefix = strings.Join(parts[:at], "/")
+	if at+1 < len(parts) {
+		suffix = "/" + strings.Join(parts[at+1:], "/")
 	}
-	return nil
+	return prefix, suffix, true
 }
 
 func (p Patch) move(doc *container, op Operation, options *Options) error {
-	con, key := findObject(doc, op.From, options)
+	con, key, err := resolveObject(doc, op.From, options)
 	if con == nil {
-		return fmt.Errorf("move operation does not apply for from %q, %v", op.From, ErrMissing)
+		return fmt.Errorf("move operation does not apply for from %q, %w", op.From, err)
 	}
 
 	val, err := con.get(key, options)
 	if err != nil {
-		return fmt.Errorf("move operation does not apply for from %q, %v", op.From, err)
+		return fmt.Errorf("move operation does not apply for from %q, %w", op.From, err)
 	}
 
+	sz := containerLen(con)
 	if err = con.remove(key, options); err != nil {
-		return fmt.Errorf("move operation does not apply for from %q, %v", op.From, err)
+		return fmt.Errorf("move operation does not apply for from %q, %w", op.From, err)
 	}
+	shiftIndexes(con, op.From, key, sz, options.OnArrayShift)
+	from, fromKey, fromSz := con, key, sz
 
-	con, key = findObject(doc, op.Path, options)
+	con, key, err = resolveObject(doc, op.Path, options)
 	if con == nil {
-		return fmt.Errorf("move operation does not apply for path %q, %v", op.Path, ErrMissing)
+		return fmt.Errorf("move operation does not apply for path %q, %w", op.Path, err)
 	}
 
+	sz = containerLen(con)
 	if err = con.add(key, val, options); err != nil {
-		return fmt.Errorf("move operation does not apply for path %q, %v", op.Path, err)
+		return fmt.Errorf("move operation does not apply for path %q, %w", op.Path, err)
+	}
+
+	shiftIndexes(con, op.Path, key, sz, options.OnArrayShift)
+	if con == from {
+		options.moveIndex(con, op.Path, fromKey, fromSz, val)
+	} else {
+		shiftIndexes(from, op.From, fromKey, fromSz, options.OnIndexChange)
+		shiftIndexes(con, op.Path, key, sz, options.OnIndexChange)
 	}
 	return nil
 }
 
 func (p Patch) test(doc *container, op Operation, options *Options) error {
 	if op.Path == "" {
-		var self Node
-
-		switch sv := (*doc).(type) {
-		case *partialDoc:
-			self.doc = sv
-			self.which = eDoc
-		case *partialArray:
-			self.ary = *sv
-			self.which = eAry
+		raw, err := json.Marshal(*doc)
+		if err != nil {
+			return fmt.Errorf("test operation for path %q failed, %w", op.Path, err)
 		}
-
-		if self.Equal(NewNode(op.Value)) {
+		if NewNode(raw).Equal(NewNode(op.Value)) {
 			return nil
 		}
 
 		return fmt.Errorf("test operation for path %q failed, not equal", op.Path)
 	}
 
-	con, key := findObject(doc, op.Path, options)
+	con, key, err := resolveObject(doc, op.Path, options)
 	if con == nil {
-		return fmt.Errorf("test operation for path %q failed, %v", op.Path, ErrMissing)
+		return fmt.Errorf("test operation for path %q failed, %w", op.Path, err)
 	}
 
 	val, err := con.get(key, options)
-	if err != nil && !strings.Contains(err.Error(), ErrMissing.Error()) {
-		return fmt.Errorf("test operation for path %q failed, %v", op.Path, err)
+	if err != nil && (options.StrictRFC6902 || !errors.Is(err, ErrMissing)) {
+		return fmt.Errorf("test operation for path %q failed, %w", op.Path, err)
 	}
 
 	if val == nil || val.isNull() {
@@ -725,11 +2320,11 @@ func (p Patch) test(doc *container, op Operation, options *Options) error {
 			return nil
 		}
 		return fmt.Errorf("test operation for path %q failed, expected %q, got nil",
-			op.Path, NewNode(op.Value).String())
+			op.Path, options.errorValue(NewNode(op.Value)))
 
 	} else if op.Value == nil {
 		return fmt.Errorf("test operation for path %q failed, expected nil, got %q",
-			op.Path, val.String())
+			op.Path, options.errorValue(val))
 	}
 
 	if val.Equal(NewNode(op.Value)) {
@@ -737,68 +2332,456 @@ func (p Patch) test(doc *container, op Operation, options *Options) error {
 	}
 
 	return fmt.Errorf("test operation for path %q failed, expected %q, got %q",
-		op.Path, NewNode(op.Value).String(), val.String())
+		op.Path, options.errorValue(NewNode(op.Value)), options.errorValue(val))
 }
 
 func (p Patch) copy(doc *container, op Operation, accumulatedCopySize *int64, options *Options) error {
-	con, key := findObject(doc, op.From, options)
+	con, key, err := resolveObject(doc, op.From, options)
 
 	if con == nil {
-		return fmt.Errorf("copy operation does not apply for from path %q, %v", op.From, ErrMissing)
+		return fmt.Errorf("copy operation does not apply for from path %q, %w", op.From, err)
 	}
 
 	val, err := con.get(key, options)
 	if err != nil {
-		return fmt.Errorf("copy operation does not apply for from path %q, %v", op.From, err)
+		return fmt.Errorf("copy operation does not apply for from path %q, %w", op.From, err)
 	}
 
-	con, key = findObject(doc, op.Path, options)
+	con, key, err = resolveObject(doc, op.Path, options)
 	if con == nil {
-		return fmt.Errorf("copy operation does not apply for path %q, %v", op.Path, ErrMissing)
+		return fmt.Errorf("copy operation does not apply for path %q, %w", op.Path, err)
+	}
+
+	if err := options.checkStringLen(val); err != nil {
+		return fmt.Errorf("copy operation does not apply for path %q, %w", op.Path, err)
 	}
 
 	valCopy, sz, err := deepCopy(val)
 	if err != nil {
-		return fmt.Errorf("copy operation does not apply for path %q while performing deep copy, %v",
+		return fmt.Errorf("copy operation does not apply for path %q while performing deep copy, %w",
 			op.Path, err)
 	}
+	valCopy.newObject = options.NewObject
+	valCopy.disallowDuplicateKeys = options.DisallowDuplicateKeys
 
 	(*accumulatedCopySize) += int64(sz)
 	if options.AccumulatedCopySizeLimit > 0 && *accumulatedCopySize > options.AccumulatedCopySizeLimit {
 		return NewAccumulatedCopySizeError(options.AccumulatedCopySizeLimit, *accumulatedCopySize)
 	}
 
+	n := containerLen(con)
 	err = con.add(key, valCopy, options)
 	if err != nil {
-		return fmt.Errorf("copy operation does not apply for path %q while adding value during copy, %v",
+		return fmt.Errorf("copy operation does not apply for path %q while adding value during copy, %w",
 			op.Path, err)
 	}
 
+	options.shiftArray(con, op.Path, key, n)
+	return nil
+}
+
+// valueRef returns the pointer of a value that is an object with a sole "$ref" member
+// holding a string, see ResolveValueRefs.
+func valueRef(value json.RawMessage) (string, bool) {
+	if DocumentType(value) != TypeObject || !bytes.Contains(value, []byte(`"$ref"`)) {
+		return "", false
+	}
+
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(value, &obj); err != nil || len(obj) != 1 {
+		return "", false
+	}
+	var ref string
+	if err := json.Unmarshal(obj["$ref"], &ref); err != nil {
+		return "", false
+	}
+	return ref, true
+}
+
+// resolveValueRef returns the encoded value at the pointer ref in the document, its size counts
+// towards AccumulatedCopySizeLimit like a copied value.
+func resolveValueRef(doc container, ref string, accumulatedCopySize *int64, options *Options) (json.RawMessage, error) {
+	var v interface{} = doc
+	if ref != "" {
+		con, key, err := resolveObject(&doc, ref, options)
+		if con == nil {
+			return nil, err
+		}
+		if v, err = con.get(key, options); err != nil {
+			return nil, err
+		}
+	}
+
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	(*accumulatedCopySize) += int64(len(raw))
+	if options.AccumulatedCopySizeLimit > 0 && *accumulatedCopySize > options.AccumulatedCopySizeLimit {
+		return nil, NewAccumulatedCopySizeError(options.AccumulatedCopySizeLimit, *accumulatedCopySize)
+	}
+	return raw, nil
+}
+
+// containerLen returns the length of an array container, or -1 for an object container.
+func containerLen(con container) int {
+	if ary, ok := con.(*partialArray); ok {
+		return len(*ary)
+	}
+	return -1
+}
+
+// checkStringLen returns an error if the value is a string longer than MaxStringValueLen.
+func (o *Options) checkStringLen(val *Node) error {
+	if o.MaxStringValueLen <= 0 || val.raw == nil {
+		return nil
+	}
+
+	raw := bytes.TrimLeft(*val.raw, " \t\r\n")
+	if len(raw) == 0 || raw[0] != '"' {
+		return nil
+	}
+
+	var str string
+	if err := json.Unmarshal(raw, &str); err != nil {
+		return err
+	}
+	if n := utf8.RuneCountInString(str); n > o.MaxStringValueLen {
+		return fmt.Errorf("string value of %d characters exceeds the limit %d, %w", n, o.MaxStringValueLen, ErrInvalid)
+	}
 	return nil
 }
 
-func findObject(pd *container, path string, options *Options) (container, string) {
+// shiftArray calls OnArrayShift and OnIndexChange for the elements shifted by inserting or
+// removing the element at key in the array container at path of the operation, sz is the
+// length of the array before the operation.
+func (o *Options) shiftArray(con container, path, key string, sz int) {
+	shiftIndexes(con, path, key, sz, o.OnArrayShift)
+	shiftIndexes(con, path, key, sz, o.OnIndexChange)
+}
+
+// moveIndex calls OnIndexChange for the elements of the array container at path whose indexes
+// change by moving the element val from key within it, sz is the length of the array before
+// the operation.
+func (o *Options) moveIndex(con container, path, key string, sz int, val *Node) {
+	ary, ok := con.(*partialArray)
+	if !ok || o.OnIndexChange == nil {
+		return
+	}
+
+	from, err := strconv.Atoi(key)
+	if err != nil {
+		return
+	}
+	if from < 0 {
+		from += sz
+	}
+	to := -1
+	for i, v := range *ary {
+		if v == val {
+			to = i
+			break
+		}
+	}
+
+	arrayPath := parentPath(path)
+	switch {
+	case to < 0 || to == from:
+		return
+	case from < to:
+		for i := from + 1; i <= to; i++ {
+			o.OnIndexChange(arrayPath, i, i-1)
+		}
+	default:
+		for i := from - 1; i >= to; i-- {
+			o.OnIndexChange(arrayPath, i, i+1)
+		}
+	}
+	o.OnIndexChange(arrayPath, from, to)
+}
+
+// shiftIndexes calls fn for the elements shifted by inserting or removing the element at key
+// in the array container at path of the operation, sz is the length of the array before the
+// operation.
+func shiftIndexes(con container, path, key string, sz int, fn func(path string, fromIdx, toIdx int)) {
+	ary, ok := con.(*partialArray)
+	if !ok || fn == nil {
+		return
+	}
+
+	idx, err := strconv.Atoi(key)
+	if err != nil {
+		return
+	}
+
+	arrayPath := parentPath(path)
+	switch len(*ary) {
+	case sz + 1:
+		if idx < 0 {
+			idx += sz + 1
+		}
+		for i := sz - 1; i >= idx; i-- {
+			fn(arrayPath, i, i+1)
+		}
+	case sz - 1:
+		if idx < 0 {
+			idx += sz
+		}
+		for i := idx + 1; i < sz; i++ {
+			fn(arrayPath, i, i-1)
+		}
+	}
+}
+
+// findObject returns the container of the value at the pointer p in the document, and its key
+// in the container. If the container does not exist, it returns an error describing why,
+// including the pointer resolved so far and the token that failed. The root pointer has no
+// container.
+func findObject(pd *container, p Pointer, options *Options) (container, string, error) {
+	if len(p) == 0 {
+		return nil, "", fmt.Errorf("unable to resolve path %q, %w", p.String(), ErrMissing)
+	}
+
 	doc := *pd
+	for i, token := range p[:len(p)-1] {
+		next, err := doc.get(token, options)
+		if next == nil || err != nil {
+			return nil, "", fmt.Errorf("unable to resolve token %q at %q (%s), %w",
+				encodePatchKey(token), p[:i].String(), describeContainer(doc), ErrMissing)
+		}
+		if doc, err = next.intoContainer(); doc == nil {
+			if err != nil && err != ErrInvalid {
+				// the value is a container that does not parse, e.g. with DisallowDuplicateKeys.
+				return nil, "", fmt.Errorf("unable to resolve token %q at %q, %w",
+					encodePatchKey(p[i+1]), p[:i+1].String(), err)
+			}
+			return nil, "", fmt.Errorf("unable to resolve token %q at %q (%s), %w",
+				encodePatchKey(p[i+1]), p[:i+1].String(), describeValue(next), ErrMissing)
+		}
+	}
+	return doc, p[len(p)-1], nil
+}
 
-	split := strings.Split(path, "/")
+// resolveObject returns the container of the value at the path in the document, and its key
+// in the container, like findObject, with the path decoded as set by the options.
+func resolveObject(pd *container, path string, options *Options) (container, string, error) {
+	p, err := resolvePointer(*pd, path, options)
+	if err != nil {
+		return nil, "", err
+	}
+	return findObject(pd, p, options)
+}
+
+// resolvePointer returns the decoded tokens of the path in the document as set by the options,
+// with the filter and id tokens resolved. The root path has no container and does not resolve.
+func resolvePointer(doc container, path string, options *Options) (Pointer, error) {
+	split, err := splitPointer(path, options)
+	if err != nil {
+		return nil, err
+	}
 	if len(split) < 2 {
-		return nil, ""
+		return nil, fmt.Errorf("unable to resolve path %q, %w", path, ErrMissing)
+	}
+	if split, err = resolveTokens(doc, split, options); err != nil {
+		return nil, err
+	}
+
+	p := make(Pointer, len(split)-1)
+	for i, part := range split[1:] {
+		p[i] = options.unescape(part)
+	}
+	return p, nil
+}
+
+// resolveTokens replaces the filter and id tokens in the split path as set by the options,
+// see resolveFilters and resolveIDs.
+func resolveTokens(doc container, split []string, options *Options) ([]string, error) {
+	if options.AllowFilterPaths {
+		var ok bool
+		if split, ok = resolveFilters(doc, split, options); !ok {
+			return nil, fmt.Errorf("unable to resolve the filters, %w", ErrMissing)
+		}
+	}
+	if options.AllowIDPaths {
+		var ok bool
+		if split, ok = resolveIDs(doc, split, options); !ok {
+			return nil, fmt.Errorf("unable to resolve the ids, %w", ErrMissing)
+		}
+	}
+	return split, nil
+}
+
+// describeContainer describes the container for error messages, listing up to 10 keys of an object.
+func describeContainer(con container) string {
+	switch v := con.(type) {
+	case *partialDoc:
+		keys := v.obj.Keys()
+		if len(keys) > 10 {
+			return fmt.Sprintf("object has %d keys [%s,...]", len(keys), strings.Join(keys[:10], ","))
+		}
+		return fmt.Sprintf("object has keys [%s]", strings.Join(keys, ","))
+	case *partialArray:
+		return fmt.Sprintf("array has %d elements", len(*v))
+	default:
+		return "not a container"
+	}
+}
+
+// describeValue describes the value that is not a container for error messages.
+func describeValue(n *Node) string {
+	if n.isNull() {
+		return "value is null"
+	}
+	return "value is " + DocumentType(*n.raw).String()
+}
+
+// splitPointer splits the path into its tokens, which are percent-decoded if the
+// PercentDecodePointers option is set.
+func splitPointer(path string, options *Options) ([]string, error) {
+	split := strings.Split(path, "/")
+	if !options.PercentDecodePointers {
+		return split, nil
+	}
+
+	for i, part := range split {
+		token, err := url.PathUnescape(part)
+		if err != nil {
+			return nil, fmt.Errorf("unable to percent-decode path %q, %w", path, ErrInvalid)
+		}
+		split[i] = token
+	}
+	return split, nil
+}
+
+// resolveFilters replaces the filter tokens like "items[id=5]" in the split path with the
+// array name and the index of the first matching element, it reports false if a filter
+// token does not resolve.
+func resolveFilters(doc container, split []string, options *Options) ([]string, bool) {
+	if !strings.Contains(strings.Join(split, "/"), "]") {
+		return split, true
 	}
 
-	parts := split[1 : len(split)-1]
-	key := split[len(split)-1]
+	res := make([]string, 1, len(split)+1)
+	for _, part := range split[1:] {
+		if name, key, value, ok := parseFilter(part); ok {
+			if name != "" {
+				if doc = childContainer(doc, name, options); doc == nil {
+					return nil, false
+				}
+				res = append(res, name)
+			}
 
-	for _, part := range parts {
-		next, ok := doc.get(decodePatchKey(part), options)
-		if next == nil || ok != nil {
-			return nil, ""
+			ary, ok := doc.(*partialArray)
+			if !ok {
+				return nil, false
+			}
+			idx := -1
+			for i, elem := range *ary {
+				if elem == nil {
+					continue
+				}
+				if pd, _ := elem.intoContainer(); pd != nil {
+					if v, err := pd.get(key, options); err == nil && v.Equal(value) {
+						idx = i
+						break
+					}
+				}
+			}
+			if idx < 0 {
+				return nil, false
+			}
+			part = strconv.Itoa(idx)
 		}
-		doc, _ = next.intoContainer()
-		if doc == nil {
-			return nil, ""
+
+		res = append(res, part)
+		doc = childContainer(doc, part, options)
+	}
+	return res, true
+}
+
+// resolveIDs replaces the id tokens like "id:abc" of arrays in the split path with the index
+// of the element with the id, it reports false if an id token does not resolve.
+func resolveIDs(doc container, split []string, options *Options) ([]string, bool) {
+	if !strings.Contains(strings.Join(split, "/"), "id:") {
+		return split, true
+	}
+
+	idKey := options.IDPathKey
+	if idKey == "" {
+		idKey = "id"
+	}
+
+	res := make([]string, 1, len(split))
+	for _, part := range split[1:] {
+		if ary, ok := doc.(*partialArray); ok && strings.HasPrefix(part, "id:") {
+			id := options.unescape(part[3:])
+			raw, _ := json.Marshal(id)
+			ids := []*Node{NewNode(raw)}
+			if DocumentType([]byte(id)) == TypeNumber && json.Valid([]byte(id)) {
+				ids = append(ids, NewNode([]byte(id)))
+			}
+
+			idx := -1
+		elems:
+			for i, elem := range *ary {
+				if elem == nil {
+					continue
+				}
+				if pd, _ := elem.intoContainer(); pd != nil {
+					v, err := pd.get(idKey, options)
+					if err != nil {
+						continue
+					}
+					for _, n := range ids {
+						if v.Equal(n) {
+							idx = i
+							break elems
+						}
+					}
+				}
+			}
+			if idx < 0 {
+				return nil, false
+			}
+			part = strconv.Itoa(idx)
 		}
+
+		res = append(res, part)
+		doc = childContainer(doc, part, options)
+	}
+	return res, true
+}
+
+// parseFilter parses a filter token like "items[id=5]" into the encoded array name,
+// the decoded member key and the value to match.
+func parseFilter(part string) (name, key string, value *Node, ok bool) {
+	i := strings.LastIndex(part, "[")
+	if i < 0 || !strings.HasSuffix(part, "]") {
+		return "", "", nil, false
+	}
+	j := strings.Index(part[i:], "=")
+	if j < 0 {
+		return "", "", nil, false
 	}
-	return doc, decodePatchKey(key)
+
+	raw := []byte(part[i+j+1 : len(part)-1])
+	if !json.Valid(raw) {
+		raw, _ = json.Marshal(decodePatchKey(string(raw)))
+	}
+	return part[:i], decodePatchKey(part[i+1 : i+j]), NewNode(raw), true
+}
+
+// childContainer returns the container of the child at the encoded token, or nil.
+func childContainer(doc container, token string, options *Options) container {
+	if doc == nil {
+		return nil
+	}
+	next, err := doc.get(options.unescape(token), options)
+	if err != nil || next == nil {
+		return nil
+	}
+	con, _ := next.intoContainer()
+	return con
 }
 
 // Given a document and a path to a key, walk the path and create all missing elements
@@ -808,10 +2791,18 @@ func ensurePathExists(pd *container, path string, options *Options) error {
 	var arrIndex int
 
 	doc := *pd
-	split := strings.Split(path, "/")
+	split, err := splitPointer(path, options)
+	if err != nil {
+		return err
+	}
 	if len(split) < 2 {
 		return nil
 	}
+	// the filter and id tokens refer to existing elements, they are never created, and if
+	// they do not resolve the operation fails without any parent created.
+	if split, err = resolveTokens(doc, split, options); err != nil {
+		return nil
+	}
 
 	parts := split[1:]
 	for pi, part := range parts {
@@ -821,7 +2812,8 @@ func ensurePathExists(pd *container, path string, options *Options) error {
 			return nil
 		}
 
-		target, ok := doc.get(decodePatchKey(part), options)
+		key := options.unescape(part)
+		target, ok := doc.get(key, options)
 		if target == nil || ok != nil {
 			// If the current container is an array which has fewer elements than our target index,
 			// pad the current container with nulls.
@@ -831,6 +2823,9 @@ func ensurePathExists(pd *container, path string, options *Options) error {
 				if ok && arrIndex >= len(*pa)+1 {
 					// Pad the array with null values up to the required index.
 					for i := len(*pa); i <= arrIndex-1; i++ {
+						if err := options.ctxErrEvery(i); err != nil {
+							return err
+						}
 						doc.add(strconv.Itoa(i), NewNode(nil), options)
 					}
 				}
@@ -841,35 +2836,39 @@ func ensurePathExists(pd *container, path string, options *Options) error {
 			if arrIndex, err = strconv.Atoi(parts[pi+1]); err == nil || parts[pi+1] == "-" {
 				if arrIndex < 0 {
 					if !options.SupportNegativeIndices {
-						return fmt.Errorf("unable to ensure path for invalid index %d, %v",
+						return fmt.Errorf("unable to ensure path for invalid index %d, %w",
 							arrIndex, ErrInvalidIndex)
 					}
 
 					if arrIndex < -1 {
-						return fmt.Errorf("unable to ensure path for invalid index %d: %v",
+						return fmt.Errorf("unable to ensure path for invalid index %d: %w",
 							arrIndex, ErrInvalidIndex)
 					}
 
 					arrIndex = 0
 				}
 
-				node := NewNode(rawJSONArray)
-				doc.add(part, node, options)
+				node := newValueNode(rawJSONArray, options)
+				doc.add(key, node, options)
 				doc, _ = node.intoContainer()
 
 				// Pad the new array with null values up to the required index.
 				for i := 0; i < arrIndex; i++ {
+					if err := options.ctxErrEvery(i); err != nil {
+						return err
+					}
 					doc.add(strconv.Itoa(i), NewNode(nil), options)
 				}
 			} else {
-				node := NewNode(rawJSONObject)
-				doc.add(part, node, options)
+				node := newValueNode(rawJSONObject, options)
+				doc.add(key, node, options)
 				doc, _ = node.intoContainer()
 			}
 		} else {
 			doc, err = target.intoContainer()
 			if doc == nil {
-				return fmt.Errorf("unable to ensure path for invalid target %q, %v", target.String(), err)
+				return fmt.Errorf("unable to ensure path for invalid target %q, %w",
+					options.errorValue(target), err)
 			}
 		}
 	}
@@ -889,7 +2888,25 @@ func deepCopy(src *Node) (*Node, int, error) {
 	return NewNode(a), sz, nil
 }
 
-func skipValue(de *json.Decoder) error {
+// maxNestingDepth is the maximum nesting depth of the containers that are parsed, so that deeply
+// nested documents return an error instead of overflowing the stack when walked.
+const maxNestingDepth = 1000
+
+// CheckDuplicateKeys returns an error naming the first duplicate key, and the path of its
+// object, if any JSON object in the document has duplicate keys. Unlike the lazy parsing of
+// Options.DisallowDuplicateKeys, it checks the whole document.
+func CheckDuplicateKeys(doc []byte) error {
+	de := json.NewDecoder(bytes.NewReader(doc))
+	if err := checkDuplicateKeys(de, "", 0); err != nil {
+		return err
+	}
+	if _, err := de.Token(); err != io.EOF {
+		return fmt.Errorf("unexpected data after the JSON document, %w", ErrInvalid)
+	}
+	return nil
+}
+
+func checkDuplicateKeys(de *json.Decoder, path string, depth int) error {
 	t, err := de.Token()
 	if err != nil {
 		return err
@@ -897,14 +2914,25 @@ func skipValue(de *json.Decoder) error {
 	if t != startObject && t != startArray {
 		return nil
 	}
-	for de.More() {
+	if depth >= maxNestingDepth {
+		return fmt.Errorf("exceeded max nesting depth %d, %w", maxNestingDepth, ErrInvalid)
+	}
+	seen := make(map[string]struct{})
+	for i := 0; de.More(); i++ {
+		p := path + "/" + strconv.Itoa(i)
 		if t == startObject {
-			// consume key token
-			if _, err := de.Token(); err != nil {
+			k, err := de.Token()
+			if err != nil {
 				return err
 			}
+			key, _ := k.(string)
+			if _, ok := seen[key]; ok {
+				return fmt.Errorf("duplicate key %q in object at %q, %w", key, path, ErrInvalid)
+			}
+			seen[key] = struct{}{}
+			p = path + "/" + encodePatchKey(key)
 		}
-		if err := skipValue(de); err != nil {
+		if err := checkDuplicateKeys(de, p, depth+1); err != nil {
 			return err
 		}
 	}
@@ -921,23 +2949,186 @@ func skipValue(de *json.Decoder) error {
 }
 
 func checkWhich(buf []byte) int {
-Loop:
-	for _, c := range buf {
+	switch DocumentType(buf) {
+	case TypeArray:
+		return eAry
+	case TypeObject:
+		return eDoc
+	default:
+		return eOther
+	}
+}
+
+// the FNV-1a parameters of rawHash and hasRepeatedKeys.
+const (
+	offset64 = 14695981039346656037
+	prime64  = 1099511628211
+)
+
+// rawHash returns a hash of the tokens in the raw encoded JSON that does not depend on
+// whitespaces or the order of members, so equal documents without repeated keys have
+// the same hash.
+// It reports false if the hash is not reliable, as for strings with escape sequences.
+// If ordered is true, the hash depends on the order of the tokens, and strings with escape
+// sequences are hashed as written.
+func rawHash(data []byte, ordered bool) (uint64, bool) {
+	var sum uint64
+	for i := 0; i < len(data); {
+		c := data[i]
 		switch c {
-		case ' ':
-		case '\n':
-		case '\t':
+		case ' ', '\t', '\n', '\r':
+			i++
 			continue
-		case '[':
-			return eAry
-		case '{':
-			return eDoc
+		}
+
+		j := i + 1
+		switch c {
+		case '{', '}', '[', ']', ':', ',':
+		case '"':
+			for ; j < len(data) && data[j] != '"'; j++ {
+				if data[j] == '\\' {
+					if !ordered {
+						return 0, false
+					}
+					j++
+				}
+			}
+			j++
 		default:
-			break Loop
+		Scalar:
+			for ; j < len(data); j++ {
+				switch data[j] {
+				case ' ', '\t', '\n', '\r', '{', '}', '[', ']', ':', ',', '"':
+					break Scalar
+				}
+			}
+		}
+		if j > len(data) {
+			j = len(data)
+		}
+
+		h := uint64(offset64)
+		for _, b := range data[i:j] {
+			h ^= uint64(b)
+			h *= prime64
+		}
+		if ordered {
+			sum = (sum ^ h) * prime64
+		} else {
+			sum += h
+		}
+		i = j
+	}
+	return sum, true
+}
+
+// hasRepeatedKeys reports whether an object in the raw encoded JSON may repeat a key, keys
+// are compared by their hashes as written, so a collision reports a repeated key too.
+func hasRepeatedKeys(data []byte) bool {
+	// keys holds the key hashes of the open objects, starts the offsets of their keys.
+	var keys []uint64
+	var starts []int
+	for i := 0; i < len(data); i++ {
+		switch data[i] {
+		case '{':
+			starts = append(starts, len(keys))
+		case '}':
+			if len(starts) == 0 {
+				return false
+			}
+			start := starts[len(starts)-1]
+			starts = starts[:len(starts)-1]
+			if repeated(keys[start:]) {
+				return true
+			}
+			keys = keys[:start]
+		case '"':
+			h := uint64(offset64)
+			for i++; i < len(data) && data[i] != '"'; i++ {
+				if data[i] == '\\' {
+					h ^= uint64(data[i])
+					h *= prime64
+					i++
+					if i == len(data) {
+						break
+					}
+				}
+				h ^= uint64(data[i])
+				h *= prime64
+			}
+			j := i + 1
+			for j < len(data) && (data[j] == ' ' || data[j] == '\t' || data[j] == '\n' || data[j] == '\r') {
+				j++
+			}
+			if j < len(data) && data[j] == ':' && len(starts) > 0 {
+				keys = append(keys, h)
+			}
+		}
+	}
+	return false
+}
+
+// repeated reports whether the hashes repeat, small objects are checked without sorting.
+func repeated(hashes []uint64) bool {
+	if len(hashes) <= 16 {
+		for i := 1; i < len(hashes); i++ {
+			for _, h := range hashes[:i] {
+				if h == hashes[i] {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	sort.Slice(hashes, func(a, b int) bool { return hashes[a] < hashes[b] })
+	for i := 1; i < len(hashes); i++ {
+		if hashes[i] == hashes[i-1] {
+			return true
 		}
 	}
+	return false
+}
 
-	return eOther
+// normalizeNumbers returns the raw encoded JSON with the numbers that have a fraction
+// or an exponent re-encoded as encoding/json encodes a float64.
+func normalizeNumbers(data json.RawMessage) json.RawMessage {
+	if len(data) == 0 {
+		return data
+	}
+
+	res := make(json.RawMessage, 0, len(data))
+	inString, escaped := false, false
+	for i := 0; i < len(data); {
+		c := data[i]
+		switch {
+		case escaped:
+			escaped = false
+		case inString && c == '\\':
+			escaped = true
+		case c == '"':
+			inString = !inString
+		case !inString && (c == '-' || c >= '0' && c <= '9'):
+			j := i + 1
+			for j < len(data) && strings.IndexByte("0123456789.eE+-", data[j]) >= 0 {
+				j++
+			}
+			num := data[i:j]
+			if strings.ContainsAny(string(num), ".eE") {
+				if f, err := strconv.ParseFloat(string(num), 64); err == nil {
+					if b, err := json.Marshal(f); err == nil {
+						num = b
+					}
+				}
+			}
+			res = append(res, num...)
+			i = j
+			continue
+		}
+		res = append(res, c)
+		i++
+	}
+	return res
 }
 
 func isNull(data json.RawMessage) bool {
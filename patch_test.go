@@ -39,12 +39,15 @@ package jsonpatch
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"reflect"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -998,6 +1001,51 @@ func TestEquality(t *testing.T) {
 	}
 }
 
+func TestDiff1(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, tc := range EqualityCases {
+		path, equal := NewNode([]byte(tc.a)).Diff1(NewNode([]byte(tc.b)))
+		assert.Equalf(tc.equal, equal, tc.name)
+		if equal {
+			assert.Equalf("", path, tc.name)
+		}
+	}
+
+	cases := []struct {
+		a, b, path string
+	}{
+		{`1`, `2`, ``},
+		{`{"a": 1}`, `[1]`, ``},
+		{`{"a": 1, "b": {"c": [1, 2, {"d": "x"}]}}`, `{"a": 1, "b": {"c": [1, 2, {"d": "y"}]}}`, `/b/c/2/d`},
+		{`{"a": 1, "b": 2}`, `{"b": 3, "a": 2}`, `/a`},
+		{`{"a": 1, "b": 2}`, `{"a": 1}`, `/b`},
+		{`{"a": 1}`, `{"a": 1, "c~d": 2}`, `/c~0d`},
+		{`{"a/b": null}`, `{"a/b": false}`, `/a~1b`},
+		{`{"a": [1, 2]}`, `{"a": [1, 2, 3]}`, `/a/2`},
+		{`{"a": [1, 2, 3]}`, `{"a": [1, 5]}`, `/a/1`},
+		{`{"a": [1, 2, 3]}`, `{"a": [1, 2]}`, `/a/2`},
+		{`[{"a": 1}, {"b": [true]}]`, `[{"a": 1}, {"b": [null]}]`, `/1/b/0`},
+		{`{"a": {"b": 1}}`, `{"a": "x"}`, `/a`},
+	}
+
+	for i, c := range cases {
+		path, equal := NewNode([]byte(c.a)).Diff1(NewNode([]byte(c.b)))
+		assert.Falsef(equal, "case %d", i)
+		assert.Equalf(c.path, path, "case %d", i)
+	}
+
+	node := NewNode([]byte(`{"a": 1}`))
+	patch, _ := NewPatch([]byte(`[{"op": "add", "path": "/b", "value": {"c": [1]}}]`))
+	assert.NoError(node.Patch(patch, nil))
+	path, equal := node.Diff1(NewNode([]byte(`{"a": 1, "b": {"c": [1]}}`)))
+	assert.True(equal)
+	assert.Equal("", path)
+	path, equal = node.Diff1(NewNode([]byte(`{"a": 1, "b": {"c": [2]}}`)))
+	assert.False(equal)
+	assert.Equal("/b/c/0", path)
+}
+
 func TestMaintainOrdering(t *testing.T) {
 	cases := []struct {
 		doc      string
@@ -1071,3 +1119,2300 @@ func TestNullNode(t *testing.T) {
 	assert.False(n.Equal(NewNode([]byte(`{}`))))
 	assert.Equal(`{"key":null}`, mustJSONString(n))
 }
+
+type sliceObject struct {
+	keys   []string
+	values []*Node
+}
+
+func (o *sliceObject) Len() int {
+	return len(o.keys)
+}
+
+func (o *sliceObject) Keys() []string {
+	return o.keys
+}
+
+func (o *sliceObject) Get(key string) (*Node, bool) {
+	for i, k := range o.keys {
+		if k == key {
+			return o.values[i], true
+		}
+	}
+	return nil, false
+}
+
+func (o *sliceObject) Set(key string, val *Node) {
+	for i, k := range o.keys {
+		if k == key {
+			o.values[i] = val
+			return
+		}
+	}
+	o.keys = append(o.keys, key)
+	o.values = append(o.values, val)
+}
+
+func (o *sliceObject) Delete(key string) bool {
+	for i, k := range o.keys {
+		if k == key {
+			o.keys = append(o.keys[:i], o.keys[i+1:]...)
+			o.values = append(o.values[:i], o.values[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func TestCustomObject(t *testing.T) {
+	assert := assert.New(t)
+
+	created := 0
+	options := NewOptions()
+	options.NewObject = func() Object {
+		created++
+		return &sliceObject{}
+	}
+	options.EnsurePathExistsOnAdd = true
+
+	for _, c := range Cases {
+		if c.allowMissingPathOnRemove {
+			continue
+		}
+
+		out, err := applyPatchWithOptions(c.doc, c.patch, options)
+		if !assert.NoErrorf(err, "Unable to apply patch %s", c.patch) {
+			continue
+		}
+		assert.Truef(compareJSON(out, c.result), "Patch did not apply. Expected:\n%s\n\nActual:\n%s",
+			reformatJSON(c.result), reformatJSON(out))
+	}
+	assert.True(created > 0)
+
+	node := NewNode([]byte(`{"z":1,"a":{"y":2,"b":[{"x":3}]}}`))
+	patch, err := NewPatch([]byte(`[
+		{"op": "add", "path": "/a/b/0/c", "value": {"w": 4}},
+		{"op": "add", "path": "/a/b/0/c/d", "value": 5},
+		{"op": "remove", "path": "/z"}
+	]`))
+	assert.NoError(err)
+	assert.NoError(node.Patch(patch, options))
+	assert.IsType(&sliceObject{}, node.doc.obj)
+
+	child, err := node.GetChild("/a/b/0/c", nil)
+	assert.NoError(err)
+	child.intoContainer()
+	assert.IsType(&sliceObject{}, child.doc.obj)
+	assert.Equal(`{"a":{"y":2,"b":[{"x":3,"c":{"w":4,"d":5}}]}}`, mustJSONString(node))
+}
+
+func TestMaxErrorValueLen(t *testing.T) {
+	assert := assert.New(t)
+
+	doc := `{"foo": "` + repeatedA(100) + `"}`
+	patch := `[{"op": "test", "path": "/foo", "value": "bar"}]`
+
+	_, err := applyPatch(doc, patch)
+	assert.ErrorContains(err, repeatedA(100))
+
+	options := NewOptions()
+	options.MaxErrorValueLen = 10
+	_, err = applyPatchWithOptions(doc, patch, options)
+	assert.EqualError(err, `test operation for path "/foo" failed, expected "bar", got "AAAAAAAAAA..."`)
+
+	_, err = applyPatchWithOptions(`"`+repeatedA(100)+`"`, patch, options)
+	assert.EqualError(err, `unexpected node "AAAAAAAAAA...", invalid node detected`)
+
+	options.MaxErrorValueLen = 3
+	_, err = applyPatchWithOptions(`{"foo": "世界你好"}`, patch, options)
+	assert.EqualError(err, `test operation for path "/foo" failed, expected "bar", got "世界你..."`)
+}
+
+func TestUnresolvedPathErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	doc := `{"a": {"x": 1, "y": [0, {"z": "s"}]}, "b~c": null}`
+	cases := []struct {
+		patch, err string
+	}{
+		{
+			`[{"op": "replace", "path": "/a/b/c", "value": 1}]`,
+			`replace operation does not apply for "/a/b/c", unable to resolve token "b" at "/a" (object has keys [x,y]), missing value`,
+		},
+		{
+			`[{"op": "add", "path": "/q/b", "value": 1}]`,
+			`add operation does not apply for "/q/b", unable to resolve token "q" at "" (object has keys [a,b~c]), missing value`,
+		},
+		{
+			`[{"op": "remove", "path": "/a/y/5/z"}]`,
+			`remove operation does not apply for "/a/y/5/z", unable to resolve token "5" at "/a/y" (array has 2 elements), missing value`,
+		},
+		{
+			`[{"op": "test", "path": "/a/y/1/z/0", "value": 1}]`,
+			`test operation for path "/a/y/1/z/0" failed, unable to resolve token "0" at "/a/y/1/z" (value is string), missing value`,
+		},
+		{
+			`[{"op": "move", "from": "/b~0c/d", "path": "/e"}]`,
+			`move operation does not apply for from "/b~0c/d", unable to resolve token "d" at "/b~0c" (value is null), missing value`,
+		},
+		{
+			`[{"op": "copy", "from": "/a/x", "path": "/a/x/y"}]`,
+			`copy operation does not apply for path "/a/x/y", unable to resolve token "y" at "/a/x" (value is number), missing value`,
+		},
+	}
+
+	for i, c := range cases {
+		_, err := applyPatch(doc, c.patch)
+		assert.EqualErrorf(err, c.err, "case %d", i)
+	}
+
+	keys := make([]string, 12)
+	for i := range keys {
+		keys[i] = fmt.Sprintf(`"k%d": %d`, i, i)
+	}
+	_, err := applyPatch(`{`+strings.Join(keys, ",")+`}`, `[{"op": "remove", "path": "/x/y"}]`)
+	assert.EqualError(err, `remove operation does not apply for "/x/y", unable to resolve token "x" at "" (object has 12 keys [k0,k1,k2,k3,k4,k5,k6,k7,k8,k9,...]), missing value`)
+
+	_, err = NewNode([]byte(doc)).GetValue("/a/q/r", nil)
+	assert.EqualError(err, `unable to get child node by path "/a/q/r", unable to resolve token "q" at "/a" (object has keys [x,y]), missing value`)
+}
+
+func TestApplyTemplate(t *testing.T) {
+	assert := assert.New(t)
+
+	doc := []byte(`{"user": {"name": "John", "a/b": 1, "a": {"b": 2}}, "list": []}`)
+	patch, err := NewPatch([]byte(`[
+		{"op": "replace", "path": "/user/${field}", "value": "Jane"},
+		{"op": "remove", "path": "/user/${key}"},
+		{"op": "copy", "from": "/user/${field}", "path": "/${list}/-"}
+	]`))
+	assert.NoError(err)
+
+	out, err := ApplyTemplate(doc, patch, map[string]string{
+		"field": "name",
+		"key":   "a/b",
+		"list":  "list",
+	}, nil)
+	assert.NoError(err)
+	assert.Equal(`{"user":{"name":"Jane","a":{"b":2}},"list":["Jane"]}`, string(out))
+	assert.Equal("/user/${field}", patch[0].Path)
+
+	_, err = ApplyTemplate(doc, patch, map[string]string{"field": "name"}, nil)
+	assert.EqualError(err, `undefined template variable "key"`)
+
+	patch, _ = NewPatch([]byte(`[{"op": "remove", "path": "/user/${key"}]`))
+	_, err = ApplyTemplate(doc, patch, map[string]string{"key": "name"}, nil)
+	assert.EqualError(err, `unterminated template variable in "/user/${key"`)
+}
+
+func TestTemplateVars(t *testing.T) {
+	assert := assert.New(t)
+
+	patch, err := NewPatch([]byte(`[
+		{"op": "replace", "path": "/users/${user}/${field}", "value": "Jane"},
+		{"op": "test", "path": "/users/${user}/rev", "value": 1},
+		{"op": "move", "from": "/${src}/${user}", "path": "/${dst}/${user}"},
+		{"op": "add", "path": "/x${a}y${b}z/${a}", "value": "${c}"},
+		{"op": "remove", "path": "/${}/${unterminated"}
+	]`))
+	assert.NoError(err)
+	assert.Equal([]string{"user", "field", "dst", "src", "a", "b", ""}, patch.TemplateVars())
+
+	patch, _ = NewPatch([]byte(`[{"op": "add", "path": "/a", "value": 1}]`))
+	assert.Equal([]string{}, patch.TemplateVars())
+	assert.Equal([]string{}, Patch{}.TemplateVars())
+}
+
+func TestApplyIfRevision(t *testing.T) {
+	assert := assert.New(t)
+
+	doc := []byte(`{"meta": {"rev": "3", "num": 7}, "a": 1}`)
+	patch, _ := NewPatch([]byte(`[{"op": "replace", "path": "/a", "value": 2}]`))
+
+	out, err := ApplyIfRevision(doc, patch, "3", "/meta/rev", nil)
+	assert.NoError(err)
+	assert.Equal(`{"meta":{"rev":"3","num":7},"a":2}`, string(out))
+
+	out, err = ApplyIfRevision(doc, patch, "7", "/meta/num", nil)
+	assert.NoError(err)
+	assert.Equal(`{"meta":{"rev":"3","num":7},"a":2}`, string(out))
+
+	_, err = ApplyIfRevision(doc, patch, "2", "/meta/rev", nil)
+	assert.EqualError(err, `stale revision "3" at "/meta/rev", expected "2", conflicting operation`)
+	_, err = ApplyIfRevision(doc, patch, "3", "/meta/missing", nil)
+	assert.EqualError(err, `unable to get revision at "/meta/missing", unable to get nonexistent key "missing", missing value`)
+	assert.Equal(`{"meta": {"rev": "3", "num": 7}, "a": 1}`, string(doc))
+
+	options := NewOptions()
+	options.NextRevision = func(rev string) string {
+		n, _ := strconv.Atoi(rev)
+		return strconv.Itoa(n + 1)
+	}
+	out, err = ApplyIfRevision(doc, patch, "3", "/meta/rev", options)
+	assert.NoError(err)
+	assert.Equal(`{"meta":{"rev":"4","num":7},"a":2}`, string(out))
+
+	_, err = ApplyIfRevision(out, patch, "3", "/meta/rev", options)
+	assert.ErrorContains(err, "stale revision")
+
+	bad, _ := NewPatch([]byte(`[{"op": "remove", "path": "/x"}]`))
+	_, err = ApplyIfRevision(doc, bad, "3", "/meta/rev", options)
+	assert.EqualError(err, `remove operation does not apply for "/x", unable to remove nonexistent key "x", missing value`)
+	assert.Equal(1, len(bad))
+}
+
+func TestApplyOpResolved(t *testing.T) {
+	assert := assert.New(t)
+
+	cases := []struct {
+		doc, op, path, result string
+		ensurePathExistsOnAdd bool
+	}{
+		{
+			`{"arr": [1, 2, 3]}`,
+			`{"op": "add", "path": "/arr/-", "value": 4}`,
+			"/arr/3",
+			`{"arr":[1,2,3,4]}`,
+			false,
+		},
+		{
+			`{"arr": [1, 2, 3]}`,
+			`{"op": "add", "path": "/arr/-1", "value": 4}`,
+			"/arr/3",
+			`{"arr":[1,2,3,4]}`,
+			false,
+		},
+		{
+			`{"arr": [1, 2, 3]}`,
+			`{"op": "add", "path": "/arr/-2", "value": 4}`,
+			"/arr/2",
+			`{"arr":[1,2,4,3]}`,
+			false,
+		},
+		{
+			`{"arr": [1, 2, 3]}`,
+			`{"op": "remove", "path": "/arr/-1"}`,
+			"/arr/2",
+			`{"arr":[1,2]}`,
+			false,
+		},
+		{
+			`[[1], [2, 3]]`,
+			`{"op": "replace", "path": "/-1/-2", "value": 4}`,
+			"/1/0",
+			`[[1],[4,3]]`,
+			false,
+		},
+		{
+			`{"a": 1, "arr": []}`,
+			`{"op": "move", "from": "/a", "path": "/arr/-"}`,
+			"/arr/0",
+			`{"arr":[1]}`,
+			false,
+		},
+		{
+			`{}`,
+			`{"op": "add", "path": "/a/b/-", "value": 1}`,
+			"/a/b/0",
+			`{"a":{"b":[1]}}`,
+			true,
+		},
+		{
+			`{"a": {"b~c": 1}}`,
+			`{"op": "replace", "path": "/a/b~0c", "value": 2}`,
+			"/a/b~0c",
+			`{"a":{"b~c":2}}`,
+			false,
+		},
+		{
+			`{"a": 1}`,
+			`{"op": "replace", "path": "", "value": [1]}`,
+			"",
+			`[1]`,
+			false,
+		},
+	}
+
+	for i, c := range cases {
+		var op Operation
+		assert.NoError(json.Unmarshal([]byte(c.op), &op))
+
+		options := NewOptions()
+		options.EnsurePathExistsOnAdd = c.ensurePathExistsOnAdd
+		node := NewNode([]byte(c.doc))
+		path, err := node.ApplyOpResolved(op, options)
+		if !assert.NoErrorf(err, "case %d", i) {
+			continue
+		}
+		assert.Equalf(c.path, path, "case %d", i)
+		assert.Equalf(c.result, mustJSONString(node), "case %d", i)
+	}
+
+	_, err := NewNode([]byte(`{"arr": []}`)).ApplyOpResolved(Operation{Op: "remove", Path: "/arr/0"}, nil)
+	assert.Error(err)
+}
+
+func TestMaybeEqual(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, tc := range EqualityCases {
+		if tc.equal {
+			assert.Truef(NewNode([]byte(tc.a)).MaybeEqual(NewNode([]byte(tc.b))), tc.name)
+			assert.Truef(NewNode([]byte(tc.b)).MaybeEqual(NewNode([]byte(tc.a))), tc.name)
+		}
+	}
+
+	assert.True(NewNode([]byte(`{"a": [1, {"b": "c"}], "d": null}`)).
+		MaybeEqual(NewNode([]byte(`{ "d" : null, "a" : [ 1 , { "b" : "c" } ] }`))))
+	assert.True(NewNode([]byte(`{"ab": 1}`)).MaybeEqual(NewNode([]byte(`{"ab": 1}`))))
+	assert.True(NewNode([]byte(`{"ab": 1}`)).Equal(NewNode([]byte(`{"ab": 1}`))))
+
+	assert.False(NewNode([]byte(`{"a": 1}`)).MaybeEqual(NewNode([]byte(`{"a": 2}`))))
+	assert.False(NewNode([]byte(`{"a": 1}`)).MaybeEqual(NewNode([]byte(`[1]`))))
+	assert.False(NewNode([]byte(`"abc"`)).MaybeEqual(NewNode([]byte(`"abd"`))))
+	assert.False(NewNode([]byte(`null`)).MaybeEqual(NewNode([]byte(`0`))))
+
+	// the last member of a repeated key wins.
+	cases := []struct{ a, b string }{
+		{`{"a": 1, "a": 2}`, `{"a": 2}`},
+		{`{"x": {"a": 1, "b": 0, "a": 2}}`, `{"x": {"b": 0, "a": 2}}`},
+		{`[{"a": "\"", "a": 2}]`, `[{"a": 2}]`},
+	}
+	for i, c := range cases {
+		assert.Truef(NewNode([]byte(c.a)).MaybeEqual(NewNode([]byte(c.b))), "case %d", i)
+		assert.Truef(NewNode([]byte(c.b)).Equal(NewNode([]byte(c.a))), "case %d", i)
+	}
+	assert.False(NewNode([]byte(`{"a": {"a": 1}}`)).MaybeEqual(NewNode([]byte(`{"a": {"a": 2}}`))))
+	members := make([]string, 0, 20)
+	for i := 0; i < 20; i++ {
+		members = append(members, fmt.Sprintf(`"k%d": %d`, i, i))
+	}
+	repeatedKey := `{` + strings.Join(members, ",") + `, "k3": 0}`
+	members[3] = `"k3": 0`
+	assert.True(NewNode([]byte(repeatedKey)).Equal(NewNode([]byte(`{` + strings.Join(members, ",") + `}`))))
+	assert.False(NewNode([]byte(`{"a": 1, "b": {"a": 1}}`)).Equal(NewNode([]byte(`{"a": 2, "b": {"a": 1}}`))))
+
+	// parsed nodes are not checked.
+	a, b := NewNode([]byte(`{"a": 1}`)), NewNode([]byte(`{"a": 2}`))
+	a.intoContainer()
+	assert.True(a.MaybeEqual(b))
+	assert.False(a.Equal(b))
+}
+
+func largeDocument(n int, last string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(`{"items": [`)
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&buf, `{"id": %d, "name": "item %d", "tags": ["a", "b", "c"]},`, i, i)
+	}
+	buf.WriteString(`{"id": -1, "name": "` + last + `"}]}`)
+	return buf.Bytes()
+}
+
+func BenchmarkEqualLargeUnequal(b *testing.B) {
+	x, y := largeDocument(1000, "x"), largeDocument(1000, "y")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if NewNode(x).Equal(NewNode(y)) {
+			b.Fatal("documents should not be equal")
+		}
+	}
+}
+
+func BenchmarkMaybeEqualLargeUnequal(b *testing.B) {
+	x, y := NewNode(largeDocument(1000, "x")), NewNode(largeDocument(1000, "y"))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if x.MaybeEqual(y) {
+			b.Fatal("documents should not be maybe equal")
+		}
+	}
+}
+
+func TestReplaceWhere(t *testing.T) {
+	assert := assert.New(t)
+
+	redactStrings := func(path string, value *Node) (json.RawMessage, bool) {
+		if checkWhich(*value.raw) == eOther && len(*value.raw) > 0 && (*value.raw)[0] == '"' {
+			return []byte(`"***"`), true
+		}
+		return nil, false
+	}
+
+	node := NewNode([]byte(`{"name": "John", "age": 24, "emails": ["a@b.c", null, {"work": "x@y.z"}], "x": null}`))
+	count, err := node.ReplaceWhere(redactStrings)
+	assert.NoError(err)
+	assert.Equal(3, count)
+	assert.Equal(`{"name":"***","age":24,"emails":["***",null,{"work":"***"}],"x":null}`, mustJSONString(node))
+
+	var paths []string
+	node = NewNode([]byte(`{"a": {"b": [1, 2]}, "c~d": 3}`))
+	count, err = node.ReplaceWhere(func(path string, value *Node) (json.RawMessage, bool) {
+		paths = append(paths, path)
+		if path == "/a/b" {
+			return []byte(`"list"`), true
+		}
+		return nil, false
+	})
+	assert.NoError(err)
+	assert.Equal(1, count)
+	assert.Equal([]string{"", "/a", "/a/b", "/c~0d"}, paths)
+	assert.Equal(`{"a":{"b":"list"},"c~d":3}`, mustJSONString(node))
+
+	node = NewNode([]byte(`"secret"`))
+	count, err = node.ReplaceWhere(redactStrings)
+	assert.NoError(err)
+	assert.Equal(1, count)
+	assert.Equal(`"***"`, mustJSONString(node))
+
+	_, err = NewNode([]byte(`{"a": [}`)).ReplaceWhere(redactStrings)
+	assert.Error(err)
+}
+
+func TestSortArraysByKey(t *testing.T) {
+	assert := assert.New(t)
+
+	cases := []struct {
+		doc, result string
+	}{
+		{`[]`, `[]`},
+		{`[3, 1, 2]`, `[3,1,2]`},
+		{`{"a": 1}`, `{"a":1}`},
+		{
+			`[{"id": 3}, {"id": 1}, {"id": 2}]`,
+			`[{"id":1},{"id":2},{"id":3}]`,
+		},
+		{
+			`[{"id": 10}, {"id": 9.5}, {"id": -1e3}]`,
+			`[{"id":-1e3},{"id":9.5},{"id":10}]`,
+		},
+		{
+			`[{"id": "b"}, {"name": "x"}, {"id": "a"}, 1, {"id": null}, {"id": 2}, {"name": "y"}]`,
+			`[{"id":null},{"id":2},{"id":"a"},{"id":"b"},{"name":"x"},1,{"name":"y"}]`,
+		},
+		{
+			`{"users": [{"id": 2, "tags": [{"id": "y"}, {"id": "x"}]}, {"id": 1}], "other": {"list": [{"id": true}, {"id": false}]}}`,
+			`{"users":[{"id":1},{"id":2,"tags":[{"id":"x"},{"id":"y"}]}],"other":{"list":[{"id":false},{"id":true}]}}`,
+		},
+		{
+			`[{"id": 1, "v": "a"}, {"id": 0}, {"id": 1, "v": "b"}]`,
+			`[{"id":0},{"id":1,"v":"a"},{"id":1,"v":"b"}]`,
+		},
+	}
+
+	for i, c := range cases {
+		out, err := SortArraysByKey([]byte(c.doc), "id")
+		if assert.NoErrorf(err, "case %d", i) {
+			assert.Equalf(c.result, string(out), "case %d", i)
+		}
+	}
+
+	a, _ := SortArraysByKey([]byte(`{"list": [{"id": "x", "v": 1}, {"id": "y", "v": 2}]}`), "id")
+	b, _ := SortArraysByKey([]byte(`{"list": [{"v": 2, "id": "y"}, {"id": "x", "v": 1}]}`), "id")
+	assert.True(Equal(a, b))
+
+	_, err := SortArraysByKey([]byte(`[{"id": 1}, {]`), "id")
+	assert.Error(err)
+}
+
+func TestPatchEnvelope(t *testing.T) {
+	assert := assert.New(t)
+
+	patch, err := NewPatch([]byte(`[
+		{"op": "replace", "path": "/name", "value": "Jane"},
+		{"op": "move", "from": "/a", "path": "/b"}
+	]`))
+	assert.NoError(err)
+
+	data, err := patch.MarshalEnvelope(map[string]interface{}{"author": "john", "timestamp": 1666000000})
+	assert.NoError(err)
+	assert.Equal(`{"version":"6902","meta":{"author":"john","timestamp":1666000000},"operations":[`+
+		`{"op":"replace","path":"/name","value":"Jane"},{"op":"move","path":"/b","from":"/a"}]}`, string(data))
+
+	p, meta, err := UnmarshalEnvelope(data)
+	assert.NoError(err)
+	assert.Equal(patch, p)
+	assert.Equal(map[string]interface{}{"author": "john", "timestamp": float64(1666000000)}, meta)
+
+	data, err = Patch(nil).MarshalEnvelope(nil)
+	assert.NoError(err)
+	assert.Equal(`{"version":"6902","operations":[]}`, string(data))
+	p, meta, err = UnmarshalEnvelope(data)
+	assert.NoError(err)
+	assert.Equal(Patch{}, p)
+	assert.Nil(meta)
+
+	_, _, err = UnmarshalEnvelope([]byte(`{"version":"6901","operations":[]}`))
+	assert.EqualError(err, `unsupported patch envelope version "6901"`)
+	_, _, err = UnmarshalEnvelope([]byte(`{"version":"6902"}`))
+	assert.EqualError(err, `patch envelope without operations`)
+	_, _, err = UnmarshalEnvelope([]byte(`[]`))
+	assert.Error(err)
+}
+
+func appendPatch(n int, path func(i int) string) Patch {
+	patch := make(Patch, 0, n)
+	for i := 0; i < n; i++ {
+		patch = append(patch, Operation{Op: "add", Path: path(i), Value: []byte(strconv.Itoa(i))})
+	}
+	return patch
+}
+
+func TestAppendToArray(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, patch := range []Patch{
+		appendPatch(5, func(i int) string { return "/a/-" }),
+		appendPatch(5, func(i int) string { return "/a/" + strconv.Itoa(i+1) }),
+		appendPatch(5, func(i int) string { return "/a/-1" }),
+	} {
+		out, err := patch.Apply([]byte(`{"a": [-1]}`))
+		assert.NoError(err)
+		assert.Equal(`{"a":[-1,0,1,2,3,4]}`, string(out))
+	}
+
+	out, err := appendPatch(3, func(i int) string { return "/a/1" }).Apply([]byte(`{"a": [-1, 9]}`))
+	assert.NoError(err)
+	assert.Equal(`{"a":[-1,2,1,0,9]}`, string(out))
+}
+
+func BenchmarkAppendToArray(b *testing.B) {
+	patch := appendPatch(10000, func(i int) string { return "/a/" + strconv.Itoa(i) })
+	doc := []byte(`{"a": []}`)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := patch.Apply(doc); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	patch := appendPatch(10, func(i int) string { return "/" + strconv.Itoa(i) })
+	for i := range patch {
+		patch[i].Value = []byte(`{"a": {}}`)
+	}
+	patch = append(patch, Operation{Op: "test", Path: "/0/a", Value: []byte(`{}`)})
+	patch = append(patch, Operation{Op: "test", Path: "/9/a", Value: []byte(`{}`)})
+
+	options := NewOptions()
+	options.Timeout = 20 * time.Millisecond
+	_, err := patch.ApplyWithOptions([]byte(`[]`), options)
+	assert.NoError(err)
+
+	// parsing every object is deliberately slow.
+	options.NewObject = func() Object {
+		time.Sleep(15 * time.Millisecond)
+		return newOrderedObject()
+	}
+	_, err = patch.ApplyWithOptions([]byte(`[]`), options)
+	assert.EqualError(err, "unable to apply operation 11 after 20ms, patch application timed out")
+
+	options.Timeout = 0
+	_, err = patch.ApplyWithOptions([]byte(`[]`), options)
+	assert.NoError(err)
+}
+
+func TestCasOperation(t *testing.T) {
+	assert := assert.New(t)
+
+	doc := `{"counter": 1, "user": {"name": "John"}, "list": [1, 2]}`
+	options := NewOptions()
+
+	_, err := applyPatchWithOptions(doc, `[{"op": "cas", "path": "/counter", "expected": 1, "value": 2}]`, options)
+	assert.EqualError(err, `unexpected operation "cas"`)
+
+	options.AllowExtendedOps = true
+	cases := []struct {
+		patch, result, err string
+	}{
+		{
+			`[{"op": "cas", "path": "/counter", "expected": 1, "value": 2}]`,
+			`{"counter":2,"user":{"name":"John"},"list":[1,2]}`,
+			``,
+		},
+		{
+			`[{"op": "cas", "path": "/user", "expected": {"name": "John"}, "value": {"name": "Jane"}},
+			  {"op": "cas", "path": "/list/-1", "expected": 2, "value": 3}]`,
+			`{"counter":1,"user":{"name":"Jane"},"list":[1,3]}`,
+			``,
+		},
+		{
+			`[{"op": "cas", "path": "/counter", "expected": 2, "value": 3}]`,
+			``,
+			`cas operation for path "/counter" failed, expected "2", got "1"`,
+		},
+		{
+			`[{"op": "cas", "path": "/counter", "expected": 1, "value": 2},
+			  {"op": "cas", "path": "/counter", "expected": 1, "value": 3}]`,
+			``,
+			`cas operation for path "/counter" failed, expected "1", got "2"`,
+		},
+		{
+			`[{"op": "cas", "path": "/missing", "expected": null, "value": 1}]`,
+			``,
+			`cas operation does not apply for "/missing", unable to get nonexistent key "missing", missing value`,
+		},
+	}
+
+	for i, c := range cases {
+		out, err := applyPatchWithOptions(doc, c.patch, options)
+		if c.err != "" {
+			assert.EqualErrorf(err, c.err, "case %d", i)
+			continue
+		}
+		assert.NoErrorf(err, "case %d", i)
+		assert.Equalf(c.result, out, "case %d", i)
+	}
+}
+
+func TestRemoveEachOperation(t *testing.T) {
+	assert := assert.New(t)
+
+	doc := `{"items": [{"id": 1, "tmp": "a"}, {"id": 2}, {"id": 3, "tmp": {"b": 1}}], "map": {"x": {"tmp": 1}, "y": 2}}`
+	options := NewOptions()
+
+	_, err := applyPatchWithOptions(doc, `[{"op": "remove_each", "path": "/items/*/tmp"}]`, options)
+	assert.EqualError(err, `unexpected operation "remove_each"`)
+
+	options.AllowExtendedOps = true
+	cases := []struct {
+		patch, result, err string
+	}{
+		{
+			`[{"op": "remove_each", "path": "/items/*/tmp"}]`,
+			`{"items":[{"id":1},{"id":2},{"id":3}],"map":{"x":{"tmp":1},"y":2}}`,
+			``,
+		},
+		{
+			`[{"op": "remove_each", "path": "/map/*/tmp"}]`,
+			`{"items":[{"id":1,"tmp":"a"},{"id":2},{"id":3,"tmp":{"b":1}}],"map":{"x":{},"y":2}}`,
+			``,
+		},
+		{
+			`[{"op": "remove_each", "path": "/items/*"}]`,
+			`{"items":[],"map":{"x":{"tmp":1},"y":2}}`,
+			``,
+		},
+		{
+			`[{"op": "remove_each", "path": "/*/x"}]`,
+			`{"items":[{"id":1,"tmp":"a"},{"id":2},{"id":3,"tmp":{"b":1}}],"map":{"y":2}}`,
+			``,
+		},
+		{
+			`[{"op": "remove_each", "path": "/items/tmp"}]`,
+			``,
+			`remove_each operation does not apply for "/items/tmp", need exactly one "*" token, invalid node detected`,
+		},
+		{
+			`[{"op": "remove_each", "path": "/items/*/tmp/*"}]`,
+			``,
+			`remove_each operation does not apply for "/items/*/tmp/*", need exactly one "*" token, invalid node detected`,
+		},
+		{
+			`[{"op": "remove_each", "path": "/missing/*/tmp"}]`,
+			``,
+			`remove_each operation does not apply for "/missing/*/tmp", unable to get nonexistent key "missing", missing value`,
+		},
+		{
+			`[{"op": "remove_each", "path": "/items/0/id/*"}]`,
+			``,
+			`remove_each operation does not apply for "/items/0/id/*", invalid node detected`,
+		},
+	}
+
+	for i, c := range cases {
+		out, err := applyPatchWithOptions(doc, c.patch, options)
+		if c.err != "" {
+			assert.EqualErrorf(err, c.err, "case %d", i)
+			continue
+		}
+		assert.NoErrorf(err, "case %d", i)
+		assert.Equalf(c.result, out, "case %d", i)
+	}
+}
+
+func TestFilterPaths(t *testing.T) {
+	assert := assert.New(t)
+
+	doc := `{"items": [{"id": 4, "name": "a"}, {"id": "5", "name": "b"}, {"id": 5, "name": "c", "tags": []}, {"id": 5}], "ok": [true, false]}`
+	options := NewOptions()
+
+	_, err := applyPatchWithOptions(doc, `[{"op": "remove", "path": "/items[id=5]"}]`, options)
+	assert.EqualError(err, `remove operation does not apply for "/items[id=5]", unable to remove nonexistent key "items[id=5]", missing value`)
+
+	options.AllowFilterPaths = true
+	cases := []struct {
+		patch, result, err string
+	}{
+		{
+			`[{"op": "replace", "path": "/items[id=5]/name", "value": "x"}]`,
+			`{"items":[{"id":4,"name":"a"},{"id":"5","name":"b"},{"id":5,"name":"x","tags":[]},{"id":5}],"ok":[true,false]}`,
+			``,
+		},
+		{
+			`[{"op": "add", "path": "/items[id=5]/tags/-", "value": "t"},
+			  {"op": "replace", "path": "/items[id=\"5\"]/name", "value": "y"}]`,
+			`{"items":[{"id":4,"name":"a"},{"id":"5","name":"y"},{"id":5,"name":"c","tags":["t"]},{"id":5}],"ok":[true,false]}`,
+			``,
+		},
+		{
+			`[{"op": "remove", "path": "/items[id=4]"}, {"op": "remove", "path": "/items[name=b]"}]`,
+			`{"items":[{"id":5,"name":"c","tags":[]},{"id":5}],"ok":[true,false]}`,
+			``,
+		},
+		{
+			`[{"op": "add", "path": "/items[name=c]", "value": {"id": 6}}]`,
+			`{"items":[{"id":4,"name":"a"},{"id":"5","name":"b"},{"id":6},{"id":5,"name":"c","tags":[]},{"id":5}],"ok":[true,false]}`,
+			``,
+		},
+		{
+			`[{"op": "replace", "path": "/items/3/id", "value": 7}]`,
+			`{"items":[{"id":4,"name":"a"},{"id":"5","name":"b"},{"id":5,"name":"c","tags":[]},{"id":7}],"ok":[true,false]}`,
+			``,
+		},
+		{
+			`[{"op": "remove", "path": "/items[id=6]"}]`,
+			``,
+			`remove operation does not apply for "/items[id=6]", unable to resolve the filters, missing value`,
+		},
+		{
+			`[{"op": "replace", "path": "/items[id=6]/name", "value": "x"}]`,
+			``,
+			`replace operation does not apply for "/items[id=6]/name", unable to resolve the filters, missing value`,
+		},
+		{
+			`[{"op": "remove", "path": "/ok[id=true]"}]`,
+			``,
+			`remove operation does not apply for "/ok[id=true]", unable to resolve the filters, missing value`,
+		},
+	}
+
+	for i, c := range cases {
+		out, err := applyPatchWithOptions(doc, c.patch, options)
+		if c.err != "" {
+			assert.EqualErrorf(err, c.err, "case %d", i)
+			continue
+		}
+		assert.NoErrorf(err, "case %d", i)
+		assert.Equalf(c.result, out, "case %d", i)
+	}
+
+	out, err := applyPatchWithOptions(`[{"id": 1}, {"id": 2}]`, `[{"op": "remove", "path": "/[id=2]"}]`, options)
+	assert.NoError(err)
+	assert.Equal(`[{"id":1}]`, out)
+	// the filter tokens are resolved before the missing parents are created.
+	options.EnsurePathExistsOnAdd = true
+	out, err = applyPatchWithOptions(`{"items": [{"id": 5}]}`, `[{"op": "add", "path": "/items[id=5]/x", "value": 1}]`, options)
+	assert.NoError(err)
+	assert.Equal(`{"items":[{"id":5,"x":1}]}`, out)
+
+	out, err = applyPatchWithOptions(`{"items": [{"id": 5}]}`, `[{"op": "add", "path": "/items[id=5]/x/y", "value": 1}]`, options)
+	assert.NoError(err)
+	assert.Equal(`{"items":[{"id":5,"x":{"y":1}}]}`, out)
+
+	_, err = applyPatchWithOptions(`{"items": [{"id": 5}]}`, `[{"op": "add", "path": "/items[id=6]/x", "value": 1}]`, options)
+	assert.EqualError(err, `add operation does not apply for "/items[id=6]/x", unable to resolve the filters, missing value`)
+
+	options.AllowIDPaths = true
+	out, err = applyPatchWithOptions(`{"items": [{"id": "a"}]}`, `[{"op": "add", "path": "/items/id:a/x/0", "value": 1}]`, options)
+	assert.NoError(err)
+	assert.Equal(`{"items":[{"id":"a","x":[1]}]}`, out)
+}
+
+func TestIDPaths(t *testing.T) {
+	assert := assert.New(t)
+
+	doc := `{"items": [{"id": "abc", "name": "a"}, {"id": 5, "name": "b"}, {"name": "c"}], "id:x": 1}`
+	options := NewOptions()
+
+	_, err := applyPatchWithOptions(doc, `[{"op": "remove", "path": "/items/id:abc"}]`, options)
+	assert.Error(err)
+
+	options.AllowIDPaths = true
+	cases := []struct {
+		patch, result, err string
+	}{
+		{
+			`[{"op": "replace", "path": "/items/id:abc/name", "value": "x"}]`,
+			`{"items":[{"id":"abc","name":"x"},{"id":5,"name":"b"},{"name":"c"}],"id:x":1}`,
+			``,
+		},
+		{
+			`[{"op": "remove", "path": "/items/id:abc"}, {"op": "test", "path": "/items/id:5/name", "value": "b"}]`,
+			`{"items":[{"id":5,"name":"b"},{"name":"c"}],"id:x":1}`,
+			``,
+		},
+		{
+			`[{"op": "move", "from": "/items/id:5", "path": "/items/0"}]`,
+			`{"items":[{"id":5,"name":"b"},{"id":"abc","name":"a"},{"name":"c"}],"id:x":1}`,
+			``,
+		},
+		{
+			`[{"op": "replace", "path": "/id:x", "value": 2}]`,
+			`{"items":[{"id":"abc","name":"a"},{"id":5,"name":"b"},{"name":"c"}],"id:x":2}`,
+			``,
+		},
+		{
+			`[{"op": "remove", "path": "/items/id:xyz"}]`,
+			``,
+			`remove operation does not apply for "/items/id:xyz", unable to resolve the ids, missing value`,
+		},
+		{
+			`[{"op": "replace", "path": "/items/id:xyz/name", "value": "x"}]`,
+			``,
+			`replace operation does not apply for "/items/id:xyz/name", unable to resolve the ids, missing value`,
+		},
+	}
+
+	for i, c := range cases {
+		out, err := applyPatchWithOptions(doc, c.patch, options)
+		if c.err != "" {
+			assert.EqualErrorf(err, c.err, "case %d", i)
+			continue
+		}
+		assert.NoErrorf(err, "case %d", i)
+		assert.Equalf(c.result, out, "case %d", i)
+	}
+
+	options.IDPathKey = "name"
+	out, err := applyPatchWithOptions(doc, `[{"op": "remove", "path": "/items/id:c"}]`, options)
+	assert.NoError(err)
+	assert.Equal(`{"items":[{"id":"abc","name":"a"},{"id":5,"name":"b"}],"id:x":1}`, out)
+}
+
+func TestNormalizeNumbers(t *testing.T) {
+	assert := assert.New(t)
+
+	doc := `{"a": 1.0, "b": [2e1]}`
+	patch := `[
+		{"op": "replace", "path": "/a", "value": 1e3},
+		{"op": "add", "path": "/b/-", "value": {"x": 1.50, "y": "1e3", "z": [-0.5E-1, 10, 12345678901234567890]}},
+		{"op": "copy", "from": "/b/1", "path": "/c"}
+	]`
+
+	out, err := applyPatch(doc, patch)
+	assert.NoError(err)
+	assert.Equal(`{"a":1e3,"b":[2e1,{"x":1.50,"y":"1e3","z":[-0.5E-1,10,12345678901234567890]}],`+
+		`"c":{"x":1.50,"y":"1e3","z":[-0.5E-1,10,12345678901234567890]}}`, out)
+
+	out, err = applyPatch(doc, `[{"op": "replace", "path": "", "value": {"a": 1e3}}]`)
+	assert.NoError(err)
+	assert.Equal(`{"a":1e3}`, out)
+
+	options := NewOptions()
+	options.NormalizeNumbers = true
+	out, err = applyPatchWithOptions(doc, patch, options)
+	assert.NoError(err)
+	assert.Equal(`{"a":1000,"b":[2e1,{"x":1.5,"y":"1e3","z":[-0.05,10,12345678901234567890]}],`+
+		`"c":{"x":1.5,"y":"1e3","z":[-0.05,10,12345678901234567890]}}`, out)
+
+	out, err = applyPatchWithOptions(doc, `[{"op": "replace", "path": "", "value": {"a": "\\\"", "b": 1e3}}]`, options)
+	assert.NoError(err)
+	assert.Equal(`{"a":"\\\"","b":1000}`, out)
+}
+
+func TestPercentDecodePointers(t *testing.T) {
+	assert := assert.New(t)
+
+	doc := `{"a b": 1, "a/b": 2, "a%20b": 3, "c": {"d~e": [1, 2]}}`
+	options := NewOptions()
+
+	out, err := applyPatchWithOptions(doc, `[{"op": "replace", "path": "/a%20b", "value": 0}]`, options)
+	assert.NoError(err)
+	assert.Equal(`{"a b":1,"a/b":2,"a%20b":0,"c":{"d~e":[1,2]}}`, out)
+
+	options.PercentDecodePointers = true
+	cases := []struct {
+		patch, result, err string
+	}{
+		{
+			`[{"op": "replace", "path": "/a%20b", "value": 0}]`,
+			`{"a b":0,"a/b":2,"a%20b":3,"c":{"d~e":[1,2]}}`,
+			``,
+		},
+		{
+			`[{"op": "replace", "path": "/a~1b", "value": 0}, {"op": "test", "path": "/a%7E1b", "value": 0}]`,
+			`{"a b":1,"a/b":0,"a%20b":3,"c":{"d~e":[1,2]}}`,
+			``,
+		},
+		{
+			`[{"op": "replace", "path": "/a%7E1b", "value": 0}, {"op": "remove", "path": "/a%2520b"}]`,
+			`{"a b":1,"a/b":0,"c":{"d~e":[1,2]}}`,
+			``,
+		},
+		{
+			`[{"op": "move", "from": "/c/d%7E0e/1", "path": "/c/d~0e/0"}]`,
+			`{"a b":1,"a/b":2,"a%20b":3,"c":{"d~e":[2,1]}}`,
+			``,
+		},
+		{
+			`[{"op": "add", "path": "/x%20y/z", "value": 1, "x-ensure-path": true}]`,
+			`{"a b":1,"a/b":2,"a%20b":3,"c":{"d~e":[1,2]},"x y":{"z":1}}`,
+			``,
+		},
+		{
+			`[{"op": "replace", "path": "/a%zzb", "value": 0}]`,
+			``,
+			`replace operation does not apply for "/a%zzb", unable to percent-decode path "/a%zzb", invalid node detected`,
+		},
+	}
+
+	for i, c := range cases {
+		out, err := applyPatchWithOptions(doc, c.patch, options)
+		if c.err != "" {
+			assert.EqualErrorf(err, c.err, "case %d", i)
+			continue
+		}
+		assert.NoErrorf(err, "case %d", i)
+		assert.Equalf(c.result, out, "case %d", i)
+	}
+}
+
+func TestPointerUnescape(t *testing.T) {
+	assert := assert.New(t)
+
+	doc := `{"a/b": 1, "a~1b": 2, "c": {"d/e": [1, 2]}}`
+	options := NewOptions()
+	options.PointerUnescape = func(token string) string {
+		return strings.ReplaceAll(token, "%2F", "/")
+	}
+
+	cases := []struct {
+		patch, result, err string
+	}{
+		{
+			`[{"op": "replace", "path": "/a%2Fb", "value": 0}]`,
+			`{"a/b":0,"a~1b":2,"c":{"d/e":[1,2]}}`,
+			``,
+		},
+		{
+			`[{"op": "replace", "path": "/a~1b", "value": 0}]`,
+			`{"a/b":1,"a~1b":0,"c":{"d/e":[1,2]}}`,
+			``,
+		},
+		{
+			`[{"op": "move", "from": "/c/d%2Fe/1", "path": "/c/d%2Fe/0"}, {"op": "test", "path": "/c/d%2Fe", "value": [2, 1]}]`,
+			`{"a/b":1,"a~1b":2,"c":{"d/e":[2,1]}}`,
+			``,
+		},
+		{
+			`[{"op": "add", "path": "/x%2Fy/z", "value": 1, "x-ensure-path": true}]`,
+			`{"a/b":1,"a~1b":2,"c":{"d/e":[1,2]},"x/y":{"z":1}}`,
+			``,
+		},
+		{
+			`[{"op": "remove", "path": "/c/d~1e"}]`,
+			``,
+			`remove operation does not apply for "/c/d~1e", unable to remove nonexistent key "d~1e", missing value`,
+		},
+	}
+
+	for i, c := range cases {
+		out, err := applyPatchWithOptions(doc, c.patch, options)
+		if c.err != "" {
+			assert.EqualErrorf(err, c.err, "case %d", i)
+			continue
+		}
+		assert.NoErrorf(err, "case %d", i)
+		assert.Equalf(c.result, out, "case %d", i)
+	}
+	value, parent, key, index, err := NewNode([]byte(doc)).LocateDetailed("/c/d%2Fe/1", options)
+	assert.NoError(err)
+	assert.Equal("2", string(*value.raw))
+	assert.Equal(TypeArray, parent.Type())
+	assert.Equal("1", key)
+	assert.Equal(1, index)
+
+	_, _, key, index, err = NewNode([]byte(doc)).LocateDetailed("/a%2Fb", options)
+	assert.NoError(err)
+	assert.Equal("a/b", key)
+	assert.Equal(0, index)
+
+	pvs, err := NewNode([]byte(`{"x": {"k": 1, "a/b": 2}, "y": {"k": 1, "a/b": 3}}`)).FindChildren(
+		[]*PV{{Path: "/k", Value: json.RawMessage(`1`)}, {Path: "/a%2Fb", Value: json.RawMessage(`3`)}}, options)
+	assert.NoError(err)
+	assert.Equal(`[{"path":"/y","value":{"k":1,"a/b":3}}]`, mustJSONString(pvs))
+
+	options.AllowIDPaths = true
+	out, err := applyPatchWithOptions(`{"items": [{"id": "a/b", "v": 1}]}`,
+		`[{"op": "replace", "path": "/items/id:a%2Fb/v", "value": 2}]`, options)
+	assert.NoError(err)
+	assert.Equal(`{"items":[{"id":"a/b","v":2}]}`, out)
+}
+
+func TestEqualWithRules(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, tc := range EqualityCases {
+		assert.Equalf(tc.equal, NewNode([]byte(tc.a)).EqualWithRules(NewNode([]byte(tc.b)), nil), tc.name)
+	}
+
+	doc := `{"tags": ["a", "b", "a"], "list": [1, 2], "users": [{"roles": ["x", "y"]}, {"roles": [[1, 2], [3]]}]}`
+	rules := []string{"/tags", "/users/*/roles"}
+	cases := []struct {
+		other string
+		equal bool
+	}{
+		{`{"tags": ["a", "b", "a"], "list": [1, 2], "users": [{"roles": ["x", "y"]}, {"roles": [[1, 2], [3]]}]}`, true},
+		{`{"tags": ["b", "a", "a"], "list": [1, 2], "users": [{"roles": ["y", "x"]}, {"roles": [[3], [1, 2]]}]}`, true},
+		{`{"tags": ["a", "b", "b"], "list": [1, 2], "users": [{"roles": ["x", "y"]}, {"roles": [[1, 2], [3]]}]}`, false},
+		{`{"tags": ["a", "b"], "list": [1, 2], "users": [{"roles": ["x", "y"]}, {"roles": [[1, 2], [3]]}]}`, false},
+		{`{"tags": ["a", "b", "a"], "list": [2, 1], "users": [{"roles": ["x", "y"]}, {"roles": [[1, 2], [3]]}]}`, false},
+		{`{"tags": ["a", "b", "a"], "list": [1, 2], "users": [{"roles": [[1, 2], [3]]}, {"roles": ["x", "y"]}]}`, false},
+		{`{"tags": ["a", "b", "a"], "list": [1, 2], "users": [{"roles": ["x", "y"]}, {"roles": [[2, 1], [3]]}]}`, false},
+		{`{"tags": {"0": "a"}, "list": [1, 2], "users": [{"roles": ["x", "y"]}, {"roles": [[1, 2], [3]]}]}`, false},
+	}
+
+	for i, c := range cases {
+		assert.Equalf(c.equal, NewNode([]byte(doc)).EqualWithRules(NewNode([]byte(c.other)), rules), "case %d", i)
+		assert.Equalf(c.equal, NewNode([]byte(c.other)).EqualWithRules(NewNode([]byte(doc)), rules), "case %d", i)
+	}
+
+	assert.True(NewNode([]byte(`[3, 1, 2]`)).EqualWithRules(NewNode([]byte(`[1, 2, 3]`)), []string{""}))
+	assert.False(NewNode([]byte(`[3, 1, 2]`)).EqualWithRules(NewNode([]byte(`[1, 2, 3]`)), []string{"/0"}))
+}
+
+func TestMaxStringValueLen(t *testing.T) {
+	assert := assert.New(t)
+
+	doc := `{"short": "abc", "long": "abcdef", "list": [1], "obj": {"s": "abcdefgh"}}`
+	options := NewOptions()
+	options.MaxStringValueLen = 5
+
+	cases := []struct {
+		patch, result, err string
+	}{
+		{
+			`[{"op": "add", "path": "/a", "value": "abcde"}, {"op": "replace", "path": "/short", "value": "\u00e9\u00e9\u00e9\u00e9\u00e9"}]`,
+			`{"short":"\u00e9\u00e9\u00e9\u00e9\u00e9","long":"abcdef","list":[1],"obj":{"s":"abcdefgh"},"a":"abcde"}`,
+			``,
+		},
+		{
+			`[{"op": "add", "path": "/list/-", "value": 1234567890}, {"op": "add", "path": "/o", "value": {"s": "abcdefgh"}},
+			  {"op": "copy", "from": "/obj", "path": "/c"}, {"op": "copy", "from": "/short", "path": "/d"}]`,
+			`{"short":"abc","long":"abcdef","list":[1,1234567890],"obj":{"s":"abcdefgh"},"o":{"s":"abcdefgh"},"c":{"s":"abcdefgh"},"d":"abc"}`,
+			``,
+		},
+		{
+			`[{"op": "add", "path": "/list/0", "value": "abcdef"}]`,
+			``,
+			`add operation does not apply for "/list/0", string value of 6 characters exceeds the limit 5, invalid node detected`,
+		},
+		{
+			`[{"op": "replace", "path": "/short", "value": "ab\"def"}]`,
+			``,
+			`replace operation does not apply for "/short", string value of 6 characters exceeds the limit 5, invalid node detected`,
+		},
+		{
+			`[{"op": "copy", "from": "/long", "path": "/c"}]`,
+			``,
+			`copy operation does not apply for path "/c", string value of 6 characters exceeds the limit 5, invalid node detected`,
+		},
+		{
+			`[{"op": "move", "from": "/long", "path": "/c"}, {"op": "test", "path": "/c", "value": "abcdef"}]`,
+			`{"short":"abc","list":[1],"obj":{"s":"abcdefgh"},"c":"abcdef"}`,
+			``,
+		},
+	}
+
+	for i, c := range cases {
+		out, err := applyPatchWithOptions(doc, c.patch, options)
+		if c.err != "" {
+			assert.EqualErrorf(err, c.err, "case %d", i)
+			continue
+		}
+		assert.NoErrorf(err, "case %d", i)
+		assert.Equalf(c.result, out, "case %d", i)
+	}
+}
+
+func TestStableArrayIndices(t *testing.T) {
+	assert := assert.New(t)
+
+	doc := `{"arr": ["a", "b", "c", "d"], "obj": {"x": 1}}`
+	cases := []struct {
+		patch, result, stable, err string
+	}{
+		{
+			`[{"op": "remove", "path": "/arr/0"}, {"op": "replace", "path": "/arr/0", "value": "B"}]`,
+			`{"arr":["B","c","d"],"obj":{"x":1}}`,
+			``,
+			`replace operation does not apply for "/arr/0", the element at "/arr/0" was removed by operation 0, missing value`,
+		},
+		{
+			`[{"op": "remove", "path": "/arr/0"}, {"op": "replace", "path": "/arr/1", "value": "B"}]`,
+			`{"arr":["b","B","d"],"obj":{"x":1}}`,
+			`{"arr":["B","c","d"],"obj":{"x":1}}`,
+			``,
+		},
+		{
+			`[{"op": "add", "path": "/arr/1", "value": "x"}, {"op": "add", "path": "/arr/1", "value": "y"},
+			  {"op": "remove", "path": "/arr/2"}, {"op": "test", "path": "/arr/-1", "value": "d"}]`,
+			`{"arr":["a","y","b","c","d"],"obj":{"x":1}}`,
+			`{"arr":["a","x","y","b","d"],"obj":{"x":1}}`,
+			``,
+		},
+		{
+			`[{"op": "move", "from": "/arr/0", "path": "/arr/-"}, {"op": "copy", "from": "/arr/0", "path": "/obj/y"},
+			  {"op": "add", "path": "/obj/z", "value": [1]}, {"op": "add", "path": "/obj/z/0", "value": 0}]`,
+			`{"arr":["b","c","d","a"],"obj":{"x":1,"y":"b","z":[0,1]}}`,
+			``,
+			`copy operation does not apply for "/obj/y", the element at "/arr/0" was removed by operation 0, missing value`,
+		},
+		{
+			`[{"op": "remove", "path": "/arr/3"}, {"op": "remove", "path": "/arr/2"}, {"op": "add", "path": "/arr/2", "value": "x"},
+			  {"op": "replace", "path": "/arr/1", "value": "B"}]`,
+			`{"arr":["a","B","x"],"obj":{"x":1}}`,
+			`{"arr":["a","B","x"],"obj":{"x":1}}`,
+			``,
+		},
+	}
+
+	for i, c := range cases {
+		out, err := applyPatch(doc, c.patch)
+		if assert.NoErrorf(err, "case %d", i) {
+			assert.Equalf(c.result, out, "case %d", i)
+		}
+
+		options := NewOptions()
+		options.StableArrayIndices = true
+		out, err = applyPatchWithOptions(doc, c.patch, options)
+		if c.err != "" {
+			assert.EqualErrorf(err, c.err, "case %d", i)
+			continue
+		}
+		if assert.NoErrorf(err, "case %d", i) {
+			assert.Equalf(c.stable, out, "case %d", i)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	assert := assert.New(t)
+
+	for i, c := range TestCases {
+		patch, _ := NewPatch([]byte(c.patch))
+		err := patch.Check([]byte(c.doc), nil)
+		if c.result {
+			assert.NoErrorf(err, "case %d", i)
+		} else {
+			assert.Errorf(err, "case %d", i)
+		}
+	}
+
+	doc := []byte(`{"a": [1, 2]}`)
+	patch, _ := NewPatch([]byte(`[{"op": "add", "path": "/a/-", "value": 3}, {"op": "test", "path": "/a/2", "value": 3}]`))
+	assert.NoError(patch.Check(doc, nil))
+	assert.Equal(`{"a": [1, 2]}`, string(doc))
+
+	patch, _ = NewPatch([]byte(`[{"op": "remove", "path": "/b"}]`))
+	assert.Error(patch.Check(doc, nil))
+	assert.Error(Patch{}.Check(nil, nil))
+}
+
+func BenchmarkCheckTestOnly(b *testing.B) {
+	doc := largeDocument(1000, "x")
+	patch, _ := NewPatch([]byte(`[{"op": "test", "path": "/items/1000/name", "value": "x"}]`))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := patch.Check(doc, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkApplyTestOnly(b *testing.B) {
+	doc := largeDocument(1000, "x")
+	patch, _ := NewPatch([]byte(`[{"op": "test", "path": "/items/1000/name", "value": "x"}]`))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := patch.Apply(doc); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestApplyRecording(t *testing.T) {
+	assert := assert.New(t)
+
+	patch, err := NewPatch([]byte(`[
+		{"op": "add", "path": "/arr/-", "value": 3},
+		{"op": "add", "path": "/arr/-", "value": 4},
+		{"op": "copy", "from": "/arr/0", "path": "/other/-"},
+		{"op": "remove", "path": "/arr/-1"},
+		{"op": "replace", "path": "/name", "value": "Jane"}
+	]`))
+	assert.NoError(err)
+
+	out, recorded, err := patch.ApplyRecording([]byte(`{"arr": [1, 2], "other": [], "name": "John"}`), nil)
+	assert.NoError(err)
+	assert.Equal(`{"arr":[1,2,3],"other":[1],"name":"Jane"}`, string(out))
+	assert.Equal(`[{"op":"add","path":"/arr/2","value":3},{"op":"add","path":"/arr/3","value":4},`+
+		`{"op":"copy","path":"/other/0","from":"/arr/0"},{"op":"remove","path":"/arr/3"},`+
+		`{"op":"replace","path":"/name","value":"Jane"}]`, mustJSONString(recorded))
+	assert.Equal("/arr/-", patch[0].Path)
+
+	out, err = recorded.Apply([]byte(`{"arr": [1, 2], "other": [], "name": "John"}`))
+	assert.NoError(err)
+	assert.Equal(`{"arr":[1,2,3],"other":[1],"name":"Jane"}`, string(out))
+
+	_, _, err = patch.ApplyRecording([]byte(`{"arr": 1}`), nil)
+	assert.Error(err)
+}
+
+func TestApplyWithTouched(t *testing.T) {
+	assert := assert.New(t)
+
+	patch, err := NewPatch([]byte(`[
+		{"op": "add", "path": "/arr/-", "value": 3},
+		{"op": "test", "path": "/arr/0", "value": 1},
+		{"op": "replace", "path": "/name", "value": "Jane"},
+		{"op": "remove", "path": "/arr/-1"},
+		{"op": "move", "from": "/arr/-1", "path": "/other/-"},
+		{"op": "add", "path": "/obj/a/b", "value": "x", "x-ensure-path": true},
+		{"op": "replace", "path": "/name", "value": "Joe"}
+	]`))
+	assert.NoError(err)
+
+	out, touched, err := patch.ApplyWithTouched([]byte(`{"arr": [1, 2], "other": [0], "name": "John"}`), nil)
+	assert.NoError(err)
+	assert.Equal(`{"arr":[1],"other":[0,2],"name":"Joe","obj":{"a":{"b":"x"}}}`, string(out))
+	assert.Equal([]string{"/arr/2", "/name", "/arr/1", "/other/1", "/obj/a/b"}, touched)
+
+	_, _, err = patch.ApplyWithTouched([]byte(`{"arr": 1}`), nil)
+	assert.Error(err)
+}
+
+func TestApplyRecordingWithOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	doc := `{"arr": [1, 2, 3], "long": "0123456789abcdef"}`
+	apply := map[string]func(p Patch, options *Options) ([]byte, error){
+		"ApplyRecording": func(p Patch, options *Options) ([]byte, error) {
+			res, _, err := p.ApplyRecording([]byte(doc), options)
+			return res, err
+		},
+		"ApplyWithTouched": func(p Patch, options *Options) ([]byte, error) {
+			res, _, err := p.ApplyWithTouched([]byte(doc), options)
+			return res, err
+		},
+	}
+
+	for name, fn := range apply {
+		options := NewOptions()
+		options.AccumulatedCopySizeLimit = 20
+		p, _ := NewPatch([]byte(`[{"op": "copy", "from": "/long", "path": "/a"}, {"op": "copy", "from": "/long", "path": "/b"}]`))
+		_, err := fn(p, options)
+		assert.ErrorContainsf(err, "unable to copy, the accumulated size increase of copy is 36, exceeding the limit 20", name)
+		var opErr *OpError
+		if assert.ErrorAsf(err, &opErr, name) {
+			assert.Equalf(1, opErr.Index, name)
+		}
+
+		options = NewOptions()
+		options.MaxMoveCopyOps = 1
+		p, _ = NewPatch([]byte(`[{"op": "copy", "from": "/arr/0", "path": "/a"}, {"op": "move", "from": "/a", "path": "/b"}]`))
+		_, err = fn(p, options)
+		assert.EqualErrorf(err, "patch has 2 move and copy operations, exceeds the limit 1, invalid node detected", name)
+
+		var indexes []int
+		options = NewOptions()
+		options.StepValidate = func(index int, afterOp []byte) error {
+			indexes = append(indexes, index)
+			return nil
+		}
+		p, _ = NewPatch([]byte(`[{"op": "add", "path": "/a", "value": 1}, {"op": "remove", "path": "/a"}, {"op": "test", "path": "/arr/0", "value": 1}]`))
+		_, err = fn(p, options)
+		assert.NoErrorf(err, name)
+		assert.Equalf([]int{0, 1, 2}, indexes, name)
+
+		options = NewOptions()
+		options.StableArrayIndices = true
+		p, _ = NewPatch([]byte(`[{"op": "remove", "path": "/arr/0"}, {"op": "replace", "path": "/arr/2", "value": "x"}]`))
+		res, err := fn(p, options)
+		assert.NoErrorf(err, name)
+		assert.Equalf(`{"arr":[2,"x"],"long":"0123456789abcdef"}`, string(res), name)
+	}
+
+	options := NewOptions()
+	options.StableArrayIndices = true
+	p, _ := NewPatch([]byte(`[{"op": "remove", "path": "/arr/0"}, {"op": "move", "from": "/arr/2", "path": "/arr/1"},
+		{"op": "copy", "from": "/arr/1", "path": "/arr/-"}]`))
+	res, recorded, err := p.ApplyRecording([]byte(doc), options)
+	assert.NoError(err)
+	assert.Equal(`{"arr":[3,2,2],"long":"0123456789abcdef"}`, string(res))
+	assert.Equal(`[{"op":"remove","path":"/arr/0"},{"op":"move","path":"/arr/0","from":"/arr/1"},`+
+		`{"op":"copy","path":"/arr/2","from":"/arr/1"}]`, mustJSONString(recorded))
+
+	res, err = recorded.Apply([]byte(doc))
+	assert.NoError(err)
+	assert.Equal(`{"arr":[3,2,2],"long":"0123456789abcdef"}`, string(res))
+
+	_, touched, err := p.ApplyWithTouched([]byte(doc), options)
+	assert.NoError(err)
+	assert.Equal([]string{"/arr/0", "/arr/1", "/arr/2"}, touched)
+}
+
+func TestDocumentType(t *testing.T) {
+	assert := assert.New(t)
+
+	cases := []struct {
+		doc string
+		typ NodeType
+	}{
+		{``, TypeNull},
+		{`   `, TypeNull},
+		{`null`, TypeNull},
+		{` true`, TypeBool},
+		{"\n\tfalse", TypeBool},
+		{`0`, TypeNumber},
+		{`-1.5e3`, TypeNumber},
+		{"\r\n 42", TypeNumber},
+		{`"abc"`, TypeString},
+		{` "`, TypeString},
+		{`[]`, TypeArray},
+		{"\n [1, 2]", TypeArray},
+		{`{}`, TypeObject},
+		{"\t{\"a\": 1}", TypeObject},
+		{`abc`, TypeInvalid},
+		{`+1`, TypeInvalid},
+	}
+
+	for _, c := range cases {
+		assert.Equalf(c.typ, DocumentType([]byte(c.doc)), "%q", c.doc)
+	}
+
+	assert.Equal("object", TypeObject.String())
+	assert.Equal("array", TypeArray.String())
+	assert.Equal("string", TypeString.String())
+	assert.Equal("number", TypeNumber.String())
+	assert.Equal("boolean", TypeBool.String())
+	assert.Equal("null", TypeNull.String())
+	assert.Equal("invalid", TypeInvalid.String())
+}
+
+func TestOperationOptionsOverrides(t *testing.T) {
+	assert := assert.New(t)
+
+	patch := `[
+		{"op": "add", "path": "/a/b/c", "value": 1, "x-ensure-path": true},
+		{"op": "remove", "path": "/x/y", "x-allow-missing": true},
+		{"op": "add", "path": "/d/e", "value": 2}
+	]`
+	_, err := applyPatch(`{}`, patch)
+	assert.EqualError(err, `add operation does not apply for "/d/e", unable to resolve token "d" at "" (object has keys [a]), missing value`)
+
+	out, err := applyPatch(`{"d": {}}`, patch)
+	assert.NoError(err)
+	assert.Equal(`{"d":{"e":2},"a":{"b":{"c":1}}}`, out)
+
+	options := NewOptions()
+	options.EnsurePathExistsOnAdd = true
+	out, err = applyPatchWithOptions(`{}`, patch, options)
+	assert.NoError(err)
+	assert.Equal(`{"a":{"b":{"c":1}},"d":{"e":2}}`, out)
+
+	_, err = applyPatchWithOptions(`{}`, `[{"op": "add", "path": "/a/b", "value": 1, "x-ensure-path": false}]`, options)
+	assert.EqualError(err, `add operation does not apply for "/a/b", unable to resolve token "a" at "" (object has keys []), missing value`)
+	assert.True(options.EnsurePathExistsOnAdd)
+
+	p, err := NewPatch([]byte(patch))
+	assert.NoError(err)
+	assert.Equal(`[{"op":"add","path":"/a/b/c","value":1,"x-ensure-path":true},`+
+		`{"op":"remove","path":"/x/y","x-allow-missing":true},{"op":"add","path":"/d/e","value":2}]`, mustJSONString(p))
+}
+
+func TestOnArrayShift(t *testing.T) {
+	assert := assert.New(t)
+
+	var shifts []string
+	options := NewOptions()
+	options.OnArrayShift = func(path string, fromIdx, toIdx int) {
+		shifts = append(shifts, fmt.Sprintf("%s:%d->%d", path, fromIdx, toIdx))
+	}
+
+	cases := []struct {
+		patch  string
+		shifts []string
+	}{
+		{`[{"op": "add", "path": "/arr/1", "value": 9}]`, []string{"/arr:3->4", "/arr:2->3", "/arr:1->2"}},
+		{`[{"op": "add", "path": "/arr/-", "value": 9}]`, nil},
+		{`[{"op": "add", "path": "/arr/-2", "value": 9}]`, []string{"/arr:3->4"}},
+		{`[{"op": "remove", "path": "/arr/1"}]`, []string{"/arr:2->1", "/arr:3->2"}},
+		{`[{"op": "remove", "path": "/arr/-1"}]`, nil},
+		{`[{"op": "remove", "path": "/arr/9"}]`, nil},
+		{`[{"op": "replace", "path": "/arr/0", "value": 9}]`, nil},
+		{`[{"op": "copy", "from": "/arr/3", "path": "/obj/list/0"}]`, []string{"/obj/list:0->1"}},
+		{
+			`[{"op": "move", "from": "/arr/0", "path": "/arr/2"}]`,
+			[]string{"/arr:1->0", "/arr:2->1", "/arr:3->2", "/arr:2->3"},
+		},
+		{`[{"op": "add", "path": "/obj/k", "value": 9}, {"op": "remove", "path": "/obj/list"}]`, nil},
+	}
+
+	for i, c := range cases {
+		shifts = nil
+		options.AllowMissingPathOnRemove = true
+		_, err := applyPatchWithOptions(`{"arr": [0, 1, 2, 3], "obj": {"list": ["a"]}}`, c.patch, options)
+		assert.NoErrorf(err, "case %d", i)
+		assert.Equalf(c.shifts, shifts, "case %d", i)
+	}
+}
+
+func TestOnIndexChange(t *testing.T) {
+	assert := assert.New(t)
+
+	var changes []string
+	options := NewOptions()
+	options.OnIndexChange = func(arrayPath string, oldIndex, newIndex int) {
+		changes = append(changes, fmt.Sprintf("%s:%d->%d", arrayPath, oldIndex, newIndex))
+	}
+
+	cases := []struct {
+		patch   string
+		changes []string
+	}{
+		{`[{"op": "add", "path": "/arr/1", "value": 9}]`, []string{"/arr:3->4", "/arr:2->3", "/arr:1->2"}},
+		{`[{"op": "add", "path": "/arr/-", "value": 9}]`, nil},
+		{`[{"op": "remove", "path": "/arr/1"}]`, []string{"/arr:2->1", "/arr:3->2"}},
+		{`[{"op": "copy", "from": "/arr/3", "path": "/obj/list/0"}]`, []string{"/obj/list:0->1"}},
+		{`[{"op": "move", "from": "/arr/0", "path": "/arr/2"}]`, []string{"/arr:1->0", "/arr:2->1", "/arr:0->2"}},
+		{`[{"op": "move", "from": "/arr/3", "path": "/arr/1"}]`, []string{"/arr:2->3", "/arr:1->2", "/arr:3->1"}},
+		{`[{"op": "move", "from": "/arr/-1", "path": "/arr/-"}]`, nil},
+		{`[{"op": "move", "from": "/arr/1", "path": "/obj/list/0"}]`, []string{"/arr:2->1", "/arr:3->2", "/obj/list:0->1"}},
+		{`[{"op": "remove_each", "path": "/obj/*/0"}]`, nil},
+		{`[{"op": "replace", "path": "/arr/0", "value": 9}]`, nil},
+	}
+
+	for i, c := range cases {
+		changes = nil
+		options.AllowExtendedOps = true
+		_, err := applyPatchWithOptions(`{"arr": [0, 1, 2, 3], "obj": {"list": ["a"]}}`, c.patch, options)
+		assert.NoErrorf(err, "case %d", i)
+		assert.Equalf(c.changes, changes, "case %d", i)
+	}
+}
+
+func TestMaxNestingDepth(t *testing.T) {
+	assert := assert.New(t)
+
+	nested := func(open, close string, n int) string {
+		return strings.Repeat(open, n) + `1` + strings.Repeat(close, n)
+	}
+
+	// the innermost object is at depth maxNestingDepth-1.
+	doc := nested(`{"a":`, `}`, maxNestingDepth)
+	path := strings.Repeat("/a", maxNestingDepth-1) + "/b"
+	p, _ := NewPatch([]byte(`[{"op": "add", "path": "` + path + `", "value": 2}]`))
+	res, err := p.Apply([]byte(doc))
+	assert.NoError(err)
+	assert.True(strings.HasSuffix(string(res), `{"a":1,"b":2}`+strings.Repeat(`}`, maxNestingDepth-1)))
+
+	doc = nested(`{"a":`, `}`, maxNestingDepth+1)
+	path = strings.Repeat("/a", maxNestingDepth) + "/b"
+	p, _ = NewPatch([]byte(`[{"op": "add", "path": "` + path + `", "value": 2}]`))
+	_, err = p.Apply([]byte(doc))
+	assert.ErrorContains(err, "exceeded max nesting depth 1000, invalid node detected")
+
+	doc = nested(`[`, `]`, maxNestingDepth+1)
+	path = strings.Repeat("/0", maxNestingDepth) + "/-"
+	p, _ = NewPatch([]byte(`[{"op": "add", "path": "` + path + `", "value": 2}]`))
+	_, err = p.Apply([]byte(doc))
+	assert.ErrorIs(err, ErrInvalid)
+	assert.ErrorContains(err, "exceeded max nesting depth 1000")
+
+	// untouched deep subtrees are not parsed.
+	p, _ = NewPatch([]byte(`[{"op": "add", "path": "/b", "value": 2}]`))
+	res, err = p.Apply([]byte(`{"a": ` + doc + `}`))
+	assert.NoError(err)
+	assert.Equal(`{"a":`+doc+`,"b":2}`, string(res))
+}
+
+func TestKeyNormalize(t *testing.T) {
+	assert := assert.New(t)
+
+	doc := `{"name": "a", "Tags": ["x"], "Info": {"City": "Paris"}}`
+	options := NewOptions()
+	options.KeyNormalize = func(key string) string {
+		return strings.ToLower(strings.TrimSpace(key))
+	}
+
+	cases := []struct {
+		doc, patch, result, err string
+	}{
+		{
+			doc,
+			`[{"op": "add", "path": "/Age", "value": 24}]`,
+			`{"name":"a","Tags":["x"],"Info":{"City":"Paris"},"age":24}`,
+			``,
+		},
+		{
+			doc,
+			`[{"op": "replace", "path": "/NAME ", "value": "b"}, {"op": "test", "path": "/Name", "value": "b"}]`,
+			`{"name":"b","Tags":["x"],"Info":{"City":"Paris"}}`,
+			``,
+		},
+		{
+			doc,
+			`[{"op": "add", "path": "/tags/-", "value": "y"}, {"op": "replace", "path": "/info/city", "value": "Lyon"}]`,
+			`{"name":"a","Tags":["x","y"],"Info":{"city":"Lyon"}}`,
+			``,
+		},
+		{
+			doc,
+			`[{"op": "add", "path": "/TAGS", "value": []}]`,
+			`{"name":"a","Info":{"City":"Paris"},"tags":[]}`,
+			``,
+		},
+		{
+			doc,
+			`[{"op": "move", "from": "/INFO/CITY", "path": "/City"}, {"op": "remove", "path": "/info"}]`,
+			`{"name":"a","Tags":["x"],"city":"Paris"}`,
+			``,
+		},
+		{
+			doc,
+			`[{"op": "copy", "from": "/Name", "path": "/Info/ Alias "}]`,
+			`{"name":"a","Tags":["x"],"Info":{"City":"Paris","alias":"a"}}`,
+			``,
+		},
+		{
+			`{"Name": "a", "NAME": "b"}`,
+			`[{"op": "add", "path": "/name", "value": "c"}]`,
+			`{"name":"c"}`,
+			``,
+		},
+		{
+			`{"Name": "a", "NAME": "b"}`,
+			`[{"op": "test", "path": "/name", "value": "a"}]`,
+			``,
+			`test operation for path "/name" failed, keys "Name" and "NAME" both normalize to "name", conflicting operation`,
+		},
+		{
+			doc,
+			`[{"op": "remove", "path": "/missing"}]`,
+			``,
+			`remove operation does not apply for "/missing", unable to remove nonexistent key "missing", missing value`,
+		},
+	}
+
+	for i, c := range cases {
+		out, err := applyPatchWithOptions(c.doc, c.patch, options)
+		if c.err != "" {
+			assert.EqualErrorf(err, c.err, "case %d", i)
+			continue
+		}
+		if assert.NoErrorf(err, "case %d", i) {
+			assert.Equalf(c.result, out, "case %d", i)
+		}
+	}
+
+	out, err := applyPatchWithOptions(doc, `[{"op": "add", "path": "/Age", "value": 24}]`, NewOptions())
+	assert.NoError(err)
+	assert.Equal(`{"name":"a","Tags":["x"],"Info":{"City":"Paris"},"Age":24}`, out)
+}
+
+func TestInvert(t *testing.T) {
+	assert := assert.New(t)
+
+	cases := []struct {
+		doc, patch, inverse string
+	}{
+		{
+			`{"a": 1}`,
+			`[{"op": "add", "path": "/b", "value": 2}, {"op": "add", "path": "/a", "value": 3}]`,
+			`[{"op":"replace","path":"/a","value":1},{"op":"remove","path":"/b"}]`,
+		},
+		{
+			`{"list": [1, 2, 3, 4]}`,
+			`[{"op": "remove", "path": "/list/1"}, {"op": "remove", "path": "/list/-1"}, {"op": "remove", "path": "/list/0"}]`,
+			`[{"op":"add","path":"/list/0","value":1},{"op":"add","path":"/list/2","value":4},{"op":"add","path":"/list/1","value":2}]`,
+		},
+		{
+			`{"list": [1, 2]}`,
+			`[{"op": "add", "path": "/list/-", "value": 3}, {"op": "add", "path": "/list/0", "value": 0}]`,
+			`[{"op":"remove","path":"/list/0"},{"op":"remove","path":"/list/2"}]`,
+		},
+		{
+			`{"a": {"b": [1, {"c": 2}]}}`,
+			`[{"op": "replace", "path": "/a/b/1/c", "value": 3}, {"op": "replace", "path": "/a/b", "value": null}]`,
+			`[{"op":"replace","path":"/a/b","value":[1,{"c":3}]},{"op":"replace","path":"/a/b/1/c","value":2}]`,
+		},
+		{
+			`{"list": ["a", "b", "c"], "x": {"y": 1}}`,
+			`[{"op": "move", "from": "/list/0", "path": "/list/2"}, {"op": "move", "from": "/x/y", "path": "/z"}]`,
+			`[{"op":"move","path":"/x/y","from":"/z"},{"op":"move","path":"/list/0","from":"/list/2"}]`,
+		},
+		{
+			`{"a": 1, "b": 2}`,
+			`[{"op": "move", "from": "/a", "path": "/b"}]`,
+			`[{"op":"move","path":"/a","from":"/b"},{"op":"add","path":"/b","value":2}]`,
+		},
+		{
+			`{"a": {"b": 1}, "list": [1]}`,
+			`[{"op": "copy", "from": "/a", "path": "/list/0"}, {"op": "copy", "from": "/a/b", "path": "/a/c"}]`,
+			`[{"op":"remove","path":"/a/c"},{"op":"remove","path":"/list/0"}]`,
+		},
+		{
+			`{"a": 1}`,
+			`[{"op": "test", "path": "/a", "value": 1}, {"op": "replace", "path": "", "value": [1]}]`,
+			`[{"op":"replace","path":"","value":{"a":1}}]`,
+		},
+		{
+			`{"a": {}, "list": [1]}`,
+			`[{"op": "add", "path": "/a/b/c", "value": 1, "x-ensure-path": true}, {"op": "add", "path": "/list/3/x", "value": 1, "x-ensure-path": true}]`,
+			`[{"op":"replace","path":"/list","value":[1]},{"op":"replace","path":"/a","value":{}}]`,
+		},
+		{
+			`{"a": 1}`,
+			`[{"op": "remove", "path": "/b", "x-allow-missing": true}]`,
+			`[]`,
+		},
+	}
+
+	for i, c := range cases {
+		p, err := NewPatch([]byte(c.patch))
+		if !assert.NoErrorf(err, "case %d", i) {
+			continue
+		}
+		inverse, err := p.Invert([]byte(c.doc))
+		if !assert.NoErrorf(err, "case %d", i) {
+			continue
+		}
+		assert.Equalf(c.inverse, mustJSONString(inverse), "case %d", i)
+
+		ok, err := IsInverse(p, inverse, []byte(c.doc), nil)
+		assert.NoErrorf(err, "case %d", i)
+		assert.Truef(ok, "case %d", i)
+	}
+
+	for i, c := range Cases {
+		if c.allowMissingPathOnRemove || c.ensurePathExistsOnAdd {
+			continue
+		}
+		p, err := NewPatch([]byte(c.patch))
+		if !assert.NoErrorf(err, "case %d", i) {
+			continue
+		}
+		inverse, err := p.Invert([]byte(c.doc))
+		if !assert.NoErrorf(err, "case %d", i) {
+			continue
+		}
+		ok, err := IsInverse(p, inverse, []byte(c.doc), nil)
+		assert.NoErrorf(err, "case %d", i)
+		assert.Truef(ok, "case %d, %s", i, mustJSONString(inverse))
+	}
+
+	p := Patch{{Op: "remove", Path: "/missing"}}
+	_, err := p.Invert([]byte(`{"a": 1}`))
+	assert.ErrorContains(err, "unable to invert remove operation 0")
+}
+
+func TestStepValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	doc := `{"balance": 10, "log": []}`
+	patch := `[
+		{"op": "replace", "path": "/balance", "value": 5},
+		{"op": "add", "path": "/log/-", "value": "withdraw 5"},
+		{"op": "replace", "path": "/balance", "value": -5},
+		{"op": "replace", "path": "/balance", "value": 0}
+	]`
+
+	var steps []string
+	options := NewOptions()
+	options.StepValidate = func(index int, afterOp []byte) error {
+		steps = append(steps, fmt.Sprintf("%d:%s", index, afterOp))
+		var v struct {
+			Balance int `json:"balance"`
+		}
+		if err := json.Unmarshal(afterOp, &v); err != nil {
+			return err
+		}
+		if v.Balance < 0 {
+			return fmt.Errorf("negative balance %d", v.Balance)
+		}
+		return nil
+	}
+
+	_, err := applyPatchWithOptions(doc, patch, options)
+	assert.EqualError(err, "replace operation 2 does not validate, negative balance -5")
+	assert.Equal([]string{
+		`0:{"balance":5,"log":[]}`,
+		`1:{"balance":5,"log":["withdraw 5"]}`,
+		`2:{"balance":-5,"log":["withdraw 5"]}`,
+	}, steps)
+
+	steps = nil
+	options.StepValidate = func(index int, afterOp []byte) error {
+		steps = append(steps, fmt.Sprintf("%d:%s", index, afterOp))
+		return nil
+	}
+	out, err := applyPatchWithOptions(doc, `[{"op": "replace", "path": "", "value": [1]}, {"op": "add", "path": "/-", "value": 2}]`, options)
+	assert.NoError(err)
+	assert.Equal(`[1,2]`, out)
+	assert.Equal([]string{`0:[1]`, `1:[1,2]`}, steps)
+
+	out, err = applyPatchWithOptions(doc, patch, options)
+	assert.NoError(err)
+	assert.Equal(`{"balance":0,"log":["withdraw 5"]}`, out)
+}
+
+func TestApplyWithContext(t *testing.T) {
+	assert := assert.New(t)
+
+	doc := []byte(`{"a": 1, "list": []}`)
+	patch, _ := NewPatch([]byte(`[
+		{"op": "replace", "path": "/a", "value": 2},
+		{"op": "add", "path": "/list/-", "value": 1}
+	]`))
+
+	out, err := patch.ApplyWithContext(context.Background(), doc, nil)
+	assert.NoError(err)
+	assert.Equal(`{"a":2,"list":[1]}`, string(out))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = patch.ApplyWithContext(ctx, doc, nil)
+	assert.Equal(context.Canceled, err)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	applied := 0
+	options := NewOptions()
+	options.StepValidate = func(index int, afterOp []byte) error {
+		applied++
+		cancel()
+		return nil
+	}
+	_, err = patch.ApplyWithContext(ctx, doc, options)
+	assert.Equal(context.Canceled, err)
+	assert.Equal(1, applied)
+	assert.Nil(options.ctx)
+
+	options = NewOptions()
+	options.EnsurePathExistsOnAdd = true
+	options.ctx = ctx
+	pd, _ := NewNode(doc).intoContainer()
+	assert.Equal(context.Canceled, ensurePathExists(&pd, "/list/100000/x", options))
+	assert.Equal(context.Canceled, ensurePathExists(&pd, "/b/100000/x", options))
+	a, _ := pd.get("list", options)
+	assert.Equal(`[]`, a.String())
+}
+
+func TestOpError(t *testing.T) {
+	assert := assert.New(t)
+
+	doc := []byte(`{"a": 1, "list": [1, 2]}`)
+	cases := []struct {
+		patch    string
+		index    int
+		op, path string
+		sentinel error
+	}{
+		{
+			`[{"op": "add", "path": "/b", "value": 1}, {"op": "test", "path": "/a", "value": 1}, {"op": "remove", "path": "/foo"}]`,
+			2, "remove", "/foo", ErrMissing,
+		},
+		{
+			`[{"op": "replace", "path": "/list/5", "value": 1}]`,
+			0, "replace", "/list/5", ErrMissing,
+		},
+		{
+			`[{"op": "add", "path": "/list/5", "value": 1}]`,
+			0, "add", "/list/5", ErrInvalidIndex,
+		},
+		{
+			`[{"op": "add", "path": "/b", "value": 1}, {"op": "add", "path": "/x/y", "value": 1}]`,
+			1, "add", "/x/y", ErrMissing,
+		},
+		{
+			`[{"op": "move", "from": "/list", "path": "/list/0"}]`,
+			0, "move", "/list/0", ErrMissing,
+		},
+		{
+			`[{"op": "unknown", "path": "/a"}]`,
+			0, "unknown", "/a", nil,
+		},
+	}
+
+	for i, c := range cases {
+		p, err := NewPatch([]byte(c.patch))
+		if !assert.NoErrorf(err, "case %d", i) {
+			continue
+		}
+
+		_, err = p.Apply(doc)
+		var opErr *OpError
+		if !assert.Truef(errors.As(err, &opErr), "case %d, %v", i, err) {
+			continue
+		}
+		assert.Equalf(c.index, opErr.Index, "case %d", i)
+		assert.Equalf(c.op, opErr.Op.Op, "case %d", i)
+		assert.Equalf(c.path, opErr.Path, "case %d", i)
+		assert.Equalf(opErr.Err.Error(), err.Error(), "case %d", i)
+		assert.Equalf(opErr.Err, errors.Unwrap(err), "case %d", i)
+		if c.sentinel != nil {
+			assert.Truef(errors.Is(err, c.sentinel), "case %d, %v", i, err)
+		}
+		for _, sentinel := range []error{ErrMissing, ErrInvalid, ErrInvalidIndex, ErrTimeout, ErrConflict} {
+			if sentinel != c.sentinel {
+				assert.Falsef(errors.Is(err, sentinel), "case %d, %v", i, sentinel)
+			}
+		}
+
+		_, _, err = p.ApplyRecording(doc, nil)
+		if assert.Truef(errors.As(err, &opErr), "case %d", i) {
+			assert.Equalf(c.index, opErr.Index, "case %d", i)
+		}
+	}
+
+	options := NewOptions()
+	options.StepValidate = func(index int, afterOp []byte) error { return ErrConflict }
+	p, _ := NewPatch([]byte(`[{"op": "replace", "path": "/a", "value": 2}]`))
+	_, err := p.ApplyWithOptions(doc, options)
+	var opErr *OpError
+	assert.True(errors.As(err, &opErr))
+	assert.True(errors.Is(err, ErrConflict))
+	assert.Equal(`replace operation 0 does not validate, conflicting operation`, err.Error())
+
+	// the sentinels are matched by wrapping, not by the error message.
+	options.StepValidate = func(index int, afterOp []byte) error { return errors.New("missing value") }
+	_, err = p.ApplyWithOptions(doc, options)
+	assert.Equal(`replace operation 0 does not validate, missing value`, err.Error())
+	assert.False(errors.Is(err, ErrMissing))
+
+	options = NewOptions()
+	options.Timeout = time.Nanosecond
+	_, err = p.ApplyWithOptions(doc, options)
+	assert.True(errors.Is(err, ErrTimeout), err)
+}
+
+func TestMaxMoveCopyOps(t *testing.T) {
+	assert := assert.New(t)
+
+	doc := `{"a": 1, "b": [1, 2]}`
+	options := NewOptions()
+	options.MaxMoveCopyOps = 2
+
+	cases := []struct {
+		patch, result, err string
+	}{
+		{
+			`[{"op": "add", "path": "/c", "value": 1}, {"op": "replace", "path": "/a", "value": 2},
+			  {"op": "add", "path": "/d", "value": 1}, {"op": "remove", "path": "/b/0"}]`,
+			`{"a":2,"b":[2],"c":1,"d":1}`,
+			``,
+		},
+		{
+			`[{"op": "copy", "from": "/a", "path": "/c"}, {"op": "move", "from": "/b/0", "path": "/b/-"}]`,
+			`{"a":1,"b":[2,1],"c":1}`,
+			``,
+		},
+		{
+			`[{"op": "copy", "from": "/a", "path": "/c"}, {"op": "copy", "from": "/b", "path": "/d"},
+			  {"op": "copy", "from": "/a", "path": "/e"}]`,
+			``,
+			`patch has 3 move and copy operations, exceeds the limit 2, invalid node detected`,
+		},
+		{
+			`[{"op": "add", "path": "/c", "value": 1}, {"op": "move", "from": "/a", "path": "/x"},
+			  {"op": "copy", "from": "/b", "path": "/d"}, {"op": "move", "from": "/x", "path": "/a"}]`,
+			``,
+			`patch has 3 move and copy operations, exceeds the limit 2, invalid node detected`,
+		},
+	}
+
+	for i, c := range cases {
+		p, err := NewPatch([]byte(c.patch))
+		if !assert.NoErrorf(err, "case %d", i) {
+			continue
+		}
+
+		node := NewNode([]byte(doc))
+		err = node.Patch(p, options)
+		if c.err != "" {
+			assert.EqualErrorf(err, c.err, "case %d", i)
+			// the patch is rejected before any operation applies.
+			assert.Equalf(`{"a":1,"b":[1,2]}`, marshal(t, node), "case %d", i)
+			continue
+		}
+		if assert.NoErrorf(err, "case %d", i) {
+			assert.Equalf(c.result, marshal(t, node), "case %d", i)
+		}
+	}
+
+	p, _ := NewPatch([]byte(`[{"op": "copy", "from": "/a", "path": "/c"}, {"op": "copy", "from": "/a", "path": "/d"},
+		{"op": "copy", "from": "/a", "path": "/e"}]`))
+	res, err := p.ApplyWithOptions([]byte(doc), NewOptions())
+	assert.NoError(err)
+	assert.Equal(`{"a":1,"b":[1,2],"c":1,"d":1,"e":1}`, string(res))
+}
+
+func TestResolveValueRefs(t *testing.T) {
+	assert := assert.New(t)
+
+	doc := `{"a": {"x": [1, 2]}, "b": "s"}`
+	options := NewOptions()
+	options.ResolveValueRefs = true
+	options.AllowExtendedOps = true
+
+	cases := []struct {
+		patch, result, err string
+	}{
+		{
+			`[{"op": "add", "path": "/c", "value": {"$ref": "/a"}}, {"op": "add", "path": "/c/x/-", "value": 3}]`,
+			`{"a":{"x":[1,2]},"b":"s","c":{"x":[1,2,3]}}`,
+			``,
+		},
+		{
+			`[{"op": "replace", "path": "/b", "value": { "$ref" : "/a/x/1" }}, {"op": "add", "path": "/a/x/0", "value": {"$ref": "/b"}}]`,
+			`{"a":{"x":[2,1,2]},"b":2}`,
+			``,
+		},
+		{
+			`[{"op": "cas", "path": "/b", "expected": "s", "value": {"$ref": ""}}]`,
+			`{"a":{"x":[1,2]},"b":{"a":{"x":[1,2]},"b":"s"}}`,
+			``,
+		},
+		{
+			`[{"op": "add", "path": "/c", "value": {"$ref": "/a", "title": "t"}}, {"op": "add", "path": "/d", "value": {"$ref": 1}},
+			  {"op": "add", "path": "/e", "value": [{"$ref": "/a"}]}, {"op": "test", "path": "/b", "value": "s"}]`,
+			`{"a":{"x":[1,2]},"b":"s","c":{"$ref":"/a","title":"t"},"d":{"$ref":1},"e":[{"$ref":"/a"}]}`,
+			``,
+		},
+		{
+			`[{"op": "add", "path": "/c", "value": {"$ref": "/missing"}}]`,
+			``,
+			`add operation does not apply for "/c", unable to resolve value reference "/missing", unable to get nonexistent key "missing", missing value`,
+		},
+		{
+			`[{"op": "add", "path": "/c", "value": {"$ref": "#/definitions/a"}}]`,
+			``,
+			`add operation does not apply for "/c", unable to resolve value reference "#/definitions/a"`,
+		},
+	}
+
+	for i, c := range cases {
+		p, err := NewPatch([]byte(c.patch))
+		if !assert.NoErrorf(err, "case %d", i) {
+			continue
+		}
+
+		res, err := p.ApplyWithOptions([]byte(doc), options)
+		if c.err != "" {
+			assert.ErrorContainsf(err, c.err, "case %d", i)
+			continue
+		}
+		if assert.NoErrorf(err, "case %d", i) {
+			assert.Equalf(c.result, string(res), "case %d", i)
+		}
+	}
+
+	p, _ := NewPatch([]byte(`[{"op": "add", "path": "/c", "value": {"$ref": "/a"}}]`))
+	res, err := p.Apply([]byte(doc))
+	assert.NoError(err)
+	assert.Equal(`{"a":{"x":[1,2]},"b":"s","c":{"$ref":"/a"}}`, string(res))
+
+	options.AccumulatedCopySizeLimit = 10
+	_, err = p.ApplyWithOptions([]byte(doc), options)
+	assert.ErrorContains(err, "unable to copy, the accumulated size increase of copy is 11, exceeding the limit 10")
+}
+
+func TestNodeType(t *testing.T) {
+	assert := assert.New(t)
+
+	node := NewNode([]byte(`{"o": {}, "a": [1], "s": "x", "n": 1.5, "b": false, "z": null}`))
+	assert.Equal(TypeObject, node.Type())
+	cases := map[string]NodeType{
+		"/o": TypeObject, "/a": TypeArray, "/s": TypeString, "/n": TypeNumber, "/b": TypeBool, "/z": TypeNull,
+	}
+	for path, typ := range cases {
+		child, err := node.GetChild(path, nil)
+		assert.NoError(err)
+		assert.Equalf(typ, child.Type(), "path %q", path)
+	}
+
+	var n *Node
+	assert.Equal(TypeNull, n.Type())
+	assert.Equal(TypeArray, NewNode([]byte(` [1]`)).Type())
+	assert.Equal(TypeInvalid, NewNode([]byte(`x`)).Type())
+
+	p, _ := NewPatch([]byte(`[{"op": "replace", "path": "", "value": [1]}]`))
+	assert.NoError(node.Patch(p, nil))
+	assert.Equal(TypeArray, node.Type())
+}
+
+func TestStrictRFC6902(t *testing.T) {
+	assert := assert.New(t)
+
+	doc := `{"foo": ["bar", "baz"], "a": {"b": 1}}`
+	options := NewOptions()
+	options.AllowMissingPathOnRemove = true
+	options.EnsurePathExistsOnAdd = true
+	options.AllowExtendedOps = true
+	options.StrictRFC6902 = true
+
+	cases := []struct {
+		patch, result, err string
+	}{
+		{
+			`[{"op": "add", "path": "/foo/1", "value": "qux"}, {"op": "replace", "path": "/a/b", "value": 2}]`,
+			`{"a":{"b":2},"foo":["bar","qux","baz"]}`,
+			``,
+		},
+		{
+			`[{"op": "add", "path": "/foo/2", "value": "qux"}, {"op": "move", "from": "/foo/0", "path": "/foo/-"}]`,
+			`{"a":{"b":1},"foo":["baz","qux","bar"]}`,
+			``,
+		},
+		{
+			`[{"op": "add", "path": "/baz", "value": "qux", "op2": "remove"}]`,
+			``,
+			`add operation for "/baz" has member "op2" not defined by RFC 6902, invalid node detected`,
+		},
+		{
+			`[{"op": "add", "path": "/baz", "value": "qux", "Value": 1}]`,
+			``,
+			`add operation for "/baz" has member "Value" not defined by RFC 6902, invalid node detected`,
+		},
+		{
+			`[{"op": "test", "path": "/foo/1", "value": "baz"}, {"op": "copy", "from": "/a", "path": "/c"}]`,
+			`{"a":{"b":1},"c":{"b":1},"foo":["bar","baz"]}`,
+			``,
+		},
+		{
+			`[{"op": "add", "path": "/foo/-1", "value": "qux"}]`,
+			``,
+			`value was not a proper array index -1`,
+		},
+		{
+			`[{"op": "remove", "path": "/foo/-1"}]`,
+			``,
+			`value was not a proper array index -1`,
+		},
+		{
+			`[{"op": "replace", "path": "/foo/01", "value": "qux"}]`,
+			``,
+			`replace operation does not apply for "/foo/01", missing value`,
+		},
+		{
+			`[{"op": "test", "path": "/foo/1e0", "value": "baz"}]`,
+			``,
+			`value was not a proper array index 1e0`,
+		},
+		{
+			`[{"op": "add", "path": "/foo/3", "value": "qux"}]`,
+			``,
+			`unable to access invalid index 3`,
+		},
+		{
+			`[{"op": "test", "path": "/foo/0"}]`,
+			``,
+			`test operation for "/foo/0" has no value, invalid node detected`,
+		},
+		{
+			`[{"op": "add", "path": "/c"}]`,
+			``,
+			`add operation for "/c" has no value, invalid node detected`,
+		},
+		{
+			`[{"op": "copy", "path": "/c"}]`,
+			``,
+			`copy operation for "/c" has no from, invalid node detected`,
+		},
+		{
+			`[{"op": "remove", "path": "/missing"}]`,
+			``,
+			`missing value`,
+		},
+		{
+			`[{"op": "remove", "path": "/missing", "x-allow-missing": true}]`,
+			``,
+			`remove operation for "/missing" has member "x-allow-missing" not defined by RFC 6902, invalid node detected`,
+		},
+		{
+			`[{"op": "add", "path": "/x/y", "value": 1, "x-ensure-path": true}]`,
+			``,
+			`add operation for "/x/y" has member "x-ensure-path" not defined by RFC 6902, invalid node detected`,
+		},
+		{
+			`[{"op": "cas", "path": "/a/b", "expected": 1, "value": 2}]`,
+			``,
+			`cas operation for "/a/b" has member "expected" not defined by RFC 6902, invalid node detected`,
+		},
+		{
+			`[{"op": "cas", "path": "/a/b", "value": 2}]`,
+			``,
+			`unexpected op`,
+		},
+		{
+			`[{"op": "add", "path": "/foo/01", "value": "qux"}]`,
+			``,
+			`add operation does not apply for "/foo/01", value was not a proper array index 01, invalid index referenced`,
+		},
+		{
+			`[{"op": "test", "path": "/baz", "value": null}]`,
+			``,
+			`test operation for path "/baz" failed, unable to get nonexistent key "baz", missing value`,
+		},
+		{
+			`[{"op": "test", "path": "", "value": {"foo": ["bar", "baz"], "a": {"b": 1}}},
+			  {"op": "test", "path": "", "value": {"a": {"b": 1}, "foo": ["bar", "baz"]}}]`,
+			`{"a":{"b":1},"foo":["bar","baz"]}`,
+			``,
+		},
+		{
+			`[{"op": "test", "path": "", "value": {"foo": ["bar", "baz"]}}]`,
+			``,
+			`test operation for path "" failed, not equal`,
+		},
+	}
+
+	for i, c := range cases {
+		p, err := NewPatch([]byte(c.patch))
+		if !assert.NoErrorf(err, "case %d", i) {
+			continue
+		}
+		node := NewNode([]byte(doc))
+		err = node.Patch(p, options)
+		if c.err != "" {
+			assert.ErrorContainsf(err, c.err, "case %d", i)
+			continue
+		}
+		if assert.NoErrorf(err, "case %d", i) {
+			assert.JSONEqf(c.result, marshal(t, node), "case %d", i)
+		}
+	}
+
+	// the lenient options apply without StrictRFC6902, and unknown members are ignored.
+	options.StrictRFC6902 = false
+	p, _ := NewPatch([]byte(`[{"op": "remove", "path": "/foo/-1", "x": 1}, {"op": "remove", "path": "/missing"},
+		{"op": "add", "path": "/x/y", "value": 1}, {"op": "test", "path": "/baz", "value": null}]`))
+	res, err := p.ApplyWithOptions([]byte(doc), options)
+	assert.NoError(err)
+	assert.JSONEq(`{"a":{"b":1},"foo":["bar"],"x":{"y":1}}`, string(res))
+}
+
+func TestDisallowDuplicateKeys(t *testing.T) {
+	assert := assert.New(t)
+
+	options := NewOptions()
+	options.DisallowDuplicateKeys = true
+	options.AllowExtendedOps = true
+
+	cases := []struct {
+		doc, patch, result, err string
+	}{
+		{
+			`{"a": 1, "b": {"c": 2}}`,
+			`[{"op": "replace", "path": "/b/c", "value": 3}]`,
+			`{"a":1,"b":{"c":3}}`,
+			``,
+		},
+		{
+			`{"a": 1, "b": 2, "a": 3}`,
+			`[{"op": "add", "path": "/c", "value": 3}]`,
+			``,
+			`duplicate key "a" in document node, invalid node detected`,
+		},
+		{
+			`{"a": 1, "b": {"c": 2, "c": 3}}`,
+			`[{"op": "remove", "path": "/b/c"}]`,
+			``,
+			`duplicate key "c" in document node, invalid node detected`,
+		},
+		{
+			`{"a": [{"id": 1}, {"id": 2, "id": 3}]}`,
+			`[{"op": "replace", "path": "/a/1/id", "value": 4}]`,
+			``,
+			`duplicate key "id" in document node, invalid node detected`,
+		},
+		{
+			`{"a": 1}`,
+			`[{"op": "add", "path": "/b", "value": {"x": 1, "x": 2}}, {"op": "add", "path": "/b/y", "value": 1}]`,
+			``,
+			`add operation does not apply for "/b", duplicate key "x" in object at "", invalid node detected`,
+		},
+		{
+			`{"a": 1}`,
+			`[{"op": "copy", "from": "/a", "path": "/b"}, {"op": "add", "path": "/a", "value": 2}]`,
+			`{"a":2,"b":1}`,
+			``,
+		},
+		{
+			`{"a": 1}`,
+			`[{"op": "add", "path": "/b", "value": {"x": 1, "x": 2}}]`,
+			``,
+			`add operation does not apply for "/b", duplicate key "x" in object at "", invalid node detected`,
+		},
+		{
+			`{"a": 1}`,
+			`[{"op": "replace", "path": "/a", "value": [{"y": {"x": 1, "x": 2}}]}]`,
+			``,
+			`replace operation does not apply for "/a", duplicate key "x" in object at "/0/y", invalid node detected`,
+		},
+		{
+			`{"a": 1}`,
+			`[{"op": "test", "path": "/a", "value": {"x": 1, "x": 2}}]`,
+			``,
+			`test operation does not apply for "/a", duplicate key "x" in object at "", invalid node detected`,
+		},
+		{
+			`{"a": {"x": 1}}`,
+			`[{"op": "cas", "path": "/a", "expected": {"x": 1, "x": 1}, "value": 2}]`,
+			``,
+			`cas operation does not apply for "/a", duplicate key "x" in object at "", invalid node detected`,
+		},
+	}
+
+	for i, c := range cases {
+		p, err := NewPatch([]byte(c.patch))
+		if !assert.NoErrorf(err, "case %d", i) {
+			continue
+		}
+		res, err := p.ApplyWithOptions([]byte(c.doc), options)
+		if c.err != "" {
+			assert.ErrorContainsf(err, c.err, "case %d", i)
+			continue
+		}
+		if assert.NoErrorf(err, "case %d", i) {
+			assert.Equalf(c.result, string(res), "case %d", i)
+		}
+	}
+
+	// the last value wins without DisallowDuplicateKeys.
+	p, _ := NewPatch([]byte(`[{"op": "add", "path": "/c", "value": 3}]`))
+	res, err := p.ApplyWithOptions([]byte(`{"a": 1, "b": 2, "a": 3}`), NewOptions())
+	assert.NoError(err)
+	assert.Equal(`{"a":3,"b":2,"c":3}`, string(res))
+}
+
+func TestCheckDuplicateKeys(t *testing.T) {
+	assert := assert.New(t)
+
+	cases := []struct {
+		doc, err string
+	}{
+		{`{"a": 1, "b": {"a": 1}, "c": [{"a": 1}, {"a": 1}]}`, ``},
+		{`[1, "a", null, {}]`, ``},
+		{`"a"`, ``},
+		{`{"a": 1, "a": 2}`, `duplicate key "a" in object at "", invalid node detected`},
+		{`{"a": {"b": {"c": 1, "c": 2}}}`, `duplicate key "c" in object at "/a/b", invalid node detected`},
+		{`{"a/b": [0, {"x": 1, "x": 1}]}`, `duplicate key "x" in object at "/a~1b/1", invalid node detected`},
+		{`{"a": 1} {"a": 2}`, `unexpected data after the JSON document, invalid node detected`},
+		{`{"a": 1`, `unexpected end of JSON input`},
+	}
+
+	for i, c := range cases {
+		err := CheckDuplicateKeys([]byte(c.doc))
+		if c.err != "" {
+			assert.EqualErrorf(err, c.err, "case %d", i)
+		} else {
+			assert.NoErrorf(err, "case %d", i)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+// (c) 2022-2022, LDC Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package jsonpatch
+
+import (
+	"fmt"
+)
+
+// PatchLog records the patches applied to a JSON document along with their inverses, e.g. for
+// event-sourced stores to roll the document back to a prior version. The inverses are computed
+// by Patch.Invert, so a reverted document equals the prior version, but its restored object
+// members may be in a different order. The zero value is ready to use, it is not safe for
+// concurrent use.
+type PatchLog struct {
+	entries []patchLogEntry
+}
+
+type patchLogEntry struct {
+	patch   Patch
+	inverse Patch
+}
+
+// Apply applies the patch to the JSON document and records it with its inverse.
+// It returns the new document, or an error without recording anything if the patch does not apply.
+func (l *PatchLog) Apply(doc []byte, p Patch) ([]byte, error) {
+	inverse, err := p.Invert(doc)
+	if err != nil {
+		return nil, err
+	}
+	res, err := p.Apply(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	l.entries = append(l.entries, patchLogEntry{patch: p, inverse: inverse})
+	return res, nil
+}
+
+// Revert applies the inverses of the last steps recorded patches to the JSON document, as
+// returned by the last Apply, most recent first, and drops the patches from the log.
+// It returns the prior version of the document, or an error without dropping anything if
+// there are fewer recorded patches than steps or an inverse does not apply.
+func (l *PatchLog) Revert(doc []byte, steps int) ([]byte, error) {
+	if steps < 0 || steps > len(l.entries) {
+		return nil, fmt.Errorf("unable to revert %d steps of %d recorded patches, %w",
+			steps, len(l.entries), ErrInvalidIndex)
+	}
+
+	n := len(l.entries) - steps
+	for i := len(l.entries) - 1; i >= n; i-- {
+		var err error
+		if doc, err = l.entries[i].inverse.Apply(doc); err != nil {
+			return nil, fmt.Errorf("unable to revert recorded patch %d, %w", i, err)
+		}
+	}
+
+	l.entries = l.entries[:n]
+	return doc, nil
+}
+
+// Len returns the number of recorded patches.
+func (l *PatchLog) Len() int {
+	return len(l.entries)
+}
+
+// Patch returns the recorded patch i and its inverse, in the order they were applied.
+func (l *PatchLog) Patch(i int) (Patch, Patch) {
+	return l.entries[i].patch, l.entries[i].inverse
+}
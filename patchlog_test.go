@@ -0,0 +1,69 @@
+// (c) 2022-2022, LDC Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package jsonpatch
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPatchLog(t *testing.T) {
+	assert := assert.New(t)
+
+	patches := []string{
+		`[{"op": "add", "path": "/items/-", "value": {"id": 3}}, {"op": "replace", "path": "/name", "value": "b"}]`,
+		`[{"op": "remove", "path": "/items/0"}, {"op": "add", "path": "/tags", "value": ["x"]}]`,
+		`[{"op": "move", "from": "/tags", "path": "/labels"}, {"op": "copy", "from": "/items/0", "path": "/first"}]`,
+	}
+
+	var log PatchLog
+	versions := []string{`{"name": "a", "items": [{"id": 1}, {"id": 2}]}`}
+	for i, s := range patches {
+		p, err := NewPatch([]byte(s))
+		assert.NoError(err)
+		doc, err := log.Apply([]byte(versions[i]), p)
+		if !assert.NoErrorf(err, "patch %d", i) {
+			return
+		}
+		versions = append(versions, string(doc))
+	}
+	assert.Equal(3, log.Len())
+	assert.JSONEq(`{"name": "b", "items": [{"id": 2}, {"id": 3}], "labels": ["x"], "first": {"id": 2}}`, versions[3])
+
+	p, inverse := log.Patch(1)
+	assert.Equal(2, len(p))
+	assert.Equal("remove", inverse[0].Op)
+
+	_, err := log.Revert([]byte(versions[3]), 4)
+	assert.ErrorContains(err, "unable to revert 4 steps of 3 recorded patches")
+	_, err = log.Revert([]byte(`{}`), 1)
+	assert.ErrorContains(err, "unable to revert recorded patch 2")
+	assert.Equal(3, log.Len())
+
+	doc, err := log.Revert([]byte(versions[3]), 2)
+	assert.NoError(err)
+	assert.True(Equal([]byte(versions[1]), doc), string(doc))
+	assert.Equal(1, log.Len())
+
+	// the log goes on from the reverted version.
+	p, _ = NewPatch([]byte(`[{"op": "add", "path": "/x", "value": 1}]`))
+	doc, err = log.Apply(doc, p)
+	assert.NoError(err)
+	assert.Equal(2, log.Len())
+
+	doc, err = log.Revert(doc, 2)
+	assert.NoError(err)
+	assert.True(Equal([]byte(versions[0]), doc), string(doc))
+	assert.Equal(0, log.Len())
+
+	doc, err = log.Revert(doc, 0)
+	assert.NoError(err)
+	assert.True(Equal([]byte(versions[0]), doc))
+
+	p, _ = NewPatch([]byte(`[{"op": "remove", "path": "/missing"}]`))
+	_, err = log.Apply(doc, p)
+	assert.Error(err)
+	assert.Equal(0, log.Len())
+}
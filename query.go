@@ -5,6 +5,7 @@ package jsonpatch
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strconv"
 	"strings"
@@ -17,22 +18,149 @@ func GetValueByPath(doc []byte, path string) ([]byte, error) {
 
 // GetChild returns the child node of a given path in the node.
 func (n *Node) GetChild(path string, options *Options) (*Node, error) {
+	if options == nil {
+		options = NewOptions()
+	}
+
 	pd, err := n.intoContainer()
 	switch {
 	case err != nil:
-		return nil, fmt.Errorf("unexpected node %q, %v", n.String(), err)
+		return nil, fmt.Errorf("unexpected node %q, %w", options.errorValue(n), err)
 	case pd == nil:
-		return nil, fmt.Errorf("unexpected node %q", n.String())
+		return nil, fmt.Errorf("unexpected node %q", options.errorValue(n))
 	}
 
+	con, key, err := resolveObject(&pd, path, options)
+	if con == nil {
+		return nil, fmt.Errorf("unable to get child node by path %q, %w", path, err)
+	}
+	return con.get(key, options)
+}
+
+// NodeRef is a live reference to a value in a node, bound to its parent container and key,
+// so that changes through the reference are written back into the node.
+// A reference is detached if its parent is replaced or removed by another change.
+type NodeRef struct {
+	con     container
+	key     string
+	options *Options
+}
+
+// Ref returns a live reference to the value of a given path in the node, the value itself
+// does not need to exist as long as its parent does, so that it can be set.
+// The root node can not be referenced.
+func (n *Node) Ref(path string, options *Options) (*NodeRef, error) {
 	if options == nil {
 		options = NewOptions()
 	}
-	con, key := findObject(&pd, path, options)
+
+	pd, err := n.intoContainer()
+	switch {
+	case err != nil:
+		return nil, fmt.Errorf("unexpected node %q, %w", options.errorValue(n), err)
+	case pd == nil:
+		return nil, fmt.Errorf("unexpected node %q", options.errorValue(n))
+	}
+
+	con, key, err := resolveObject(&pd, path, options)
 	if con == nil {
-		return nil, fmt.Errorf("unable to get child node by path %q, %v", path, ErrMissing)
+		return nil, fmt.Errorf("unable to reference node by path %q, %w", path, err)
 	}
-	return con.get(key, options)
+	return &NodeRef{con: con, key: key, options: options}, nil
+}
+
+// Value returns the referenced node, changes to it are reflected in the parent node.
+func (r *NodeRef) Value() (*Node, error) {
+	return r.con.get(r.key, r.options)
+}
+
+// Set sets the referenced value to the raw encoded JSON document, the member is added
+// if the parent is an object without it, an element of an array must exist.
+func (r *NodeRef) Set(v json.RawMessage) error {
+	if _, ok := r.con.(*partialArray); ok {
+		if _, err := r.con.get(r.key, r.options); err != nil {
+			return fmt.Errorf("unable to set %q, %w", r.key, err)
+		}
+	}
+	return r.con.set(r.key, newValueNode(v, r.options), r.options)
+}
+
+// Delete removes the referenced value from its parent, the following elements of an array
+// are shifted, so the reference then refers to the next element.
+func (r *NodeRef) Delete() error {
+	return r.con.remove(r.key, r.options)
+}
+
+// LocateDetailed returns the child node of a given path in the node, along with its parent node,
+// its key, and the index of the key among the members of the parent object, or the index of the
+// element in the parent array. The root node has no parent and -1 as index.
+func (n *Node) LocateDetailed(path string, options *Options) (value *Node, parent *Node, key string, index int, err error) {
+	if path == "" {
+		return n, nil, "", -1, nil
+	}
+
+	if options == nil {
+		options = NewOptions()
+	}
+
+	if _, err = toSubpaths(path); err != nil {
+		return nil, nil, "", 0, err
+	}
+	pd, err := n.intoContainer()
+	if pd == nil {
+		return nil, nil, "", 0, fmt.Errorf("unable to locate path %q, %w", path, ErrMissing)
+	}
+	p, err := resolvePointer(pd, path, options)
+	if err != nil {
+		return nil, nil, "", 0, fmt.Errorf("unable to locate path %q, %w", path, err)
+	}
+
+	parent = n
+	if len(p) > 1 {
+		con, k, err := findObject(&pd, p.Parent(), options)
+		if con == nil {
+			return nil, nil, "", 0, fmt.Errorf("unable to locate path %q, %w", path, err)
+		}
+		if parent, err = con.get(k, options); err != nil {
+			return nil, nil, "", 0, locateError(path, err)
+		}
+	}
+	if pd, _ = parent.intoContainer(); pd == nil {
+		return nil, nil, "", 0, fmt.Errorf("unable to locate path %q, %s, %w", path, describeValue(parent), ErrMissing)
+	}
+	key = p[len(p)-1]
+	if value, err = pd.get(key, options); err != nil {
+		return nil, nil, "", 0, locateError(path, err)
+	}
+
+	switch parent.which {
+	case eDoc:
+		// the key as stored, see KeyNormalize.
+		key, _ = parent.doc.lookupKey(key, options)
+		for i, k := range parent.doc.obj.Keys() {
+			if k == key {
+				index = i
+				break
+			}
+		}
+	case eAry:
+		if index, err = options.arrayIndex(key); err != nil {
+			return nil, nil, "", 0, fmt.Errorf("unable to locate path %q, %w", path, err)
+		}
+		if index < 0 {
+			index += len(parent.ary)
+		}
+	}
+	return value, parent, key, index, nil
+}
+
+// locateError returns the error of a path with a member or element that does not exist,
+// such as an array index out of range, as a missing value.
+func locateError(path string, err error) error {
+	if errors.Is(err, ErrMissing) {
+		return fmt.Errorf("unable to locate path %q, %w", path, err)
+	}
+	return fmt.Errorf("unable to locate path %q, %v, %w", path, err, ErrMissing)
 }
 
 // GetValue returns the child node of a given path in the node.
@@ -44,10 +172,324 @@ func (n *Node) GetValue(path string, options *Options) (json.RawMessage, error)
 	return cn.MarshalJSON()
 }
 
+// Exists reports whether a given path resolves to a value in the node, a member with
+// a null value exists. Like GetChild, the path must refer to a member or an element,
+// so the root path "" does not exist.
+func (n *Node) Exists(path string, options *Options) bool {
+	if options == nil {
+		options = NewOptions()
+	}
+
+	pd, err := n.intoContainer()
+	if err != nil || pd == nil {
+		return false
+	}
+
+	con, key, _ := resolveObject(&pd, path, options)
+	if con == nil {
+		return false
+	}
+	_, err = con.get(key, options)
+	return err == nil
+}
+
+// SetValue sets the value of a given path in the node to the raw encoded JSON document,
+// it replaces an existing value, or adds it like an "add" operation otherwise,
+// so the parents are created with Options.EnsurePathExistsOnAdd.
+func (n *Node) SetValue(path string, value json.RawMessage, options *Options) error {
+	if options == nil {
+		options = NewOptions()
+	}
+
+	op := Operation{Op: "add", Path: path, Value: value}
+	if path == "" {
+		op.Op = "replace"
+	} else if _, err := n.GetChild(path, options); err == nil {
+		op.Op = "replace"
+	}
+	return n.Patch(Patch{op}, options)
+}
+
+// DeleteValue removes the value of a given path in the node like a "remove" operation,
+// a missing path is ignored with Options.AllowMissingPathOnRemove.
+func (n *Node) DeleteValue(path string, options *Options) error {
+	return n.Patch(Patch{{Op: "remove", Path: path}}, options)
+}
+
+// Pointer is a JSON Pointer split into its decoded tokens, the root pointer has no tokens.
+type Pointer []string
+
+// ParsePointer parses the RFC 6901 JSON Pointer s into its decoded tokens. It returns an error
+// if s is not valid, see ValidatePointer.
+func ParsePointer(s string) (Pointer, error) {
+	if err := ValidatePointer(s); err != nil {
+		return nil, err
+	}
+	if s == "" {
+		return Pointer{}, nil
+	}
+
+	tokens := strings.Split(s[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = decodePatchKey(token)
+	}
+	return Pointer(tokens), nil
+}
+
+// String returns the RFC 6901 representation of the pointer.
+func (p Pointer) String() string {
+	var b strings.Builder
+	for _, token := range p {
+		b.WriteByte('/')
+		b.WriteString(encodePatchKey(token))
+	}
+	return b.String()
+}
+
+// Append returns a new pointer to the child of the pointer with the decoded token.
+func (p Pointer) Append(token string) Pointer {
+	res := make(Pointer, len(p), len(p)+1)
+	copy(res, p)
+	return append(res, token)
+}
+
+// Parent returns the pointer to the parent of the pointer, the root pointer is its own parent.
+func (p Pointer) Parent() Pointer {
+	if len(p) == 0 {
+		return p
+	}
+	return p[: len(p)-1 : len(p)-1]
+}
+
+// CompilePointer compiles the JSON Pointer path for repeated lookups with Node.GetCompiled,
+// see ParsePointer. The tokens are decoded once, Options.PointerUnescape does not apply.
+func CompilePointer(path string) (*Pointer, error) {
+	p, err := ParsePointer(path)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// GetCompiled returns the value of the compiled pointer in the node, like GetValue.
+func (n *Node) GetCompiled(p *Pointer, options *Options) ([]byte, error) {
+	if options == nil {
+		options = NewOptions()
+	}
+	if len(*p) == 0 {
+		return n.MarshalJSON()
+	}
+
+	pd, err := n.intoContainer()
+	if pd == nil {
+		return nil, fmt.Errorf("unable to get child node by path %q, %w", p.String(), err)
+	}
+	con, key, err := findObject(&pd, *p, options)
+	if con == nil {
+		return nil, fmt.Errorf("unable to get child node by path %q, %w", p.String(), err)
+	}
+	cn, err := con.get(key, options)
+	if err != nil {
+		return nil, err
+	}
+	return cn.MarshalJSON()
+}
+
+// Extract returns the value of a given path in the node as a standalone JSON document,
+// the empty path extracts the whole node. The value is encoded anew, so the result does not
+// share memory with the node and is not affected by further changes to it, or vice versa.
+func (n *Node) Extract(path string, options *Options) ([]byte, error) {
+	if path == "" {
+		return n.MarshalJSON()
+	}
+	return n.GetValue(path, options)
+}
+
+// GetValueOr returns the value of a given path in the node, or def if the value can not be
+// resolved, including for malformed paths. A present null value is returned as null.
+func (n *Node) GetValueOr(path string, def json.RawMessage, options *Options) []byte {
+	v, err := n.Extract(path, options)
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+// GetValuesWithDefault returns the values of the given paths in the node, def is returned
+// for any path that does not exist. A malformed path that does not start with "/" has a
+// nil value, so that it can be told apart from the default value.
+func (n *Node) GetValuesWithDefault(paths []string, def json.RawMessage, options *Options) [][]byte {
+	res := make([][]byte, len(paths))
+	for i, path := range paths {
+		switch {
+		case path == "":
+			if v, err := n.MarshalJSON(); err == nil {
+				res[i] = v
+			}
+		case path[0] != '/':
+			continue
+		default:
+			if v, err := n.GetValue(path, options); err == nil {
+				res[i] = v
+			} else {
+				res[i] = def
+			}
+		}
+	}
+	return res
+}
+
+// GetValues returns the values of the given paths in the node, in the order of the paths,
+// with a nil value for each path that does not exist. The node parses each container once
+// and keeps it, so looking up many paths does not parse the document again.
+// It returns an error only for a malformed path, e.g. one that does not start with "/".
+func (n *Node) GetValues(paths []string, options *Options) ([]json.RawMessage, error) {
+	if options == nil {
+		options = NewOptions()
+	}
+
+	res := make([]json.RawMessage, len(paths))
+	for i, path := range paths {
+		if path == "" {
+			v, err := n.MarshalJSON()
+			if err != nil {
+				return nil, err
+			}
+			res[i] = v
+			continue
+		}
+
+		if path[0] != '/' {
+			return nil, fmt.Errorf("unable to get value by malformed path %q, %w", path, ErrInvalid)
+		}
+		if _, err := splitPointer(path, options); err != nil {
+			return nil, err
+		}
+		cn, err := n.GetChild(path, options)
+		if err != nil {
+			continue
+		}
+		if res[i], err = cn.MarshalJSON(); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// MaxDepth returns the deepest nesting level in the node.
+// A scalar node has depth 0, `{"a":1}` and `[]` have depth 1, and so on.
+func (n *Node) MaxDepth() (int, error) {
+	if n.isNull() {
+		return 0, nil
+	}
+
+	if _, err := n.intoContainer(); err != nil && err != ErrInvalid {
+		return 0, fmt.Errorf("unexpected node %q, %w", n.String(), err)
+	}
+
+	var children []*Node
+	switch n.which {
+	case eDoc:
+		for _, k := range n.doc.obj.Keys() {
+			v, _ := n.doc.obj.Get(k)
+			children = append(children, v)
+		}
+	case eAry:
+		children = n.ary
+	default:
+		return 0, nil
+	}
+
+	max := 0
+	for _, c := range children {
+		d, err := c.MaxDepth()
+		if err != nil {
+			return 0, err
+		}
+		if d > max {
+			max = d
+		}
+	}
+	return max + 1, nil
+}
+
+// Walk calls fn for each value in the node depth-first, with its JSON Pointer, starting with
+// the node itself at path "", the members of objects in their order and the elements of arrays.
+// A null value is passed as a nil node, and the nodes are not copied, fn should not modify them.
+// Objects and arrays are visited before their children, fn returns ErrSkip to skip the children
+// of a value, or any other error to stop walking and return it.
+func (n *Node) Walk(fn func(path string, value *Node) error) error {
+	err := n.walk("", fn)
+	if err == ErrSkip {
+		return nil
+	}
+	return err
+}
+
+func (n *Node) walk(path string, fn func(path string, value *Node) error) error {
+	if n == nil {
+		return fn(path, nil)
+	}
+
+	if n.which == eRaw && n.raw != nil {
+		if _, err := n.intoContainer(); err != nil && checkWhich(*n.raw) != eOther {
+			return fmt.Errorf("unexpected node %q at %q, %w", n.String(), path, err)
+		}
+	}
+	if err := fn(path, n); err != nil {
+		return err
+	}
+
+	switch n.which {
+	case eDoc:
+		for _, k := range n.doc.obj.Keys() {
+			v, _ := n.doc.obj.Get(k)
+			if err := v.walk(path+"/"+encodePatchKey(k), fn); err != nil && err != ErrSkip {
+				return err
+			}
+		}
+	case eAry:
+		for i, v := range n.ary {
+			if err := v.walk(path+"/"+strconv.Itoa(i), fn); err != nil && err != ErrSkip {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 // FindChildren returns the children nodes that pass the given test operations in the node.
+// A "*" token of the test paths matches any member or element, and a "**" token matches any
+// number of nested levels, including none, e.g. "/**/id" matches the "id" member at any depth.
+// A test passes if any of the values its path matches equals its value, and so the members
+// with a "*" or "**" key can not be tested by themselves.
 func (n *Node) FindChildren(tests []*PV, options *Options) (result []*PV, err error) {
+	res, err := n.findChildren(tests, options)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range res {
+		result = append(result, r.pv)
+	}
+	return
+}
+
+// FindChildrenTyped is like FindChildren, but it also returns the type of each child node.
+// Since the test paths are relative to the children, they are always objects or arrays.
+func (n *Node) FindChildrenTyped(tests []*PV, options *Options) (result []*PVT, err error) {
+	res, err := n.findChildren(tests, options)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range res {
+		result = append(result, &PVT{Path: r.pv.Path, Value: r.pv.Value, Type: r.node.Type()})
+	}
+	return
+}
+
+func (n *Node) findChildren(tests []*PV, options *Options) ([]*nodePV, error) {
 	if len(tests) == 0 {
-		return
+		return nil, nil
 	}
 
 	if options == nil {
@@ -81,11 +523,7 @@ func (n *Node) FindChildren(tests []*PV, options *Options) (result []*PV, err er
 			break
 		}
 	}
-
-	for _, r := range res {
-		result = append(result, r.pv)
-	}
-	return
+	return res, nil
 }
 
 // PV represents a node with a path and a raw encoded JSON value.
@@ -97,6 +535,13 @@ type PV struct {
 // PVs represents a list of PV.
 type PVs []*PV
 
+// PVT represents a node with a path, a raw encoded JSON value and its type.
+type PVT struct {
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+	Type  NodeType        `json:"type"`
+}
+
 type nodePV struct {
 	pv   *PV
 	node *Node
@@ -138,7 +583,8 @@ func findChildNodes(
 			}
 		}
 	} else {
-		for k, n := range node.doc.obj {
+		for _, k := range node.doc.obj.Keys() {
+			n, _ := node.doc.obj.Get(k)
 			if n == nil {
 				continue
 			}
@@ -155,33 +601,157 @@ func findChildNodes(
 	return
 }
 
+// assertObject reports whether a value at the subpaths in the container node equals the value.
+// A "*" token matches any member or element, a "**" token matches any number of nested levels.
 func assertObject(node *Node, subpaths []string, value *Node, options *Options) bool {
-	last := len(subpaths) - 1
 	doc, _ := node.intoContainer()
 	if doc == nil {
 		return false
 	}
 
-	for i, part := range subpaths {
-		next, ok := doc.get(decodePatchKey(part), options)
-		if ok != nil {
-			return false
+	part, rest := subpaths[0], subpaths[1:]
+	switch part {
+	case "*":
+		for _, child := range childNodes(node) {
+			if assertValue(child, rest, value, options) {
+				return true
+			}
 		}
-		if i == last {
-			if next == nil {
-				return value.isNull()
+		return false
+
+	case "**":
+		if assertValue(node, rest, value, options) {
+			return true
+		}
+		for _, child := range childNodes(node) {
+			if assertValue(child, subpaths, value, options) {
+				return true
 			}
-			return next.Equal(value)
 		}
+		return false
+	}
+
+	next, err := doc.get(options.unescape(part), options)
+	if err != nil {
+		return false
+	}
+	return assertValue(next, rest, value, options)
+}
 
-		if next == nil {
-			return false
+// assertValue is like assertObject, but the node itself is compared for empty subpaths.
+func assertValue(node *Node, subpaths []string, value *Node, options *Options) bool {
+	if len(subpaths) == 0 {
+		if node == nil {
+			return value.isNull()
 		}
+		return node.Equal(value)
+	}
+	if node == nil {
+		return false
+	}
+	return assertObject(node, subpaths, value, options)
+}
 
-		doc, _ = next.intoContainer()
-		if doc == nil {
-			return false
+// childNodes returns the members of the parsed object node in order, or the elements of the
+// parsed array node, nil for null members.
+func childNodes(n *Node) []*Node {
+	switch n.which {
+	case eDoc:
+		children := make([]*Node, 0, n.doc.obj.Len())
+		for _, k := range n.doc.obj.Keys() {
+			v, _ := n.doc.obj.Get(k)
+			children = append(children, v)
+		}
+		return children
+	case eAry:
+		return n.ary
+	}
+	return nil
+}
+
+// OrderedMap is a JSON object with its members in order, as converted by Node.ToOrderedMap.
+// The values are *OrderedMap for objects, []interface{} for arrays, and string, float64, bool
+// or nil for other values, as decoded by encoding/json.
+type OrderedMap struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+// Len returns the number of members.
+func (m *OrderedMap) Len() int {
+	return len(m.keys)
+}
+
+// Keys returns the member keys in order.
+func (m *OrderedMap) Keys() []string {
+	return m.keys
+}
+
+// Get returns the member value of the given key.
+func (m *OrderedMap) Get(key string) (interface{}, bool) {
+	v, ok := m.values[key]
+	return v, ok
+}
+
+// ToOrderedMap converts the JSON object in the node into an OrderedMap that keeps the order
+// of the members of all nested objects. It returns an error if the node is not an object.
+func (n *Node) ToOrderedMap() (*OrderedMap, error) {
+	if _, err := n.intoContainer(); err != nil || n.which != eDoc {
+		return nil, fmt.Errorf("unexpected node %q, %w", n.String(), ErrInvalid)
+	}
+
+	v, err := n.toValue()
+	if err != nil {
+		return nil, err
+	}
+	return v.(*OrderedMap), nil
+}
+
+func (n *Node) toValue() (interface{}, error) {
+	if n == nil {
+		return nil, nil
+	}
+
+	if n.which == eRaw && n.raw != nil {
+		if _, err := n.intoContainer(); err != nil && err != ErrInvalid {
+			return nil, err
+		}
+	}
+
+	switch n.which {
+	case eDoc:
+		keys := n.doc.obj.Keys()
+		m := &OrderedMap{keys: make([]string, len(keys)), values: make(map[string]interface{}, len(keys))}
+		copy(m.keys, keys)
+		for _, k := range keys {
+			v, _ := n.doc.obj.Get(k)
+			val, err := v.toValue()
+			if err != nil {
+				return nil, err
+			}
+			m.values[k] = val
+		}
+		return m, nil
+
+	case eAry:
+		res := make([]interface{}, len(n.ary))
+		for i, v := range n.ary {
+			val, err := v.toValue()
+			if err != nil {
+				return nil, err
+			}
+			res[i] = val
+		}
+		return res, nil
+
+	default:
+		if n.isNull() {
+			return nil, nil
+		}
+		var v interface{}
+		if err := json.Unmarshal(*n.raw, &v); err != nil {
+			return nil, err
 		}
+		return v, nil
 	}
-	return false
 }
@@ -4,6 +4,7 @@
 package jsonpatch
 
 import (
+	"errors"
 	"strings"
 	"testing"
 )
@@ -356,6 +357,60 @@ var FindChildrenCases = []FindChildrenCase{
 			{"/1/1/5", []byte(`["span", {"data-type": null}, "Hello 4"]`)},
 		},
 	},
+	{
+		[]byte(`["root", ["p",
+			["span", {"data-type": "text"},
+				["span", {"data-type": "leaf"}, "Hello 1"],
+				["span", {"data-type": "leaf"}, "Hello 2"],
+				["span", {"data-type": "leaf"}, "Hello 3"],
+				["span", {"data-type": null}, "Hello 4"]
+			]
+		]]`),
+		[]*PV{{"/0", []byte(`"span"`)}, {"/*/data-type", []byte(`"leaf"`)}},
+		[]*PV{
+			{"/1/1/2", []byte(`["span", {"data-type": "leaf"}, "Hello 1"]`)},
+			{"/1/1/3", []byte(`["span", {"data-type": "leaf"}, "Hello 2"]`)},
+			{"/1/1/4", []byte(`["span", {"data-type": "leaf"}, "Hello 3"]`)},
+		},
+	},
+	{
+		[]byte(`["root", ["p",
+			["span", {"data-type": "text"},
+				["span", {"data-type": "leaf"}, "Hello 1"],
+				["span", {"data-type": "leaf"}, "Hello 2"],
+				["span", {"data-type": "leaf"}, "Hello 3"],
+				["span", {"data-type": null}, "Hello 4"]
+			]
+		]]`),
+		[]*PV{{"/0", []byte(`"span"`)}, {"/**/data-type", nil}},
+		[]*PV{
+			{"/1/1", []byte(`["span", {"data-type": "text"},
+			["span", {"data-type": "leaf"}, "Hello 1"],
+			["span", {"data-type": "leaf"}, "Hello 2"],
+			["span", {"data-type": "leaf"}, "Hello 3"],
+			["span", {"data-type": null}, "Hello 4"]]`)},
+			{"/1/1/5", []byte(`["span", {"data-type": null}, "Hello 4"]`)},
+		},
+	},
+	{
+		[]byte(`["root", ["p",
+			["span", {"data-type": "text"},
+				["span", {"data-type": "leaf"}, "Hello 1"]
+			]
+		]]`),
+		[]*PV{{"/**/*/data-type", []byte(`"text"`)}},
+		[]*PV{
+			{"", []byte(`["root", ["p", ["span", {"data-type": "text"}, ["span", {"data-type": "leaf"}, "Hello 1"]]]]`)},
+			{"/1", []byte(`["p", ["span", {"data-type": "text"}, ["span", {"data-type": "leaf"}, "Hello 1"]]]`)},
+			{"/1/1", []byte(`["span", {"data-type": "text"}, ["span", {"data-type": "leaf"}, "Hello 1"]]`)},
+		},
+	},
+	{
+		[]byte(`{"a": {"x": {"t": 1}}, "b": {"y": {"t": 2}, "z": {"t": 3}}, "*": {"t": 2}}`),
+		[]*PV{{"/*/t", []byte(`2`)}},
+		[]*PV{{"", []byte(`{"a": {"x": {"t": 1}}, "b": {"y": {"t": 2}, "z": {"t": 3}}, "*": {"t": 2}}`)},
+			{"/b", []byte(`{"y": {"t": 2}, "z": {"t": 3}}`)}},
+	},
 }
 
 func TestFindChildren(t *testing.T) {
@@ -381,3 +436,732 @@ func TestFindChildren(t *testing.T) {
 		}
 	}
 }
+
+func TestFindChildrenTyped(t *testing.T) {
+	doc := []byte(`["root", ["p",
+		["span", {"data-type": "text"},
+			["span", {"data-type": "leaf"}, "Hello 1"],
+			["span", {"data-type": null}, "Hello 2"]
+		]
+	]]`)
+	cases := []struct {
+		tests  []*PV
+		result []*PVT
+	}{
+		{
+			[]*PV{{"/0", []byte(`"span"`)}, {"/*/data-type", []byte(`"leaf"`)}},
+			[]*PVT{{"/1/1/2", []byte(`["span", {"data-type": "leaf"}, "Hello 1"]`), TypeArray}},
+		},
+		{
+			[]*PV{{"/data-type", nil}},
+			[]*PVT{{"/1/1/3/1", []byte(`{"data-type": null}`), TypeObject}},
+		},
+		{
+			[]*PV{{"/**/data-type", []byte(`"leaf"`)}},
+			[]*PVT{
+				{"", doc, TypeArray},
+				{"/1", []byte(`["p", ["span", {"data-type": "text"}, ["span", {"data-type": "leaf"}, "Hello 1"], ["span", {"data-type": null}, "Hello 2"]]]`), TypeArray},
+				{"/1/1", []byte(`["span", {"data-type": "text"}, ["span", {"data-type": "leaf"}, "Hello 1"], ["span", {"data-type": null}, "Hello 2"]]`), TypeArray},
+				{"/1/1/2", []byte(`["span", {"data-type": "leaf"}, "Hello 1"]`), TypeArray},
+				{"/1/1/2/1", []byte(`{"data-type": "leaf"}`), TypeObject},
+			},
+		},
+		{
+			[]*PV{{"/0", []byte(`"Hello 1"`)}},
+			nil,
+		},
+	}
+
+	for i, c := range cases {
+		res, err := NewNode(doc).FindChildrenTyped(c.tests, nil)
+		if err != nil {
+			t.Fatalf("Testing failed at case %d: %v", i, err)
+		}
+		if len(res) != len(c.result) {
+			t.Fatalf("Testing failed at case %d: expected %d results, got %d", i, len(c.result), len(res))
+		}
+		for j, r := range res {
+			if r.Path != c.result[j].Path || !Equal(r.Value, c.result[j].Value) || r.Type != c.result[j].Type {
+				t.Errorf("Testing failed at case %d: expected %s [%s] %v, got %s [%s] %v", i,
+					c.result[j].Path, string(c.result[j].Value), c.result[j].Type, r.Path, string(r.Value), r.Type)
+			}
+		}
+	}
+
+	if _, err := NewNode(doc).FindChildrenTyped([]*PV{{"data-type", nil}}, nil); err == nil {
+		t.Error("Testing failed for invalid path: expected error")
+	}
+}
+
+func TestMaxDepth(t *testing.T) {
+	cases := []struct {
+		doc   string
+		depth int
+	}{
+		{``, 0},
+		{`null`, 0},
+		{`1`, 0},
+		{`"abc"`, 0},
+		{`{}`, 1},
+		{`[]`, 1},
+		{`{"a":1}`, 1},
+		{`[1, 2, 3]`, 1},
+		{`{"a":{"b":{"c":null}}}`, 3},
+		{`[[[[]]], []]`, 4},
+		{`{"a":[{"b":[1]}], "c":{"d":2}}`, 4},
+		{`[{"a":1}, [null, {"b":{"c":[]}}]]`, 5},
+	}
+
+	for i, c := range cases {
+		depth, err := NewNode([]byte(c.doc)).MaxDepth()
+		if err != nil {
+			t.Errorf("Testing failed when case %d should have passed: %s", i, err)
+		} else if depth != c.depth {
+			t.Errorf("Testing failed for case %d, %s: expected %d, got %d", i, c.doc, c.depth, depth)
+		}
+	}
+
+	if _, err := NewNode([]byte(`{"a":[1,}`)).MaxDepth(); err == nil {
+		t.Errorf("Testing failed when it should have error for invalid document")
+	}
+}
+
+func TestGetValuesWithDefault(t *testing.T) {
+	node := NewNode([]byte(`{"baz": "qux", "foo": ["a", 2, null, {"bar": null}], "nil": null}`))
+	paths := []string{
+		"/baz", "/foo/1", "/foo/2", "/foo/3/bar", "/nil",
+		"/missing", "/foo/9", "/foo/3/missing", "/baz/missing", "malformed", "",
+	}
+	expected := []string{
+		`"qux"`, `2`, `null`, `null`, `null`,
+		`"default"`, `"default"`, `"default"`, `"default"`, ``,
+		`{"baz":"qux","foo":["a",2,null,{"bar":null}],"nil":null}`,
+	}
+
+	res := node.GetValuesWithDefault(paths, []byte(`"default"`), nil)
+	if len(res) != len(expected) {
+		t.Fatalf("Testing failed: expected %d values, got %d", len(expected), len(res))
+	}
+	for i := range res {
+		if string(res[i]) != expected[i] {
+			t.Errorf("Testing failed for path %q: expected [%s], got [%s]", paths[i], expected[i], string(res[i]))
+		}
+	}
+	if res[9] != nil {
+		t.Errorf("Testing failed for malformed path: expected nil, got [%s]", string(res[9]))
+	}
+
+	res = node.GetValuesWithDefault([]string{"/missing"}, nil, nil)
+	if res[0] != nil {
+		t.Errorf("Testing failed for nil default: expected nil, got [%s]", string(res[0]))
+	}
+}
+
+func TestGetValues(t *testing.T) {
+	node := NewNode([]byte(`{"baz": "qux", "foo": ["a", [1, [2, 3]], null, {"bar": null}], "a/b": {"~": 1}}`))
+	paths := []string{
+		"/foo/1/1/0", "/missing", "/baz", "/foo/1/1", "/foo/9", "/foo/2", "/foo/3/bar",
+		"/a~1b/~0", "/foo/1/1/5", "/baz/missing", "/foo/-", "",
+	}
+	expected := []string{
+		`2`, ``, `"qux"`, `[2,3]`, ``, `null`, `null`,
+		`1`, ``, ``, ``, `{"baz":"qux","foo":["a",[1,[2,3]],null,{"bar":null}],"a/b":{"~":1}}`,
+	}
+
+	res, err := node.GetValues(paths, nil)
+	if err != nil {
+		t.Fatalf("Testing failed: %v", err)
+	}
+	if len(res) != len(expected) {
+		t.Fatalf("Testing failed: expected %d values, got %d", len(expected), len(res))
+	}
+	for i := range res {
+		if string(res[i]) != expected[i] {
+			t.Errorf("Testing failed for path %q: expected [%s], got [%s]", paths[i], expected[i], string(res[i]))
+		}
+		if expected[i] == "" && res[i] != nil {
+			t.Errorf("Testing failed for missing path %q: expected nil, got [%s]", paths[i], string(res[i]))
+		}
+	}
+
+	res, err = node.GetValues(nil, nil)
+	if err != nil || len(res) != 0 {
+		t.Errorf("Testing failed for no paths: got %v, %v", res, err)
+	}
+
+	_, err = node.GetValues([]string{"/baz", "malformed"}, nil)
+	if err == nil || err.Error() != `unable to get value by malformed path "malformed", invalid node detected` {
+		t.Errorf("Testing failed for malformed path: got %v", err)
+	}
+
+	options := NewOptions()
+	options.PercentDecodePointers = true
+	_, err = node.GetValues([]string{"/baz", "/a%zz"}, options)
+	if err == nil {
+		t.Errorf("Testing failed for malformed percent-encoded path: expected error")
+	}
+	res, err = node.GetValues([]string{"/a%2Fb/~0"}, options)
+	if err != nil || string(res[0]) != `1` {
+		t.Errorf("Testing failed for percent-encoded path: got [%s], %v", string(res[0]), err)
+	}
+}
+
+func TestLocateDetailed(t *testing.T) {
+	node := NewNode([]byte(`{"z": 1, "a": {"y": [10, 20, 30], "b/c": null, "x": true}, "m": "n"}`))
+
+	cases := []struct {
+		path, value, parent, key string
+		index                    int
+	}{
+		{"", `{"z":1,"a":{"y":[10,20,30],"b/c":null,"x":true},"m":"n"}`, `null`, "", -1},
+		{"/z", `1`, `{"z":1,"a":{"y":[10,20,30],"b/c":null,"x":true},"m":"n"}`, "z", 0},
+		{"/m", `"n"`, `{"z":1,"a":{"y":[10,20,30],"b/c":null,"x":true},"m":"n"}`, "m", 2},
+		{"/a/b~1c", `null`, `{"y":[10,20,30],"b/c":null,"x":true}`, "b/c", 1},
+		{"/a/x", `true`, `{"y":[10,20,30],"b/c":null,"x":true}`, "x", 2},
+		{"/a/y/1", `20`, `[10,20,30]`, "1", 1},
+		{"/a/y/-1", `30`, `[10,20,30]`, "-1", 2},
+	}
+
+	for _, c := range cases {
+		value, parent, key, index, err := node.LocateDetailed(c.path, nil)
+		if err != nil {
+			t.Errorf("Testing failed when path %q should have passed: %s", c.path, err)
+			continue
+		}
+		if v, _ := value.MarshalJSON(); string(v) != c.value {
+			t.Errorf("Testing failed for path %q: expected value [%s], got [%s]", c.path, c.value, string(v))
+		}
+		if p, _ := parent.MarshalJSON(); string(p) != c.parent {
+			t.Errorf("Testing failed for path %q: expected parent [%s], got [%s]", c.path, c.parent, string(p))
+		}
+		if key != c.key || index != c.index {
+			t.Errorf("Testing failed for path %q: expected key %q at %d, got %q at %d",
+				c.path, c.key, c.index, key, index)
+		}
+	}
+
+	for _, path := range []string{"/missing", "/a/y/3", "/a/y/-", "/a/q/r", "/z/a"} {
+		if _, _, _, _, err := node.LocateDetailed(path, nil); !errors.Is(err, ErrMissing) {
+			t.Errorf("Testing failed when it should have missing value error for path %q, got %v", path, err)
+		}
+	}
+	if _, _, _, _, err := node.LocateDetailed("a", nil); err == nil {
+		t.Error("Testing failed when it should have error for path \"a\"")
+	}
+
+	// the paths are resolved as set by the options.
+	node = NewNode([]byte(`{"Name": "x", "Items": [{"id": 5, "b c": 1}, {"id": 6, "b c": 2}]}`))
+	options := NewOptions()
+	options.KeyNormalize = strings.ToLower
+	options.PercentDecodePointers = true
+	options.AllowFilterPaths = true
+	options.AllowIDPaths = true
+	cases = []struct {
+		path, value, parent, key string
+		index                    int
+	}{
+		{"/name", `"x"`, `{"Name":"x","Items":[{"id":5,"b c":1},{"id":6,"b c":2}]}`, "Name", 0},
+		{"/items/1/b%20c", `2`, `{"id":6,"b c":2}`, "b c", 1},
+		{"/items[id=6]", `{"id":6,"b c":2}`, `[{"id":5,"b c":1},{"id":6,"b c":2}]`, "1", 1},
+		{"/items/id:5/id", `5`, `{"id":5,"b c":1}`, "id", 0},
+	}
+	for _, c := range cases {
+		value, parent, key, index, err := node.LocateDetailed(c.path, options)
+		if err != nil {
+			t.Errorf("Testing failed when path %q should have passed: %s", c.path, err)
+			continue
+		}
+		v, _ := value.MarshalJSON()
+		p, _ := parent.MarshalJSON()
+		if string(v) != c.value || string(p) != c.parent || key != c.key || index != c.index {
+			t.Errorf("Testing failed for path %q: expected [%s] in [%s] by %q at %d, got [%s] in [%s] by %q at %d",
+				c.path, c.value, c.parent, c.key, c.index, string(v), string(p), key, index)
+		}
+	}
+	if _, _, _, _, err := node.LocateDetailed("/items[id=7]/id", options); !errors.Is(err, ErrMissing) {
+		t.Errorf("Testing failed when it should have missing value error, got %v", err)
+	}
+}
+
+func TestExtract(t *testing.T) {
+	node := NewNode([]byte(`{"a": {"b": {"c": 1}, "list": [1, [2, 3]]}, "d": "x"}`))
+
+	cases := []struct {
+		path, result string
+	}{
+		{"", `{"a":{"b":{"c":1},"list":[1,[2,3]]},"d":"x"}`},
+		{"/a/b", `{"c":1}`},
+		{"/a/list", `[1,[2,3]]`},
+		{"/a/list/1", `[2,3]`},
+		{"/d", `"x"`},
+	}
+
+	extracted := make([][]byte, len(cases))
+	for i, c := range cases {
+		res, err := node.Extract(c.path, nil)
+		if err != nil {
+			t.Fatalf("Testing failed at case %d: %v", i, err)
+		}
+		extracted[i] = res
+	}
+
+	patch, _ := NewPatch([]byte(`[
+		{"op": "replace", "path": "/a/b/c", "value": 2},
+		{"op": "add", "path": "/a/list/1/-", "value": 4},
+		{"op": "remove", "path": "/a/list/0"},
+		{"op": "replace", "path": "/d", "value": "y"}
+	]`))
+	if err := node.Patch(patch, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, c := range cases {
+		if string(extracted[i]) != c.result {
+			t.Errorf("Testing failed at case %d: expected [%s], got [%s]", i, c.result, string(extracted[i]))
+		}
+	}
+
+	extracted[1][2] = 'x'
+	if res, _ := node.Extract("/a/b", nil); string(res) != `{"c":2}` {
+		t.Errorf("Testing failed for mutated extract: expected [%s], got [%s]", `{"c":2}`, string(res))
+	}
+
+	if _, err := node.Extract("/missing", nil); err == nil {
+		t.Error("Testing failed for missing path: expected error")
+	}
+}
+
+func TestGetValueOr(t *testing.T) {
+	node := NewNode([]byte(`{"a": {"b": null, "c": [1, 2]}, "d": "x"}`))
+	def := []byte(`"default"`)
+
+	cases := []struct {
+		path, result string
+	}{
+		{"", `{"a":{"b":null,"c":[1,2]},"d":"x"}`},
+		{"/d", `"x"`},
+		{"/a/c/1", `2`},
+		{"/a/b", `null`},
+		{"/missing", `"default"`},
+		{"/a/b/c", `"default"`},
+		{"/a/c/5", `"default"`},
+		{"a", `"default"`},
+		{"/a/c/x", `"default"`},
+	}
+
+	for i, c := range cases {
+		if res := node.GetValueOr(c.path, def, nil); string(res) != c.result {
+			t.Errorf("Testing failed at case %d: expected [%s], got [%s]", i, c.result, string(res))
+		}
+	}
+
+	if res := node.GetValueOr("/missing", nil, nil); res != nil {
+		t.Errorf("Testing failed for nil default: expected nil, got [%s]", string(res))
+	}
+}
+
+func TestGetCompiled(t *testing.T) {
+	node := NewNode([]byte(`{"a": {"b~c": [1, {"d/e": "x"}]}, "f": null}`))
+
+	cases := []struct {
+		path, result string
+	}{
+		{"", `{"a":{"b~c":[1,{"d/e":"x"}]},"f":null}`},
+		{"/a/b~0c/0", `1`},
+		{"/a/b~0c/1/d~1e", `"x"`},
+		{"/a/b~0c/-1", `{"d/e":"x"}`},
+		{"/f", `null`},
+		{"/missing", ``},
+		{"/a/b~0c/5", ``},
+		{"/a/b~0c/0/x", ``},
+	}
+
+	for i, c := range cases {
+		p, err := CompilePointer(c.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.String() != c.path {
+			t.Errorf("Testing failed at case %d: expected path %q, got %q", i, c.path, p.String())
+		}
+
+		res, err := node.GetCompiled(p, nil)
+		if c.result == "" {
+			if err == nil {
+				t.Errorf("Testing failed at case %d: expected error, got [%s]", i, string(res))
+			}
+			continue
+		}
+		if err != nil || string(res) != c.result {
+			t.Errorf("Testing failed at case %d: expected [%s], got [%s], %v", i, c.result, string(res), err)
+		}
+		if v, _ := node.Extract(c.path, nil); string(v) != string(res) {
+			t.Errorf("Testing failed at case %d: expected [%s] as Extract, got [%s]", i, string(v), string(res))
+		}
+	}
+
+	p, _ := CompilePointer("/a/b~0c/0/x/y")
+	expected := `unable to get child node by path "/a/b~0c/0/x/y", unable to resolve token "x" at "/a/b~0c/0" (value is number), missing value`
+	if _, err := node.GetCompiled(p, nil); err == nil || err.Error() != expected || !errors.Is(err, ErrMissing) {
+		t.Errorf("Testing failed: expected error %q, got %v", expected, err)
+	}
+
+	if _, err := CompilePointer("a/b"); err == nil {
+		t.Error("Testing failed for invalid pointer: expected error")
+	}
+}
+
+func TestPointer(t *testing.T) {
+	cases := []struct {
+		path   string
+		tokens []string
+	}{
+		{"", []string{}},
+		{"/", []string{""}},
+		{"/a/b", []string{"a", "b"}},
+		{"/a~1b/~0/~01/~10", []string{"a/b", "~", "~1", "/0"}},
+		{"/0/-//x y", []string{"0", "-", "", "x y"}},
+	}
+
+	for i, c := range cases {
+		p, err := ParsePointer(c.path)
+		if err != nil {
+			t.Fatalf("Testing failed at case %d: %v", i, err)
+		}
+		if strings.Join(p, "|") != strings.Join(c.tokens, "|") || len(p) != len(c.tokens) {
+			t.Errorf("Testing failed at case %d: expected tokens %q, got %q", i, c.tokens, p)
+		}
+		if p.String() != c.path {
+			t.Errorf("Testing failed at case %d: expected path %q, got %q", i, c.path, p.String())
+		}
+	}
+
+	for _, path := range []string{"a", "a/b", "/a~", "/a~2", "/~a/b", "/a/b~", "/a/~~0"} {
+		if p, err := ParsePointer(path); err == nil {
+			t.Errorf("Testing failed for invalid pointer %q: expected error, got %q", path, p)
+		}
+	}
+
+	p, _ := ParsePointer("/a/b")
+	c1, c2 := p.Parent().Append("x/y"), p.Parent().Append("~z")
+	if c1.String() != "/a/x~1y" || c2.String() != "/a/~0z" || p.String() != "/a/b" {
+		t.Errorf("Testing failed for Append: got %q, %q and %q", c1.String(), c2.String(), p.String())
+	}
+	if c := p.Append("c"); c.String() != "/a/b/c" || c.Parent().String() != "/a/b" {
+		t.Errorf("Testing failed for Append: got %q", c.String())
+	}
+	if root := (Pointer{}); root.Parent().String() != "" || root.Append("").String() != "/" {
+		t.Errorf("Testing failed for root pointer")
+	}
+}
+
+func BenchmarkGetValueByPath(b *testing.B) {
+	doc := []byte(`{"a": {"b": [1, 2, {"c": {"d": "x"}}]}, "e": 1}`)
+	node := NewNode(doc)
+	options := NewOptions()
+	for i := 0; i < b.N; i++ {
+		if _, err := node.GetValue("/a/b/2/c/d", options); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetCompiled(b *testing.B) {
+	doc := []byte(`{"a": {"b": [1, 2, {"c": {"d": "x"}}]}, "e": 1}`)
+	node := NewNode(doc)
+	p, _ := CompilePointer("/a/b/2/c/d")
+	options := NewOptions()
+	for i := 0; i < b.N; i++ {
+		if _, err := node.GetCompiled(p, options); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestRef(t *testing.T) {
+	node := NewNode([]byte(`{"a": {"b": 1, "c": [1, 2, 3]}, "d~e": null}`))
+	check := func(expected string) {
+		t.Helper()
+		if res, err := node.MarshalJSON(); err != nil || string(res) != expected {
+			t.Errorf("Testing failed: expected [%s], got [%s], %v", expected, string(res), err)
+		}
+	}
+
+	ref, err := node.Ref("/a/b", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := ref.Value(); err != nil || v.String() != "1" {
+		t.Errorf("Testing failed for value: expected [1], got [%v], %v", v, err)
+	}
+	if err = ref.Set([]byte(`{"x": true}`)); err != nil {
+		t.Fatal(err)
+	}
+	check(`{"a":{"b":{"x":true},"c":[1,2,3]},"d~e":null}`)
+
+	ref, _ = node.Ref("/a/b/y", nil)
+	if err = ref.Set([]byte(`"new"`)); err != nil {
+		t.Fatal(err)
+	}
+	check(`{"a":{"b":{"x":true,"y":"new"},"c":[1,2,3]},"d~e":null}`)
+
+	ref, _ = node.Ref("/a/c/1", nil)
+	if err = ref.Set([]byte(`20`)); err != nil {
+		t.Fatal(err)
+	}
+	if err = ref.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := ref.Value(); err != nil || v.String() != "3" {
+		t.Errorf("Testing failed for shifted value: expected [3], got [%v], %v", v, err)
+	}
+	check(`{"a":{"b":{"x":true,"y":"new"},"c":[1,3]},"d~e":null}`)
+
+	ref, _ = node.Ref("/a/c/5", nil)
+	if err = ref.Set([]byte(`5`)); err == nil {
+		t.Error("Testing failed for missing element: expected error")
+	}
+	if err = ref.Delete(); err == nil {
+		t.Error("Testing failed for missing element: expected error")
+	}
+
+	ref, _ = node.Ref("/d~0e", nil)
+	if v, err := ref.Value(); err != nil || !v.isNull() {
+		t.Errorf("Testing failed for null value: expected [null], got [%v], %v", v, err)
+	}
+	if err = ref.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	check(`{"a":{"b":{"x":true,"y":"new"},"c":[1,3]}}`)
+
+	ref, _ = node.Ref("/a", nil)
+	v, _ := ref.Value()
+	patch, _ := NewPatch([]byte(`[{"op": "replace", "path": "/b", "value": 0}]`))
+	if err = v.Patch(patch, nil); err != nil {
+		t.Fatal(err)
+	}
+	check(`{"a":{"b":0,"c":[1,3]}}`)
+
+	for _, path := range []string{"", "/x/y", "/a/b/c"} {
+		if _, err := node.Ref(path, nil); err == nil {
+			t.Errorf("Testing failed for path %q: expected error", path)
+		}
+	}
+}
+
+func TestExists(t *testing.T) {
+	node := NewNode([]byte(`{"a": null, "b": [1, null, {"c": null}], "d~e": {"f/g": 0}}`))
+	cases := []struct {
+		path   string
+		exists bool
+	}{
+		{"/a", true},
+		{"/b/1", true},
+		{"/b/2/c", true},
+		{"/d~0e/f~1g", true},
+		{"/b/-1", true},
+		{"/x", false},
+		{"/b/2/x", false},
+		{"/a/x", false},
+		{"/b/3", false},
+		{"/b/-4", false},
+		{"/b/-", false},
+		{"/b/x", false},
+		{"/x/y", false},
+		{"", false},
+		{"a", false},
+	}
+
+	for _, c := range cases {
+		if exists := node.Exists(c.path, nil); exists != c.exists {
+			t.Errorf("Testing failed for path %q: expected %v, got %v", c.path, c.exists, exists)
+		}
+	}
+
+	if NewNode([]byte(`1`)).Exists("/a", nil) {
+		t.Error("Testing failed for scalar node: expected false")
+	}
+}
+
+func TestWalk(t *testing.T) {
+	node := NewNode([]byte(`{"b": [1, {"x": null}], "a~/": "s", "skip": {"c": 1}, "e": []}`))
+
+	var visits []string
+	err := node.Walk(func(path string, value *Node) error {
+		raw, err := value.MarshalJSON()
+		if err != nil {
+			return err
+		}
+		visits = append(visits, path+"="+string(raw))
+		if path == "/skip" {
+			return ErrSkip
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		`={"b":[1,{"x":null}],"a~/":"s","skip":{"c":1},"e":[]}`,
+		`/b=[1,{"x":null}]`, `/b/0=1`, `/b/1={"x":null}`, `/b/1/x=null`,
+		`/a~0~1="s"`, `/skip={"c":1}`, `/e=[]`,
+	}
+	if strings.Join(visits, " ") != strings.Join(expected, " ") {
+		t.Errorf("Testing failed: expected %v, got %v", expected, visits)
+	}
+
+	visits = nil
+	stop := errors.New("stop")
+	err = node.Walk(func(path string, value *Node) error {
+		visits = append(visits, path)
+		if path == "/b/0" {
+			return stop
+		}
+		return nil
+	})
+	if err != stop || strings.Join(visits, " ") != " /b /b/0" {
+		t.Errorf("Testing failed for stop: got %v, %v", visits, err)
+	}
+
+	visits = nil
+	err = NewNode([]byte(`[1, 2]`)).Walk(func(path string, value *Node) error {
+		visits = append(visits, path)
+		return ErrSkip
+	})
+	if err != nil || len(visits) != 1 {
+		t.Errorf("Testing failed for root skip: got %v, %v", visits, err)
+	}
+
+	b, _ := node.GetChild("/b", nil)
+	visited := map[string]*Node{}
+	err = node.Walk(func(path string, value *Node) error {
+		visited[path] = value
+		return nil
+	})
+	if err != nil || visited["/b"] != b || visited["/b/1/x"] != nil || visited[""] != node {
+		t.Errorf("Testing failed for nodes: got %v, %v", visited, err)
+	}
+
+	if err = NewNode([]byte(`{"a": [}`)).Walk(func(string, *Node) error { return nil }); err == nil {
+		t.Error("Testing failed for invalid node: expected error")
+	}
+}
+
+func TestSetValueAndDeleteValue(t *testing.T) {
+	node := NewNode([]byte(`{"a": {"b": 1}, "c": [1, 2, 3]}`))
+	check := func(expected string) {
+		t.Helper()
+		if res, err := node.MarshalJSON(); err != nil || string(res) != expected {
+			t.Errorf("Testing failed: expected [%s], got [%s], %v", expected, string(res), err)
+		}
+	}
+
+	if err := node.SetValue("/a/b", []byte(`{"x": true}`), nil); err != nil {
+		t.Fatal(err)
+	}
+	check(`{"a":{"b":{"x":true}},"c":[1,2,3]}`)
+
+	if err := node.SetValue("/c/1", []byte(`20`), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := node.SetValue("/c/-", []byte(`4`), nil); err != nil {
+		t.Fatal(err)
+	}
+	check(`{"a":{"b":{"x":true}},"c":[1,20,3,4]}`)
+
+	if err := node.SetValue("/x/y/z", []byte(`1`), nil); err == nil {
+		t.Error("Testing failed for missing parents: expected error")
+	}
+	options := NewOptions()
+	options.EnsurePathExistsOnAdd = true
+	if err := node.SetValue("/x/y/z", []byte(`1`), options); err != nil {
+		t.Fatal(err)
+	}
+	if err := node.SetValue("/x/arr/0", []byte(`"v"`), options); err != nil {
+		t.Fatal(err)
+	}
+	check(`{"a":{"b":{"x":true}},"c":[1,20,3,4],"x":{"y":{"z":1},"arr":["v"]}}`)
+
+	if err := node.DeleteValue("/c/1", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := node.DeleteValue("/c/-1", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := node.DeleteValue("/x/y", nil); err != nil {
+		t.Fatal(err)
+	}
+	check(`{"a":{"b":{"x":true}},"c":[1,3],"x":{"arr":["v"]}}`)
+
+	if err := node.DeleteValue("/c/5", nil); err == nil {
+		t.Error("Testing failed for missing element: expected error")
+	}
+	options.AllowMissingPathOnRemove = true
+	if err := node.DeleteValue("/m/n", options); err != nil {
+		t.Errorf("Testing failed for missing path: %v", err)
+	}
+
+	if err := node.SetValue("", []byte(`[1]`), nil); err != nil {
+		t.Fatal(err)
+	}
+	check(`[1]`)
+}
+
+func TestToOrderedMap(t *testing.T) {
+	node := NewNode([]byte(`{"z": 1, "a": {"y": [3, {"c": true, "b": null}], "x": "s"}, "m": [], "k": 1.5}`))
+	patch, _ := NewPatch([]byte(`[{"op": "add", "path": "/d", "value": {"q": 1, "p": 2}}]`))
+	if err := node.Patch(patch, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := node.ToOrderedMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := strings.Join(m.Keys(), ","); keys != "z,a,m,k,d" || m.Len() != 5 {
+		t.Errorf("Testing failed for keys: expected [z,a,m,k,d], got [%s]", keys)
+	}
+	if v, ok := m.Get("z"); !ok || v != float64(1) {
+		t.Errorf("Testing failed for z: expected 1, got %v", v)
+	}
+	if v, ok := m.Get("k"); !ok || v != 1.5 {
+		t.Errorf("Testing failed for k: expected 1.5, got %v", v)
+	}
+	if _, ok := m.Get("missing"); ok {
+		t.Error("Testing failed for missing key: expected not found")
+	}
+
+	v, _ := m.Get("a")
+	a := v.(*OrderedMap)
+	if keys := strings.Join(a.Keys(), ","); keys != "y,x" {
+		t.Errorf("Testing failed for nested keys: expected [y,x], got [%s]", keys)
+	}
+	v, _ = a.Get("y")
+	y := v.([]interface{})
+	if len(y) != 2 || y[0] != float64(3) {
+		t.Errorf("Testing failed for array: got %v", y)
+	}
+	c := y[1].(*OrderedMap)
+	if keys := strings.Join(c.Keys(), ","); keys != "c,b" {
+		t.Errorf("Testing failed for object in array: expected [c,b], got [%s]", keys)
+	}
+	if v, ok := c.Get("b"); !ok || v != nil {
+		t.Errorf("Testing failed for null: expected nil, got %v", v)
+	}
+	if v, _ := a.Get("x"); v != "s" {
+		t.Errorf("Testing failed for string: expected s, got %v", v)
+	}
+	if v, _ := m.Get("m"); len(v.([]interface{})) != 0 {
+		t.Errorf("Testing failed for empty array: got %v", v)
+	}
+	v, _ = m.Get("d")
+	if keys := strings.Join(v.(*OrderedMap).Keys(), ","); keys != "q,p" {
+		t.Errorf("Testing failed for patched object: expected [q,p], got [%s]", keys)
+	}
+
+	for _, doc := range []string{`[1]`, `1`, `null`, `{"a":`} {
+		if _, err := NewNode([]byte(doc)).ToOrderedMap(); err == nil {
+			t.Errorf("Testing failed for %s: expected error", doc)
+		}
+	}
+}
@@ -0,0 +1,305 @@
+// (c) 2022-2022, LDC Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package jsonpatch
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Transform transforms the local patch, made against the base JSON document concurrently with
+// the remote patch, so that it applies after the remote patch, as in operational transformation.
+// The array indexes of the local operations are adjusted for the elements inserted or removed
+// by the remote patch, with "-" and negative indexes resolved, and the local "remove" operations
+// of values the remote patch already removed are dropped. Remote insertions at the same index
+// come first.
+// It returns an error with ErrConflict if a local operation touches a value that the remote patch
+// replaced or removed, or an object member that both patches add.
+func Transform(local, remote Patch, base []byte) (Patch, error) {
+	ls, err := resolveOTOps(local, base)
+	if err != nil {
+		return nil, fmt.Errorf("unable to resolve local patch, %w", err)
+	}
+	rs, err := resolveOTOps(remote, base)
+	if err != nil {
+		return nil, fmt.Errorf("unable to resolve remote patch, %w", err)
+	}
+
+	res := make(Patch, 0, len(ls))
+	for _, l := range ls {
+		next := make([]otOp, 0, len(rs))
+		gone := false
+		for _, r := range rs {
+			if gone {
+				next = append(next, r)
+				continue
+			}
+
+			l2, status, path := l.transform(r, true)
+			switch status {
+			case otConflict:
+				return nil, fmt.Errorf("local operation %d conflicts with remote operation %d at %q, %w",
+					l.index, r.index, path, ErrConflict)
+			case otGone:
+				// both removed the same value, so r has no effect after l.
+				gone = true
+			default:
+				// r after l, local operations come after remote insertions at the same index.
+				next = append(next, r.shift(l, false))
+			}
+			l = l2
+		}
+
+		if !gone {
+			res = append(res, l.op)
+		}
+		rs = next
+	}
+	return res, nil
+}
+
+// the effect of an operation on one of its paths.
+const (
+	otRead   = iota // the value is only read.
+	otWrite         // an object member or the root is set.
+	otErase         // an object member is removed.
+	otInsert        // an array element is inserted.
+	otDelete        // an array element is removed.
+)
+
+// the status of a transformed operation.
+const (
+	otOK       = iota
+	otConflict // the operation touches a value changed by the other one.
+	otGone     // the operation has already been done by the other one.
+)
+
+// otOp is an operation with resolved paths and their effects.
+type otOp struct {
+	op       Operation
+	index    int
+	fromKind int
+	pathKind int
+}
+
+// resolveOTOps applies the patch to the base document to resolve the paths of its operations
+// and their effects.
+func resolveOTOps(p Patch, base []byte) ([]otOp, error) {
+	options := NewOptions()
+	node := NewNode(base)
+	pd, err := node.intoContainer()
+	switch {
+	case err != nil:
+		return nil, fmt.Errorf("unexpected node %q, %w", options.errorValue(node), err)
+	case pd == nil:
+		return nil, fmt.Errorf("unexpected node %q", options.errorValue(node))
+	}
+
+	var accumulatedCopySize int64
+	res := make([]otOp, 0, len(p))
+	for i, op := range p {
+		x, err := p.applyOTOp(&pd, op, &accumulatedCopySize, options)
+		if err != nil {
+			return nil, err
+		}
+		x.index = i
+		res = append(res, x)
+	}
+	return res, nil
+}
+
+// applyOTOp applies the operation to the document, and returns it with its paths resolved
+// and their effects.
+func (p Patch) applyOTOp(doc *container, op Operation, accumulatedCopySize *int64, options *Options) (otOp, error) {
+	x := otOp{op: op}
+	switch op.Op {
+	case "add", "copy", "move":
+		x.pathKind = otWrite
+		if con, _, _ := resolveObject(doc, op.Path, options); isArray(con) {
+			x.pathKind = otInsert
+		}
+		if op.Op == "move" {
+			x.op.From = resolvePath(*doc, op.From, options)
+			x.fromKind = otErase
+			if con, _, _ := resolveObject(doc, op.From, options); isArray(con) {
+				x.fromKind = otDelete
+			}
+		} else if op.Op == "copy" {
+			x.op.From = resolvePath(*doc, op.From, options)
+		}
+	case "remove":
+		x.op.Path = resolvePath(*doc, op.Path, options)
+		x.pathKind = otErase
+		if con, _, _ := resolveObject(doc, op.Path, options); isArray(con) {
+			x.pathKind = otDelete
+		}
+	case "test":
+		x.op.Path = resolvePath(*doc, op.Path, options)
+	default:
+		x.op.Path = resolvePath(*doc, op.Path, options)
+		x.pathKind = otWrite
+	}
+
+	if err := p.applyOp(doc, op, accumulatedCopySize, options); err != nil {
+		return x, err
+	}
+
+	switch op.Op {
+	case "add", "copy", "move":
+		x.op.Path = resolvePath(*doc, op.Path, options)
+	}
+	return x, nil
+}
+
+// applyStable applies the operation with the array indexes in its paths interpreted against
+// the original document, given the array edits of the operations applied so far, to which
+// the edits of the operation are appended.
+func (p Patch) applyStable(doc *container, i int, op Operation, edits *[]otOp, accumulatedCopySize *int64,
+	options *Options) error {
+	x := otOp{op: op, pathKind: otWrite}
+	switch op.Op {
+	case "add", "copy":
+		x.pathKind = otInsert
+	case "move":
+		x.fromKind = otDelete
+		x.pathKind = otInsert
+	case "remove":
+		x.pathKind = otDelete
+	case "test":
+		x.pathKind = otRead
+	}
+
+	for _, e := range *edits {
+		var status int
+		var path string
+		if x, status, path = x.transform(e, true); status != otOK {
+			return fmt.Errorf("%s operation does not apply for %q, the element at %q was removed by operation %d, %w",
+				op.Op, op.Path, path, e.index, ErrMissing)
+		}
+	}
+
+	applied, err := p.applyOTOp(doc, x.op, accumulatedCopySize, options)
+	if err != nil {
+		return err
+	}
+	// only the array edits shift the indexes, other effects are ignored.
+	if applied.fromKind != otDelete {
+		applied.fromKind = otRead
+	}
+	if applied.pathKind != otInsert && applied.pathKind != otDelete {
+		applied.pathKind = otRead
+	}
+	if applied.fromKind != otRead || applied.pathKind != otRead {
+		applied.index = i
+		*edits = append(*edits, applied)
+	}
+	return nil
+}
+
+func isArray(con container) bool {
+	_, ok := con.(*partialArray)
+	return ok
+}
+
+// otEdit is a path of an operation and its effect.
+type otEdit struct {
+	path string
+	kind int
+}
+
+// edits returns the paths of the operation and their effects, in the order they apply.
+func (x otOp) edits() []otEdit {
+	return []otEdit{{x.op.From, x.fromKind}, {x.op.Path, x.pathKind}}
+}
+
+// transform returns the operation transformed to apply after the operation e.
+// If ties is true, the operation comes after the elements inserted by e at the same index.
+func (x otOp) transform(e otOp, ties bool) (otOp, int, string) {
+	for _, edit := range e.edits() {
+		if edit.kind == otRead {
+			continue
+		}
+
+		var status int
+		if x.op.Op == "move" || x.op.Op == "copy" {
+			if x.op.From, status = shiftPath(x.op.From, x.fromKind, edit.path, edit.kind, ties); status != otOK {
+				return x, otConflict, x.op.From
+			}
+		}
+		if x.op.Path, status = shiftPath(x.op.Path, x.pathKind, edit.path, edit.kind, ties); status != otOK {
+			if status == otGone && x.op.Op != "remove" {
+				status = otConflict
+			}
+			return x, status, x.op.Path
+		}
+	}
+	return x, otOK, ""
+}
+
+// shift returns the operation with its array indexes shifted to apply after the operation e,
+// unlike transform it ignores the conflicts with e, which are reported by transforming e.
+func (x otOp) shift(e otOp, ties bool) otOp {
+	for _, edit := range e.edits() {
+		if edit.kind == otRead {
+			continue
+		}
+		if x.op.Op == "move" || x.op.Op == "copy" {
+			x.op.From, _ = shiftPath(x.op.From, x.fromKind, edit.path, edit.kind, ties)
+		}
+		x.op.Path, _ = shiftPath(x.op.Path, x.pathKind, edit.path, edit.kind, ties)
+	}
+	return x
+}
+
+// shiftPath returns the path, on which the operation has the given effect, adjusted to
+// apply after an edit of the other path with the other effect.
+func shiftPath(path string, kind int, other string, otherKind int, ties bool) (string, int) {
+	switch otherKind {
+	case otRead:
+		return path, otOK
+	case otWrite, otErase:
+		switch {
+		case !isPathAtOrBelow(path, other):
+			return path, otOK
+		case path == other && kind == otErase && otherKind == otErase:
+			return path, otGone
+		default:
+			return path, otConflict
+		}
+	}
+
+	parent := parentPath(other)
+	i, err := strconv.Atoi(other[len(parent)+1:])
+	if err != nil || !strings.HasPrefix(path, parent+"/") {
+		return path, otOK
+	}
+
+	token, tail := path[len(parent)+1:], ""
+	if k := strings.Index(token, "/"); k >= 0 {
+		token, tail = token[:k], token[k:]
+	}
+	j, err := strconv.Atoi(token)
+	if err != nil {
+		return path, otOK
+	}
+
+	switch {
+	case otherKind == otInsert && (j > i || j == i && (tail != "" || kind != otInsert || ties)):
+		j++
+	case otherKind == otDelete && j > i:
+		j--
+	case otherKind == otDelete && j == i && tail == "":
+		switch kind {
+		case otInsert:
+		case otDelete:
+			return path, otGone
+		default:
+			return path, otConflict
+		}
+	case otherKind == otDelete && j == i:
+		return path, otConflict
+	}
+	return parent + "/" + strconv.Itoa(j) + tail, otOK
+}
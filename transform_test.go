@@ -0,0 +1,139 @@
+// (c) 2022-2022, LDC Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package jsonpatch
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransform(t *testing.T) {
+	assert := assert.New(t)
+
+	base := `{"list": [1, 2, 3], "a": {"b": 1}, "c": "d"}`
+	cases := []struct {
+		local, remote, transformed, result string
+	}{
+		{
+			`[{"op": "replace", "path": "/list/1", "value": "x"}]`,
+			`[{"op": "add", "path": "/list/0", "value": 0}]`,
+			`[{"op":"replace","path":"/list/2","value":"x"}]`,
+			`{"list":[0,1,"x",3],"a":{"b":1},"c":"d"}`,
+		},
+		{
+			`[{"op": "add", "path": "/list/1", "value": "l"}, {"op": "add", "path": "/list/-", "value": "e"}]`,
+			`[{"op": "add", "path": "/list/1", "value": "r"}]`,
+			`[{"op":"add","path":"/list/2","value":"l"},{"op":"add","path":"/list/5","value":"e"}]`,
+			`{"list":[1,"r","l",2,3,"e"],"a":{"b":1},"c":"d"}`,
+		},
+		{
+			`[{"op": "remove", "path": "/list/2"}, {"op": "remove", "path": "/list/0"}, {"op": "replace", "path": "/c", "value": 1}]`,
+			`[{"op": "remove", "path": "/list/0"}, {"op": "replace", "path": "/a/b", "value": 2}]`,
+			`[{"op":"remove","path":"/list/1"},{"op":"replace","path":"/c","value":1}]`,
+			`{"list":[2],"a":{"b":2},"c":1}`,
+		},
+		{
+			`[{"op": "move", "from": "/list/-1", "path": "/list/0"}]`,
+			`[{"op": "add", "path": "/list/1", "value": "r"}, {"op": "remove", "path": "/c"}]`,
+			`[{"op":"move","path":"/list/0","from":"/list/3"}]`,
+			`{"list":[3,1,"r",2],"a":{"b":1}}`,
+		},
+		{
+			`[{"op": "add", "path": "/list/0", "value": "l"}, {"op": "replace", "path": "/list/2", "value": "x"}]`,
+			`[{"op": "remove", "path": "/list/0"}]`,
+			`[{"op":"add","path":"/list/0","value":"l"},{"op":"replace","path":"/list/1","value":"x"}]`,
+			`{"list":["l","x",3],"a":{"b":1},"c":"d"}`,
+		},
+		{
+			`[{"op": "remove", "path": "/c"}, {"op": "test", "path": "/list/0", "value": 1}]`,
+			`[{"op": "remove", "path": "/c"}, {"op": "add", "path": "/list/0", "value": 0}]`,
+			`[{"op":"test","path":"/list/1","value":1}]`,
+			`{"list":[0,1,2,3],"a":{"b":1}}`,
+		},
+		{
+			`[{"op": "replace", "path": "/list/0", "value": "x"}, {"op": "replace", "path": "/list/1", "value": "y"}]`,
+			`[{"op": "add", "path": "/list/0", "value": 0}]`,
+			`[{"op":"replace","path":"/list/1","value":"x"},{"op":"replace","path":"/list/2","value":"y"}]`,
+			`{"list":[0,"x","y",3],"a":{"b":1},"c":"d"}`,
+		},
+		{
+			`[{"op": "remove", "path": "/list/0"}, {"op": "replace", "path": "/list/0", "value": "x"},
+			  {"op": "add", "path": "/list/1", "value": "y"}, {"op": "remove", "path": "/list/0"}]`,
+			`[{"op": "add", "path": "/list/1", "value": "r"}, {"op": "replace", "path": "/c", "value": 1}]`,
+			`[{"op":"remove","path":"/list/0"},{"op":"replace","path":"/list/1","value":"x"},` +
+				`{"op":"add","path":"/list/2","value":"y"},{"op":"remove","path":"/list/1"}]`,
+			`{"list":["r","y",3],"a":{"b":1},"c":1}`,
+		},
+		{
+			`[{"op": "remove", "path": "/list/0"}, {"op": "remove", "path": "/list/0"}, {"op": "replace", "path": "/list/0", "value": "x"}]`,
+			`[{"op": "remove", "path": "/list/0"}, {"op": "add", "path": "/list/-", "value": 4}]`,
+			`[{"op":"remove","path":"/list/0"},{"op":"replace","path":"/list/0","value":"x"}]`,
+			`{"list":["x",4],"a":{"b":1},"c":"d"}`,
+		},
+	}
+
+	for i, c := range cases {
+		local, _ := NewPatch([]byte(c.local))
+		remote, _ := NewPatch([]byte(c.remote))
+		transformed, err := Transform(local, remote, []byte(base))
+		if !assert.NoErrorf(err, "case %d", i) {
+			continue
+		}
+		assert.Equalf(c.transformed, mustJSONString(transformed), "case %d", i)
+
+		out, err := remote.Apply([]byte(base))
+		assert.NoErrorf(err, "case %d", i)
+		out, err = transformed.Apply(out)
+		assert.NoErrorf(err, "case %d", i)
+		assert.Equalf(c.result, string(out), "case %d", i)
+	}
+
+	errCases := []struct {
+		local, remote, err string
+	}{
+		{
+			`[{"op": "replace", "path": "/a/b", "value": 2}]`,
+			`[{"op": "replace", "path": "/a", "value": {}}]`,
+			`local operation 0 conflicts with remote operation 0 at "/a/b", conflicting operation`,
+		},
+		{
+			`[{"op": "add", "path": "/e", "value": 1}]`,
+			`[{"op": "add", "path": "/e", "value": 2}]`,
+			`local operation 0 conflicts with remote operation 0 at "/e", conflicting operation`,
+		},
+		{
+			`[{"op": "replace", "path": "/c", "value": 1}, {"op": "replace", "path": "/list/0", "value": "x"}]`,
+			`[{"op": "add", "path": "/list/-", "value": 4}, {"op": "remove", "path": "/list/0"}]`,
+			`local operation 1 conflicts with remote operation 1 at "/list/0", conflicting operation`,
+		},
+		{
+			`[{"op": "add", "path": "/list/0", "value": "l"}, {"op": "replace", "path": "/list/1", "value": "x"}]`,
+			`[{"op": "remove", "path": "/list/0"}]`,
+			`local operation 1 conflicts with remote operation 0 at "/list/1", conflicting operation`,
+		},
+		{
+			`[{"op": "copy", "from": "/list/1", "path": "/e"}]`,
+			`[{"op": "remove", "path": "/list/1"}]`,
+			`local operation 0 conflicts with remote operation 0 at "/list/1", conflicting operation`,
+		},
+		{
+			`[{"op": "remove", "path": "/missing"}]`,
+			`[]`,
+			`unable to resolve local patch, remove operation does not apply for "/missing", unable to remove nonexistent key "missing", missing value`,
+		},
+		{
+			`[]`,
+			`[{"op": "bad", "path": "/c"}]`,
+			`unable to resolve remote patch, unexpected operation "bad"`,
+		},
+	}
+
+	for i, c := range errCases {
+		local, _ := NewPatch([]byte(c.local))
+		remote, _ := NewPatch([]byte(c.remote))
+		_, err := Transform(local, remote, []byte(base))
+		assert.EqualErrorf(err, c.err, "case %d", i)
+	}
+}
@@ -0,0 +1,220 @@
+// (c) 2022-2022, LDC Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package jsonpatch
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ValidateAgainst checks that the path and from of each operation resolve against the
+// JSON document, without modifying it: the parents of "add" paths must exist, and so must
+// the targets of "remove", "replace" and "test" paths and "move" and "copy" froms.
+// The operations are applied in order to a working copy of the document with the given
+// options, so an operation may depend on the earlier ones.
+// It returns an error for the first operation that does not resolve or apply.
+func (p Patch) ValidateAgainst(doc []byte, options *Options) error {
+	if options == nil {
+		options = NewOptions()
+	}
+	// the working copy reports no index changes to the caller.
+	o := *options.strict()
+	o.OnArrayShift = nil
+	o.OnIndexChange = nil
+	options = &o
+
+	node := NewNode(doc)
+	node.newObject = options.NewObject
+	node.disallowDuplicateKeys = options.DisallowDuplicateKeys
+	pd, err := node.intoContainer()
+	switch {
+	case err != nil:
+		return fmt.Errorf("unexpected node %q, %w", options.errorValue(node), err)
+	case pd == nil:
+		return fmt.Errorf("unexpected node %q", options.errorValue(node))
+	}
+
+	var accumulatedCopySize int64
+	var edits []otOp
+	for i, op := range p {
+		// with StableArrayIndices the paths refer to the original document, only applying
+		// the operation resolves them.
+		if !options.StableArrayIndices {
+			if err = resolveOp(pd, op, options.forOp(op)); err != nil {
+				return fmt.Errorf("%s operation %d does not resolve, %w", op.Op, i, err)
+			}
+			err = p.applyOp(&pd, op, &accumulatedCopySize, options)
+		} else {
+			err = p.applyStable(&pd, i, op, &edits, &accumulatedCopySize, options)
+		}
+		if err != nil {
+			return fmt.Errorf("%s operation %d does not apply, %w", op.Op, i, err)
+		}
+	}
+	return nil
+}
+
+// resolveOp checks that the path and from of the operation resolve in the document.
+func resolveOp(pd container, op Operation, options *Options) (err error) {
+	switch op.Op {
+	case "add":
+		err = resolveParent(pd, op.Path, options)
+	case "remove":
+		if !options.AllowMissingPathOnRemove {
+			err = resolveTarget(pd, op.Path, options)
+		}
+	case "replace", "test", "cas":
+		err = resolveTarget(pd, op.Path, options)
+	case "remove_each":
+		if prefix, _, ok := splitWildcard(op.Path); ok {
+			err = resolveTarget(pd, prefix, options)
+		} else {
+			err = fmt.Errorf("need exactly one \"*\" token in %q, %w", op.Path, ErrInvalid)
+		}
+	case "move", "copy":
+		if err = resolveTarget(pd, op.From, options); err == nil {
+			err = resolveParent(pd, op.Path, options)
+		}
+	default:
+		if customOp(op.Op) == nil {
+			err = fmt.Errorf("unexpected operation %q", op.Op)
+		}
+	}
+	return err
+}
+
+// Validate checks that each operation of the patch is well-formed, without a target document:
+// its "op" is known, its "path" and "from" are valid JSON Pointers, "move" and "copy" have a
+// "from", "add", "replace", "test" and "cas" have a "value", "cas" has an "expected", and other
+// operations have no "value". Since an absent "from" can not be told from the root pointer,
+// "move" and "copy" operations from the root pointer are rejected too.
+// It returns an error listing every offending operation with its index and all its problems.
+func (p Patch) Validate() error {
+	var invalid []string
+	for i, op := range p {
+		var problems []string
+		known, needValue, needFrom := true, false, false
+		switch op.Op {
+		case "add", "replace", "test":
+			needValue = true
+		case "cas":
+			needValue = true
+			if op.Expected == nil {
+				problems = append(problems, "missing expected")
+			}
+		case "move", "copy":
+			needFrom = true
+		case "remove":
+		case "remove_each":
+			if _, _, ok := splitWildcard(op.Path); !ok {
+				problems = append(problems, fmt.Sprintf("need exactly one \"*\" token in path %q", op.Path))
+			}
+		default:
+			// the members of a custom operation are up to its OpFunc.
+			known = false
+			if customOp(op.Op) == nil {
+				problems = append(problems, fmt.Sprintf("unexpected operation %q", op.Op))
+			}
+		}
+
+		if err := ValidatePointer(op.Path); err != nil {
+			problems = append(problems, fmt.Sprintf("invalid path, %v", err))
+		}
+		switch {
+		case op.From != "":
+			if err := ValidatePointer(op.From); err != nil {
+				problems = append(problems, fmt.Sprintf("invalid from, %v", err))
+			}
+		case needFrom:
+			problems = append(problems, "missing from")
+		}
+		switch {
+		case !known:
+		case needValue && op.Value == nil:
+			problems = append(problems, "missing value")
+		case !needValue && op.Value != nil:
+			problems = append(problems, "unexpected value")
+		}
+
+		if len(problems) > 0 {
+			invalid = append(invalid, fmt.Sprintf("%s operation %d: %s", op.Op, i, strings.Join(problems, ", ")))
+		}
+	}
+
+	if len(invalid) > 0 {
+		return fmt.Errorf("invalid operations [%s], %w", strings.Join(invalid, "; "), ErrInvalid)
+	}
+	return nil
+}
+
+// ValidatePointer checks that the path is a JSON Pointer as strictly defined by RFC 6901:
+// the empty string, or a sequence of "/" prefixed tokens in which "~" only appears escaped
+// as "~0" or "~1". Tokens are not checked against any document, so "-" and negative
+// indexes are valid.
+func ValidatePointer(path string) error {
+	if path == "" {
+		return nil
+	}
+	if path[0] != '/' {
+		return fmt.Errorf("pointer %q does not start with \"/\", %w", path, ErrInvalid)
+	}
+
+	for i := 0; i < len(path); i++ {
+		if path[i] != '~' {
+			continue
+		}
+		if i+1 == len(path) || path[i+1] != '0' && path[i+1] != '1' {
+			return fmt.Errorf("invalid escape sequence at offset %d in pointer %q, %w", i, path, ErrInvalid)
+		}
+		i++
+	}
+	return nil
+}
+
+// resolveTarget checks that the value at path exists in the document.
+func resolveTarget(doc container, path string, options *Options) error {
+	if path == "" {
+		return nil
+	}
+
+	con, key, err := resolveObject(&doc, path, options)
+	if con == nil {
+		return fmt.Errorf("unable to resolve parent of %q, %w", path, err)
+	}
+	if _, err := con.get(key, options); err != nil {
+		return fmt.Errorf("unable to resolve %q, %w", path, err)
+	}
+	return nil
+}
+
+// resolveParent checks that a value can be added at path in the document.
+func resolveParent(doc container, path string, options *Options) error {
+	if path == "" {
+		return nil
+	}
+
+	con, key, err := resolveObject(&doc, path, options)
+	if con == nil {
+		if options.EnsurePathExistsOnAdd {
+			return nil
+		}
+		return fmt.Errorf("unable to resolve parent of %q, %w", path, err)
+	}
+
+	ary, ok := con.(*partialArray)
+	if !ok || key == "-" {
+		return nil
+	}
+
+	idx, err := strconv.Atoi(key)
+	if err != nil {
+		return fmt.Errorf("value was not a proper array index %s, %w", key, err)
+	}
+	sz := len(*ary) + 1
+	if idx >= sz || idx < 0 && (!options.SupportNegativeIndices || idx < -sz) {
+		return fmt.Errorf("unable to access invalid index %s, %w", key, ErrInvalidIndex)
+	}
+	return nil
+}
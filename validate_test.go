@@ -0,0 +1,212 @@
+// (c) 2022-2022, LDC Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package jsonpatch
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateAgainst(t *testing.T) {
+	assert := assert.New(t)
+
+	doc := []byte(`{"a": {"b": 1}, "list": [1, 2], "nil": null}`)
+	cases := []struct {
+		patch, err string
+	}{
+		{`[]`, ``},
+		{`[
+			{"op": "add", "path": "/c", "value": 1},
+			{"op": "add", "path": "/a/c", "value": 1},
+			{"op": "add", "path": "/list/2", "value": 1},
+			{"op": "add", "path": "/list/-", "value": 1},
+			{"op": "add", "path": "/list/-3", "value": 1},
+			{"op": "remove", "path": "/a/b"},
+			{"op": "replace", "path": "/list/1", "value": 1},
+			{"op": "test", "path": "/nil", "value": null},
+			{"op": "move", "from": "/a/c", "path": "/list/0"},
+			{"op": "copy", "from": "/list/-1", "path": "/a/d"},
+			{"op": "add", "path": "/x", "value": {}},
+			{"op": "add", "path": "/x/y", "value": 1},
+			{"op": "replace", "path": "", "value": {"z": 1}},
+			{"op": "test", "path": "/z", "value": 1}
+		]`, ``},
+		{
+			`[{"op": "remove", "path": "/a/b"}, {"op": "move", "from": "/a/b", "path": "/c"}]`,
+			`move operation 1 does not resolve, unable to resolve "/a/b", unable to get nonexistent key "b", missing value`,
+		},
+		{
+			`[{"op": "remove", "path": "/list/0"}, {"op": "replace", "path": "/list/1", "value": 1}]`,
+			`replace operation 1 does not resolve, unable to resolve "/list/1", unable to access invalid index 1, invalid index referenced`,
+		},
+		{
+			`[{"op": "test", "path": "/a/b", "value": 2}]`,
+			`test operation 0 does not apply, test operation for path "/a/b" failed, expected "2", got "1"`,
+		},
+		{
+			`[{"op": "remove", "path": "/x", "x-allow-missing": true}, {"op": "remove", "path": "/x"}]`,
+			`remove operation 1 does not resolve, unable to resolve "/x", unable to get nonexistent key "x", missing value`,
+		},
+		{
+			`[{"op": "add", "path": "/x/y", "value": 1}]`,
+			`add operation 0 does not resolve, unable to resolve parent of "/x/y", unable to resolve token "x" at "" (object has keys [a,list,nil]), missing value`,
+		},
+		{
+			`[{"op": "add", "path": "/list/3", "value": 1}]`,
+			`add operation 0 does not resolve, unable to access invalid index 3, invalid index referenced`,
+		},
+		{
+			`[{"op": "add", "path": "/c", "value": 1}, {"op": "remove", "path": "/a/c"}]`,
+			`remove operation 1 does not resolve, unable to resolve "/a/c", unable to get nonexistent key "c", missing value`,
+		},
+		{
+			`[{"op": "replace", "path": "/list/2", "value": 1}]`,
+			`replace operation 0 does not resolve, unable to resolve "/list/2", unable to access invalid index 2, invalid index referenced`,
+		},
+		{
+			`[{"op": "test", "path": "/x/y", "value": 1}]`,
+			`test operation 0 does not resolve, unable to resolve parent of "/x/y", unable to resolve token "x" at "" (object has keys [a,list,nil]), missing value`,
+		},
+		{
+			`[{"op": "move", "from": "/x", "path": "/y"}]`,
+			`move operation 0 does not resolve, unable to resolve "/x", unable to get nonexistent key "x", missing value`,
+		},
+		{
+			`[{"op": "move", "from": "/a", "path": "/x/y"}]`,
+			`move operation 0 does not resolve, unable to resolve parent of "/x/y", unable to resolve token "x" at "" (object has keys [a,list,nil]), missing value`,
+		},
+		{
+			`[{"op": "copy", "from": "/a/x", "path": "/y"}]`,
+			`copy operation 0 does not resolve, unable to resolve "/a/x", unable to get nonexistent key "x", missing value`,
+		},
+		{
+			`[{"op": "copy", "from": "/a", "path": "/nil/y"}]`,
+			`copy operation 0 does not resolve, unable to resolve parent of "/nil/y", unable to resolve token "y" at "/nil" (value is null), missing value`,
+		},
+		{
+			`[{"op": "unknown", "path": "/a"}]`,
+			`unknown operation 0 does not resolve, unexpected operation "unknown"`,
+		},
+	}
+
+	for i, c := range cases {
+		patch, err := NewPatch([]byte(c.patch))
+		if !assert.NoErrorf(err, "case %d", i) {
+			continue
+		}
+		err = patch.ValidateAgainst(doc, nil)
+		if c.err == "" {
+			assert.NoErrorf(err, "case %d", i)
+		} else {
+			assert.EqualErrorf(err, c.err, "case %d", i)
+		}
+	}
+	assert.Equal(`{"a": {"b": 1}, "list": [1, 2], "nil": null}`, string(doc))
+
+	patch, _ := NewPatch([]byte(`[{"op": "add", "path": "/x/y", "value": 1}]`))
+	options := NewOptions()
+	options.EnsurePathExistsOnAdd = true
+	assert.NoError(patch.ValidateAgainst(doc, options))
+
+	patch, _ = NewPatch([]byte(`[
+		{"op": "add", "path": "/x/y", "value": 1},
+		{"op": "remove", "path": "/x/y"},
+		{"op": "remove", "path": "/x/y"}
+	]`))
+	options = NewOptions()
+	options.EnsurePathExistsOnAdd = true
+	assert.EqualError(patch.ValidateAgainst(doc, options),
+		`remove operation 2 does not resolve, unable to resolve "/x/y", unable to get nonexistent key "y", missing value`)
+	options.AllowMissingPathOnRemove = true
+	assert.NoError(patch.ValidateAgainst(doc, options))
+	options.StrictRFC6902 = true
+	assert.Error(patch.ValidateAgainst(doc, options))
+	assert.Equal(`{"a": {"b": 1}, "list": [1, 2], "nil": null}`, string(doc))
+	assert.Error(patch.ValidateAgainst([]byte(`1`), nil))
+}
+
+func TestValidatePointer(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, path := range []string{"", "/", "//", "/a", "/a/b", "/a~0b", "/a~1b/~01", "/~0~1", "/a b/%20/\\", "/list/-", "/list/-1", "/é/🙂"} {
+		assert.NoErrorf(ValidatePointer(path), "path %q", path)
+	}
+
+	cases := []struct {
+		path, err string
+	}{
+		{"a", `pointer "a" does not start with "/", invalid node detected`},
+		{"a/b", `pointer "a/b" does not start with "/", invalid node detected`},
+		{"#/a", `pointer "#/a" does not start with "/", invalid node detected`},
+		{"/~", `invalid escape sequence at offset 1 in pointer "/~", invalid node detected`},
+		{"/a~", `invalid escape sequence at offset 2 in pointer "/a~", invalid node detected`},
+		{"/a~/b", `invalid escape sequence at offset 2 in pointer "/a~/b", invalid node detected`},
+		{"/a~2b", `invalid escape sequence at offset 2 in pointer "/a~2b", invalid node detected`},
+		{"/~0~", `invalid escape sequence at offset 3 in pointer "/~0~", invalid node detected`},
+		{"/~~1", `invalid escape sequence at offset 1 in pointer "/~~1", invalid node detected`},
+	}
+	for _, c := range cases {
+		assert.EqualErrorf(ValidatePointer(c.path), c.err, "path %q", c.path)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	valid := `[
+		{"op": "add", "path": "/a", "value": null},
+		{"op": "add", "path": "", "value": {}},
+		{"op": "remove", "path": "/a~0b/0"},
+		{"op": "replace", "path": "/a/-", "value": 1},
+		{"op": "move", "from": "/a", "path": "/b"},
+		{"op": "copy", "from": "/a~1b", "path": "/c"},
+		{"op": "test", "path": "/c", "value": "x"},
+		{"op": "cas", "path": "/c", "expected": "x", "value": "y"},
+		{"op": "remove_each", "path": "/items/*/x"}
+	]`
+	p, err := NewPatch([]byte(valid))
+	assert.NoError(err)
+	assert.NoError(p.Validate())
+	assert.NoError(Patch{}.Validate())
+
+	cases := []struct {
+		patch, err string
+	}{
+		{`[{"op": "delete", "path": "/a", "value": 1}]`, `delete operation 0: unexpected operation "delete"`},
+		{`[{"path": "/a"}]`, ` operation 0: unexpected operation ""`},
+		{`[{"op": "add", "path": "a", "value": 1}]`,
+			`add operation 0: invalid path, pointer "a" does not start with "/", invalid node detected`},
+		{`[{"op": "remove", "path": "/a~2"}]`,
+			`remove operation 0: invalid path, invalid escape sequence at offset 2 in pointer "/a~2", invalid node detected`},
+		{`[{"op": "move", "path": "/a"}]`, `move operation 0: missing from`},
+		{`[{"op": "copy", "from": "", "path": "/a"}]`, `copy operation 0: missing from`},
+		{`[{"op": "copy", "from": "a~", "path": "/a"}]`,
+			`copy operation 0: invalid from, pointer "a~" does not start with "/", invalid node detected`},
+		{`[{"op": "test", "path": "/a", "from": "/~"}]`,
+			`test operation 0: invalid from, invalid escape sequence at offset 1 in pointer "/~", invalid node detected, missing value`},
+		{`[{"op": "add", "path": "/a"}]`, `add operation 0: missing value`},
+		{`[{"op": "replace", "path": "/a"}]`, `replace operation 0: missing value`},
+		{`[{"op": "test", "path": "/a"}]`, `test operation 0: missing value`},
+		{`[{"op": "cas", "path": "/a", "value": 1}]`, `cas operation 0: missing expected`},
+		{`[{"op": "remove", "path": "/a", "value": 1}]`, `remove operation 0: unexpected value`},
+		{`[{"op": "move", "from": "/b", "path": "/a", "value": 1}]`, `move operation 0: unexpected value`},
+		{`[{"op": "copy", "from": "/b", "path": "/a", "value": null}]`, `copy operation 0: unexpected value`},
+		{`[{"op": "remove_each", "path": "/a/*/*"}]`, `remove_each operation 0: need exactly one "*" token in path "/a/*/*"`},
+		{
+			`[{"op": "add", "path": "/a", "value": 1}, {"op": "move", "path": "b", "value": 1},
+			  {"op": "test", "path": "/a", "value": 1}, {"op": "bad", "path": "/a"}]`,
+			`move operation 1: invalid path, pointer "b" does not start with "/", invalid node detected, missing from, unexpected value; ` +
+				`bad operation 3: unexpected operation "bad"`,
+		},
+	}
+
+	for i, c := range cases {
+		p, err := NewPatch([]byte(c.patch))
+		if !assert.NoErrorf(err, "case %d", i) {
+			continue
+		}
+		assert.EqualErrorf(p.Validate(), "invalid operations ["+c.err+"], invalid node detected", "case %d", i)
+	}
+}